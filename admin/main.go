@@ -0,0 +1,411 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/Venafi/aws-private-ca-policy-venafi/internal/cliutil"
+	"github.com/Venafi/vcert/v4/pkg/endpoint"
+	"github.com/Venafi/vcert/v4/pkg/verror"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `Usage: policy-admin <command> [flags]
+
+Commands:
+  list     list zones of the policy table with their sync status
+  show     show policy of a zone
+  add      add a zone for the policy lambda to sync from Venafi
+  refresh  sync policy of a zone from Venafi now
+  delete   delete a zone from the policy table
+  export   write the whole policy table as JSON or YAML
+  import   load zones from an export
+
+Run "policy-admin <command> -h" for command flags. The table is DYNAMODB_ZONES_TABLE (VenafiCertPolicy by default),
+AWS credentials and region come from the environment and shared configuration like for AWS CLI. refresh reads
+Venafi credentials from the same variables as the policy lambda, but tokens from ADMIN_TPP_ACCESS_TOKEN and
+ADMIN_TPP_REFRESH_TOKEN. Set ENCRYPTED_CREDENTIALS=false for plain text ones.
+`
+
+// policyTable is the zones table. policies is DynamoDB, tests use an in-memory table.
+type policyTable interface {
+	Export() (common.PolicyTableDump, error)
+	Get(zone string) (common.PolicyRecord, error)
+	Add(zone string) error
+	Save(r common.PolicyRecord) error
+	Delete(zone string) error
+}
+
+type dynamoDBTable struct{}
+
+func (dynamoDBTable) Export() (common.PolicyTableDump, error) {
+	return common.ExportPolicyTable()
+}
+
+func (dynamoDBTable) Get(zone string) (common.PolicyRecord, error) {
+	return common.GetPolicyRecord(zone)
+}
+
+func (dynamoDBTable) Add(zone string) error {
+	return common.CreateEmptyPolicy(zone)
+}
+
+func (dynamoDBTable) Save(r common.PolicyRecord) error {
+	return common.SavePolicyRecord(r)
+}
+
+func (dynamoDBTable) Delete(zone string) error {
+	return common.DeletePolicy(zone)
+}
+
+var policies policyTable = dynamoDBTable{}
+
+// newConnector connects to Venafi with ADMIN_ tokens, since consuming the refresh token of the policy lambda
+// would break its sync.
+var newConnector = func() (endpoint.Connector, error) {
+	return common.GetConnectionFromEnvWithTokenPrefix("ADMIN_")
+}
+
+// command has the zone flag of single zone commands.
+type command struct {
+	flags *flag.FlagSet
+	zone  string
+}
+
+func newCommand(name string, stderr io.Writer, zone bool) *command {
+	c := &command{flags: flag.NewFlagSet(name, flag.ContinueOnError)}
+	c.flags.SetOutput(stderr)
+	if zone {
+		c.flags.StringVar(&c.zone, "zone", "", "Venafi zone")
+	}
+	return c
+}
+
+func (c *command) parse(args []string) error {
+	if err := c.flags.Parse(args); err != nil {
+		return cliutil.FlagError(err)
+	}
+	if c.flags.Lookup("zone") != nil && c.zone == "" {
+		return cliutil.Usagef("--zone should be set")
+	}
+	return nil
+}
+
+// syncStatus is "pending" until the policy lambda saves the policy of the zone, "stale" when the last
+// save is older than staleAfter.
+func syncStatus(e common.PolicyTableEntry, staleAfter time.Duration, now time.Time) string {
+	switch {
+	case e.Policy == nil:
+		return "pending"
+	case e.LastSync == nil:
+		return "synced"
+	case now.Sub(*e.LastSync) > staleAfter:
+		return "stale"
+	}
+	return "synced"
+}
+
+func list(args []string, stdout, stderr io.Writer) error {
+	c := newCommand("list", stderr, false)
+	staleAfter := c.flags.Duration("stale-after", 10*time.Minute, "age of the last sync after which the zone is stale")
+	if err := c.parse(args); err != nil {
+		return err
+	}
+	dump, err := policies.Export()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ZONE\tSTATUS\tLAST SYNC\tVERSION")
+	for _, e := range dump.Zones {
+		lastSync, version := "-", "-"
+		if e.LastSync != nil {
+			lastSync = e.LastSync.UTC().Format(time.RFC3339)
+		}
+		if e.Policy != nil {
+			version = common.PolicyVersion(*e.Policy)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", e.Zone, syncStatus(e, *staleAfter, now), lastSync, version)
+	}
+	return w.Flush()
+}
+
+func show(args []string, stdout, stderr io.Writer) error {
+	c := newCommand("show", stderr, true)
+	format := c.flags.String("format", "text", "output format, text, json or yaml")
+	if err := c.parse(args); err != nil {
+		return err
+	}
+	r, err := policies.Get(c.zone)
+	if err == common.PolicyFoundButEmpty {
+		return fmt.Errorf("zone %s is not synced from Venafi yet", c.zone)
+	} else if err == common.PolicyNotFound {
+		return fmt.Errorf("zone %s is not in the table", c.zone)
+	} else if err != nil {
+		return err
+	}
+	d := common.DescribePolicy(r)
+	if *format != "text" {
+		b, err := common.MarshalDocument(d, *format)
+		if err != nil {
+			return cliutil.UsageError(err)
+		}
+		_, err = stdout.Write(b)
+		return err
+	}
+	return writeDescription(stdout, d)
+}
+
+// writeDescription prints the policy as aligned lines, one restriction per line.
+func writeDescription(out io.Writer, d common.PolicyDescription) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	lastSync := "unknown"
+	if d.LastSync != nil {
+		lastSync = d.LastSync.UTC().Format(time.RFC3339)
+	}
+	fmt.Fprintf(w, "Zone:\t%s\n", d.Zone)
+	fmt.Fprintf(w, "Version:\t%s\n", d.Version)
+	fmt.Fprintf(w, "Last sync:\t%s\n", lastSync)
+	for _, r := range []struct {
+		name    string
+		regexes []string
+	}{
+		{"Common name", d.Domains.CommonName},
+		{"DNS SANs", d.Domains.DNS},
+		{"IP SANs", d.Domains.IP},
+		{"Email SANs", d.Domains.Email},
+		{"URI SANs", d.Domains.URI},
+		{"UPN SANs", d.Domains.UPN},
+		{"Organization", d.Subject.Organization},
+		{"Organizational unit", d.Subject.OrganizationalUnit},
+		{"Locality", d.Subject.Locality},
+		{"State", d.Subject.State},
+		{"Country", d.Subject.Country},
+	} {
+		if len(r.regexes) == 0 {
+			fmt.Fprintf(w, "%s:\tnone allowed\n", r.name)
+			continue
+		}
+		for i, regex := range r.regexes {
+			name := r.name + ":"
+			if i > 0 {
+				name = ""
+			}
+			fmt.Fprintf(w, "%s\t%s\n", name, regex)
+		}
+	}
+	if len(d.AllowedKeyConfigurations) == 0 {
+		fmt.Fprintf(w, "Keys:\tany\n")
+	}
+	for i, k := range d.AllowedKeyConfigurations {
+		name := "Keys:"
+		if i > 0 {
+			name = ""
+		}
+		var options []string
+		for _, size := range k.KeySizes {
+			options = append(options, fmt.Sprint(size))
+		}
+		options = append(options, k.KeyCurves...)
+		fmt.Fprintf(w, "%s\t%s %s\n", name, k.KeyType, strings.Join(options, ", "))
+	}
+	fmt.Fprintf(w, "Wildcards:\t%s\n", allowed(d.AllowWildcards))
+	fmt.Fprintf(w, "Key reuse:\t%s\n", allowed(d.AllowKeyReuse))
+	return w.Flush()
+}
+
+func allowed(b bool) string {
+	if b {
+		return "allowed"
+	}
+	return "not allowed"
+}
+
+func add(args []string, stdout, stderr io.Writer) error {
+	c := newCommand("add", stderr, true)
+	if err := c.parse(args); err != nil {
+		return err
+	}
+	// adding existing zone would drop its synced policy
+	if _, err := policies.Get(c.zone); err != common.PolicyNotFound {
+		if err == nil || err == common.PolicyFoundButEmpty {
+			return fmt.Errorf("zone %s is already in the table", c.zone)
+		}
+		return err
+	}
+	if err := policies.Add(c.zone); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(stdout, "Zone %s added, the policy lambda will sync it from Venafi\n", c.zone)
+	return err
+}
+
+func refresh(args []string, stdout, stderr io.Writer) error {
+	c := newCommand("refresh", stderr, true)
+	if err := c.parse(args); err != nil {
+		return err
+	}
+	old, err := policies.Get(c.zone)
+	if err == common.PolicyNotFound {
+		return fmt.Errorf("zone %s is not in the table, add it first", c.zone)
+	} else if err != nil && err != common.PolicyFoundButEmpty {
+		return err
+	}
+	connector, err := newConnector()
+	if err != nil {
+		return fmt.Errorf("can't connect to Venafi: %s", err)
+	}
+	connector.SetZone(c.zone)
+	p, err := connector.ReadPolicyConfiguration()
+	if err == verror.ZoneNotFoundError {
+		return fmt.Errorf("zone %s is not found in Venafi, the policy lambda will delete it", c.zone)
+	} else if err != nil {
+		return err
+	}
+	if err = policies.Save(common.PolicyRecord{Name: c.zone, Policy: *p, LastSync: time.Now()}); err != nil {
+		return err
+	}
+	version := common.PolicyVersion(*p)
+	if version == common.PolicyVersion(old.Policy) {
+		_, err = fmt.Fprintf(stdout, "Zone %s refreshed, policy version %s is not changed\n", c.zone, version)
+	} else {
+		_, err = fmt.Fprintf(stdout, "Zone %s refreshed, policy version %s\n", c.zone, version)
+	}
+	return err
+}
+
+func remove(args []string, stdout, stderr io.Writer) error {
+	c := newCommand("delete", stderr, true)
+	if err := c.parse(args); err != nil {
+		return err
+	}
+	if _, err := policies.Get(c.zone); err == common.PolicyNotFound {
+		return fmt.Errorf("zone %s is not in the table", c.zone)
+	} else if err != nil && err != common.PolicyFoundButEmpty {
+		return err
+	}
+	if err := policies.Delete(c.zone); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(stdout, "Zone %s deleted\n", c.zone)
+	return err
+}
+
+func export(args []string, stdout, stderr io.Writer) error {
+	c := newCommand("export", stderr, false)
+	out := c.flags.String("out", "", "file to write, standard output by default")
+	format := c.flags.String("format", "", "json or yaml, by default taken from the file extension or json")
+	if err := c.parse(args); err != nil {
+		return err
+	}
+	if *format == "" {
+		*format = common.FormatFromPath(*out)
+	}
+	dump, err := policies.Export()
+	if err != nil {
+		return err
+	}
+	b, err := common.MarshalDocument(dump, *format)
+	if err != nil {
+		return cliutil.UsageError(err)
+	}
+	if *out == "" {
+		_, err = stdout.Write(b)
+		return err
+	}
+	if err = ioutil.WriteFile(*out, b, 0644); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(stderr, "Exported %d zones to %s\n", len(dump.Zones), *out)
+	return err
+}
+
+func load(args []string, stdout, stderr io.Writer) error {
+	c := newCommand("import", stderr, false)
+	in := c.flags.String("in", "", "JSON or YAML export to load")
+	replace := c.flags.Bool("replace", false, "delete zones that are not in the export")
+	if err := c.parse(args); err != nil {
+		return err
+	}
+	if *in == "" {
+		return cliutil.Usagef("--in should be set")
+	}
+	b, err := ioutil.ReadFile(*in)
+	if err != nil {
+		return err
+	}
+	var dump common.PolicyTableDump
+	if err = common.UnmarshalDocument(b, &dump); err != nil {
+		return fmt.Errorf("can't read %s: %s", *in, err)
+	}
+	for _, e := range dump.Zones {
+		if e.Zone == "" {
+			return fmt.Errorf("%s has a zone without name", *in)
+		}
+	}
+	var deleted []string
+	if *replace {
+		current, err := policies.Export()
+		if err != nil {
+			return err
+		}
+		for _, e := range current.Zones {
+			if _, ok := dump.Zone(e.Zone); !ok {
+				deleted = append(deleted, e.Zone)
+			}
+		}
+	}
+	pending := 0
+	for _, e := range dump.Zones {
+		if e.Policy == nil {
+			pending++
+			err = policies.Add(e.Zone)
+		} else {
+			err = policies.Save(e.Record())
+		}
+		if err != nil {
+			return fmt.Errorf("can't import zone %s: %s", e.Zone, err)
+		}
+	}
+	for _, zone := range deleted {
+		if err = policies.Delete(zone); err != nil {
+			return fmt.Errorf("can't delete zone %s: %s", zone, err)
+		}
+	}
+	_, err = fmt.Fprintf(stdout, "Imported %d zones (%d pending sync), deleted %d zones\n", len(dump.Zones), pending, len(deleted))
+	return err
+}
+
+var commands = map[string]func(args []string, stdout, stderr io.Writer) error{
+	"list":    list,
+	"show":    show,
+	"add":     add,
+	"refresh": refresh,
+	"delete":  remove,
+	"export":  export,
+	"import":  load,
+}
+
+// run returns the exit code: 1 for failed commands, 2 for usage errors.
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "Unknown command %q\n\n%s", args[0], usage)
+		return 2
+	}
+	return cliutil.ExitCode(cmd(args[1:], stdout, stderr), stderr)
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
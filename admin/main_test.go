@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/Venafi/vcert/v4/pkg/certificate"
+	"github.com/Venafi/vcert/v4/pkg/endpoint"
+	"github.com/Venafi/vcert/v4/pkg/verror"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeTable keeps zones in memory, nil policy is a zone that is not synced yet.
+type fakeTable map[string]*common.PolicyRecord
+
+func (t fakeTable) Export() (d common.PolicyTableDump, err error) {
+	d.Table = "VenafiCertPolicy"
+	for name, r := range t {
+		if r == nil {
+			d.Zones = append(d.Zones, common.PolicyTableEntry{Zone: name})
+			continue
+		}
+		d.Zones = append(d.Zones, common.NewPolicyTableEntry(*r))
+	}
+	sort.Slice(d.Zones, func(i, j int) bool { return d.Zones[i].Zone < d.Zones[j].Zone })
+	return
+}
+
+func (t fakeTable) Get(zone string) (common.PolicyRecord, error) {
+	r, ok := t[zone]
+	if !ok {
+		return common.PolicyRecord{}, common.PolicyNotFound
+	} else if r == nil {
+		return common.PolicyRecord{Name: zone}, common.PolicyFoundButEmpty
+	}
+	return *r, nil
+}
+
+func (t fakeTable) Add(zone string) error {
+	t[zone] = nil
+	return nil
+}
+
+func (t fakeTable) Save(r common.PolicyRecord) error {
+	t[r.Name] = &r
+	return nil
+}
+
+func (t fakeTable) Delete(zone string) error {
+	delete(t, zone)
+	return nil
+}
+
+// fakeVenafi has policies of zones, other zones are not found.
+type fakeVenafi struct {
+	endpoint.Connector
+	zone     string
+	policies map[string]endpoint.Policy
+}
+
+func (f *fakeVenafi) SetZone(z string) {
+	f.zone = z
+}
+
+func (f *fakeVenafi) ReadPolicyConfiguration() (*endpoint.Policy, error) {
+	p, ok := f.policies[f.zone]
+	if !ok {
+		return nil, verror.ZoneNotFoundError
+	}
+	return &p, nil
+}
+
+var testPolicy = endpoint.Policy{
+	SubjectCNRegexes: []string{`^.*\.example\.com$`},
+	DnsSanRegExs:     []string{`^.*\.example\.com$`},
+	SubjectCRegexes:  []string{"^US$"},
+	AllowedKeyConfigurations: []endpoint.AllowedKeyConfiguration{
+		{KeyType: certificate.KeyTypeRSA, KeySizes: []int{2048, 4096}},
+		{KeyType: certificate.KeyTypeECDSA, KeyCurves: []certificate.EllipticCurve{certificate.EllipticCurveP256}},
+	},
+	AllowWildcards: true,
+}
+
+func TestCommands(t *testing.T) {
+	table := fakeTable{
+		"Default": {Name: "Default", Policy: testPolicy, LastSync: time.Now().Add(-time.Minute)},
+		"Old":     {Name: "Old", Policy: testPolicy, LastSync: time.Now().Add(-time.Hour)},
+	}
+	venafi := &fakeVenafi{policies: map[string]endpoint.Policy{"Default": testPolicy}}
+	defer func(p policyTable) { policies = p }(policies)
+	policies = table
+	defer func(c func() (endpoint.Connector, error)) { newConnector = c }(newConnector)
+	newConnector = func() (endpoint.Connector, error) { return venafi, nil }
+	admin := func(code int, args ...string) string {
+		var stdout, stderr bytes.Buffer
+		if got := run(args, &stdout, &stderr); got != code {
+			t.Fatalf("%v should exit with %d, got %d: %s%s", args, code, got, stdout.String(), stderr.String())
+		}
+		return stdout.String()
+	}
+
+	admin(0, "add", "--zone", "Business App\\Enterprise")
+	if r, ok := table["Business App\\Enterprise"]; !ok || r != nil {
+		t.Fatal("empty zone should be added")
+	}
+	admin(1, "add", "--zone", "Default")
+	out := admin(0, "list")
+	for _, line := range []string{"Business App\\Enterprise  pending", "Default                  synced", "Old                      stale"} {
+		if !strings.Contains(out, line) {
+			t.Fatalf("zones should be listed with sync status, got\n%s", out)
+		}
+	}
+
+	out = admin(0, "show", "--zone", "Default")
+	for _, line := range []string{`Common name:          ^.*\.example\.com$`, "Keys:                 RSA 2048, 4096\n                      ECDSA P256", "IP SANs:              none allowed", "Wildcards:            allowed"} {
+		if !strings.Contains(out, line) {
+			t.Fatalf("policy should be described, got\n%s", out)
+		}
+	}
+	if out = admin(0, "show", "--zone", "Default", "--format", "yaml"); !strings.Contains(out, "Zone: Default") {
+		t.Fatalf("policy description should be YAML, got\n%s", out)
+	}
+	admin(1, "show", "--zone", "Business App\\Enterprise")
+
+	venafi.policies["Business App\\Enterprise"] = endpoint.Policy{SubjectCNRegexes: []string{".*"}}
+	if out = admin(0, "refresh", "--zone", "Business App\\Enterprise"); !strings.Contains(out, "policy version") {
+		t.Fatalf("new policy version should be printed, got %s", out)
+	}
+	if r := table["Business App\\Enterprise"]; r == nil || r.Policy.SubjectCNRegexes[0] != ".*" || r.LastSync.IsZero() {
+		t.Fatalf("policy should be saved, got %+v", r)
+	}
+	admin(1, "refresh", "--zone", "Old")
+	admin(1, "refresh", "--zone", "Missing")
+
+	dir, err := ioutil.TempDir("", "policy-admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backup := filepath.Join(dir, "backup.yaml")
+	admin(0, "export", "--out", backup)
+	if b, _ := ioutil.ReadFile(backup); !strings.Contains(string(b), "- Zone: Default") {
+		t.Fatalf("export should be YAML by the file extension, got\n%s", b)
+	}
+
+	admin(0, "delete", "--zone", "Default")
+	admin(1, "delete", "--zone", "Default")
+	admin(0, "add", "--zone", "Extra")
+	if out = admin(0, "import", "--in", backup, "--replace"); out != "Imported 3 zones (0 pending sync), deleted 1 zones\n" {
+		t.Fatalf("unexpected import summary %q", out)
+	}
+	if _, ok := table["Extra"]; ok || len(table) != 3 {
+		t.Fatalf("table should be replaced by the export, got %v", table)
+	}
+	if r := table["Old"]; r == nil || time.Since(r.LastSync) < 59*time.Minute {
+		t.Fatalf("last sync should be imported, got %+v", r)
+	}
+
+	admin(2, "show")
+	admin(2, "export", "--format", "xml")
+	admin(2, "import")
+	admin(2, "unknown")
+}
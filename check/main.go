@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/Venafi/aws-private-ca-policy-venafi/internal/cliutil"
+	"github.com/Venafi/vcert/v4/pkg/certificate"
+	"github.com/Venafi/vcert/v4/pkg/endpoint"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+const usage = `Usage: policy-check --policy <file> (--csr <file> | --request <file>) [flags]
+
+Checks a certificate request against a zone policy the same way as the request lambda, without calling AWS or
+Venafi. The policy file is endpoint.Policy or a policy-admin export in JSON or YAML. Exits with code 1 when the
+request violates the policy.
+
+Flags:
+`
+
+// request is ACM-PCA IssueCertificate or ACM RequestCertificate body, other fields are ignored.
+type request struct {
+	Csr                     []byte   `json:"Csr"`
+	DomainName              *string  `json:"DomainName"`
+	SubjectAlternativeNames []string `json:"SubjectAlternativeNames"`
+	VenafiZone              string   `json:"VenafiZone"`
+}
+
+// loadPolicy reads policy of the zone from policy file or export. Zone may be empty for policy files and exports
+// of one zone.
+func loadPolicy(path, zone string) (string, endpoint.Policy, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", endpoint.Policy{}, err
+	}
+	var doc map[string]json.RawMessage
+	if err = common.UnmarshalDocument(b, &doc); err != nil {
+		return "", endpoint.Policy{}, fmt.Errorf("can't read %s: %s", path, err)
+	}
+	if _, ok := doc["Zones"]; !ok {
+		// a typo or policy description would be read as a policy without restrictions
+		fields := map[string]json.RawMessage{}
+		empty, _ := json.Marshal(endpoint.Policy{})
+		_ = json.Unmarshal(empty, &fields)
+		for name := range doc {
+			if _, ok := fields[name]; !ok {
+				return "", endpoint.Policy{}, fmt.Errorf("%s is not a policy, it has unknown field %s", path, name)
+			}
+		}
+		var p endpoint.Policy
+		if err = common.UnmarshalDocument(b, &p); err != nil {
+			return "", endpoint.Policy{}, fmt.Errorf("can't read policy %s: %s", path, err)
+		}
+		return zone, p, nil
+	}
+
+	var dump common.PolicyTableDump
+	if err = common.UnmarshalDocument(b, &dump); err != nil {
+		return "", endpoint.Policy{}, fmt.Errorf("can't read export %s: %s", path, err)
+	}
+	if zone == "" {
+		if len(dump.Zones) != 1 {
+			return "", endpoint.Policy{}, cliutil.Usagef("%s has %d zones, --zone or VenafiZone of the request should be set", path, len(dump.Zones))
+		}
+		zone = dump.Zones[0].Zone
+	}
+	e, ok := dump.Zone(zone)
+	if !ok {
+		return "", endpoint.Policy{}, fmt.Errorf("zone %s is not in %s", zone, path)
+	} else if e.Policy == nil {
+		return "", endpoint.Policy{}, fmt.Errorf("zone %s is not synced from Venafi in %s", zone, path)
+	}
+	return zone, *e.Policy, nil
+}
+
+// readRequest returns the request from CSR file or request file, CSR of the request may be PEM or DER.
+func readRequest(csrPath, requestPath string) (r request, err error) {
+	switch {
+	case csrPath != "" && requestPath == "":
+		r.Csr, err = ioutil.ReadFile(csrPath)
+		return
+	case csrPath == "" && requestPath != "":
+		b, err := ioutil.ReadFile(requestPath)
+		if err != nil {
+			return r, err
+		}
+		if err = common.UnmarshalDocument(b, &r); err != nil {
+			return r, fmt.Errorf("can't read request %s: %s", requestPath, err)
+		}
+		if len(r.Csr) == 0 && r.DomainName == nil {
+			return r, fmt.Errorf("request %s should have either Csr or DomainName", requestPath)
+		}
+		return r, nil
+	}
+	return r, cliutil.Usagef("either --csr or --request should be set")
+}
+
+// evaluate runs the policy checks of IssueCertificate requests for CSRs and of RequestCertificate requests
+// for domain names. The subject is returned for normalized CSRs.
+func evaluate(p endpoint.Policy, r request, normalize bool) (string, common.PolicyViolations, error) {
+	if len(r.Csr) == 0 {
+		var commonName string
+		if r.DomainName != nil {
+			commonName = *r.DomainName
+		}
+		return "", common.CheckDomainNames(p, commonName, r.SubjectAlternativeNames), nil
+	}
+	var req certificate.Request
+	if err := req.SetCSR(r.Csr); err != nil {
+		return "", nil, fmt.Errorf("can't parse certificate request: %s", err)
+	}
+	subject, violations, err := common.ValidateCSR(p, req.GetCSR(), normalize)
+	if err != nil {
+		return "", nil, fmt.Errorf("can't parse certificate request: %s", err)
+	}
+	if !normalize {
+		return "", violations, nil
+	}
+	return subject.String(), violations, nil
+}
+
+func check(args []string, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("policy-check", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		flags.PrintDefaults()
+	}
+	policyPath := flags.String("policy", "", "JSON or YAML file with endpoint.Policy or policy-admin export")
+	zone := flags.String("zone", "", "zone of the export, VenafiZone of the request by default")
+	csrPath := flags.String("csr", "", "PEM or DER CSR checked as IssueCertificate request")
+	requestPath := flags.String("request", "", "JSON or YAML body of IssueCertificate (Csr) or RequestCertificate (DomainName) request")
+	normalize := flags.Bool("normalize", os.Getenv("NORMALIZE_SUBJECT") == "true", "normalize CSR subject to the policy like NORMALIZE_SUBJECT of the lambda")
+	if err := flags.Parse(args); err != nil {
+		return cliutil.FlagError(err)
+	}
+	if *policyPath == "" {
+		return cliutil.Usagef("--policy should be set")
+	}
+	r, err := readRequest(*csrPath, *requestPath)
+	if err != nil {
+		return err
+	}
+	if *zone == "" {
+		*zone = r.VenafiZone
+	}
+	name, policy, err := loadPolicy(*policyPath, *zone)
+	if err != nil {
+		return err
+	}
+	subject, violations, err := evaluate(policy, r, *normalize)
+	if err != nil {
+		return err
+	}
+	in := ""
+	if name != "" {
+		in = fmt.Sprintf(" of zone %s", name)
+	}
+	if len(violations) == 0 {
+		fmt.Fprintf(stdout, "Request is valid in policy%s\n", in)
+		if subject != "" {
+			fmt.Fprintf(stdout, "Certificate subject: %s\n", subject)
+		}
+		return nil
+	}
+	fmt.Fprintf(stdout, "Request violates policy%s:\n", in)
+	for _, v := range violations {
+		fmt.Fprintf(stdout, "  %s\n", v)
+	}
+	return cliutil.ErrInvalid
+}
+
+// run returns the exit code: 1 for invalid requests and failures, 2 for usage errors.
+func run(args []string, stdout, stderr io.Writer) int {
+	return cliutil.ExitCode(check(args, stdout, stderr), stderr)
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
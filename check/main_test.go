@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/Venafi/vcert/v4/pkg/certificate"
+	"github.com/Venafi/vcert/v4/pkg/endpoint"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testPolicy = endpoint.Policy{
+	SubjectCNRegexes: []string{`^.*\.example\.com$`},
+	SubjectORegexes:  []string{`^Venafi Inc\.$`},
+	SubjectOURegexes: []string{".*"},
+	SubjectSTRegexes: []string{".*"},
+	SubjectLRegexes:  []string{".*"},
+	SubjectCRegexes:  []string{".*"},
+	DnsSanRegExs:     []string{`^.*\.example\.com$`},
+	AllowedKeyConfigurations: []endpoint.AllowedKeyConfiguration{
+		{KeyType: certificate.KeyTypeRSA, KeySizes: []int{2048}},
+	},
+}
+
+var openPolicy = endpoint.Policy{
+	SubjectCNRegexes: []string{".*"},
+	SubjectORegexes:  []string{".*"},
+	SubjectOURegexes: []string{".*"},
+	SubjectSTRegexes: []string{".*"},
+	SubjectLRegexes:  []string{".*"},
+	SubjectCRegexes:  []string{".*"},
+	DnsSanRegExs:     []string{".*"},
+}
+
+func TestCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy-check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name string, b []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	csr := func(name string, subject pkix.Name, dnsNames ...string) []byte {
+		var key interface{}
+		if name == "ecdsa.csr" {
+			key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		} else {
+			key, _ = rsa.GenerateKey(rand.Reader, 2048)
+		}
+		der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: subject, DNSNames: dnsNames}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+	}
+	b, _ := common.MarshalDocument(testPolicy, common.FormatJSON)
+	policy := write("policy.json", b)
+	b, _ = common.MarshalDocument(common.PolicyTableDump{Zones: []common.PolicyTableEntry{
+		common.NewPolicyTableEntry(common.PolicyRecord{Name: "Default", Policy: testPolicy}),
+		common.NewPolicyTableEntry(common.PolicyRecord{Name: "Open", Policy: openPolicy}),
+		{Zone: "Pending"},
+	}}, common.FormatYAML)
+	export := write("policies.yaml", b)
+
+	valid := write("valid.csr", csr("valid.csr", pkix.Name{CommonName: "www.example.com", Organization: []string{"Venafi Inc."}}, "www.example.com"))
+	unnormalized := write("unnormalized.csr", csr("unnormalized.csr", pkix.Name{CommonName: "www.example.com"}))
+	invalid := write("ecdsa.csr", csr("ecdsa.csr", pkix.Name{CommonName: "www.example.org", Organization: []string{"Venafi Inc."}}, "www.example.org"))
+	issueRequest := write("issue.json", []byte(`{"CertificateAuthorityArn": "arn:ca", "SigningAlgorithm": "SHA256WITHRSA",
+		"Csr": "`+base64.StdEncoding.EncodeToString(csr("ecdsa.csr", pkix.Name{CommonName: "test.example.org"}))+`", "VenafiZone": "Open"}`))
+	acmRequest := write("request.yaml", []byte("DomainName: www.example.com\nSubjectAlternativeNames:\n  - api.example.org\n"))
+
+	policyCheck := func(code int, args ...string) string {
+		var stdout, stderr bytes.Buffer
+		if got := run(args, &stdout, &stderr); got != code {
+			t.Fatalf("%v should exit with %d, got %d: %s%s", args, code, got, stdout.String(), stderr.String())
+		}
+		return stdout.String() + stderr.String()
+	}
+
+	if out := policyCheck(0, "--policy", policy, "--csr", valid); out != "Request is valid in policy\n" {
+		t.Fatalf("unexpected output %q", out)
+	}
+	out := policyCheck(1, "--policy", policy, "--csr", invalid)
+	for _, violation := range []string{"common name www.example.org is not allowed", "DNS SANs [www.example.org]", "Key Type and Size"} {
+		if !strings.Contains(out, violation) {
+			t.Fatalf("all violations should be printed, got\n%s", out)
+		}
+	}
+	policyCheck(1, "--policy", policy, "--csr", unnormalized)
+	if out = policyCheck(0, "--policy", policy, "--csr", unnormalized, "--normalize"); !strings.Contains(out, "Certificate subject: CN=www.example.com,O=Venafi Inc.") {
+		t.Fatalf("normalized subject should be printed, got %q", out)
+	}
+
+	if out = policyCheck(0, "--policy", export, "--request", issueRequest); !strings.Contains(out, "valid in policy of zone Open") {
+		t.Fatalf("zone of the request should be taken from the export, got %q", out)
+	}
+	if out = policyCheck(1, "--policy", export, "--zone", "Default", "--request", acmRequest); !strings.Contains(out, "DNS SANs [api.example.org]") {
+		t.Fatalf("ACM request domain names should be checked, got %q", out)
+	}
+	policyCheck(1, "--policy", export, "--zone", "Pending", "--csr", valid)
+	policyCheck(1, "--policy", export, "--zone", "Missing", "--csr", valid)
+	policyCheck(2, "--policy", export, "--csr", valid)
+
+	description, _ := common.MarshalDocument(common.DescribePolicy(common.PolicyRecord{Name: "Default", Policy: testPolicy}), common.FormatJSON)
+	if out = policyCheck(1, "--policy", write("description.json", description), "--csr", valid); !strings.Contains(out, "is not a policy") {
+		t.Fatalf("policy description should not be read as a policy, got %q", out)
+	}
+	policyCheck(1, "--policy", policy, "--csr", policy)
+	policyCheck(2, "--policy", policy)
+	policyCheck(2, "--csr", valid)
+	policyCheck(2, "--policy", policy, "--csr", valid, "--request", acmRequest)
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"github.com/Venafi/aws-private-ca-policy-venafi/client"
+	"github.com/Venafi/aws-private-ca-policy-venafi/internal/cliutil"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/acm"
+	"github.com/aws/aws-sdk-go-v2/service/acmpca"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+const usage = `Usage: cert-cli <command> [flags]
+
+Commands:
+  issue          issue ACM-PCA certificate for a CSR
+  request        request ACM private certificate for domain names
+  get            get issued certificate and its chain
+  validate       check a CSR or domain names against the zone policy without issuing
+  revoke         revoke ACM-PCA certificate
+  list-policies  list zones with policies
+
+Run "cert-cli <command> -h" for command flags. The endpoint is --endpoint or VENAFI_ENDPOINT, AWS credentials
+and region come from the environment and shared configuration like for AWS CLI.
+`
+
+// stringList is a repeatable flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// newClient creates the API client from AWS shared configuration, tests point it to a fake endpoint.
+var newClient = func(endpoint, profile, region string) (*client.Client, error) {
+	c, err := client.NewFromDefaultConfig(endpoint, profile)
+	if err != nil {
+		return nil, err
+	}
+	if region != "" {
+		c.Region = region
+	}
+	return c, nil
+}
+
+// command has flags shared by all commands.
+type command struct {
+	flags    *flag.FlagSet
+	endpoint string
+	profile  string
+	region   string
+	timeout  time.Duration
+	stdout   io.Writer
+}
+
+func newCommand(name string, stderr, stdout io.Writer) *command {
+	c := &command{flags: flag.NewFlagSet(name, flag.ContinueOnError), stdout: stdout}
+	c.flags.SetOutput(stderr)
+	c.flags.StringVar(&c.endpoint, "endpoint", os.Getenv("VENAFI_ENDPOINT"), "URL of the request lambda API or server")
+	c.flags.StringVar(&c.profile, "profile", "", "AWS shared configuration profile")
+	c.flags.StringVar(&c.region, "region", "", "region requests are signed for, by default taken from the endpoint or AWS configuration")
+	c.flags.DurationVar(&c.timeout, "timeout", 5*time.Minute, "time limit of the command including waiting for issuance")
+	return c
+}
+
+func (c *command) parse(args []string) (*client.Client, error) {
+	if err := c.flags.Parse(args); err != nil {
+		return nil, cliutil.FlagError(err)
+	}
+	if c.endpoint == "" {
+		return nil, cliutil.Usagef("--endpoint or VENAFI_ENDPOINT should be set")
+	}
+	return newClient(c.endpoint, c.profile, c.region)
+}
+
+// output has flags of commands returning certificates.
+type output struct {
+	wait     bool
+	certOut  string
+	chainOut string
+	stdout   io.Writer
+}
+
+func (c *command) output() *output {
+	o := &output{stdout: c.stdout}
+	c.flags.BoolVar(&o.wait, "wait", false, "wait until the certificate is issued and write it")
+	c.flags.StringVar(&o.certOut, "cert-out", "", "PEM file for the certificate, standard output by default")
+	c.flags.StringVar(&o.chainOut, "chain-out", "", "PEM file for the certificate chain, standard output by default")
+	return o
+}
+
+// write writes certificate and chain to the files or standard output.
+func (o *output) write(cert, chain string) error {
+	for _, f := range []struct{ path, pem string }{{o.certOut, cert}, {o.chainOut, chain}} {
+		if f.pem == "" {
+			continue
+		}
+		pemText := strings.TrimSpace(f.pem) + "\n"
+		if f.path == "" {
+			if _, err := io.WriteString(o.stdout, pemText); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := ioutil.WriteFile(f.path, []byte(pemText), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readCSR(path string) ([]byte, *x509.CertificateRequest, error) {
+	if path == "" {
+		return nil, nil, cliutil.Usagef("--csr should be set")
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || !strings.HasSuffix(block.Type, "CERTIFICATE REQUEST") {
+		return nil, nil, fmt.Errorf("%s is not PEM certificate request", path)
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return b, csr, nil
+}
+
+func issue(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	c := newCommand("issue", stderr, stdout)
+	csrPath := c.flags.String("csr", "", "PEM CSR file")
+	caArn := c.flags.String("ca-arn", "", "ACM-PCA certificate authority ARN")
+	zone := c.flags.String("zone", "", "Venafi zone, chosen by the lambda zone rules by default")
+	templateArn := c.flags.String("template-arn", "", "ACM-PCA certificate template ARN")
+	algorithm := c.flags.String("signing-algorithm", "", "ACM-PCA signing algorithm, the lambda picks the one of the CA key type by default")
+	days := c.flags.Int64("validity-days", 90, "certificate validity in days")
+	out := c.output()
+	cli, err := c.parse(args)
+	if err != nil {
+		return err
+	}
+	if *caArn == "" {
+		return cliutil.Usagef("--ca-arn should be set")
+	}
+	csrPEM, _, err := readCSR(*csrPath)
+	if err != nil {
+		return err
+	}
+	in := &client.IssueCertificateInput{
+		IssueCertificateInput: acmpca.IssueCertificateInput{
+			CertificateAuthorityArn: caArn,
+			Csr:                     csrPEM,
+			SigningAlgorithm:        acmpca.SigningAlgorithm(*algorithm),
+			Validity:                &acmpca.Validity{Type: acmpca.ValidityPeriodTypeDays, Value: days},
+		},
+		VenafiZone: *zone,
+	}
+	if *templateArn != "" {
+		in.TemplateArn = templateArn
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	issued, err := cli.IssueCertificate(ctx, in)
+	if err != nil {
+		return err
+	}
+	return finish(ctx, cli, aws.StringValue(issued.CertificateArn), out, stderr)
+}
+
+func request(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	c := newCommand("request", stderr, stdout)
+	domain := c.flags.String("domain", "", "certificate domain name")
+	var sans stringList
+	c.flags.Var(&sans, "san", "subject alternative name, may be repeated")
+	caArn := c.flags.String("ca-arn", "", "ACM-PCA certificate authority ARN of the private certificate")
+	zone := c.flags.String("zone", "", "Venafi zone, chosen by the lambda zone rules by default")
+	out := c.output()
+	cli, err := c.parse(args)
+	if err != nil {
+		return err
+	}
+	if *domain == "" || *caArn == "" {
+		return cliutil.Usagef("--domain and --ca-arn should be set")
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	requested, err := cli.RequestCertificate(ctx, &client.RequestCertificateInput{
+		RequestCertificateInput: acm.RequestCertificateInput{
+			DomainName:              domain,
+			SubjectAlternativeNames: sans,
+			CertificateAuthorityArn: caArn,
+		},
+		VenafiZone: *zone,
+	})
+	if err != nil {
+		return err
+	}
+	return finish(ctx, cli, aws.StringValue(requested.CertificateArn), out, stderr)
+}
+
+// finish prints the ARN of the new certificate and writes the certificate when it was asked to wait.
+func finish(ctx context.Context, cli *client.Client, arn string, out *output, stderr io.Writer) error {
+	if !out.wait {
+		_, err := fmt.Fprintln(out.stdout, arn)
+		return err
+	}
+	// standard output may have the certificate
+	fmt.Fprintln(stderr, arn)
+	cert, chain, err := cli.WaitUntilCertificateIssued(ctx, arn)
+	if err != nil {
+		return err
+	}
+	return out.write(cert, chain)
+}
+
+func get(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	c := newCommand("get", stderr, stdout)
+	arn := c.flags.String("arn", "", "ACM-PCA or ACM certificate ARN")
+	out := c.output()
+	cli, err := c.parse(args)
+	if err != nil {
+		return err
+	}
+	if *arn == "" {
+		return cliutil.Usagef("--arn should be set")
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	get := cli.Certificate
+	if out.wait {
+		get = cli.WaitUntilCertificateIssued
+	}
+	cert, chain, err := get(ctx, *arn)
+	if err != nil {
+		return err
+	}
+	return out.write(cert, chain)
+}
+
+func validate(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	c := newCommand("validate", stderr, stdout)
+	csrPath := c.flags.String("csr", "", "PEM CSR file of IssueCertificate request")
+	domain := c.flags.String("domain", "", "domain name of RequestCertificate request")
+	var sans stringList
+	c.flags.Var(&sans, "san", "subject alternative name of RequestCertificate request, may be repeated")
+	caArn := c.flags.String("ca-arn", "", "ACM-PCA certificate authority ARN, used by zone rules")
+	templateArn := c.flags.String("template-arn", "", "ACM-PCA certificate template ARN, used by zone rules")
+	zone := c.flags.String("zone", "", "Venafi zone, chosen by the lambda zone rules by default")
+	cli, err := c.parse(args)
+	if err != nil {
+		return err
+	}
+	in := &client.ValidateCertificateRequestInput{VenafiZone: *zone}
+	switch {
+	case *csrPath != "" && *domain == "":
+		if in.Csr, _, err = readCSR(*csrPath); err != nil {
+			return err
+		}
+	case *csrPath == "" && *domain != "":
+		in.DomainName, in.SubjectAlternativeNames = domain, sans
+	default:
+		return cliutil.Usagef("either --csr or --domain should be set")
+	}
+	if *caArn != "" {
+		in.CertificateAuthorityArn = caArn
+	}
+	if *templateArn != "" {
+		in.TemplateArn = templateArn
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	result, err := cli.ValidateCertificateRequest(ctx, in)
+	if err != nil {
+		return err
+	}
+	if result.Valid {
+		fmt.Fprintf(stdout, "Request is valid in zone %s\n", result.Zone)
+		if result.Subject != "" {
+			fmt.Fprintf(stdout, "Certificate subject: %s\n", result.Subject)
+		}
+		return nil
+	}
+	fmt.Fprintf(stdout, "Request violates policy of zone %s:\n", result.Zone)
+	for _, v := range result.Violations {
+		fmt.Fprintf(stdout, "  %s\n", v)
+	}
+	return cliutil.ErrInvalid
+}
+
+func revoke(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	c := newCommand("revoke", stderr, stdout)
+	arn := c.flags.String("arn", "", "ACM-PCA certificate ARN")
+	serial := c.flags.String("serial", "", "certificate serial number in hex, read from the certificate by default")
+	reason := c.flags.String("reason", string(acmpca.RevocationReasonUnspecified), "revocation reason, e.g. KEY_COMPROMISE or SUPERSEDED")
+	cli, err := c.parse(args)
+	if err != nil {
+		return err
+	}
+	if *arn == "" {
+		return cliutil.Usagef("--arn should be set")
+	}
+	caArn, err := client.CertificateAuthorityArn(*arn)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	if *serial == "" {
+		out, err := cli.GetCertificate(ctx, &acmpca.GetCertificateInput{CertificateAuthorityArn: aws.String(caArn), CertificateArn: arn})
+		if err != nil {
+			return err
+		}
+		block, _ := pem.Decode([]byte(aws.StringValue(out.Certificate)))
+		if block == nil {
+			return fmt.Errorf("certificate %s is not PEM", *arn)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return err
+		}
+		*serial = formatSerial(cert)
+	}
+	_, err = cli.RevokeCertificate(ctx, &acmpca.RevokeCertificateInput{
+		CertificateAuthorityArn: aws.String(caArn),
+		CertificateSerial:       serial,
+		RevocationReason:        acmpca.RevocationReason(strings.ToUpper(*reason)),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(stdout, "Certificate %s (serial %s) revoked\n", *arn, *serial)
+	return err
+}
+
+// formatSerial returns serial number the way ACM-PCA expects it, colon separated hex bytes.
+func formatSerial(cert *x509.Certificate) string {
+	b := cert.SerialNumber.Bytes()
+	parts := make([]string, len(b))
+	for i := range b {
+		parts[i] = fmt.Sprintf("%02x", b[i])
+	}
+	return strings.Join(parts, ":")
+}
+
+func listPolicies(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	c := newCommand("list-policies", stderr, stdout)
+	describe := c.flags.Bool("describe", false, "print policies of the zones as JSON")
+	cli, err := c.parse(args)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	zones, err := cli.ListAllPolicies(ctx)
+	if err != nil {
+		return err
+	}
+	for _, zone := range zones {
+		if !*describe {
+			fmt.Fprintln(stdout, zone)
+			continue
+		}
+		policy, err := cli.GetPolicy(ctx, zone)
+		if err != nil {
+			return fmt.Errorf("can't get policy of zone %s: %s", zone, err)
+		}
+		b, err := json.MarshalIndent(policy, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, string(b))
+	}
+	return nil
+}
+
+var commands = map[string]func(ctx context.Context, args []string, stdout, stderr io.Writer) error{
+	"issue":         issue,
+	"request":       request,
+	"get":           get,
+	"validate":      validate,
+	"revoke":        revoke,
+	"list-policies": listPolicies,
+}
+
+// run returns the exit code: 1 for failed commands and invalid requests, 2 for usage errors.
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "Unknown command %q\n\n%s", args[0], usage)
+		return 2
+	}
+	return cliutil.ExitCode(cmd(context.Background(), args[1:], stdout, stderr), stderr)
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
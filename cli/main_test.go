@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/Venafi/aws-private-ca-policy-venafi/client"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testCertificateArn = "arn:aws:acm-pca:eu-west-1:123456789012:certificate-authority/ca-id/certificate/cert-id"
+
+func testCertificatePEM(t *testing.T) string {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(0x1a2b3c),
+		Subject:      pkix.Name{CommonName: "www.example.com"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestCommands(t *testing.T) {
+	cert := testCertificatePEM(t)
+	pending := 1
+	var requests []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		body["Target"] = r.Header.Get("X-Amz-Target")
+		requests = append(requests, body)
+		var resp interface{}
+		switch r.Header.Get("X-Amz-Target") {
+		case client.TargetIssueCertificate:
+			resp = map[string]string{"CertificateArn": testCertificateArn}
+		case client.TargetGetCertificate:
+			if pending > 0 {
+				pending--
+				w.WriteHeader(http.StatusBadRequest)
+				resp = map[string]string{"__type": client.CodeRequestInProgress, "message": "in progress"}
+				break
+			}
+			resp = map[string]string{"Certificate": cert, "CertificateChain": "-----BEGIN CERTIFICATE-----\nchain\n-----END CERTIFICATE-----"}
+		case client.TargetValidateCertificateRequest:
+			resp = map[string]interface{}{"Valid": false, "Zone": "Default", "Violations": []string{"common name test.example.org is not allowed"}}
+		case client.TargetRevokeCertificate:
+			resp = map[string]string{}
+		case client.TargetListPolicies:
+			if body["NextToken"] == nil {
+				resp = map[string]string{"NextToken": "next"}
+			} else {
+				resp = map[string]interface{}{"Zones": []string{"Default", "Business App\\Enterprise"}}
+			}
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			resp = map[string]string{"__type": client.CodeUnknownOperation, "message": "unknown"}
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+	newClient = func(endpoint, profile, region string) (*client.Client, error) {
+		return client.New(endpoint, aws.Config{Region: "eu-west-1", Credentials: aws.NewStaticCredentialsProvider("AKID", "SECRET", "")}), nil
+	}
+	defer func(d time.Duration) { client.DefaultWaitDelay = d }(client.DefaultWaitDelay)
+	client.DefaultWaitDelay = time.Millisecond
+
+	dir, err := ioutil.TempDir("", "cert-cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	csrDER, _ := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "www.example.com"}}, key)
+	csrPath := filepath.Join(dir, "csr.pem")
+	if err = ioutil.WriteFile(csrPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cli := func(code int, args ...string) string {
+		var stdout, stderr bytes.Buffer
+		if got := run(append(args, "--endpoint", srv.URL), &stdout, &stderr); got != code {
+			t.Fatalf("%v should exit with %d, got %d: %s%s", args, code, got, stdout.String(), stderr.String())
+		}
+		return stdout.String()
+	}
+
+	certPath, chainPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "chain.pem")
+	cli(0, "issue", "--csr", csrPath, "--ca-arn", "arn:ca", "--zone", "Default", "--wait", "--cert-out", certPath, "--chain-out", chainPath)
+	if requests[0]["SigningAlgorithm"] != "" || requests[0]["VenafiZone"] != "Default" {
+		t.Fatalf("unexpected issue request: %v", requests[0])
+	}
+	if b, _ := ioutil.ReadFile(certPath); string(b) != cert {
+		t.Fatalf("certificate should be written to the file, got %s", b)
+	}
+	if b, _ := ioutil.ReadFile(chainPath); !strings.Contains(string(b), "chain") {
+		t.Fatalf("chain should be written to the file, got %s", b)
+	}
+
+	if out := cli(0, "get", "--arn", testCertificateArn); !strings.Contains(out, cert) || !strings.Contains(out, "chain") {
+		t.Fatalf("certificate and chain should be printed, got %s", out)
+	}
+	if out := cli(1, "validate", "--domain", "test.example.org", "--san", "www.example.com"); !strings.Contains(out, "test.example.org is not allowed") {
+		t.Fatalf("violations should be printed, got %s", out)
+	}
+	cli(0, "revoke", "--arn", testCertificateArn, "--reason", "superseded")
+	revoke := requests[len(requests)-1]
+	if revoke["CertificateSerial"] != "1a:2b:3c" || revoke["RevocationReason"] != "SUPERSEDED" ||
+		revoke["CertificateAuthorityArn"] != "arn:aws:acm-pca:eu-west-1:123456789012:certificate-authority/ca-id" {
+		t.Fatalf("unexpected revoke request: %v", revoke)
+	}
+	if out := cli(0, "list-policies"); out != "Default\nBusiness App\\Enterprise\n" {
+		t.Fatalf("all pages of zones should be listed, got %q", out)
+	}
+
+	cli(2, "issue", "--csr", csrPath)
+	cli(2, "validate", "--csr", csrPath, "--domain", "www.example.com")
+	cli(2, "unknown")
+	cli(2, "get", "--no-such-flag")
+}
@@ -0,0 +1,259 @@
+// Package client calls the Venafi Certificate Request Lambda through API Gateway, a Lambda function URL or
+// the standalone request server. Requests are signed with SigV4, retried when that is safe and failures are
+// returned as *Error with the AWS error code.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/external"
+	"github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	amzJSONContentType = "application/x-amz-json-1.1"
+
+	defaultMaxRetries    = 3
+	defaultRetryDelay    = 200 * time.Millisecond
+	defaultMaxRetryDelay = 20 * time.Second
+)
+
+// apiGatewayHost and functionURLHost match API Gateway and Lambda function URL hosts with the region
+// the request has to be signed for.
+var (
+	apiGatewayHost  = regexp.MustCompile(`\.execute-api\.([a-z0-9-]+)\.amazonaws\.com$`)
+	functionURLHost = regexp.MustCompile(`\.lambda-url\.([a-z0-9-]+)\.on\.aws$`)
+)
+
+// Client is safe for concurrent use. Fields may be changed before the first request.
+type Client struct {
+	// Endpoint is the URL requests are posted to, e.g. https://abcde12345.execute-api.us-east-1.amazonaws.com/v1/request
+	Endpoint string
+	// Region and Service are the SigV4 scope, by default taken from Endpoint host or AWS configuration
+	Region  string
+	Service string
+
+	Credentials aws.CredentialsProvider
+	HTTPClient  *http.Client
+	// MaxRetries is the number of retries of throttled and failed requests. Retry-After longer than
+	// MaxRetryDelay is returned to the caller as error.
+	MaxRetries    int
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+}
+
+// New returns client of the endpoint signing requests with credentials from the AWS configuration.
+func New(endpoint string, cfg aws.Config) *Client {
+	c := &Client{
+		Endpoint:      endpoint,
+		Region:        cfg.Region,
+		Service:       "execute-api",
+		Credentials:   cfg.Credentials,
+		HTTPClient:    http.DefaultClient,
+		MaxRetries:    defaultMaxRetries,
+		RetryDelay:    defaultRetryDelay,
+		MaxRetryDelay: defaultMaxRetryDelay,
+	}
+	if cfg.HTTPClient != nil {
+		c.HTTPClient = cfg.HTTPClient
+	}
+	host := endpoint
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	host = strings.SplitN(host, "/", 2)[0]
+	if m := apiGatewayHost.FindStringSubmatch(host); m != nil {
+		c.Region = m[1]
+	} else if m := functionURLHost.FindStringSubmatch(host); m != nil {
+		c.Region, c.Service = m[1], "lambda"
+	}
+	return c
+}
+
+// NewFromDefaultConfig loads AWS configuration the way AWS CLI does (environment, AWS_PROFILE or profile,
+// shared config and credentials files) and returns client of the endpoint.
+func NewFromDefaultConfig(endpoint, profile string) (*Client, error) {
+	var configs []external.Config
+	if profile != "" {
+		configs = append(configs, external.WithSharedConfigProfile(profile))
+	}
+	cfg, err := external.LoadDefaultAWSConfig(configs...)
+	if err != nil {
+		return nil, fmt.Errorf("can't load AWS configuration: %s", err)
+	}
+	return New(endpoint, cfg), nil
+}
+
+// Error is an error response of the lambda or of ACM and ACM-PCA passed through by it.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	// RetryAfter is set for requests over rate limits
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (HTTP %d): %s", e.Code, e.StatusCode, e.Message)
+}
+
+// Error codes returned by the lambda, ACM and ACM-PCA.
+const (
+	CodeAccessDenied      = "AccessDeniedException"
+	CodeValidation        = "ValidationException"
+	CodeNotFound          = "ResourceNotFoundException"
+	CodeThrottling        = "ThrottlingException"
+	CodeRequestInProgress = "RequestInProgressException"
+	CodeRequestFailed     = "RequestFailedException"
+	CodeUnknownOperation  = "UnknownOperationException"
+	CodeTooManyRequests   = "TooManyRequestsException"
+)
+
+// ErrorCode returns the AWS error code of the error, empty if it's not *Error.
+func ErrorCode(err error) string {
+	if e, ok := err.(*Error); ok {
+		return e.Code
+	}
+	return ""
+}
+
+func decodeError(resp *http.Response, body []byte) *Error {
+	e := &Error{StatusCode: resp.StatusCode, Code: resp.Header.Get("X-Amzn-ErrorType")}
+	var b struct {
+		Type    string `json:"__type"`
+		Message string `json:"message"`
+		// API Gateway and some services use capitalized Message
+		CapitalMessage string `json:"Message"`
+	}
+	if json.Unmarshal(body, &b) == nil {
+		if b.Type != "" {
+			e.Code = b.Type
+		}
+		e.Message = b.Message
+		if e.Message == "" {
+			e.Message = b.CapitalMessage
+		}
+	}
+	// service error types may be namespaced, e.g. com.amazonaws.acmpca#ThrottlingException, and API Gateway
+	// adds the error location after a colon
+	if i := strings.LastIndex(e.Code, "#"); i >= 0 {
+		e.Code = e.Code[i+1:]
+	}
+	e.Code = strings.SplitN(e.Code, ":", 2)[0]
+	if e.Code == "" {
+		e.Code = http.StatusText(resp.StatusCode)
+	}
+	if e.Message == "" {
+		e.Message = strings.TrimSpace(string(body))
+	}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		e.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return e
+}
+
+func (e *Error) throttled() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.Code == CodeThrottling || e.Code == CodeTooManyRequests
+}
+
+// retryable tells whether the request may be sent again. Requests that may have issued a certificate
+// are only retried when they are idempotent.
+func (e *Error) retryable(idempotent bool) bool {
+	if e.throttled() {
+		return true
+	}
+	return idempotent && e.StatusCode >= 500 && e.StatusCode != http.StatusNotImplemented
+}
+
+// newIdempotencyToken returns a token valid for both ACM and ACM-PCA: up to 32 word characters.
+func newIdempotencyToken() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// backoff returns the delay before retry attempt (counted from 0) with full jitter.
+func (c *Client) backoff(attempt int) time.Duration {
+	max := c.RetryDelay << uint(attempt)
+	if max <= 0 || max > c.MaxRetryDelay {
+		max = c.MaxRetryDelay
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max)+1))
+	if err != nil {
+		return max
+	}
+	return time.Duration(n.Int64())
+}
+
+// send posts signed request with X-Amz-Target header and returns body of the successful response.
+func (c *Client) send(ctx context.Context, target string, in interface{}, idempotent bool) ([]byte, error) {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	signer := v4.NewSigner(c.Credentials)
+	for attempt := 0; ; attempt++ {
+		respBody, err := c.sendOnce(ctx, signer, target, body)
+		if err == nil {
+			return respBody, nil
+		}
+		if attempt >= c.MaxRetries {
+			return nil, err
+		}
+		delay := c.backoff(attempt)
+		if e, ok := err.(*Error); ok {
+			if !e.retryable(idempotent) || e.RetryAfter > c.MaxRetryDelay {
+				return nil, err
+			}
+			if e.RetryAfter > delay {
+				delay = e.RetryAfter
+			}
+		} else if !idempotent {
+			// the request might have been processed before the connection failed
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (c *Client) sendOnce(ctx context.Context, signer *v4.Signer, target string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, c.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", amzJSONContentType)
+	req.Header.Set("X-Amz-Target", target)
+	if _, err = signer.Sign(req, bytes.NewReader(body), c.Service, c.Region, time.Now()); err != nil {
+		return nil, fmt.Errorf("can't sign request: %s", err)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, decodeError(resp, respBody)
+	}
+	return respBody, nil
+}
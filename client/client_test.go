@@ -0,0 +1,183 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/acm"
+	"github.com/aws/aws-sdk-go-v2/service/acmpca"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testCertificateArn = "arn:aws:acm-pca:eu-west-1:123456789012:certificate-authority/ca-id/certificate/cert-id"
+
+// fakeLambda answers with the responses queued for each target and records request bodies.
+type fakeLambda struct {
+	sync.Mutex
+	t         *testing.T
+	responses map[string][]func(w http.ResponseWriter)
+	bodies    map[string][]map[string]interface{}
+}
+
+func (f *fakeLambda) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	auth := r.Header.Get("Authorization")
+	if !strings.Contains(auth, "Credential=AKID/") || !strings.Contains(auth, "/eu-west-1/execute-api/aws4_request") ||
+		!strings.Contains(auth, "x-amz-target") {
+		f.t.Errorf("request is not signed for the endpoint region: %s", auth)
+	}
+	target := r.Header.Get("X-Amz-Target")
+	b, _ := ioutil.ReadAll(r.Body)
+	var body map[string]interface{}
+	_ = json.Unmarshal(b, &body)
+	f.bodies[target] = append(f.bodies[target], body)
+	queue := f.responses[target]
+	if len(queue) == 0 {
+		f.t.Errorf("unexpected %s request", target)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	f.responses[target] = queue[1:]
+	queue[0](w)
+}
+
+func respond(status int, body string, headers ...string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		for i := 0; i+1 < len(headers); i += 2 {
+			w.Header().Set(headers[i], headers[i+1])
+		}
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}
+}
+
+func testClient(t *testing.T) (*Client, *fakeLambda, func()) {
+	f := &fakeLambda{t: t, responses: map[string][]func(w http.ResponseWriter){}, bodies: map[string][]map[string]interface{}{}}
+	srv := httptest.NewServer(f)
+	c := New(srv.URL, aws.Config{Region: "eu-west-1", Credentials: aws.NewStaticCredentialsProvider("AKID", "SECRET", "")})
+	c.RetryDelay = time.Millisecond
+	c.MaxRetryDelay = 2 * time.Second
+	return c, f, srv.Close
+}
+
+func TestNewSigningScope(t *testing.T) {
+	cfg := aws.Config{Region: "eu-west-1"}
+	for endpoint, scope := range map[string][2]string{
+		"https://abcde12345.execute-api.us-east-1.amazonaws.com/v1/request": {"us-east-1", "execute-api"},
+		"https://abcdefghij.lambda-url.ap-south-1.on.aws/":                  {"ap-south-1", "lambda"},
+		"http://localhost:8080": {"eu-west-1", "execute-api"},
+	} {
+		c := New(endpoint, cfg)
+		if c.Region != scope[0] || c.Service != scope[1] {
+			t.Errorf("%s should be signed for %v, got %s and %s", endpoint, scope, c.Region, c.Service)
+		}
+	}
+}
+
+func TestRetries(t *testing.T) {
+	c, f, cleanup := testClient(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	f.responses[TargetIssueCertificate] = []func(w http.ResponseWriter){
+		respond(http.StatusServiceUnavailable, `{"message": "Service Unavailable"}`),
+		respond(http.StatusBadRequest, `{"__type": "com.amazonaws.acmpca#ThrottlingException", "message": "Rate exceeded"}`),
+		respond(http.StatusOK, `{"CertificateArn": "`+testCertificateArn+`"}`),
+	}
+	out, err := c.IssueCertificate(ctx, &IssueCertificateInput{
+		IssueCertificateInput: acmpca.IssueCertificateInput{Csr: []byte("csr")},
+		VenafiZone:            "Default",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.StringValue(out.CertificateArn) != testCertificateArn {
+		t.Fatalf("unexpected certificate ARN %s", aws.StringValue(out.CertificateArn))
+	}
+	bodies := f.bodies[TargetIssueCertificate]
+	token := bodies[0]["IdempotencyToken"]
+	if len(bodies) != 3 || token == nil || bodies[1]["IdempotencyToken"] != token || bodies[2]["IdempotencyToken"] != token {
+		t.Fatalf("retries should have the same generated idempotency token: %v", bodies)
+	}
+	if bodies[0]["Csr"] != "Y3Ny" || bodies[0]["VenafiZone"] != "Default" {
+		t.Fatalf("unexpected request body: %v", bodies[0])
+	}
+
+	// key generation may have issued the certificate before failing
+	f.responses[TargetIssueWithKeyGeneration] = []func(w http.ResponseWriter){
+		respond(http.StatusInternalServerError, `{"__type": "InternalFailure", "message": "Can't encrypt private key"}`),
+	}
+	if _, err = c.IssueWithKeyGeneration(ctx, &IssueWithKeyGenerationInput{Passphrase: "passphrase"}); ErrorCode(err) != "InternalFailure" {
+		t.Fatalf("key generation should not be retried, got %v", err)
+	}
+
+	// rate limits of the lambda are waited out only when they are short
+	f.responses[TargetValidateCertificateRequest] = []func(w http.ResponseWriter){
+		respond(http.StatusTooManyRequests, `{"__type": "ThrottlingException", "message": "Limit exceeded"}`, "Retry-After", "3600"),
+	}
+	_, err = c.ValidateCertificateRequest(ctx, &ValidateCertificateRequestInput{DomainName: aws.String("www.example.com")})
+	e, ok := err.(*Error)
+	if !ok || e.StatusCode != http.StatusTooManyRequests || e.Code != CodeThrottling || e.RetryAfter != time.Hour || e.Message != "Limit exceeded" {
+		t.Fatalf("long throttling should be returned as error, got %#v", err)
+	}
+
+	c.MaxRetries = 1
+	f.responses[TargetGetPolicy] = []func(w http.ResponseWriter){
+		respond(http.StatusBadGateway, `{"message": "Internal server error"}`),
+		respond(http.StatusBadGateway, `{"message": "Internal server error"}`),
+	}
+	if _, err = c.GetPolicy(ctx, "Default"); ErrorCode(err) != http.StatusText(http.StatusBadGateway) {
+		t.Fatalf("error of the last retry should be returned, got %v", err)
+	}
+}
+
+func TestWaitUntilCertificateIssued(t *testing.T) {
+	c, f, cleanup := testClient(t)
+	defer cleanup()
+	defer func(d time.Duration) { DefaultWaitDelay = d }(DefaultWaitDelay)
+	DefaultWaitDelay = time.Millisecond
+
+	f.responses[TargetGetCertificate] = []func(w http.ResponseWriter){
+		respond(http.StatusBadRequest, `{"__type": "RequestInProgressException", "message": "in progress"}`),
+		respond(http.StatusOK, `{"Certificate": "cert", "CertificateChain": "chain"}`),
+	}
+	cert, chain, err := c.WaitUntilCertificateIssued(context.Background(), testCertificateArn)
+	if err != nil || cert != "cert" || chain != "chain" {
+		t.Fatalf("unexpected certificate %q and chain %q: %v", cert, chain, err)
+	}
+	if ca := f.bodies[TargetGetCertificate][1]["CertificateAuthorityArn"]; ca != "arn:aws:acm-pca:eu-west-1:123456789012:certificate-authority/ca-id" {
+		t.Fatalf("CA ARN should be taken from certificate ARN, got %v", ca)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	for i := 0; i < 100; i++ {
+		f.responses[TargetGetACMCertificate] = append(f.responses[TargetGetACMCertificate],
+			respond(http.StatusBadRequest, `{"__type": "RequestInProgressException", "message": "in progress"}`))
+	}
+	if _, _, err = c.WaitUntilCertificateIssued(ctx, "arn:aws:acm:eu-west-1:123456789012:certificate/cert-id"); err == nil {
+		t.Fatal("wait should end with the context")
+	}
+}
+
+func TestSDKResponses(t *testing.T) {
+	c, f, cleanup := testClient(t)
+	defer cleanup()
+	f.responses[TargetDescribeCertificate] = []func(w http.ResponseWriter){
+		respond(http.StatusOK, `{"Certificate": {"DomainName": "www.example.com", "NotAfter": 1.5777e9, "Status": "ISSUED"}}`),
+	}
+	out, err := c.DescribeCertificate(context.Background(), &acm.DescribeCertificateInput{CertificateArn: aws.String("arn")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Certificate.Status != acm.CertificateStatusIssued || out.Certificate.NotAfter.Unix() != 1577700000 {
+		t.Fatalf("unexpected certificate description: %+v", out.Certificate)
+	}
+}
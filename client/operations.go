@@ -0,0 +1,169 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/private/protocol/json/jsonutil"
+	"github.com/aws/aws-sdk-go-v2/service/acm"
+	"github.com/aws/aws-sdk-go-v2/service/acmpca"
+)
+
+// call sends Venafi target request and decodes its JSON response.
+func (c *Client) call(ctx context.Context, target string, in, out interface{}, idempotent bool) error {
+	body, err := c.send(ctx, target, in, idempotent)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, out)
+}
+
+// callSDK sends ACM or ACM-PCA request and decodes the response the way the SDK does, timestamps
+// are epoch seconds and blobs are base64.
+func (c *Client) callSDK(ctx context.Context, target string, in, out interface{}) error {
+	body, err := c.send(ctx, target, in, true)
+	if err != nil {
+		return err
+	}
+	return jsonutil.UnmarshalJSON(out, bytes.NewReader(body))
+}
+
+// IssueCertificate checks the CSR against the zone policy and issues it with ACM-PCA. IdempotencyToken is
+// generated when it's empty, so the request is safely retried.
+func (c *Client) IssueCertificate(ctx context.Context, in *IssueCertificateInput) (*acmpca.IssueCertificateOutput, error) {
+	req := *in
+	if aws.StringValue(req.IdempotencyToken) == "" {
+		req.IdempotencyToken = aws.String(newIdempotencyToken())
+	}
+	var out acmpca.IssueCertificateOutput
+	return &out, c.callSDK(ctx, TargetIssueCertificate, &req, &out)
+}
+
+// RequestCertificate checks the domains against the zone policy and requests the certificate from ACM.
+// IdempotencyToken is generated when it's empty.
+func (c *Client) RequestCertificate(ctx context.Context, in *RequestCertificateInput) (*acm.RequestCertificateOutput, error) {
+	req := *in
+	if aws.StringValue(req.IdempotencyToken) == "" {
+		req.IdempotencyToken = aws.String(newIdempotencyToken())
+	}
+	var out acm.RequestCertificateOutput
+	return &out, c.callSDK(ctx, TargetRequestCertificate, &req, &out)
+}
+
+// IssueWithKeyGeneration issues certificate for a key pair generated by the lambda. The request isn't
+// idempotent, so it's only retried when it was throttled.
+func (c *Client) IssueWithKeyGeneration(ctx context.Context, in *IssueWithKeyGenerationInput) (*IssueWithKeyGenerationOutput, error) {
+	var out IssueWithKeyGenerationOutput
+	return &out, c.call(ctx, TargetIssueWithKeyGeneration, in, &out, false)
+}
+
+// BatchIssueCertificates sends many IssueCertificate and RequestCertificate requests at once. Requests without
+// IdempotencyToken get one, so a retried batch doesn't issue certificates twice.
+func (c *Client) BatchIssueCertificates(ctx context.Context, in *BatchIssueCertificatesInput) (*BatchIssueCertificatesOutput, error) {
+	req := BatchIssueCertificatesInput{Requests: make([]BatchRequest, len(in.Requests))}
+	for i, r := range in.Requests {
+		if r.IssueCertificate != nil && aws.StringValue(r.IssueCertificate.IdempotencyToken) == "" {
+			issue := *r.IssueCertificate
+			issue.IdempotencyToken = aws.String(newIdempotencyToken())
+			r.IssueCertificate = &issue
+		}
+		if r.RequestCertificate != nil && aws.StringValue(r.RequestCertificate.IdempotencyToken) == "" {
+			request := *r.RequestCertificate
+			request.IdempotencyToken = aws.String(newIdempotencyToken())
+			r.RequestCertificate = &request
+		}
+		req.Requests[i] = r
+	}
+	var out BatchIssueCertificatesOutput
+	return &out, c.call(ctx, TargetBatchIssueCertificates, &req, &out, true)
+}
+
+// ValidateCertificateRequest checks the request against the zone policy without issuing it.
+func (c *Client) ValidateCertificateRequest(ctx context.Context, in *ValidateCertificateRequestInput) (*ValidateCertificateRequestOutput, error) {
+	var out ValidateCertificateRequestOutput
+	return &out, c.call(ctx, TargetValidateCertificateRequest, in, &out, true)
+}
+
+// GetPolicy returns the policy of the zone, empty zone is the default zone of the lambda.
+func (c *Client) GetPolicy(ctx context.Context, zone string) (*common.PolicyDescription, error) {
+	var out common.PolicyDescription
+	return &out, c.call(ctx, TargetGetPolicy, map[string]string{"VenafiZone": zone}, &out, true)
+}
+
+// ListPolicies returns one page of zone names.
+func (c *Client) ListPolicies(ctx context.Context, in *ListPoliciesInput) (*ListPoliciesOutput, error) {
+	var out ListPoliciesOutput
+	return &out, c.call(ctx, TargetListPolicies, in, &out, true)
+}
+
+// ListAllPolicies pages through all zone names.
+func (c *Client) ListAllPolicies(ctx context.Context) ([]string, error) {
+	var zones []string
+	in := ListPoliciesInput{}
+	for {
+		out, err := c.ListPolicies(ctx, &in)
+		if err != nil {
+			return nil, err
+		}
+		zones = append(zones, out.Zones...)
+		if out.NextToken == "" {
+			return zones, nil
+		}
+		in.NextToken = out.NextToken
+	}
+}
+
+// QueryAuditLog returns one page of audit records.
+func (c *Client) QueryAuditLog(ctx context.Context, in *QueryAuditLogInput) (*QueryAuditLogOutput, error) {
+	var out QueryAuditLogOutput
+	return &out, c.call(ctx, TargetQueryAuditLog, in, &out, true)
+}
+
+// GetCertificate returns ACM-PCA certificate and its chain, RequestInProgressException error until it's issued.
+func (c *Client) GetCertificate(ctx context.Context, in *acmpca.GetCertificateInput) (*acmpca.GetCertificateOutput, error) {
+	var out acmpca.GetCertificateOutput
+	return &out, c.callSDK(ctx, TargetGetCertificate, in, &out)
+}
+
+func (c *Client) GetCertificateAuthorityCertificate(ctx context.Context, in *acmpca.GetCertificateAuthorityCertificateInput) (*acmpca.GetCertificateAuthorityCertificateOutput, error) {
+	var out acmpca.GetCertificateAuthorityCertificateOutput
+	return &out, c.callSDK(ctx, TargetGetCertificateAuthorityCertificate, in, &out)
+}
+
+func (c *Client) ListCertificateAuthorities(ctx context.Context, in *acmpca.ListCertificateAuthoritiesInput) (*acmpca.ListCertificateAuthoritiesOutput, error) {
+	var out acmpca.ListCertificateAuthoritiesOutput
+	return &out, c.callSDK(ctx, TargetListCertificateAuthorities, in, &out)
+}
+
+func (c *Client) RevokeCertificate(ctx context.Context, in *acmpca.RevokeCertificateInput) (*acmpca.RevokeCertificateOutput, error) {
+	var out acmpca.RevokeCertificateOutput
+	return &out, c.callSDK(ctx, TargetRevokeCertificate, in, &out)
+}
+
+func (c *Client) DescribeCertificate(ctx context.Context, in *acm.DescribeCertificateInput) (*acm.DescribeCertificateOutput, error) {
+	var out acm.DescribeCertificateOutput
+	return &out, c.callSDK(ctx, TargetDescribeCertificate, in, &out)
+}
+
+func (c *Client) ExportCertificate(ctx context.Context, in *acm.ExportCertificateInput) (*acm.ExportCertificateOutput, error) {
+	var out acm.ExportCertificateOutput
+	return &out, c.callSDK(ctx, TargetExportCertificate, in, &out)
+}
+
+// GetACMCertificate returns ACM certificate and its chain, RequestInProgressException error until it's issued.
+func (c *Client) GetACMCertificate(ctx context.Context, in *acm.GetCertificateInput) (*acm.GetCertificateOutput, error) {
+	var out acm.GetCertificateOutput
+	return &out, c.callSDK(ctx, TargetGetACMCertificate, in, &out)
+}
+
+func (c *Client) ListCertificates(ctx context.Context, in *acm.ListCertificatesInput) (*acm.ListCertificatesOutput, error) {
+	var out acm.ListCertificatesOutput
+	return &out, c.callSDK(ctx, TargetListCertificates, in, &out)
+}
+
+func (c *Client) RenewCertificate(ctx context.Context, in *acm.RenewCertificateInput) (*acm.RenewCertificateOutput, error) {
+	var out acm.RenewCertificateOutput
+	return &out, c.callSDK(ctx, TargetRenewCertificate, in, &out)
+}
@@ -0,0 +1,153 @@
+package client
+
+import (
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/Venafi/vcert/v4/pkg/endpoint"
+	"github.com/aws/aws-sdk-go-v2/service/acm"
+	"github.com/aws/aws-sdk-go-v2/service/acmpca"
+	"time"
+)
+
+// X-Amz-Target values of the request lambda.
+const (
+	TargetIssueCertificate                   = "ACMPrivateCAIssueCertificate"
+	TargetGetCertificate                     = "ACMPrivateCAGetCertificate"
+	TargetGetCertificateAuthorityCertificate = "ACMPrivateCAGetCertificateAuthorityCertificate"
+	TargetListCertificateAuthorities         = "ACMPrivateCAListCertificateAuthorities"
+	TargetRevokeCertificate                  = "ACMPrivateCARevokeCertificate"
+
+	TargetRequestCertificate  = "CertificateManagerRequestCertificate"
+	TargetDescribeCertificate = "CertificateManagerDescribeCertificate"
+	TargetExportCertificate   = "CertificateManagerExportCertificate"
+	TargetGetACMCertificate   = "CertificateManagerGetCertificate"
+	TargetListCertificates    = "CertificateManagerListCertificates"
+	TargetRenewCertificate    = "CertificateManagerRenewCertificate"
+
+	TargetIssueWithKeyGeneration     = "VenafiIssueWithKeyGeneration"
+	TargetBatchIssueCertificates     = "VenafiBatchIssueCertificates"
+	TargetValidateCertificateRequest = "VenafiValidateCertificateRequest"
+	TargetGetPolicy                  = "VenafiGetPolicy"
+	TargetListPolicies               = "VenafiListPolicies"
+	TargetQueryAuditLog              = "VenafiQueryAuditLog"
+)
+
+// Private key encryption of IssueWithKeyGeneration response.
+const (
+	PrivateKeyEncryptionPassphrase = "PKCS8-PBES2-AES256"
+	PrivateKeyEncryptionKMS        = "KMS"
+)
+
+// IssueCertificateInput is ACM-PCA IssueCertificate request with the fields the lambda adds.
+// Empty VenafiZone is chosen by zone rules of the lambda.
+type IssueCertificateInput struct {
+	acmpca.IssueCertificateInput
+	TemplateArn *string `json:"TemplateArn,omitempty"`
+	VenafiZone  string  `json:"VenafiZone,omitempty"`
+}
+
+// RequestCertificateInput is ACM RequestCertificate request with the fields the lambda adds.
+type RequestCertificateInput struct {
+	acm.RequestCertificateInput
+	Tags       []acm.Tag `json:"Tags,omitempty"`
+	VenafiZone string    `json:"VenafiZone,omitempty"`
+}
+
+// IssueWithKeyGenerationInput is IssueCertificate request without CSR, the lambda generates the key pair.
+// Exactly one of Passphrase and KmsKeyId should be set.
+type IssueWithKeyGenerationInput struct {
+	CertificateAuthorityArn *string                 `json:"CertificateAuthorityArn"`
+	TemplateArn             *string                 `json:"TemplateArn,omitempty"`
+	SigningAlgorithm        acmpca.SigningAlgorithm `json:"SigningAlgorithm,omitempty"`
+	Validity                *acmpca.Validity        `json:"Validity,omitempty"`
+	Subject                 acmpca.ASN1Subject      `json:"Subject"`
+	SubjectAlternativeNames []string                `json:"SubjectAlternativeNames,omitempty"`
+	KeyAlgorithm            acmpca.KeyAlgorithm     `json:"KeyAlgorithm,omitempty"`
+	Passphrase              string                  `json:"Passphrase,omitempty"`
+	KmsKeyId                string                  `json:"KmsKeyId,omitempty"`
+	VenafiZone              string                  `json:"VenafiZone,omitempty"`
+}
+
+// IssueWithKeyGenerationOutput has Certificate and CertificateChain when the certificate was issued in time.
+// PrivateKey is encrypted PKCS#8 PEM (see common.DecryptPrivateKey) or base64 KMS ciphertext.
+type IssueWithKeyGenerationOutput struct {
+	CertificateArn       string `json:"CertificateArn"`
+	Certificate          string `json:"Certificate"`
+	CertificateChain     string `json:"CertificateChain"`
+	PrivateKey           string `json:"PrivateKey"`
+	PrivateKeyEncryption string `json:"PrivateKeyEncryption"`
+}
+
+// BatchRequest has either IssueCertificate or RequestCertificate.
+type BatchRequest struct {
+	IssueCertificate   *IssueCertificateInput   `json:"IssueCertificate,omitempty"`
+	RequestCertificate *RequestCertificateInput `json:"RequestCertificate,omitempty"`
+}
+
+type BatchIssueCertificatesInput struct {
+	Requests []BatchRequest `json:"Requests"`
+}
+
+// BatchResult is the outcome of one request, Decision is the audit log decision of it.
+type BatchResult struct {
+	Index          int      `json:"Index"`
+	Target         string   `json:"Target"`
+	Decision       string   `json:"Decision"`
+	CertificateArn string   `json:"CertificateArn"`
+	Zone           string   `json:"Zone"`
+	Violations     []string `json:"Violations"`
+	Error          string   `json:"Error"`
+	AuditRecordId  string   `json:"AuditRecordId"`
+}
+
+type BatchIssueCertificatesOutput struct {
+	Results   []BatchResult `json:"Results"`
+	Approved  int           `json:"Approved"`
+	Rejected  int           `json:"Rejected"`
+	Throttled int           `json:"Throttled"`
+	Failed    int           `json:"Failed"`
+}
+
+// ValidateCertificateRequestInput has either Csr (IssueCertificate) or DomainName (RequestCertificate).
+type ValidateCertificateRequestInput struct {
+	Csr                     []byte    `json:"Csr,omitempty"`
+	DomainName              *string   `json:"DomainName,omitempty"`
+	SubjectAlternativeNames []string  `json:"SubjectAlternativeNames,omitempty"`
+	CertificateAuthorityArn *string   `json:"CertificateAuthorityArn,omitempty"`
+	TemplateArn             *string   `json:"TemplateArn,omitempty"`
+	Tags                    []acm.Tag `json:"Tags,omitempty"`
+	VenafiZone              string    `json:"VenafiZone,omitempty"`
+}
+
+type ValidateCertificateRequestOutput struct {
+	Valid      bool            `json:"Valid"`
+	Zone       string          `json:"Zone"`
+	ZoneRule   string          `json:"ZoneRule"`
+	Subject    string          `json:"Subject"`
+	Violations []string        `json:"Violations"`
+	Policy     endpoint.Policy `json:"Policy"`
+}
+
+type ListPoliciesInput struct {
+	MaxResults int    `json:"MaxResults,omitempty"`
+	NextToken  string `json:"NextToken,omitempty"`
+}
+
+type ListPoliciesOutput struct {
+	Zones     []string `json:"Zones"`
+	NextToken string   `json:"NextToken"`
+}
+
+// QueryAuditLogInput selects audit records, empty fields match any record.
+type QueryAuditLogInput struct {
+	Zone       string    `json:"Zone,omitempty"`
+	Principal  string    `json:"Principal,omitempty"`
+	From       time.Time `json:"From"`
+	To         time.Time `json:"To"`
+	MaxResults int       `json:"MaxResults,omitempty"`
+	NextToken  string    `json:"NextToken,omitempty"`
+}
+
+type QueryAuditLogOutput struct {
+	Records   []common.AuditRecord `json:"Records"`
+	NextToken string               `json:"NextToken"`
+}
@@ -0,0 +1,65 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/acm"
+	"github.com/aws/aws-sdk-go-v2/service/acmpca"
+	"strings"
+	"time"
+)
+
+// DefaultWaitDelay is the delay between GetCertificate calls while the certificate is being issued.
+var DefaultWaitDelay = 2 * time.Second
+
+// CertificateAuthorityArn returns the CA ARN of ACM-PCA certificate ARN, which is the CA ARN
+// followed by /certificate/<id>.
+func CertificateAuthorityArn(certificateArn string) (string, error) {
+	a, err := arn.Parse(certificateArn)
+	if err != nil {
+		return "", err
+	}
+	i := strings.Index(certificateArn, "/certificate/")
+	if a.Service != "acm-pca" || i < 0 {
+		return "", fmt.Errorf("%s is not ACM-PCA certificate ARN", certificateArn)
+	}
+	return certificateArn[:i], nil
+}
+
+// WaitUntilCertificateIssued polls GetCertificate of ACM-PCA (acm-pca ARNs) or ACM until the certificate is
+// issued and returns the certificate and its chain. ctx limits the wait.
+func (c *Client) WaitUntilCertificateIssued(ctx context.Context, certificateArn string) (string, string, error) {
+	for {
+		cert, chain, err := c.Certificate(ctx, certificateArn)
+		if ErrorCode(err) != CodeRequestInProgress {
+			return cert, chain, err
+		}
+		select {
+		case <-ctx.Done():
+			return "", "", fmt.Errorf("certificate %s is not issued yet: %s", certificateArn, ctx.Err())
+		case <-time.After(DefaultWaitDelay):
+		}
+	}
+}
+
+// Certificate returns PEM certificate and chain of ACM-PCA (acm-pca ARNs) or ACM certificate,
+// RequestInProgressException error until it's issued.
+func (c *Client) Certificate(ctx context.Context, certificateArn string) (string, string, error) {
+	if caArn, err := CertificateAuthorityArn(certificateArn); err == nil {
+		out, err := c.GetCertificate(ctx, &acmpca.GetCertificateInput{
+			CertificateAuthorityArn: aws.String(caArn),
+			CertificateArn:          aws.String(certificateArn),
+		})
+		if err != nil {
+			return "", "", err
+		}
+		return aws.StringValue(out.Certificate), aws.StringValue(out.CertificateChain), nil
+	}
+	out, err := c.GetACMCertificate(ctx, &acm.GetCertificateInput{CertificateArn: aws.String(certificateArn)})
+	if err != nil {
+		return "", "", err
+	}
+	return aws.StringValue(out.Certificate), aws.StringValue(out.CertificateChain), nil
+}
@@ -0,0 +1,143 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbattribute"
+	"os"
+	"sync"
+	"time"
+)
+
+const ACMEObjectNotFound venafiError = "ACME object not found"
+
+// ACMEStore keeps ACME server state: nonces, accounts, orders and authorizations. Objects are JSON encoded and
+// addressed by kind and ID.
+type ACMEStore interface {
+	// Get decodes the object into v or returns ACMEObjectNotFound if there is no such object or it has expired.
+	Get(kind, id string, v interface{}) error
+	Put(kind, id string, v interface{}, expires time.Time) error
+	// Take removes the object and reports whether it existed and hasn't expired. It's used to consume nonces once.
+	Take(kind, id string) (bool, error)
+}
+
+type acmeItem struct {
+	Key  string
+	Data string
+	// Expires is epoch seconds, so the DynamoDB table can use it as TTL attribute.
+	Expires int64
+}
+
+func acmeItemKey(kind, id string) string {
+	return kind + "#" + id
+}
+
+// MemoryACMEStore keeps ACME state in memory. It's intended for tests and single instance servers.
+type MemoryACMEStore struct {
+	sync.Mutex
+	items map[string]acmeItem
+}
+
+func NewMemoryACMEStore() *MemoryACMEStore {
+	return &MemoryACMEStore{items: map[string]acmeItem{}}
+}
+
+func (s *MemoryACMEStore) Get(kind, id string, v interface{}) error {
+	s.Lock()
+	defer s.Unlock()
+	item, ok := s.items[acmeItemKey(kind, id)]
+	if !ok || item.Expires <= time.Now().Unix() {
+		return ACMEObjectNotFound
+	}
+	return json.Unmarshal([]byte(item.Data), v)
+}
+
+func (s *MemoryACMEStore) Put(kind, id string, v interface{}, expires time.Time) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	key := acmeItemKey(kind, id)
+	s.items[key] = acmeItem{Key: key, Data: string(b), Expires: expires.Unix()}
+	return nil
+}
+
+func (s *MemoryACMEStore) Take(kind, id string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	key := acmeItemKey(kind, id)
+	item, ok := s.items[key]
+	delete(s.items, key)
+	return ok && item.Expires > time.Now().Unix(), nil
+}
+
+// DynamoDBACMEStore keeps ACME state in DynamoDB table with Key hash key.
+type DynamoDBACMEStore struct {
+	Table string
+}
+
+// NewACMEStoreFromEnv returns DynamoDB ACME store for ACME_TABLE or nil if it's not set.
+func NewACMEStoreFromEnv() ACMEStore {
+	table := os.Getenv("ACME_TABLE")
+	if table == "" {
+		return nil
+	}
+	return &DynamoDBACMEStore{Table: table}
+}
+
+func (s *DynamoDBACMEStore) Get(kind, id string, v interface{}) error {
+	result, err := db.GetItemRequest(&dynamodb.GetItemInput{
+		TableName:      aws.String(s.Table),
+		Key:            map[string]dynamodb.AttributeValue{"Key": {S: aws.String(acmeItemKey(kind, id))}},
+		ConsistentRead: aws.Bool(true),
+	}).Send(context.Background())
+	if err != nil {
+		return err
+	}
+	if len(result.Item) == 0 {
+		return ACMEObjectNotFound
+	}
+	var item acmeItem
+	err = dynamodbattribute.UnmarshalMap(result.Item, &item)
+	if err != nil {
+		return err
+	}
+	if item.Expires <= time.Now().Unix() {
+		return ACMEObjectNotFound
+	}
+	return json.Unmarshal([]byte(item.Data), v)
+}
+
+func (s *DynamoDBACMEStore) Put(kind, id string, v interface{}, expires time.Time) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	av, err := dynamodbattribute.MarshalMap(acmeItem{Key: acmeItemKey(kind, id), Data: string(b), Expires: expires.Unix()})
+	if err != nil {
+		return err
+	}
+	_, err = db.PutItemRequest(&dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(s.Table),
+	}).Send(context.Background())
+	return err
+}
+
+func (s *DynamoDBACMEStore) Take(kind, id string) (bool, error) {
+	result, err := db.DeleteItemRequest(&dynamodb.DeleteItemInput{
+		TableName:    aws.String(s.Table),
+		Key:          map[string]dynamodb.AttributeValue{"Key": {S: aws.String(acmeItemKey(kind, id))}},
+		ReturnValues: dynamodb.ReturnValueAllOld,
+	}).Send(context.Background())
+	if err != nil || len(result.Attributes) == 0 {
+		return false, err
+	}
+	var item acmeItem
+	err = dynamodbattribute.UnmarshalMap(result.Attributes, &item)
+	return err == nil && item.Expires > time.Now().Unix(), err
+}
@@ -0,0 +1,37 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryACMEStore(t *testing.T) {
+	s := NewMemoryACMEStore()
+	type object struct{ Status string }
+	if err := s.Put("order", "1", object{Status: "pending"}, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	var o object
+	if err := s.Get("order", "1", &o); err != nil || o.Status != "pending" {
+		t.Fatalf("expected stored order, got %+v (%v)", o, err)
+	}
+	if err := s.Get("authz", "1", &o); err != ACMEObjectNotFound {
+		t.Fatalf("objects of other kind should not be found, got %v", err)
+	}
+
+	_ = s.Put("nonce", "n", struct{}{}, time.Now().Add(time.Hour))
+	if ok, _ := s.Take("nonce", "n"); !ok {
+		t.Fatal("stored nonce should be taken")
+	}
+	if ok, _ := s.Take("nonce", "n"); ok {
+		t.Fatal("nonce should be taken only once")
+	}
+
+	_ = s.Put("nonce", "old", struct{}{}, time.Now().Add(-time.Second))
+	if ok, _ := s.Take("nonce", "old"); ok {
+		t.Fatal("expired nonce should not be taken")
+	}
+	if err := s.Get("nonce", "old", &struct{}{}); err != ACMEObjectNotFound {
+		t.Fatalf("expired object should not be found, got %v", err)
+	}
+}
@@ -0,0 +1,298 @@
+package common
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbattribute"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	AuditDecisionApproved  = "APPROVED"
+	AuditDecisionRejected  = "REJECTED"
+	AuditDecisionThrottled = "THROTTLED"
+	AuditDecisionError     = "ERROR"
+)
+
+// auditTimeFormat is fixed width so sort keys are ordered by time.
+const auditTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// AuditRecord describes one decision of the request lambda.
+type AuditRecord struct {
+	ID             string
+	Time           time.Time
+	Principal      string
+	SourceIP       string
+	Target         string
+	Zone           string
+	ZoneRule       string
+	PolicyVersion  string
+	Subject        string
+	SANs           []string
+	Decision       string
+	Violations     []string
+	CertificateArn string
+}
+
+// AuditQuery selects audit records. Empty Zone or Principal match any value, zero From or To leave the range open.
+type AuditQuery struct {
+	Zone      string
+	Principal string
+	From      time.Time
+	To        time.Time
+	Limit     int
+	NextToken string
+}
+
+// AuditStore saves and queries audit records.
+type AuditStore interface {
+	Save(r AuditRecord) error
+	// Query returns matched records ordered by time and a token for the next page, empty if there are no more records.
+	Query(q AuditQuery) (records []AuditRecord, nextToken string, err error)
+}
+
+// NewAuditRecordID returns random identifier for a new audit record.
+func NewAuditRecordID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (q AuditQuery) match(r AuditRecord) bool {
+	if q.Zone != "" && r.Zone != q.Zone {
+		return false
+	}
+	if q.Principal != "" && r.Principal != q.Principal {
+		return false
+	}
+	if !q.From.IsZero() && r.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && r.Time.After(q.To) {
+		return false
+	}
+	return true
+}
+
+// MemoryAuditStore keeps audit records in memory. It's intended for tests and local runs.
+type MemoryAuditStore struct {
+	sync.Mutex
+	records []AuditRecord
+}
+
+func NewMemoryAuditStore() *MemoryAuditStore {
+	return &MemoryAuditStore{}
+}
+
+func (s *MemoryAuditStore) Save(r AuditRecord) error {
+	s.Lock()
+	defer s.Unlock()
+	s.records = append(s.records, r)
+	return nil
+}
+
+func (s *MemoryAuditStore) Query(q AuditQuery) (records []AuditRecord, nextToken string, err error) {
+	s.Lock()
+	defer s.Unlock()
+	matched := make([]AuditRecord, 0)
+	for _, r := range s.records {
+		if q.match(r) {
+			matched = append(matched, r)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		return matched[i].Time.Before(matched[j].Time)
+	})
+	start := 0
+	if q.NextToken != "" {
+		for i, r := range matched {
+			if r.ID == q.NextToken {
+				start = i + 1
+				break
+			}
+		}
+	}
+	records = matched[start:]
+	if q.Limit > 0 && len(records) > q.Limit {
+		records = records[:q.Limit]
+		nextToken = records[len(records)-1].ID
+	}
+	return
+}
+
+const (
+	auditZoneKey        = "Zone"
+	auditSortKey        = "SortKey"
+	auditPrincipalKey   = "Principal"
+	auditPrincipalIndex = "PrincipalIndex"
+)
+
+// DynamoDBAuditStore keeps audit records in DynamoDB table with Zone hash key and SortKey range key.
+// Table must have PrincipalIndex global secondary index with Principal hash key and the same SortKey.
+type DynamoDBAuditStore struct {
+	Table string
+}
+
+// NewAuditStoreFromEnv returns DynamoDB audit store for AUDIT_TABLE or nil if auditing is disabled.
+func NewAuditStoreFromEnv() AuditStore {
+	table := os.Getenv("AUDIT_TABLE")
+	if table == "" {
+		return nil
+	}
+	return &DynamoDBAuditStore{Table: table}
+}
+
+type dynamoAuditRecord struct {
+	AuditRecord
+	SortKey string
+}
+
+func (s *DynamoDBAuditStore) Save(r AuditRecord) error {
+	av, err := dynamodbattribute.MarshalMap(dynamoAuditRecord{r, auditRecordSortKey(r.Time, r.ID)})
+	if err != nil {
+		return err
+	}
+	_, err = db.PutItemRequest(&dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(s.Table),
+	}).Send(context.Background())
+	return err
+}
+
+func (s *DynamoDBAuditStore) Query(q AuditQuery) (records []AuditRecord, nextToken string, err error) {
+	from := auditRecordSortKey(q.From, "")
+	to := auditRecordSortKey(time.Now().Add(time.Hour), "")
+	if !q.To.IsZero() {
+		to = auditRecordSortKey(q.To, "~")
+	}
+	values := map[string]dynamodb.AttributeValue{
+		":from": {S: aws.String(from)},
+		":to":   {S: aws.String(to)},
+	}
+	names := map[string]string{"#sk": auditSortKey}
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(s.Table),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	}
+	switch {
+	case q.Zone != "":
+		input.KeyConditionExpression = aws.String("#zone = :zone AND #sk BETWEEN :from AND :to")
+		names["#zone"] = auditZoneKey
+		values[":zone"] = dynamodb.AttributeValue{S: aws.String(q.Zone)}
+		if q.Principal != "" {
+			input.FilterExpression = aws.String("#principal = :principal")
+			names["#principal"] = auditPrincipalKey
+			values[":principal"] = dynamodb.AttributeValue{S: aws.String(q.Principal)}
+		}
+	case q.Principal != "":
+		input.IndexName = aws.String(auditPrincipalIndex)
+		input.KeyConditionExpression = aws.String("#principal = :principal AND #sk BETWEEN :from AND :to")
+		names["#principal"] = auditPrincipalKey
+		values[":principal"] = dynamodb.AttributeValue{S: aws.String(q.Principal)}
+	default:
+		return s.scan(q, from, to)
+	}
+	if q.Limit > 0 {
+		input.Limit = aws.Int64(int64(q.Limit))
+	}
+	if q.NextToken != "" {
+		input.ExclusiveStartKey, err = decodeAuditToken(q.NextToken)
+		if err != nil {
+			return
+		}
+	}
+	result, err := db.QueryRequest(input).Send(context.Background())
+	if err != nil {
+		return
+	}
+	return s.unmarshal(result.Items, result.LastEvaluatedKey)
+}
+
+func (s *DynamoDBAuditStore) scan(q AuditQuery, from, to string) (records []AuditRecord, nextToken string, err error) {
+	input := &dynamodb.ScanInput{
+		TableName:                aws.String(s.Table),
+		FilterExpression:         aws.String("#sk BETWEEN :from AND :to"),
+		ExpressionAttributeNames: map[string]string{"#sk": auditSortKey},
+		ExpressionAttributeValues: map[string]dynamodb.AttributeValue{
+			":from": {S: aws.String(from)},
+			":to":   {S: aws.String(to)},
+		},
+	}
+	if q.Limit > 0 {
+		input.Limit = aws.Int64(int64(q.Limit))
+	}
+	if q.NextToken != "" {
+		input.ExclusiveStartKey, err = decodeAuditToken(q.NextToken)
+		if err != nil {
+			return
+		}
+	}
+	result, err := db.ScanRequest(input).Send(context.Background())
+	if err != nil {
+		return
+	}
+	records, nextToken, err = s.unmarshal(result.Items, result.LastEvaluatedKey)
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+	return
+}
+
+func (s *DynamoDBAuditStore) unmarshal(items []map[string]dynamodb.AttributeValue, last map[string]dynamodb.AttributeValue) (records []AuditRecord, nextToken string, err error) {
+	var stored []dynamoAuditRecord
+	err = dynamodbattribute.UnmarshalListOfMaps(items, &stored)
+	if err != nil {
+		return
+	}
+	records = make([]AuditRecord, len(stored))
+	for i := range stored {
+		records[i] = stored[i].AuditRecord
+	}
+	if len(last) > 0 {
+		nextToken, err = encodeAuditToken(last)
+	}
+	return
+}
+
+func auditRecordSortKey(t time.Time, id string) string {
+	return t.UTC().Format(auditTimeFormat) + "#" + id
+}
+
+// encodeAuditToken packs DynamoDB LastEvaluatedKey into an opaque page token. All audit keys are strings.
+func encodeAuditToken(key map[string]dynamodb.AttributeValue) (string, error) {
+	m := make(map[string]string, len(key))
+	for k, v := range key {
+		m[k] = aws.StringValue(v.S)
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodeAuditToken(token string) (map[string]dynamodb.AttributeValue, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]string
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		return nil, err
+	}
+	key := make(map[string]dynamodb.AttributeValue, len(m))
+	for k, v := range m {
+		key[k] = dynamodb.AttributeValue{S: aws.String(v)}
+	}
+	return key, nil
+}
@@ -0,0 +1,97 @@
+package common
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"testing"
+	"time"
+)
+
+func TestMemoryAuditStoreQuery(t *testing.T) {
+	s := NewMemoryAuditStore()
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	records := []AuditRecord{
+		{ID: "1", Time: start, Zone: "zone1", Principal: "alice", Decision: AuditDecisionApproved},
+		{ID: "2", Time: start.Add(time.Hour), Zone: "zone2", Principal: "alice", Decision: AuditDecisionRejected},
+		{ID: "3", Time: start.Add(2 * time.Hour), Zone: "zone1", Principal: "bob", Decision: AuditDecisionApproved},
+		{ID: "4", Time: start.Add(3 * time.Hour), Zone: "zone1", Principal: "alice", Decision: AuditDecisionError},
+	}
+	// save out of order to check sorting
+	for _, i := range []int{3, 1, 0, 2} {
+		if err := s.Save(records[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		name string
+		q    AuditQuery
+		ids  []string
+	}{
+		{"all", AuditQuery{}, []string{"1", "2", "3", "4"}},
+		{"zone", AuditQuery{Zone: "zone1"}, []string{"1", "3", "4"}},
+		{"principal", AuditQuery{Principal: "alice"}, []string{"1", "2", "4"}},
+		{"zone and principal", AuditQuery{Zone: "zone1", Principal: "alice"}, []string{"1", "4"}},
+		{"time range", AuditQuery{From: start.Add(time.Hour), To: start.Add(2 * time.Hour)}, []string{"2", "3"}},
+	}
+	for _, c := range cases {
+		got, next, err := s.Query(c.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next != "" {
+			t.Fatalf("%s: unexpected next token %s", c.name, next)
+		}
+		if !sameIDs(got, c.ids) {
+			t.Fatalf("%s: expected %v, got %v", c.name, c.ids, got)
+		}
+	}
+
+	page, next, err := s.Query(AuditQuery{Zone: "zone1", Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameIDs(page, []string{"1", "3"}) || next == "" {
+		t.Fatalf("bad first page %v, next token %q", page, next)
+	}
+	page, next, err = s.Query(AuditQuery{Zone: "zone1", Limit: 2, NextToken: next})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameIDs(page, []string{"4"}) || next != "" {
+		t.Fatalf("bad second page %v, next token %q", page, next)
+	}
+}
+
+func TestAuditTokenRoundTrip(t *testing.T) {
+	key := map[string]string{auditZoneKey: "zone1", auditSortKey: auditRecordSortKey(time.Now(), "id")}
+	av := make(map[string]dynamodb.AttributeValue, len(key))
+	for k, v := range key {
+		av[k] = dynamodb.AttributeValue{S: aws.String(v)}
+	}
+	token, err := encodeAuditToken(av)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeAuditToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range key {
+		if *decoded[k].S != v {
+			t.Fatalf("key %s: expected %s, got %s", k, v, *decoded[k].S)
+		}
+	}
+}
+
+func sameIDs(records []AuditRecord, ids []string) bool {
+	if len(records) != len(ids) {
+		return false
+	}
+	for i := range records {
+		if records[i].ID != ids[i] {
+			return false
+		}
+	}
+	return true
+}
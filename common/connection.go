@@ -0,0 +1,187 @@
+package common
+
+import (
+	"context"
+	"encoding/base64"
+	"github.com/Venafi/vcert/v4"
+	"github.com/Venafi/vcert/v4/pkg/endpoint"
+	"github.com/aws/aws-sdk-go-v2/aws/external"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"log"
+	"os"
+	"strings"
+)
+
+// GetConnectionFromEnv creates Venafi connector using credentials from lambda environment,
+// decrypting them with KMS unless ENCRYPTED_CREDENTIALS is false. TPP_ACCESS_TOKEN and TPP_REFRESH_TOKEN
+// belong to the policy lambda.
+func GetConnectionFromEnv() (endpoint.Connector, error) {
+	return GetConnectionFromEnvWithTokenPrefix("")
+}
+
+// GetConnectionFromEnvWithTokenPrefix is GetConnectionFromEnv with the access and refresh tokens read from
+// variables with the prefix, e.g. INVENTORY_TPP_REFRESH_TOKEN. The refresh token is consumed on connection,
+// which invalidates it for anyone else, so every component connecting with tokens needs its own.
+func GetConnectionFromEnvWithTokenPrefix(prefix string) (endpoint.Connector, error) {
+	apiKey := os.Getenv("CLOUDAPIKEY")
+	password := os.Getenv("TPPPASSWORD")
+	accessToken := os.Getenv(prefix + "TPP_ACCESS_TOKEN")
+	refreshToken := os.Getenv(prefix + "TPP_REFRESH_TOKEN")
+
+	plainTextCreds := strings.HasPrefix(strings.ToLower(os.Getenv("ENCRYPTED_CREDENTIALS")), "f")
+	if !plainTextCreds {
+		var err error
+		apiKey, err = kmsDecrypt(apiKey)
+		if err != nil {
+			return nil, err
+		}
+		password, err = kmsDecrypt(password)
+		if err != nil {
+			return nil, err
+		}
+		accessToken, err = kmsDecrypt(accessToken)
+		if err != nil {
+			return nil, err
+		}
+		refreshToken, err = kmsDecrypt(refreshToken)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return GetConnection(
+		os.Getenv("TPPURL"),
+		os.Getenv("TPPUSER"),
+		password,
+		accessToken,
+		refreshToken,
+		apiKey,
+		os.Getenv("TRUST_BUNDLE"),
+	)
+}
+
+func kmsDecrypt(encrypted string) (string, error) {
+	log.Printf("Decrypting encrypted variable")
+	if encrypted == "" {
+		return "", nil
+	}
+	decodedBytes, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", err
+	}
+	cfg, err := external.LoadDefaultAWSConfig()
+	if err != nil {
+		log.Println("can`t load aws config", err)
+		return "", err
+	}
+
+	svc := kms.New(cfg)
+	input := &kms.DecryptInput{
+		CiphertextBlob: decodedBytes,
+	}
+
+	req := svc.DecryptRequest(input)
+	result, err := req.Send(context.Background())
+	if err != nil {
+		log.Println("can`t decrypt", encrypted, ":", err)
+		return "", err
+	}
+	return string(result.Plaintext[:]), nil
+}
+
+func GetConnection(tppUrl, tppUser, tppPassword, accessToken, refreshToken, apiKey, trustBundle string) (endpoint.Connector, error) {
+	log.Println("Getting Venafi connection")
+	var config vcert.Config
+
+	if tppUrl != "" && (accessToken != "" || refreshToken != "") {
+		config = vcert.Config{
+			ConnectorType: endpoint.ConnectorTypeTPP,
+			BaseUrl:       tppUrl,
+			Credentials: &endpoint.Authentication{
+				AccessToken:  accessToken,
+				RefreshToken: refreshToken,
+				ClientId:     ClientId,
+			},
+		}
+	} else if tppUrl != "" && tppUser != "" && tppPassword != "" {
+		config = vcert.Config{
+			ConnectorType: endpoint.ConnectorTypeTPP,
+			BaseUrl:       tppUrl,
+			Credentials: &endpoint.Authentication{
+				User:     tppUser,
+				Password: tppPassword,
+			},
+		}
+	} else if apiKey != "" {
+		config = vcert.Config{
+			ConnectorType: endpoint.ConnectorTypeCloud,
+			Credentials: &endpoint.Authentication{
+				APIKey: apiKey,
+			},
+		}
+
+	} else {
+		panic("bad credentials for connection") //todo: replace with something more beautiful
+	}
+
+	if config.ConnectorType == endpoint.ConnectorTypeTPP && trustBundle != "" {
+		buf, err := base64.StdEncoding.DecodeString(trustBundle)
+		if err != nil {
+			log.Printf("Can`t read trust bundle from file %s: %v\n", trustBundle, err)
+			return nil, err
+		}
+		config.ConnectionTrust = string(buf)
+	}
+
+	// When we have a refresh token, we want to consume it with the purpose of gaining exclusive ownership
+	// of the token. So, no other plugin/entity/user can refresh it and make it invalid.
+	if config.ConnectorType == endpoint.ConnectorTypeTPP && config.Credentials.RefreshToken != "" {
+		newAuth, err := consumeToken(&config)
+		if err != nil {
+			log.Printf("Error while consuming refresh token: %v\n", err)
+			return nil, err
+		}
+		config.Credentials = &newAuth
+	}
+
+	return vcert.NewClient(&config)
+}
+
+func consumeToken(cfg *vcert.Config) (auth endpoint.Authentication, err error) {
+	log.Println("Trying to consume Refresh Token")
+
+	tppConnector, err := getTppConnector(cfg)
+	if err != nil {
+		return
+	}
+	httpClient, err := getHTTPClient(cfg.ConnectionTrust)
+	if err != nil {
+		return
+	}
+
+	tppConnector.SetHTTPClient(httpClient)
+
+	tokenInfoResponse, err := tppConnector.RefreshAccessToken(&endpoint.Authentication{
+		RefreshToken: cfg.Credentials.RefreshToken,
+		ClientId:     ClientId,
+		Scope:        Scope,
+	})
+
+	if err != nil {
+		log.Printf("Error while refreshing access token: %v\n", err)
+		return
+	}
+
+	auth = endpoint.Authentication{
+		User:         cfg.Credentials.User,
+		Password:     cfg.Credentials.Password,
+		APIKey:       cfg.Credentials.APIKey,
+		RefreshToken: tokenInfoResponse.Refresh_token,
+		Scope:        Scope,
+		ClientId:     ClientId,
+		AccessToken:  tokenInfoResponse.Access_token,
+		ClientPKCS12: cfg.Credentials.ClientPKCS12,
+	}
+
+	return
+}
@@ -2,17 +2,23 @@ package common
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"github.com/Venafi/vcert/v4/pkg/endpoint"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/aws/external"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbattribute"
 	"os"
+	"time"
 )
 
 var tableName string
 
 const primaryKey = "PolicyID"
+const lastSyncKey = "LastSync"
 
 type venafiError string
 
@@ -37,7 +43,19 @@ func init() {
 
 var db *dynamodb.Client
 
+// PolicyRecord is a zone policy stored in the table with the time when policy lambda saved it.
+type PolicyRecord struct {
+	Name     string
+	Policy   endpoint.Policy
+	LastSync time.Time
+}
+
 func GetPolicy(name string) (p endpoint.Policy, err error) {
+	r, err := GetPolicyRecord(name)
+	return r.Policy, err
+}
+
+func GetPolicyRecord(name string) (r PolicyRecord, err error) {
 
 	input := &dynamodb.GetItemInput{
 		TableName: aws.String(tableName),
@@ -56,18 +74,65 @@ func GetPolicy(name string) (p endpoint.Policy, err error) {
 		err = PolicyNotFound
 		return
 	}
-	if len(result.Item) == 1 {
+	return policyRecord(result.Item)
+}
+
+// policyRecord unmarshals table item, PolicyFoundButEmpty is returned with the name for zones
+// the policy lambda hasn't synced yet.
+func policyRecord(item map[string]dynamodb.AttributeValue) (r PolicyRecord, err error) {
+	if v, ok := item[primaryKey]; ok && v.S != nil {
+		r.Name = *v.S
+	}
+	if len(item) == 1 {
 		err = PolicyFoundButEmpty
 		return
 	}
-	err = dynamodbattribute.UnmarshalMap(result.Item, &p)
+	err = dynamodbattribute.UnmarshalMap(item, &r.Policy)
 	if err != nil {
 		return
 	}
-
+	if v, ok := item[lastSyncKey]; ok && v.S != nil {
+		r.LastSync, _ = time.Parse(time.RFC3339, *v.S)
+	}
 	return
 }
 
+// GetPolicyTable returns all zones of the table sorted by name. Zones the policy lambda hasn't synced yet
+// have nil Policy.
+func GetPolicyTable() (entries []PolicyTableEntry, err error) {
+	input := &dynamodb.ScanInput{TableName: aws.String(tableName)}
+	for {
+		result, err := db.ScanRequest(input).Send(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range result.Items {
+			r, err := policyRecord(item)
+			if err == PolicyFoundButEmpty {
+				entries = append(entries, PolicyTableEntry{Zone: r.Name})
+				continue
+			} else if err != nil {
+				return nil, fmt.Errorf("can't read policy of zone %s: %s", r.Name, err)
+			}
+			entries = append(entries, NewPolicyTableEntry(r))
+		}
+		if len(result.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+	}
+	sortPolicyTable(entries)
+	return entries, nil
+}
+
+// PolicyVersion returns short fingerprint of the policy content, which changes whenever the policy lambda saves
+// a different policy for the zone.
+func PolicyVersion(p endpoint.Policy) string {
+	b, _ := json.Marshal(p)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8])
+}
+
 func CreateEmptyPolicy(name string) error {
 	av := make(map[string]dynamodb.AttributeValue)
 	av[primaryKey] = dynamodb.AttributeValue{S: aws.String(name)}
@@ -80,11 +145,19 @@ func CreateEmptyPolicy(name string) error {
 }
 
 func SavePolicy(name string, p endpoint.Policy) error {
-	av, err := dynamodbattribute.MarshalMap(p)
+	return SavePolicyRecord(PolicyRecord{Name: name, Policy: p, LastSync: time.Now()})
+}
+
+// SavePolicyRecord saves the policy with its LastSync, zero LastSync is not saved.
+func SavePolicyRecord(r PolicyRecord) error {
+	av, err := dynamodbattribute.MarshalMap(r.Policy)
 	if err != nil {
 		return err
 	}
-	av[primaryKey] = dynamodb.AttributeValue{S: aws.String(name)}
+	av[primaryKey] = dynamodb.AttributeValue{S: aws.String(r.Name)}
+	if !r.LastSync.IsZero() {
+		av[lastSyncKey] = dynamodb.AttributeValue{S: aws.String(r.LastSync.UTC().Format(time.RFC3339))}
+	}
 	input := &dynamodb.PutItemInput{
 		Item:      av,
 		TableName: aws.String(tableName),
@@ -108,6 +181,32 @@ func GetAllPoliciesNames() (names []string, err error) {
 	return
 }
 
+// ListPoliciesNames returns one page of stored zone names and the name to continue from, empty on the last page.
+func ListPoliciesNames(limit int, startName string) (names []string, next string, err error) {
+	input := &dynamodb.ScanInput{
+		TableName:            aws.String(tableName),
+		ProjectionExpression: aws.String(primaryKey),
+	}
+	if limit > 0 {
+		input.Limit = aws.Int64(int64(limit))
+	}
+	if startName != "" {
+		input.ExclusiveStartKey = map[string]dynamodb.AttributeValue{primaryKey: {S: aws.String(startName)}}
+	}
+	result, err := db.ScanRequest(input).Send(context.Background())
+	if err != nil {
+		return
+	}
+	names = make([]string, 0, len(result.Items))
+	for _, v := range result.Items {
+		names = append(names, *v[primaryKey].S)
+	}
+	if v, ok := result.LastEvaluatedKey[primaryKey]; ok && v.S != nil {
+		next = *v.S
+	}
+	return
+}
+
 func DeletePolicy(name string) error {
 	input := &dynamodb.DeleteItemInput{
 		TableName: aws.String(tableName),
@@ -0,0 +1,90 @@
+package common
+
+import (
+	"time"
+)
+
+// PolicyDescription is a documented, readable form of endpoint.Policy. All restrictions are lists of
+// regular expressions, and a value is allowed when it matches any of them.
+type PolicyDescription struct {
+	Zone                     string                 `json:"Zone"`
+	Version                  string                 `json:"Version"`
+	LastSync                 *time.Time             `json:"LastSync,omitempty"`
+	Domains                  DomainsDescription     `json:"Domains"`
+	Subject                  SubjectDescription     `json:"Subject"`
+	AllowedKeyConfigurations []KeyConfigDescription `json:"AllowedKeyConfigurations"`
+	AllowWildcards           bool                   `json:"AllowWildcards"`
+	AllowKeyReuse            bool                   `json:"AllowKeyReuse"`
+}
+
+// DomainsDescription lists restrictions for common name and subject alternative names.
+type DomainsDescription struct {
+	CommonName []string `json:"CommonName"`
+	DNS        []string `json:"DNS"`
+	IP         []string `json:"IP"`
+	Email      []string `json:"Email"`
+	URI        []string `json:"URI"`
+	UPN        []string `json:"UPN"`
+}
+
+// SubjectDescription lists restrictions for subject fields. Missing subject field is checked as empty string.
+type SubjectDescription struct {
+	Organization       []string `json:"Organization"`
+	OrganizationalUnit []string `json:"OrganizationalUnit"`
+	Locality           []string `json:"Locality"`
+	State              []string `json:"State"`
+	Country            []string `json:"Country"`
+}
+
+// KeyConfigDescription is an allowed key type with its sizes (RSA) or curves (ECDSA).
+type KeyConfigDescription struct {
+	KeyType   string   `json:"KeyType"`
+	KeySizes  []int    `json:"KeySizes,omitempty"`
+	KeyCurves []string `json:"KeyCurves,omitempty"`
+}
+
+// DescribePolicy converts stored policy record to PolicyDescription.
+func DescribePolicy(r PolicyRecord) PolicyDescription {
+	p := r.Policy
+	d := PolicyDescription{
+		Zone:    r.Name,
+		Version: PolicyVersion(p),
+		Domains: DomainsDescription{
+			CommonName: nonNil(p.SubjectCNRegexes),
+			DNS:        nonNil(p.DnsSanRegExs),
+			IP:         nonNil(p.IpSanRegExs),
+			Email:      nonNil(p.EmailSanRegExs),
+			URI:        nonNil(p.UriSanRegExs),
+			UPN:        nonNil(p.UpnSanRegExs),
+		},
+		Subject: SubjectDescription{
+			Organization:       nonNil(p.SubjectORegexes),
+			OrganizationalUnit: nonNil(p.SubjectOURegexes),
+			Locality:           nonNil(p.SubjectLRegexes),
+			State:              nonNil(p.SubjectSTRegexes),
+			Country:            nonNil(p.SubjectCRegexes),
+		},
+		AllowedKeyConfigurations: make([]KeyConfigDescription, 0, len(p.AllowedKeyConfigurations)),
+		AllowWildcards:           p.AllowWildcards,
+		AllowKeyReuse:            p.AllowKeyReuse,
+	}
+	if !r.LastSync.IsZero() {
+		lastSync := r.LastSync
+		d.LastSync = &lastSync
+	}
+	for _, k := range p.AllowedKeyConfigurations {
+		kd := KeyConfigDescription{KeyType: k.KeyType.String(), KeySizes: k.KeySizes}
+		for _, c := range k.KeyCurves {
+			kd.KeyCurves = append(kd.KeyCurves, c.String())
+		}
+		d.AllowedKeyConfigurations = append(d.AllowedKeyConfigurations, kd)
+	}
+	return d
+}
+
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
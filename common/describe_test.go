@@ -0,0 +1,45 @@
+package common
+
+import (
+	"encoding/json"
+	"github.com/Venafi/vcert/v4/pkg/certificate"
+	"github.com/Venafi/vcert/v4/pkg/endpoint"
+	"testing"
+	"time"
+)
+
+func TestDescribePolicy(t *testing.T) {
+	sync := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	d := DescribePolicy(PolicyRecord{
+		Name: "zone1",
+		Policy: endpoint.Policy{
+			SubjectCNRegexes: []string{`^.*\.example\.com$`},
+			SubjectCRegexes:  []string{"^US$"},
+			AllowedKeyConfigurations: []endpoint.AllowedKeyConfiguration{
+				{KeyType: certificate.KeyTypeRSA, KeySizes: []int{2048, 4096}},
+				{KeyType: certificate.KeyTypeECDSA, KeyCurves: []certificate.EllipticCurve{certificate.EllipticCurveP256}},
+			},
+			AllowWildcards: true,
+		},
+		LastSync: sync,
+	})
+	if d.Zone != "zone1" || d.Version == "" || d.LastSync == nil || !d.LastSync.Equal(sync) {
+		t.Fatalf("bad description header: %+v", d)
+	}
+	if d.Domains.CommonName[0] != `^.*\.example\.com$` || d.Subject.Country[0] != "^US$" {
+		t.Fatalf("bad restrictions: %+v", d)
+	}
+	if d.Domains.DNS == nil || d.Subject.Organization == nil {
+		t.Fatal("missing restrictions should be described as empty lists")
+	}
+	if len(d.AllowedKeyConfigurations) != 2 || d.AllowedKeyConfigurations[0].KeyType != "RSA" ||
+		d.AllowedKeyConfigurations[1].KeyCurves[0] != "P256" {
+		t.Fatalf("bad key configurations: %+v", d.AllowedKeyConfigurations)
+	}
+	if !d.AllowWildcards || d.AllowKeyReuse {
+		t.Fatalf("bad flags: %+v", d)
+	}
+	if _, err := json.Marshal(d); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,133 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Venafi/vcert/v4/pkg/endpoint"
+	"gopkg.in/yaml.v3"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PolicyTableEntry is one zone of the policy table export. Policy is nil for zones the policy lambda
+// hasn't synced yet.
+type PolicyTableEntry struct {
+	Zone     string           `json:"Zone"`
+	LastSync *time.Time       `json:"LastSync,omitempty"`
+	Policy   *endpoint.Policy `json:"Policy,omitempty"`
+}
+
+// PolicyTableDump is the whole policy table, the format of backups and environment clones.
+type PolicyTableDump struct {
+	Table    string             `json:"Table"`
+	Exported time.Time          `json:"Exported"`
+	Zones    []PolicyTableEntry `json:"Zones"`
+}
+
+// Dump formats.
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+)
+
+func NewPolicyTableEntry(r PolicyRecord) PolicyTableEntry {
+	p := r.Policy
+	e := PolicyTableEntry{Zone: r.Name, Policy: &p}
+	if !r.LastSync.IsZero() {
+		lastSync := r.LastSync
+		e.LastSync = &lastSync
+	}
+	return e
+}
+
+// Record returns the stored form of synced zone.
+func (e PolicyTableEntry) Record() PolicyRecord {
+	r := PolicyRecord{Name: e.Zone}
+	if e.Policy != nil {
+		r.Policy = *e.Policy
+	}
+	if e.LastSync != nil {
+		r.LastSync = *e.LastSync
+	}
+	return r
+}
+
+// Zone returns the entry of the zone.
+func (d PolicyTableDump) Zone(name string) (PolicyTableEntry, bool) {
+	for _, e := range d.Zones {
+		if e.Zone == name {
+			return e, true
+		}
+	}
+	return PolicyTableEntry{}, false
+}
+
+// ExportPolicyTable reads the whole table.
+func ExportPolicyTable() (d PolicyTableDump, err error) {
+	d.Zones, err = GetPolicyTable()
+	if err != nil {
+		return
+	}
+	d.Table = tableName
+	d.Exported = time.Now().UTC().Truncate(time.Second)
+	return
+}
+
+func sortPolicyTable(entries []PolicyTableEntry) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Zone < entries[j].Zone })
+}
+
+// FormatFromPath returns yaml for .yaml and .yml files and json for others.
+func FormatFromPath(path string) string {
+	if strings.HasSuffix(path, ".yaml") || strings.HasSuffix(path, ".yml") {
+		return FormatYAML
+	}
+	return FormatJSON
+}
+
+// MarshalDocument encodes v as indented JSON or YAML with the JSON field names.
+func MarshalDocument(v interface{}, format string) ([]byte, error) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case FormatJSON:
+		return append(b, '\n'), nil
+	case FormatYAML:
+		// JSON is YAML, the node keeps field order and types
+		var n yaml.Node
+		if err = yaml.Unmarshal(b, &n); err != nil {
+			return nil, err
+		}
+		plainStyle(&n)
+		return yaml.Marshal(&n)
+	}
+	return nil, fmt.Errorf("unknown format %q, should be %s or %s", format, FormatJSON, FormatYAML)
+}
+
+// plainStyle drops the JSON quotes and brackets, values that need quotes keep them.
+func plainStyle(n *yaml.Node) {
+	n.Style = 0
+	for _, c := range n.Content {
+		plainStyle(c)
+	}
+}
+
+// UnmarshalDocument decodes JSON or YAML into v using the JSON field names.
+func UnmarshalDocument(data []byte, v interface{}) error {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		return json.Unmarshal(data, v)
+	}
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,57 @@
+package common
+
+import (
+	"github.com/Venafi/vcert/v4/pkg/certificate"
+	"github.com/Venafi/vcert/v4/pkg/endpoint"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPolicyTableDump(t *testing.T) {
+	sync := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	dump := PolicyTableDump{
+		Table:    "VenafiCertPolicy",
+		Exported: sync.Add(time.Hour),
+		Zones: []PolicyTableEntry{
+			NewPolicyTableEntry(PolicyRecord{
+				Name: "Business App\\Enterprise",
+				Policy: endpoint.Policy{
+					SubjectCNRegexes: []string{`^.*\.example\.com$`, "^2020-05-01$"},
+					AllowedKeyConfigurations: []endpoint.AllowedKeyConfiguration{
+						{KeyType: certificate.KeyTypeECDSA, KeyCurves: []certificate.EllipticCurve{certificate.EllipticCurveP384}},
+					},
+					AllowWildcards: true,
+				},
+				LastSync: sync,
+			}),
+			{Zone: "true"},
+		},
+	}
+	for _, format := range []string{FormatJSON, FormatYAML} {
+		b, err := MarshalDocument(dump, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if format == FormatYAML && (strings.Contains(string(b), "{") || !strings.Contains(string(b), "Zone: \"true\"")) {
+			t.Fatalf("YAML should be in block style with quoted strings that look like other types:\n%s", b)
+		}
+		var got PolicyTableDump
+		if err = UnmarshalDocument(b, &got); err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+		if !reflect.DeepEqual(got, dump) {
+			t.Fatalf("%s dump should be decoded as it was, got %+v\n%s", format, got, b)
+		}
+	}
+	if _, err := MarshalDocument(dump, "xml"); err == nil {
+		t.Fatal("unknown format should be an error")
+	}
+	if e, ok := dump.Zone("true"); !ok || e.Policy != nil || e.Record().Name != "true" {
+		t.Fatalf("zone should be found, got %+v", e)
+	}
+	if FormatFromPath("backup.yml") != FormatYAML || FormatFromPath("backup.json") != FormatJSON {
+		t.Fatal("format should be taken from the file extension")
+	}
+}
@@ -0,0 +1,120 @@
+package common
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbattribute"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// IdempotencyRecord is the result of an issuance request saved under its idempotency key.
+type IdempotencyRecord struct {
+	Key            string
+	CertificateArn string
+	Zone           string
+	// Violations are set when the issued certificate failed verification, replays are rejected with them.
+	Violations []string `dynamodbav:",omitempty"`
+	// Expires is epoch seconds, so the DynamoDB table can use it as TTL attribute.
+	Expires int64
+}
+
+// IdempotencyStore remembers results of issuance requests so replays return the same certificate.
+type IdempotencyStore interface {
+	// Lookup returns the record saved for key. ok is false if there is no record or it has expired.
+	Lookup(key string) (r IdempotencyRecord, ok bool, err error)
+	Save(r IdempotencyRecord) error
+}
+
+func (r IdempotencyRecord) expired(now time.Time) bool {
+	return r.Expires <= now.Unix()
+}
+
+// MemoryIdempotencyStore keeps idempotency records in memory. It's intended for tests and local runs.
+type MemoryIdempotencyStore struct {
+	sync.Mutex
+	records map[string]IdempotencyRecord
+}
+
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{records: map[string]IdempotencyRecord{}}
+}
+
+func (s *MemoryIdempotencyStore) Lookup(key string) (r IdempotencyRecord, ok bool, err error) {
+	s.Lock()
+	defer s.Unlock()
+	r, ok = s.records[key]
+	if ok && r.expired(time.Now()) {
+		delete(s.records, key)
+		return IdempotencyRecord{}, false, nil
+	}
+	return
+}
+
+func (s *MemoryIdempotencyStore) Save(r IdempotencyRecord) error {
+	s.Lock()
+	defer s.Unlock()
+	if old, ok := s.records[r.Key]; ok && !old.expired(time.Now()) {
+		return nil
+	}
+	s.records[r.Key] = r
+	return nil
+}
+
+const idempotencyKey = "Key"
+
+// DynamoDBIdempotencyStore keeps idempotency records in DynamoDB table with Key hash key. DynamoDB TTL removes
+// expired records eventually, so Lookup checks the expiration itself.
+type DynamoDBIdempotencyStore struct {
+	Table string
+}
+
+// NewIdempotencyStoreFromEnv returns DynamoDB idempotency store for IDEMPOTENCY_TABLE or nil if deduplication is disabled.
+func NewIdempotencyStoreFromEnv() IdempotencyStore {
+	table := os.Getenv("IDEMPOTENCY_TABLE")
+	if table == "" {
+		return nil
+	}
+	return &DynamoDBIdempotencyStore{Table: table}
+}
+
+func (s *DynamoDBIdempotencyStore) Lookup(key string) (r IdempotencyRecord, ok bool, err error) {
+	result, err := db.GetItemRequest(&dynamodb.GetItemInput{
+		TableName:      aws.String(s.Table),
+		Key:            map[string]dynamodb.AttributeValue{idempotencyKey: {S: aws.String(key)}},
+		ConsistentRead: aws.Bool(true),
+	}).Send(context.Background())
+	if err != nil || len(result.Item) == 0 {
+		return
+	}
+	err = dynamodbattribute.UnmarshalMap(result.Item, &r)
+	if err != nil || r.expired(time.Now()) {
+		return IdempotencyRecord{}, false, err
+	}
+	return r, true, nil
+}
+
+func (s *DynamoDBIdempotencyStore) Save(r IdempotencyRecord) error {
+	av, err := dynamodbattribute.MarshalMap(r)
+	if err != nil {
+		return err
+	}
+	// an unexpired record is kept, so concurrent replays can't replace the first result
+	_, err = db.PutItemRequest(&dynamodb.PutItemInput{
+		Item:                     av,
+		TableName:                aws.String(s.Table),
+		ConditionExpression:      aws.String("attribute_not_exists(#key) OR #expires <= :now"),
+		ExpressionAttributeNames: map[string]string{"#key": idempotencyKey, "#expires": "Expires"},
+		ExpressionAttributeValues: map[string]dynamodb.AttributeValue{
+			":now": {N: aws.String(strconv.FormatInt(time.Now().Unix(), 10))},
+		},
+	}).Send(context.Background())
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return nil
+	}
+	return err
+}
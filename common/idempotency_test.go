@@ -0,0 +1,38 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryIdempotencyStore(t *testing.T) {
+	s := NewMemoryIdempotencyStore()
+	expires := time.Now().Add(time.Hour).Unix()
+	if err := s.Save(IdempotencyRecord{Key: "k", CertificateArn: "arn:first", Expires: expires}); err != nil {
+		t.Fatal(err)
+	}
+	// unexpired record is kept
+	if err := s.Save(IdempotencyRecord{Key: "k", CertificateArn: "arn:second", Expires: expires}); err != nil {
+		t.Fatal(err)
+	}
+	r, ok, err := s.Lookup("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || r.CertificateArn != "arn:first" {
+		t.Fatalf("expected first record, got %+v (found: %v)", r, ok)
+	}
+
+	if _, ok, _ := s.Lookup("missing"); ok {
+		t.Fatal("unknown key should not be found")
+	}
+
+	_ = s.Save(IdempotencyRecord{Key: "old", CertificateArn: "arn:old", Expires: time.Now().Add(-time.Second).Unix()})
+	if _, ok, _ := s.Lookup("old"); ok {
+		t.Fatal("expired record should not be found")
+	}
+	_ = s.Save(IdempotencyRecord{Key: "old", CertificateArn: "arn:new", Expires: expires})
+	if r, ok, _ := s.Lookup("old"); !ok || r.CertificateArn != "arn:new" {
+		t.Fatalf("expired record should be replaced, got %+v", r)
+	}
+}
@@ -0,0 +1,51 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/external"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"os"
+)
+
+const (
+	InventorySourceACMPCA = "acm-pca"
+	InventorySourceACM    = "acm"
+)
+
+// InventoryRecord is a queued certificate that should be imported into Venafi inventory
+// under the zone which approved it.
+type InventoryRecord struct {
+	Source                  string `json:"Source"`
+	CertificateArn          string `json:"CertificateArn"`
+	CertificateAuthorityArn string `json:"CertificateAuthorityArn,omitempty"`
+	Zone                    string `json:"Zone"`
+}
+
+var sqsClient *sqs.Client
+
+// InventoryEnabled reports whether INVENTORY_QUEUE_URL is configured for this lambda.
+func InventoryEnabled() bool {
+	return os.Getenv("INVENTORY_QUEUE_URL") != ""
+}
+
+// EnqueueInventoryRecord sends the record to the inventory queue for asynchronous import.
+func EnqueueInventoryRecord(r InventoryRecord) error {
+	if sqsClient == nil {
+		cfg, err := external.LoadDefaultAWSConfig()
+		if err != nil {
+			return err
+		}
+		sqsClient = sqs.New(cfg)
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = sqsClient.SendMessageRequest(&sqs.SendMessageInput{
+		QueueUrl:    aws.String(os.Getenv("INVENTORY_QUEUE_URL")),
+		MessageBody: aws.String(string(b)),
+	}).Send(context.Background())
+	return err
+}
@@ -0,0 +1,116 @@
+package common
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"github.com/Venafi/vcert/v4/pkg/certificate"
+	"github.com/Venafi/vcert/v4/pkg/endpoint"
+	"sort"
+)
+
+const (
+	KeyTypeRSA = "rsa"
+	KeyTypeEC  = "ec"
+
+	defaultRSAKeySize = 2048
+	defaultECKeySize  = 256
+)
+
+var ecCurves = map[int]struct {
+	curve  elliptic.Curve
+	policy certificate.EllipticCurve
+}{
+	256: {elliptic.P256(), certificate.EllipticCurveP256},
+	384: {elliptic.P384(), certificate.EllipticCurveP384},
+	521: {elliptic.P521(), certificate.EllipticCurveP521},
+}
+
+// allowedKeySizes returns RSA sizes or EC curve sizes the policy allows for the key type. Nil means
+// the policy doesn't restrict keys.
+func allowedKeySizes(p endpoint.Policy, keyType string) []int {
+	if len(p.AllowedKeyConfigurations) == 0 {
+		return nil
+	}
+	sizes := []int{}
+	for _, a := range p.AllowedKeyConfigurations {
+		switch {
+		case keyType == KeyTypeRSA && a.KeyType == certificate.KeyTypeRSA:
+			sizes = append(sizes, a.KeySizes...)
+		case keyType == KeyTypeEC && a.KeyType == certificate.KeyTypeECDSA:
+			for size, c := range ecCurves {
+				for _, curve := range a.KeyCurves {
+					if curve == c.policy {
+						sizes = append(sizes, size)
+					}
+				}
+			}
+		}
+	}
+	sort.Ints(sizes)
+	return sizes
+}
+
+// PolicyKeyConfiguration picks key type and size allowed by the policy. Empty keyType and zero size are chosen
+// by the policy: RSA 2048 and EC P-256 are preferred when they are allowed, otherwise the smallest allowed
+// size is used. Size is RSA modulus or EC curve size in bits.
+func PolicyKeyConfiguration(p endpoint.Policy, keyType string, size int) (string, int, error) {
+	if keyType == "" {
+		keyType = KeyTypeRSA
+		if len(p.AllowedKeyConfigurations) > 0 && p.AllowedKeyConfigurations[0].KeyType == certificate.KeyTypeECDSA {
+			keyType = KeyTypeEC
+		}
+	}
+	def := defaultRSAKeySize
+	switch keyType {
+	case KeyTypeRSA:
+	case KeyTypeEC:
+		def = defaultECKeySize
+	default:
+		return "", 0, fmt.Errorf("unsupported key type %q", keyType)
+	}
+	allowed := allowedKeySizes(p, keyType)
+	if allowed != nil && len(allowed) == 0 {
+		return "", 0, fmt.Errorf("key type %s is not allowed in this policy", keyType)
+	}
+	if size == 0 {
+		size = def
+		if allowed != nil && !containsInt(allowed, def) {
+			size = allowed[0]
+		}
+	}
+	if allowed != nil && !containsInt(allowed, size) {
+		return "", 0, fmt.Errorf("%s key size %d is not allowed in this policy, allowed sizes: %v", keyType, size, allowed)
+	}
+	if _, ok := ecCurves[size]; keyType == KeyTypeEC && !ok {
+		return "", 0, fmt.Errorf("unsupported EC key size %d", size)
+	}
+	if keyType == KeyTypeRSA && size < 2048 {
+		return "", 0, fmt.Errorf("RSA key size %d is too small", size)
+	}
+	return keyType, size, nil
+}
+
+// GenerateKey generates private key allowed by the policy, see PolicyKeyConfiguration.
+func GenerateKey(p endpoint.Policy, keyType string, size int) (crypto.Signer, error) {
+	keyType, size, err := PolicyKeyConfiguration(p, keyType, size)
+	if err != nil {
+		return nil, err
+	}
+	if keyType == KeyTypeEC {
+		return ecdsa.GenerateKey(ecCurves[size].curve, rand.Reader)
+	}
+	return rsa.GenerateKey(rand.Reader, size)
+}
+
+func containsInt(values []int, v int) bool {
+	for _, x := range values {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
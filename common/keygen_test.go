@@ -0,0 +1,69 @@
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"github.com/Venafi/vcert/v4/pkg/certificate"
+	"github.com/Venafi/vcert/v4/pkg/endpoint"
+	"testing"
+)
+
+func TestPolicyKeyConfiguration(t *testing.T) {
+	p := endpoint.Policy{AllowedKeyConfigurations: []endpoint.AllowedKeyConfiguration{
+		{KeyType: certificate.KeyTypeECDSA, KeyCurves: []certificate.EllipticCurve{certificate.EllipticCurveP521, certificate.EllipticCurveP384}},
+		{KeyType: certificate.KeyTypeRSA, KeySizes: []int{4096, 3072}},
+	}}
+	cases := []struct {
+		policy  endpoint.Policy
+		keyType string
+		size    int
+		gotType string
+		gotSize int
+		fails   bool
+	}{
+		{endpoint.Policy{}, "", 0, KeyTypeRSA, 2048, false},
+		{endpoint.Policy{}, KeyTypeEC, 0, KeyTypeEC, 256, false},
+		{endpoint.Policy{}, KeyTypeRSA, 1024, "", 0, true},
+		{endpoint.Policy{}, KeyTypeEC, 224, "", 0, true},
+		{endpoint.Policy{}, "dsa", 0, "", 0, true},
+		{p, "", 0, KeyTypeEC, 384, false},
+		{p, KeyTypeRSA, 0, KeyTypeRSA, 3072, false},
+		{p, KeyTypeRSA, 4096, KeyTypeRSA, 4096, false},
+		{p, KeyTypeRSA, 2048, "", 0, true},
+		{p, KeyTypeEC, 256, "", 0, true},
+		{endpoint.Policy{AllowedKeyConfigurations: p.AllowedKeyConfigurations[1:]}, KeyTypeEC, 0, "", 0, true},
+	}
+	for _, c := range cases {
+		keyType, size, err := PolicyKeyConfiguration(c.policy, c.keyType, c.size)
+		if c.fails {
+			if err == nil {
+				t.Errorf("%s %d should be rejected", c.keyType, c.size)
+			}
+			continue
+		}
+		if err != nil || keyType != c.gotType || size != c.gotSize {
+			t.Errorf("%s %d: expected %s %d, got %s %d %v", c.keyType, c.size, c.gotType, c.gotSize, keyType, size, err)
+		}
+	}
+}
+
+func TestGenerateKey(t *testing.T) {
+	p := endpoint.Policy{AllowedKeyConfigurations: []endpoint.AllowedKeyConfiguration{
+		{KeyType: certificate.KeyTypeRSA, KeySizes: []int{2048}},
+		{KeyType: certificate.KeyTypeECDSA, KeyCurves: []certificate.EllipticCurve{certificate.EllipticCurveP384}},
+	}}
+	key, err := GenerateKey(p, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsaKey, ok := key.(*rsa.PrivateKey); !ok || rsaKey.Size() != 256 || !keyAllowed(key.Public(), p.AllowedKeyConfigurations) {
+		t.Fatalf("expected allowed RSA 2048 key, got %T", key)
+	}
+	key, err = GenerateKey(p, KeyTypeEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ecKey, ok := key.(*ecdsa.PrivateKey); !ok || ecKey.Curve.Params().Name != "P-384" || !keyAllowed(key.Public(), p.AllowedKeyConfigurations) {
+		t.Fatalf("expected allowed P-384 key, got %T", key)
+	}
+}
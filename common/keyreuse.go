@@ -0,0 +1,113 @@
+package common
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbattribute"
+	"os"
+	"sync"
+	"time"
+)
+
+// KeyUsageRecord remembers that a public key was certified in the zone.
+type KeyUsageRecord struct {
+	Zone string
+	// Fingerprint is hex SHA-256 of the DER SubjectPublicKeyInfo.
+	Fingerprint    string
+	CertificateArn string
+	Time           time.Time
+	// Expires is epoch seconds, so the DynamoDB table can use it as TTL attribute.
+	Expires int64
+}
+
+// KeyUsageStore keeps public key fingerprints of issued certificates per zone.
+type KeyUsageStore interface {
+	// Lookup returns the latest record of the key in the zone made after since. ok is false if there is none.
+	Lookup(zone, fingerprint string, since time.Time) (r KeyUsageRecord, ok bool, err error)
+	Save(r KeyUsageRecord) error
+}
+
+// PublicKeyFingerprint returns hex SHA-256 of SubjectPublicKeyInfo of PEM or DER CSR.
+func PublicKeyFingerprint(csr []byte) (string, error) {
+	parsed, err := ParseCSR(csr)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(parsed.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// MemoryKeyUsageStore keeps key fingerprints in memory. It's intended for tests and local runs.
+type MemoryKeyUsageStore struct {
+	sync.Mutex
+	records map[string]KeyUsageRecord
+}
+
+func NewMemoryKeyUsageStore() *MemoryKeyUsageStore {
+	return &MemoryKeyUsageStore{records: map[string]KeyUsageRecord{}}
+}
+
+func (s *MemoryKeyUsageStore) Lookup(zone, fingerprint string, since time.Time) (r KeyUsageRecord, ok bool, err error) {
+	s.Lock()
+	defer s.Unlock()
+	r, ok = s.records[zone+"#"+fingerprint]
+	if ok && r.Time.Before(since) {
+		return KeyUsageRecord{}, false, nil
+	}
+	return
+}
+
+func (s *MemoryKeyUsageStore) Save(r KeyUsageRecord) error {
+	s.Lock()
+	defer s.Unlock()
+	s.records[r.Zone+"#"+r.Fingerprint] = r
+	return nil
+}
+
+// DynamoDBKeyUsageStore keeps key fingerprints in DynamoDB table with Zone hash key and Fingerprint range key.
+type DynamoDBKeyUsageStore struct {
+	Table string
+}
+
+// NewKeyUsageStoreFromEnv returns DynamoDB key usage store for KEY_USAGE_TABLE or nil if it's not set.
+func NewKeyUsageStoreFromEnv() KeyUsageStore {
+	table := os.Getenv("KEY_USAGE_TABLE")
+	if table == "" {
+		return nil
+	}
+	return &DynamoDBKeyUsageStore{Table: table}
+}
+
+func (s *DynamoDBKeyUsageStore) Lookup(zone, fingerprint string, since time.Time) (r KeyUsageRecord, ok bool, err error) {
+	result, err := db.GetItemRequest(&dynamodb.GetItemInput{
+		TableName: aws.String(s.Table),
+		Key: map[string]dynamodb.AttributeValue{
+			"Zone":        {S: aws.String(zone)},
+			"Fingerprint": {S: aws.String(fingerprint)},
+		},
+		ConsistentRead: aws.Bool(true),
+	}).Send(context.Background())
+	if err != nil || len(result.Item) == 0 {
+		return
+	}
+	err = dynamodbattribute.UnmarshalMap(result.Item, &r)
+	if err != nil || r.Time.Before(since) {
+		return KeyUsageRecord{}, false, err
+	}
+	return r, true, nil
+}
+
+func (s *DynamoDBKeyUsageStore) Save(r KeyUsageRecord) error {
+	av, err := dynamodbattribute.MarshalMap(r)
+	if err != nil {
+		return err
+	}
+	_, err = db.PutItemRequest(&dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(s.Table),
+	}).Send(context.Background())
+	return err
+}
@@ -0,0 +1,43 @@
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+	"time"
+)
+
+func TestPublicKeyFingerprint(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	csr := func(cn string) []byte {
+		der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: cn}}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return der
+	}
+	a, err := PublicKeyFingerprint(csr("a.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := PublicKeyFingerprint(csr("b.example.com"))
+	if a != b || len(a) != 64 {
+		t.Fatalf("fingerprints of the same key should match: %s %s", a, b)
+	}
+
+	s := NewMemoryKeyUsageStore()
+	now := time.Now()
+	_ = s.Save(KeyUsageRecord{Zone: "zone1", Fingerprint: a, CertificateArn: "arn:cert", Time: now})
+	if r, ok, _ := s.Lookup("zone1", a, now.Add(-time.Hour)); !ok || r.CertificateArn != "arn:cert" {
+		t.Fatal("key should be found in the zone")
+	}
+	if _, ok, _ := s.Lookup("zone2", a, now.Add(-time.Hour)); ok {
+		t.Fatal("keys should be tracked per zone")
+	}
+	if _, ok, _ := s.Lookup("zone1", a, now.Add(time.Second)); ok {
+		t.Fatal("key used before the lookback window should not be found")
+	}
+}
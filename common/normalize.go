@@ -0,0 +1,95 @@
+package common
+
+import (
+	"crypto/x509/pkix"
+	"github.com/Venafi/vcert/v4/pkg/endpoint"
+	"regexp"
+	"strings"
+)
+
+// LockedValues returns the values of a locked policy field. Venafi policy lists locked values as escaped
+// literals anchored with ^ and $, so the field is locked when every regex is such a literal.
+func LockedValues(regexes []string) ([]string, bool) {
+	if len(regexes) == 0 {
+		return nil, false
+	}
+	values := make([]string, len(regexes))
+	for i, r := range regexes {
+		if !strings.HasPrefix(r, "^") || !strings.HasSuffix(r, "$") || len(r) < 2 {
+			return nil, false
+		}
+		quoted := r[1 : len(r)-1]
+		v := unquoteMeta(quoted)
+		if regexp.QuoteMeta(v) != quoted {
+			return nil, false
+		}
+		values[i] = v
+	}
+	return values, true
+}
+
+func unquoteMeta(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// NormalizeSubject rebuilds CSR subject for the policy: locked organization, organization unit, country, locality
+// and state are set to the zone values, other values of these fields are kept if the policy allows them and
+// stripped otherwise. Every field has at most one value, as ACM-PCA API passthrough subject does. Common name is
+// kept as is and the rest of the subject is dropped.
+func NormalizeSubject(p endpoint.Policy, subject pkix.Name) pkix.Name {
+	normalized := pkix.Name{CommonName: subject.CommonName}
+	fields := []struct {
+		values  []string
+		regexes []string
+		set     *[]string
+	}{
+		{subject.Organization, p.SubjectORegexes, &normalized.Organization},
+		{subject.OrganizationalUnit, p.SubjectOURegexes, &normalized.OrganizationalUnit},
+		{subject.Country, p.SubjectCRegexes, &normalized.Country},
+		{subject.Locality, p.SubjectLRegexes, &normalized.Locality},
+		{subject.Province, p.SubjectSTRegexes, &normalized.Province},
+	}
+	for _, f := range fields {
+		if v, ok := normalizedValue(f.values, f.regexes); ok {
+			*f.set = []string{v}
+		}
+	}
+	return normalized
+}
+
+func normalizedValue(values, regexes []string) (string, bool) {
+	locked, isLocked := LockedValues(regexes)
+	for _, v := range values {
+		if v != "" && matchAny(v, regexes) {
+			return v, true
+		}
+	}
+	if isLocked {
+		return locked[0], true
+	}
+	return "", false
+}
+
+// NormalizeCSR returns normalized subject of PEM or DER CSR and checks the CSR with that subject against the policy.
+func NormalizeCSR(p endpoint.Policy, csr []byte) (pkix.Name, PolicyViolations, error) {
+	parsed, err := ParseCSR(csr)
+	if err != nil {
+		return pkix.Name{}, nil, err
+	}
+	subject := NormalizeSubject(p, parsed.Subject)
+	return subject, checkFields(p, requestFields{
+		Subject:        subject,
+		DNSNames:       parsed.DNSNames,
+		EmailAddresses: parsed.EmailAddresses,
+		IPAddresses:    parsed.IPAddresses,
+		URIs:           parsed.URIs,
+		PublicKey:      parsed.PublicKey,
+	}), nil
+}
@@ -0,0 +1,57 @@
+package common
+
+import (
+	"crypto/x509/pkix"
+	"github.com/Venafi/vcert/v4/pkg/endpoint"
+	"reflect"
+	"testing"
+)
+
+func TestLockedValues(t *testing.T) {
+	cases := []struct {
+		regexes []string
+		values  []string
+		locked  bool
+	}{
+		{[]string{`^Venafi Inc\.$`}, []string{"Venafi Inc."}, true},
+		{[]string{`^Engineering$`, `^Quality Assurance$`}, []string{"Engineering", "Quality Assurance"}, true},
+		{[]string{".*"}, nil, false},
+		{[]string{`^Venafi.*$`}, nil, false},
+		{[]string{`^US$`, ".*"}, nil, false},
+		{nil, nil, false},
+	}
+	for _, c := range cases {
+		values, locked := LockedValues(c.regexes)
+		if locked != c.locked || !reflect.DeepEqual(values, c.values) {
+			t.Errorf("%v: expected %v %v, got %v %v", c.regexes, c.values, c.locked, values, locked)
+		}
+	}
+}
+
+func TestNormalizeSubject(t *testing.T) {
+	p := endpoint.Policy{
+		SubjectORegexes:  []string{`^Venafi Inc\.$`},
+		SubjectOURegexes: []string{`^Engineering$`, `^Quality Assurance$`},
+		SubjectCRegexes:  []string{`^US$`},
+		SubjectLRegexes:  []string{".*"},
+		SubjectSTRegexes: []string{`^(Utah)?$`},
+	}
+	got := NormalizeSubject(p, pkix.Name{
+		CommonName:         "www.example.com",
+		Organization:       []string{"Other Inc."},
+		OrganizationalUnit: []string{"Sales", "Quality Assurance"},
+		Locality:           []string{"Salt Lake City"},
+		Province:           []string{"Nevada"},
+		StreetAddress:      []string{"Main St."},
+	})
+	expected := pkix.Name{
+		CommonName:         "www.example.com",
+		Organization:       []string{"Venafi Inc."},
+		OrganizationalUnit: []string{"Quality Assurance"},
+		Country:            []string{"US"},
+		Locality:           []string{"Salt Lake City"},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+}
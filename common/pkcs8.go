@@ -0,0 +1,185 @@
+package common
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+)
+
+const (
+	// pbkdf2Iterations is the work factor of encrypted private keys
+	pbkdf2Iterations = 100000
+	pbkdf2SaltSize   = 16
+
+	EncryptedPrivateKeyPEMType = "ENCRYPTED PRIVATE KEY"
+)
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// encryptedPrivateKeyInfo is PKCS#8 EncryptedPrivateKeyInfo (RFC 5958 section 3).
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// pbes2Params are PBES2 parameters (RFC 8018 appendix A.4).
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+// pbkdf2Params are PBKDF2 parameters (RFC 8018 appendix A.2). Key length is optional and omitted.
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	PRF            pkix.AlgorithmIdentifier
+}
+
+// pbkdf2 derives key with PBKDF2-HMAC-SHA256 (RFC 8018 section 5.2).
+func pbkdf2(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		_ = binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// EncryptPrivateKey returns PEM encoded PKCS#8 private key encrypted with the passphrase using PBES2 with
+// PBKDF2-HMAC-SHA256 and AES-256-CBC, the format of "openssl pkcs8 -topk8 -v2 aes256".
+func EncryptPrivateKey(key crypto.Signer, passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("passphrase is empty")
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, pbkdf2SaltSize)
+	iv := make([]byte, aes.BlockSize)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err = rand.Read(iv); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(pbkdf2([]byte(passphrase), salt, pbkdf2Iterations, 32))
+	if err != nil {
+		return nil, err
+	}
+	padding := aes.BlockSize - len(der)%aes.BlockSize
+	data := append(der, bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+
+	kdf, err := asn1.Marshal(pbkdf2Params{
+		Salt:           salt,
+		IterationCount: pbkdf2Iterations,
+		PRF:            pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue},
+	})
+	if err != nil {
+		return nil, err
+	}
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdf}},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := asn1.Marshal(encryptedPrivateKeyInfo{
+		Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+		EncryptedData: data,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: EncryptedPrivateKeyPEMType, Bytes: encrypted}), nil
+}
+
+// DecryptPrivateKey decrypts PEM encoded private key made by EncryptPrivateKey. Only PBES2 with
+// PBKDF2-HMAC-SHA256 and AES-256-CBC is supported.
+func DecryptPrivateKey(keyPEM []byte, passphrase string) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil || block.Type != EncryptedPrivateKeyPEMType {
+		return nil, fmt.Errorf("key is not PEM encoded encrypted PKCS#8")
+	}
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(block.Bytes, &info); err != nil {
+		return nil, err
+	}
+	var params pbes2Params
+	var kdf pbkdf2Params
+	var iv []byte
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported key encryption %s", info.Algorithm.Algorithm)
+	}
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) || !params.EncryptionScheme.Algorithm.Equal(oidAES256CBC) {
+		return nil, fmt.Errorf("unsupported PBES2 algorithms %s and %s", params.KeyDerivationFunc.Algorithm, params.EncryptionScheme.Algorithm)
+	}
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, err
+	}
+	if !kdf.PRF.Algorithm.Equal(oidHMACWithSHA256) {
+		return nil, fmt.Errorf("unsupported PBKDF2 function %s", kdf.PRF.Algorithm)
+	}
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize || len(info.EncryptedData) == 0 || len(info.EncryptedData)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("bad encrypted key")
+	}
+	aesBlock, err := aes.NewCipher(pbkdf2([]byte(passphrase), kdf.Salt, kdf.IterationCount, 32))
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(aesBlock, iv).CryptBlocks(data, info.EncryptedData)
+	padding := int(data[len(data)-1])
+	if padding == 0 || padding > aes.BlockSize || !bytes.Equal(data[len(data)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, fmt.Errorf("wrong passphrase")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(data[:len(data)-padding])
+	if err != nil {
+		return nil, fmt.Errorf("wrong passphrase")
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
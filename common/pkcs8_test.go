@@ -0,0 +1,39 @@
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+)
+
+func TestPBKDF2(t *testing.T) {
+	// RFC 7914 section 11 test vector
+	got := pbkdf2([]byte("passwd"), []byte("salt"), 1, 64)
+	expected := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	if hex.EncodeToString(got) != expected {
+		t.Fatalf("unexpected PBKDF2-HMAC-SHA256 output %x", got)
+	}
+}
+
+func TestEncryptPrivateKey(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	encrypted, err := EncryptPrivateKey(key, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = DecryptPrivateKey(encrypted, "wrong horse"); err == nil {
+		t.Fatal("wrong passphrase should fail")
+	}
+	decrypted, err := DecryptPrivateKey(encrypted, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted.(*ecdsa.PrivateKey).D.Cmp(key.D) != 0 {
+		t.Fatal("decrypted key doesn't match")
+	}
+	if _, err = EncryptPrivateKey(key, ""); err == nil {
+		t.Fatal("empty passphrase should be rejected")
+	}
+}
@@ -0,0 +1,126 @@
+package common
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CounterStore keeps issuance counters of rate limit windows.
+type CounterStore interface {
+	// Increment atomically adds one to the counter of key unless it has reached limit. ok is false when the limit
+	// is reached. expires is the end of the counter window, the counter can be removed after it.
+	Increment(key string, limit int64, expires time.Time) (ok bool, err error)
+	// Decrement takes back one increment of the counter of key, e.g. when the certificate was not issued.
+	Decrement(key string) error
+}
+
+type memoryCounter struct {
+	count   int64
+	expires time.Time
+}
+
+// MemoryCounterStore keeps counters in memory. It's intended for tests and local runs, counters are not shared
+// between Lambda containers or server instances.
+type MemoryCounterStore struct {
+	sync.Mutex
+	counters map[string]memoryCounter
+}
+
+func NewMemoryCounterStore() *MemoryCounterStore {
+	return &MemoryCounterStore{counters: map[string]memoryCounter{}}
+}
+
+func (s *MemoryCounterStore) Increment(key string, limit int64, expires time.Time) (ok bool, err error) {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	for k, c := range s.counters {
+		if !c.expires.After(now) {
+			delete(s.counters, k)
+		}
+	}
+	c := s.counters[key]
+	if c.count >= limit {
+		return false, nil
+	}
+	s.counters[key] = memoryCounter{count: c.count + 1, expires: expires}
+	return true, nil
+}
+
+func (s *MemoryCounterStore) Decrement(key string) error {
+	s.Lock()
+	defer s.Unlock()
+	if c, ok := s.counters[key]; ok && c.count > 0 {
+		c.count--
+		s.counters[key] = c
+	}
+	return nil
+}
+
+const (
+	counterKey     = "Key"
+	counterCount   = "Count"
+	counterExpires = "Expires"
+)
+
+// DynamoDBCounterStore keeps counters in DynamoDB table with Key hash key. Expires attribute is epoch seconds,
+// so the table can use it as TTL attribute.
+type DynamoDBCounterStore struct {
+	Table string
+}
+
+// NewCounterStoreFromEnv returns DynamoDB counter store for RATE_LIMITS_TABLE or nil if it's not set.
+func NewCounterStoreFromEnv() CounterStore {
+	table := os.Getenv("RATE_LIMITS_TABLE")
+	if table == "" {
+		return nil
+	}
+	return &DynamoDBCounterStore{Table: table}
+}
+
+func (s *DynamoDBCounterStore) Increment(key string, limit int64, expires time.Time) (ok bool, err error) {
+	_, err = db.UpdateItemRequest(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(s.Table),
+		Key:                 map[string]dynamodb.AttributeValue{counterKey: {S: aws.String(key)}},
+		UpdateExpression:    aws.String("ADD #count :one SET #expires = :expires"),
+		ConditionExpression: aws.String("attribute_not_exists(#count) OR #count < :limit"),
+		ExpressionAttributeNames: map[string]string{
+			"#count":   counterCount,
+			"#expires": counterExpires,
+		},
+		ExpressionAttributeValues: map[string]dynamodb.AttributeValue{
+			":one":     {N: aws.String("1")},
+			":limit":   {N: aws.String(strconv.FormatInt(limit, 10))},
+			":expires": {N: aws.String(strconv.FormatInt(expires.Unix(), 10))},
+		},
+	}).Send(context.Background())
+	if aerr, isAWSErr := err.(awserr.Error); isAWSErr && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *DynamoDBCounterStore) Decrement(key string) error {
+	_, err := db.UpdateItemRequest(&dynamodb.UpdateItemInput{
+		TableName:                aws.String(s.Table),
+		Key:                      map[string]dynamodb.AttributeValue{counterKey: {S: aws.String(key)}},
+		UpdateExpression:         aws.String("ADD #count :minusOne"),
+		ConditionExpression:      aws.String("#count > :zero"),
+		ExpressionAttributeNames: map[string]string{"#count": counterCount},
+		ExpressionAttributeValues: map[string]dynamodb.AttributeValue{
+			":minusOne": {N: aws.String("-1")},
+			":zero":     {N: aws.String("0")},
+		},
+	}).Send(context.Background())
+	if aerr, isAWSErr := err.(awserr.Error); isAWSErr && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		// the counter has expired or was never incremented
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,38 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryCounterStore(t *testing.T) {
+	s := NewMemoryCounterStore()
+	expires := time.Now().Add(time.Minute)
+	for i := 0; i < 2; i++ {
+		ok, err := s.Increment("k", 2, expires)
+		if err != nil || !ok {
+			t.Fatalf("increment %d should pass: %v", i, err)
+		}
+	}
+	if ok, _ := s.Increment("k", 2, expires); ok {
+		t.Fatal("increment over the limit should fail")
+	}
+	if err := s.Decrement("k"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := s.Increment("k", 2, expires); !ok {
+		t.Fatal("decremented counter should pass")
+	}
+	if err := s.Decrement("missing"); err != nil {
+		t.Fatalf("decrement of missing counter should be ignored: %s", err)
+	}
+	if ok, _ := s.Increment("other", 2, expires); !ok {
+		t.Fatal("counters should be independent")
+	}
+	if ok, _ := s.Increment("old", 1, time.Now().Add(-time.Second)); !ok {
+		t.Fatal("first increment should pass")
+	}
+	if ok, _ := s.Increment("old", 1, expires); !ok {
+		t.Fatal("expired counter should be reset")
+	}
+}
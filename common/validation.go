@@ -0,0 +1,200 @@
+package common
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/Venafi/vcert/v4/pkg/certificate"
+	"github.com/Venafi/vcert/v4/pkg/endpoint"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// PolicyViolations lists every reason why request doesn't match zone policy.
+type PolicyViolations []string
+
+func (v PolicyViolations) Error() string {
+	return strings.Join(v, "; ")
+}
+
+// Err returns nil when there are no violations.
+func (v PolicyViolations) Err() error {
+	if len(v) == 0 {
+		return nil
+	}
+	return v
+}
+
+// requestFields are the parts of CSR or certificate checked against the policy.
+type requestFields struct {
+	Subject        pkix.Name
+	DNSNames       []string
+	EmailAddresses []string
+	IPAddresses    []net.IP
+	URIs           []*url.URL
+	PublicKey      crypto.PublicKey
+}
+
+// ParseCSR parses PEM or DER encoded certificate request.
+func ParseCSR(csr []byte) (*x509.CertificateRequest, error) {
+	if block, _ := pem.Decode(csr); block != nil {
+		csr = block.Bytes
+	}
+	return x509.ParseCertificateRequest(csr)
+}
+
+// CheckCSR validates CSR against the policy as it's done for IssueCertificate requests: subject, SANs and key.
+func CheckCSR(p endpoint.Policy, csr []byte) (PolicyViolations, error) {
+	parsed, err := ParseCSR(csr)
+	if err != nil {
+		return nil, err
+	}
+	return checkFields(p, requestFields{
+		Subject:        parsed.Subject,
+		DNSNames:       parsed.DNSNames,
+		EmailAddresses: parsed.EmailAddresses,
+		IPAddresses:    parsed.IPAddresses,
+		URIs:           parsed.URIs,
+		PublicKey:      parsed.PublicKey,
+	}), nil
+}
+
+// ValidateCSR is the policy check of IssueCertificate requests. With normalize the CSR is checked with the subject
+// normalized to the policy (see NormalizeCSR), which is returned as the subject of the certificate.
+func ValidateCSR(p endpoint.Policy, csr []byte, normalize bool) (pkix.Name, PolicyViolations, error) {
+	if normalize {
+		return NormalizeCSR(p, csr)
+	}
+	violations, err := CheckCSR(p, csr)
+	return pkix.Name{}, violations, err
+}
+
+// CheckCertificate validates issued certificate against the policy the same way as its CSR.
+func CheckCertificate(p endpoint.Policy, cert *x509.Certificate) PolicyViolations {
+	return checkFields(p, requestFields{
+		Subject:        cert.Subject,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		IPAddresses:    cert.IPAddresses,
+		URIs:           cert.URIs,
+		PublicKey:      cert.PublicKey,
+	})
+}
+
+// CheckDomainNames validates ACM RequestCertificate requests where ACM generates the key, so only
+// common name and DNS SANs are checked.
+func CheckDomainNames(p endpoint.Policy, commonName string, dnsNames []string) PolicyViolations {
+	var v PolicyViolations
+	if !matchAny(commonName, p.SubjectCNRegexes) {
+		v = append(v, fmt.Sprintf("common name %s is not allowed in this policy: %v", commonName, p.SubjectCNRegexes))
+	}
+	if !componentValid(dnsNames, p.DnsSanRegExs, true) {
+		v = append(v, fmt.Sprintf("DNS SANs %v do not match regular expessions: %v", dnsNames, p.DnsSanRegExs))
+	}
+	return v
+}
+
+func checkFields(p endpoint.Policy, f requestFields) PolicyViolations {
+	v := CheckDomainNames(p, f.Subject.CommonName, f.DNSNames)
+
+	if !componentValid(f.EmailAddresses, p.EmailSanRegExs, true) {
+		v = append(v, fmt.Sprintf("email addresses %v do not match regular expessions: %v", f.EmailAddresses, p.EmailSanRegExs))
+	}
+	ips := make([]string, len(f.IPAddresses))
+	for i, ip := range f.IPAddresses {
+		ips[i] = ip.String()
+	}
+	if !componentValid(ips, p.IpSanRegExs, true) {
+		v = append(v, fmt.Sprintf("IP addresses %v do not match regular expessions: %v", ips, p.IpSanRegExs))
+	}
+	uris := make([]string, len(f.URIs))
+	for i, uri := range f.URIs {
+		uris[i] = uri.String()
+	}
+	if !componentValid(uris, p.UriSanRegExs, true) {
+		v = append(v, fmt.Sprintf("URIs %v do not match regular expessions: %v", uris, p.UriSanRegExs))
+	}
+
+	subject := []struct {
+		name    string
+		values  []string
+		regexes []string
+	}{
+		{"organization", f.Subject.Organization, p.SubjectORegexes},
+		{"organization unit", f.Subject.OrganizationalUnit, p.SubjectOURegexes},
+		{"country", f.Subject.Country, p.SubjectCRegexes},
+		{"location", f.Subject.Locality, p.SubjectLRegexes},
+		{"state (province)", f.Subject.Province, p.SubjectSTRegexes},
+	}
+	for _, s := range subject {
+		if !componentValid(s.values, s.regexes, false) {
+			v = append(v, fmt.Sprintf("%s %v doesn't match regular expessions: %v", s.name, s.values, s.regexes))
+		}
+	}
+
+	if len(p.AllowedKeyConfigurations) > 0 && !keyAllowed(f.PublicKey, p.AllowedKeyConfigurations) {
+		v = append(v, "the requested Key Type and Size do not match any of the allowed Key Types and Sizes")
+	}
+	return v
+}
+
+func keyAllowed(key crypto.PublicKey, allowed []endpoint.AllowedKeyConfiguration) bool {
+	for _, a := range allowed {
+		switch pub := key.(type) {
+		case *rsa.PublicKey:
+			if a.KeyType != certificate.KeyTypeRSA {
+				continue
+			}
+			for _, size := range a.KeySizes {
+				if size == pub.Size()*8 {
+					return true
+				}
+			}
+		case *ecdsa.PublicKey:
+			if a.KeyType != certificate.KeyTypeECDSA {
+				continue
+			}
+			var curve certificate.EllipticCurve
+			_ = curve.Set(pub.Curve.Params().Name)
+			for _, c := range a.KeyCurves {
+				if c == curve {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func matchAny(s string, regexes []string) bool {
+	for _, r := range regexes {
+		matched, err := regexp.MatchString(r, s)
+		if err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// componentValid checks that every value matches one of regexes. Optional components may be omitted,
+// otherwise missing component is checked as empty string.
+func componentValid(values []string, regexes []string, optional bool) bool {
+	if optional && len(values) == 0 {
+		return true
+	}
+	if len(values) == 0 {
+		values = []string{""}
+	}
+	for _, s := range values {
+		if !matchAny(s, regexes) {
+			return false
+		}
+	}
+	return true
+}
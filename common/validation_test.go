@@ -0,0 +1,119 @@
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/Venafi/vcert/v4/pkg/certificate"
+	"github.com/Venafi/vcert/v4/pkg/endpoint"
+	"strings"
+	"testing"
+)
+
+func testCSR(t *testing.T, subject pkix.Name, dnsNames []string, key interface{}) []byte {
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: subject, DNSNames: dnsNames}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+}
+
+func TestCheckCSRValid(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	csr := testCSR(t, pkix.Name{
+		CommonName:         "test.vfidev.com",
+		Organization:       []string{"Venafi Inc."},
+		OrganizationalUnit: []string{"Integration"},
+		Province:           []string{"Utah"},
+		Locality:           []string{"Salt Lake"},
+		Country:            []string{"US"},
+	}, []string{"www.vfidev.com"}, key)
+	v, err := CheckCSR(testPolicy, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != 0 {
+		t.Fatalf("CSR should be valid, got violations: %s", v)
+	}
+	// the result must match vcert's own validation of the same request
+	var req certificate.Request
+	_ = req.SetCSR(csr)
+	if err := testPolicy.ValidateCertificateRequest(&req); err != nil {
+		t.Fatalf("vcert rejects CSR: %s", err)
+	}
+}
+
+func TestCheckCSRReportsAllViolations(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	csr := testCSR(t, pkix.Name{
+		CommonName:   "test.example.com",
+		Organization: []string{"Other Inc."},
+		Country:      []string{"US"},
+	}, []string{"www.example.com"}, key)
+	v, err := CheckCSR(testPolicy, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"common name", "DNS SANs", "organization [", "organization unit", "location", "state (province)", "Key Type"} {
+		if !strings.Contains(v.Error(), expected) {
+			t.Errorf("violations should mention %q: %s", expected, v)
+		}
+	}
+	if strings.Contains(v.Error(), "country") {
+		t.Errorf("country is allowed but reported: %s", v)
+	}
+	if v.Err() == nil {
+		t.Fatal("violations should be reported as error")
+	}
+}
+
+func TestCheckCSRKeyCurves(t *testing.T) {
+	p := endpoint.Policy{
+		SubjectCNRegexes: []string{".*"}, SubjectORegexes: []string{".*"}, SubjectOURegexes: []string{".*"},
+		SubjectSTRegexes: []string{".*"}, SubjectLRegexes: []string{".*"}, SubjectCRegexes: []string{".*"},
+		AllowedKeyConfigurations: []endpoint.AllowedKeyConfiguration{
+			{KeyType: certificate.KeyTypeRSA, KeySizes: []int{4096}},
+			{KeyType: certificate.KeyTypeECDSA, KeyCurves: []certificate.EllipticCurve{certificate.EllipticCurveP384}},
+		},
+	}
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if v, _ := CheckCSR(p, testCSR(t, pkix.Name{CommonName: "a"}, nil, p384)); len(v) != 0 {
+		t.Fatalf("P384 key should be allowed: %s", v)
+	}
+	if v, _ := CheckCSR(p, testCSR(t, pkix.Name{CommonName: "a"}, nil, p256)); len(v) != 1 {
+		t.Fatalf("P256 key should be rejected, got: %v", v)
+	}
+}
+
+func TestCheckDomainNames(t *testing.T) {
+	if v := CheckDomainNames(testPolicy, "test.vfidev.com", []string{"alt.vfidev.net"}); len(v) != 0 {
+		t.Fatalf("domains should be allowed: %s", v)
+	}
+	if v := CheckDomainNames(testPolicy, "test.example.com", []string{"alt.example.com"}); len(v) != 2 {
+		t.Fatalf("expected 2 violations, got: %v", v)
+	}
+	if _, err := CheckCSR(testPolicy, []byte("not a csr")); err == nil {
+		t.Fatal("bad CSR should fail to parse")
+	}
+}
+
+func TestValidateCSR(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	// testPolicy has locked organization, unit, state, locality and country
+	csr := testCSR(t, pkix.Name{CommonName: "test.vfidev.com"}, nil, key)
+	if subject, v, err := ValidateCSR(testPolicy, csr, false); err != nil || len(v) != 5 || subject.CommonName != "" {
+		t.Fatalf("CSR without subject fields should be rejected: %v %v %v", subject, v, err)
+	}
+	subject, v, err := ValidateCSR(testPolicy, csr, true)
+	if err != nil || len(v) != 0 {
+		t.Fatalf("normalized CSR should be valid: %v %v", v, err)
+	}
+	if subject.String() != "CN=test.vfidev.com,OU=Integration,O=Venafi Inc.,L=Salt Lake,ST=Utah,C=US" {
+		t.Fatalf("unexpected normalized subject %s", subject)
+	}
+}
@@ -4,6 +4,7 @@ go 1.13
 
 require (
 	github.com/Venafi/vcert/v4 v4.13.1
-	github.com/aws/aws-lambda-go v1.12.0
+	github.com/aws/aws-lambda-go v1.28.0
 	github.com/aws/aws-sdk-go-v2 v0.9.0
+	gopkg.in/yaml.v3 v3.0.0-20200615113413-eeeca48fe776
 )
@@ -0,0 +1,50 @@
+// Package cliutil has the error handling shared by cert-cli, policy-admin and policy-check: usage errors exit
+// with code 2, invalid requests and other failures with code 1.
+package cliutil
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrInvalid is returned when the request violates the policy. The command has already reported violations,
+// so only the exit code is set.
+var ErrInvalid = errors.New("request is not valid")
+
+// usageError is a wrong command line. printed errors were already reported by the flag set.
+type usageError struct {
+	error
+	printed bool
+}
+
+// Usagef returns usage error with the formatted message.
+func Usagef(format string, a ...interface{}) error {
+	return usageError{error: fmt.Errorf(format, a...)}
+}
+
+// UsageError marks err as caused by the command line, e.g. an unknown output format.
+func UsageError(err error) error {
+	return usageError{error: err}
+}
+
+// FlagError wraps the error of flag.FlagSet.Parse, which the flag set already printed with ContinueOnError.
+func FlagError(err error) error {
+	return usageError{error: err, printed: true}
+}
+
+// ExitCode reports err on stderr and returns the exit code of the command.
+func ExitCode(err error, stderr io.Writer) int {
+	if err == nil {
+		return 0
+	} else if err == ErrInvalid {
+		return 1
+	} else if e, ok := err.(usageError); ok {
+		if !e.printed {
+			fmt.Fprintln(stderr, "Error:", e.error)
+		}
+		return 2
+	}
+	fmt.Fprintln(stderr, "Error:", err)
+	return 1
+}
@@ -0,0 +1,32 @@
+package cliutil
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(&bytes.Buffer{})
+	flagErr := flags.Parse([]string{"--unknown"})
+
+	for _, c := range []struct {
+		err    error
+		code   int
+		stderr string
+	}{
+		{nil, 0, ""},
+		{ErrInvalid, 1, ""},
+		{errors.New("access denied"), 1, "Error: access denied\n"},
+		{Usagef("--%s should be set", "zone"), 2, "Error: --zone should be set\n"},
+		{UsageError(errors.New("unknown format xml")), 2, "Error: unknown format xml\n"},
+		{FlagError(flagErr), 2, ""},
+	} {
+		var stderr bytes.Buffer
+		if code := ExitCode(c.err, &stderr); code != c.code || stderr.String() != c.stderr {
+			t.Fatalf("%v should exit with %d and print %q, got %d %q", c.err, c.code, c.stderr, code, stderr.String())
+		}
+	}
+}
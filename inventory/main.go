@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/Venafi/vcert/v4/pkg/certificate"
+	"github.com/Venafi/vcert/v4/pkg/endpoint"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/external"
+	"github.com/aws/aws-sdk-go-v2/service/acm"
+	"github.com/aws/aws-sdk-go-v2/service/acmpca"
+	"log"
+	"os"
+	"strings"
+)
+
+const inventoryOrigin = "AWS Private CA Policy Lambda"
+
+var (
+	vcertConnector endpoint.Connector
+	acmpcaCli      *acmpca.Client
+	acmCli         *acm.Client
+)
+
+// fetchCertificate returns PEM of the issued certificate. It's a variable to be replaced in tests.
+var fetchCertificate = func(ctx context.Context, r common.InventoryRecord) (string, error) {
+	switch r.Source {
+	case common.InventorySourceACMPCA:
+		resp, err := acmpcaCli.GetCertificateRequest(&acmpca.GetCertificateInput{
+			CertificateArn:          aws.String(r.CertificateArn),
+			CertificateAuthorityArn: aws.String(r.CertificateAuthorityArn),
+		}).Send(ctx)
+		if err != nil {
+			return "", err
+		}
+		return aws.StringValue(resp.Certificate), nil
+	case common.InventorySourceACM:
+		resp, err := acmCli.GetCertificateRequest(&acm.GetCertificateInput{
+			CertificateArn: aws.String(r.CertificateArn),
+		}).Send(ctx)
+		if err != nil {
+			return "", err
+		}
+		return aws.StringValue(resp.Certificate), nil
+	default:
+		return "", fmt.Errorf("unknown certificate source %q", r.Source)
+	}
+}
+
+// HandleRequest imports queued certificates into Venafi inventory. Returning an error leaves the message
+// in the queue so it will be retried and finally moved to the dead-letter queue.
+func HandleRequest(ctx context.Context, event events.SQSEvent) error {
+	var failed []string
+	for _, message := range event.Records {
+		err := importRecord(ctx, message.Body)
+		if err != nil {
+			log.Printf("Can't import message %s: %s", message.MessageId, err)
+			failed = append(failed, message.MessageId)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to import messages: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+func importRecord(ctx context.Context, body string) error {
+	var record common.InventoryRecord
+	err := json.Unmarshal([]byte(body), &record)
+	if err != nil {
+		return fmt.Errorf("bad inventory record: %s", err)
+	}
+	log.Printf("Importing certificate %s into zone %s", record.CertificateArn, record.Zone)
+	certPEM, err := fetchCertificate(ctx, record)
+	if err != nil {
+		return fmt.Errorf("can't get certificate %s: %s", record.CertificateArn, err)
+	}
+	vcertConnector.SetZone(record.Zone)
+	resp, err := vcertConnector.ImportCertificate(&certificate.ImportRequest{
+		ObjectName:      objectName(record.CertificateArn),
+		CertificateData: certPEM,
+		CustomFields: []certificate.CustomField{
+			{Type: certificate.CustomFieldOrigin, Value: inventoryOrigin},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("can't import certificate %s: %s", record.CertificateArn, err)
+	}
+	log.Printf("Certificate %s imported as %s%s", record.CertificateArn, resp.CertificateDN, resp.CertId)
+	return nil
+}
+
+// objectName makes certificate object name from the last segment of its ARN.
+func objectName(arn string) string {
+	return arn[strings.LastIndex(arn, "/")+1:]
+}
+
+func main() {
+	log.Println("Starting inventory lambda.")
+	var err error
+
+	// the tokens of the policy lambda can't be shared, it consumes the refresh token as well
+	vcertConnector, err = common.GetConnectionFromEnvWithTokenPrefix("INVENTORY_")
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	awsCfg, err := external.LoadDefaultAWSConfig()
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	acmpcaCli = acmpca.New(awsCfg)
+	acmCli = acm.New(awsCfg)
+
+	lambda.Start(HandleRequest)
+}
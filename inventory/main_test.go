@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/Venafi/vcert/v4/pkg/certificate"
+	"github.com/Venafi/vcert/v4/pkg/endpoint"
+	"github.com/aws/aws-lambda-go/events"
+	"testing"
+)
+
+const testCertPEM = "-----BEGIN CERTIFICATE-----\ntest\n-----END CERTIFICATE-----\n"
+
+// fakeConnector records imported certificates; other Connector methods are not used by the lambda.
+type fakeConnector struct {
+	endpoint.Connector
+	zone     string
+	imported map[string]certificate.ImportRequest
+	fail     bool
+}
+
+func (c *fakeConnector) SetZone(z string) {
+	c.zone = z
+}
+
+func (c *fakeConnector) ImportCertificate(req *certificate.ImportRequest) (*certificate.ImportResponse, error) {
+	if c.fail {
+		return nil, fmt.Errorf("server unavailable")
+	}
+	c.imported[c.zone] = *req
+	return &certificate.ImportResponse{CertificateDN: req.ObjectName}, nil
+}
+
+func sqsEvent(t *testing.T, records ...common.InventoryRecord) events.SQSEvent {
+	var event events.SQSEvent
+	for i, r := range records {
+		b, err := json.Marshal(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		event.Records = append(event.Records, events.SQSMessage{MessageId: fmt.Sprintf("msg%d", i), Body: string(b)})
+	}
+	return event
+}
+
+func TestHandleRequestImportsIntoZone(t *testing.T) {
+	c := &fakeConnector{imported: map[string]certificate.ImportRequest{}}
+	vcertConnector = c
+	fetchCertificate = func(ctx context.Context, r common.InventoryRecord) (string, error) {
+		return testCertPEM, nil
+	}
+	err := HandleRequest(context.Background(), sqsEvent(t, common.InventoryRecord{
+		Source:                  common.InventorySourceACMPCA,
+		CertificateArn:          "arn:aws:acm-pca:eu-west-1:123456789012:certificate-authority/ca/certificate/0a1b",
+		CertificateAuthorityArn: "arn:aws:acm-pca:eu-west-1:123456789012:certificate-authority/ca",
+		Zone:                    "Business App\\Enterprise CIT",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, ok := c.imported["Business App\\Enterprise CIT"]
+	if !ok {
+		t.Fatal("certificate should be imported into approving zone")
+	}
+	if req.CertificateData != testCertPEM || req.ObjectName != "0a1b" {
+		t.Fatalf("unexpected import request: %+v", req)
+	}
+}
+
+func TestHandleRequestFailsForRetry(t *testing.T) {
+	c := &fakeConnector{imported: map[string]certificate.ImportRequest{}}
+	vcertConnector = c
+	fetchCertificate = func(ctx context.Context, r common.InventoryRecord) (string, error) {
+		return "", fmt.Errorf("RequestInProgressException")
+	}
+	record := common.InventoryRecord{Source: common.InventorySourceACM, CertificateArn: "arn:aws:acm:eu-west-1:123456789012:certificate/1", Zone: "Default"}
+	if HandleRequest(context.Background(), sqsEvent(t, record)) == nil {
+		t.Fatal("pending certificate should be left in queue")
+	}
+
+	fetchCertificate = func(ctx context.Context, r common.InventoryRecord) (string, error) {
+		return testCertPEM, nil
+	}
+	c.fail = true
+	if HandleRequest(context.Background(), sqsEvent(t, record)) == nil {
+		t.Fatal("failed import should be left in queue")
+	}
+	if HandleRequest(context.Background(), events.SQSEvent{Records: []events.SQSMessage{{MessageId: "bad", Body: "{"}}}) == nil {
+		t.Fatal("malformed record should fail")
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"fmt"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	conditionReady    = "Ready"
+	conditionApproved = "Approved"
+	conditionDenied   = "Denied"
+
+	conditionTrue  = "True"
+	conditionFalse = "False"
+
+	// CertificateRequest Ready reasons defined by cert-manager
+	reasonPending = "Pending"
+	reasonFailed  = "Failed"
+	reasonIssued  = "Issued"
+	reasonDenied  = "Denied"
+
+	reasonVerified = "Verified"
+	reasonError    = "Error"
+
+	defaultValidityDays = 90
+)
+
+var (
+	// getPolicy and reportToInventory are variables so tests can replace DynamoDB and SQS backends.
+	getPolicy         = common.GetPolicy
+	reportToInventory = func(r common.InventoryRecord) error {
+		if !common.InventoryEnabled() {
+			return nil
+		}
+		return common.EnqueueInventoryRecord(r)
+	}
+)
+
+// controller signs cert-manager CertificateRequests which reference its issuers. It polls the API server,
+// so every pass reconciles all issuers and pending requests.
+type controller struct {
+	kube   kubeClient
+	signer signer
+	now    func() time.Time
+}
+
+// setCondition sets the condition and reports whether it changed. Transition time is kept while the status
+// stays the same.
+func setCondition(conditions []condition, c condition, now time.Time) ([]condition, bool) {
+	c.LastTransitionTime = now.UTC().Format(time.RFC3339)
+	for i, old := range conditions {
+		if old.Type != c.Type {
+			continue
+		}
+		if old.Status == c.Status {
+			c.LastTransitionTime = old.LastTransitionTime
+		}
+		if old == c {
+			return conditions, false
+		}
+		conditions[i] = c
+		return conditions, true
+	}
+	return append(conditions, c), true
+}
+
+func findCondition(conditions []condition, conditionType string) (condition, bool) {
+	for _, c := range conditions {
+		if c.Type == conditionType {
+			return c, true
+		}
+	}
+	return condition{}, false
+}
+
+// issuerReady returns error when the issuer can't sign requests.
+func issuerReady(iss issuer) error {
+	c, ok := findCondition(iss.Status.Conditions, conditionReady)
+	if !ok || c.Status != conditionTrue {
+		return fmt.Errorf("%s %s is not ready", iss.Kind, iss.Metadata.Name)
+	}
+	return nil
+}
+
+// reconcile runs one pass over issuers and certificate requests.
+func (c *controller) reconcile(ctx context.Context) error {
+	for _, kind := range []string{kindIssuer, kindClusterIssuer} {
+		issuers, err := c.kube.ListIssuers(ctx, kind)
+		if err != nil {
+			return fmt.Errorf("can't list %ss: %s", kind, err)
+		}
+		for _, iss := range issuers {
+			if err := c.reconcileIssuer(ctx, iss); err != nil {
+				log.Printf("Can't update %s %s/%s status: %s", kind, iss.Metadata.Namespace, iss.Metadata.Name, err)
+			}
+		}
+	}
+	requests, err := c.kube.ListCertificateRequests(ctx)
+	if err != nil {
+		return fmt.Errorf("can't list certificate requests: %s", err)
+	}
+	for _, cr := range requests {
+		if err := c.reconcileCertificateRequest(ctx, cr); err != nil {
+			log.Printf("Can't update certificate request %s/%s status: %s", cr.Metadata.Namespace, cr.Metadata.Name, err)
+		}
+	}
+	return nil
+}
+
+// verifyIssuer checks the zone policy exists and the CA is reachable.
+func (c *controller) verifyIssuer(ctx context.Context, spec issuerSpec) error {
+	if spec.Zone == "" || spec.CertificateAuthorityArn == "" {
+		return fmt.Errorf("spec.zone and spec.certificateAuthorityArn are required")
+	}
+	_, err := getPolicy(spec.Zone)
+	if err == common.PolicyNotFound {
+		return fmt.Errorf("policy of zone %s is not found in the policy table", spec.Zone)
+	} else if err != nil {
+		return fmt.Errorf("can't get policy of zone %s: %s", spec.Zone, err)
+	}
+	_, _, err = c.signer.CACertificate(ctx, spec.CertificateAuthorityArn)
+	if err != nil {
+		return fmt.Errorf("can't get certificate authority %s: %s", spec.CertificateAuthorityArn, err)
+	}
+	return nil
+}
+
+func (c *controller) reconcileIssuer(ctx context.Context, iss issuer) error {
+	ready := condition{
+		Type:               conditionReady,
+		Status:             conditionTrue,
+		Reason:             reasonVerified,
+		Message:            fmt.Sprintf("Signing requests checked against zone %s", iss.Spec.Zone),
+		ObservedGeneration: iss.Metadata.Generation,
+	}
+	if err := c.verifyIssuer(ctx, iss.Spec); err != nil {
+		ready.Status, ready.Reason, ready.Message = conditionFalse, reasonError, err.Error()
+	}
+	var changed bool
+	iss.Status.Conditions, changed = setCondition(iss.Status.Conditions, ready, c.now())
+	if !changed {
+		return nil
+	}
+	log.Printf("%s %s/%s is %s: %s", iss.Kind, iss.Metadata.Namespace, iss.Metadata.Name, ready.Reason, ready.Message)
+	return c.kube.UpdateIssuerStatus(ctx, iss)
+}
+
+// finished reports whether the request got a final Ready condition.
+func finished(cr certificateRequest) bool {
+	c, ok := findCondition(cr.Status.Conditions, conditionReady)
+	return ok && (c.Status == conditionTrue || c.Reason == reasonFailed || c.Reason == reasonDenied)
+}
+
+func (c *controller) reconcileCertificateRequest(ctx context.Context, cr certificateRequest) error {
+	ref := cr.Spec.IssuerRef
+	if ref.Group != issuerGroup || finished(cr) {
+		return nil
+	}
+	if ref.Kind == "" {
+		ref.Kind = kindIssuer
+	}
+	if ref.Kind != kindIssuer && ref.Kind != kindClusterIssuer {
+		return nil
+	}
+	if d, ok := findCondition(cr.Status.Conditions, conditionDenied); ok && d.Status == conditionTrue {
+		return c.updateRequest(ctx, cr, reasonDenied, "The certificate request has been denied")
+	}
+	if a, ok := findCondition(cr.Status.Conditions, conditionApproved); !ok || a.Status != conditionTrue {
+		// cert-manager approves requests before issuers sign them
+		return nil
+	}
+
+	namespace := cr.Metadata.Namespace
+	if ref.Kind == kindClusterIssuer {
+		namespace = ""
+	}
+	iss, err := c.kube.GetIssuer(ctx, ref.Kind, namespace, ref.Name)
+	if err == errNotFound {
+		return c.updateRequest(ctx, cr, reasonPending, fmt.Sprintf("%s %s is not found", ref.Kind, ref.Name))
+	} else if err != nil {
+		return err
+	}
+	iss.Kind = ref.Kind
+	if err := issuerReady(iss); err != nil {
+		return c.updateRequest(ctx, cr, reasonPending, err.Error())
+	}
+
+	reason, message := c.sign(ctx, &cr, iss)
+	return c.updateRequest(ctx, cr, reason, message)
+}
+
+// sign checks the CSR against the zone policy and issues the certificate. It returns Ready reason and message.
+func (c *controller) sign(ctx context.Context, cr *certificateRequest, iss issuer) (string, string) {
+	zone := iss.Spec.Zone
+	if cr.Spec.IsCA {
+		return reasonFailed, "CA certificates can't be requested"
+	}
+	policy, err := getPolicy(zone)
+	if err == common.PolicyNotFound {
+		return reasonPending, fmt.Sprintf("policy of zone %s is not found", zone)
+	} else if err != nil {
+		return reasonPending, fmt.Sprintf("can't get policy of zone %s: %s", zone, err)
+	}
+	violations, err := common.CheckCSR(policy, cr.Spec.Request)
+	if err != nil {
+		return reasonFailed, fmt.Sprintf("can't parse CSR: %s", err)
+	}
+	if len(violations) > 0 {
+		return reasonFailed, fmt.Sprintf("CSR doesn't match policy of zone %s: %s", zone, violations)
+	}
+
+	validityDays := int64(defaultValidityDays)
+	if cr.Spec.Duration != "" {
+		d, err := time.ParseDuration(cr.Spec.Duration)
+		if err != nil || d <= 0 {
+			return reasonFailed, fmt.Sprintf("bad duration %q", cr.Spec.Duration)
+		}
+		// ACM-PCA validity is set in days, round up so the certificate isn't shorter than requested
+		validityDays = int64((d + 24*time.Hour - 1) / (24 * time.Hour))
+	}
+	// the UID makes retries of the same request return the same certificate
+	certArn, certPEM, chainPEM, err := c.signer.Sign(ctx, iss.Spec, cr.Spec.Request, validityDays, cr.Metadata.UID)
+	if err != nil {
+		return reasonPending, fmt.Sprintf("can't issue certificate: %s", err)
+	}
+	cr.Status.Certificate = []byte(strings.TrimSpace(certPEM) + "\n")
+	if chainPEM != "" {
+		cr.Status.Certificate = append(cr.Status.Certificate, []byte(strings.TrimSpace(chainPEM)+"\n")...)
+		cr.Status.CA = lastCertificate([]byte(chainPEM))
+	}
+	err = reportToInventory(common.InventoryRecord{
+		Source:                  common.InventorySourceACMPCA,
+		CertificateArn:          certArn,
+		CertificateAuthorityArn: iss.Spec.CertificateAuthorityArn,
+		Zone:                    zone,
+	})
+	if err != nil {
+		log.Printf("Can't queue certificate %s for inventory: %s", certArn, err)
+	}
+	return reasonIssued, fmt.Sprintf("Certificate %s issued in zone %s", certArn, zone)
+}
+
+// lastCertificate returns the last PEM block of the chain, which is the root CA.
+func lastCertificate(chain []byte) []byte {
+	var last *pem.Block
+	for rest := bytes.TrimSpace(chain); ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		last = block
+	}
+	if last == nil {
+		return nil
+	}
+	return pem.EncodeToMemory(last)
+}
+
+// updateRequest sets Ready condition of the request. Pending requests are retried on the next pass.
+func (c *controller) updateRequest(ctx context.Context, cr certificateRequest, reason, message string) error {
+	status := conditionFalse
+	if reason == reasonIssued {
+		status = conditionTrue
+	}
+	var changed bool
+	cr.Status.Conditions, changed = setCondition(cr.Status.Conditions, condition{
+		Type:    conditionReady,
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	}, c.now())
+	if !changed {
+		return nil
+	}
+	if reason == reasonFailed || reason == reasonDenied {
+		cr.Status.FailureTime = c.now().UTC().Format(time.RFC3339)
+	}
+	log.Printf("Certificate request %s/%s is %s: %s", cr.Metadata.Namespace, cr.Metadata.Name, reason, message)
+	return c.kube.UpdateCertificateRequestStatus(ctx, cr)
+}
+
+// run reconciles every interval until the context is done.
+func (c *controller) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := c.reconcile(ctx); err != nil {
+			log.Println("Reconcile error:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/Venafi/vcert/v4/pkg/endpoint"
+	"math/big"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testCAArn = "arn:aws:acm-pca:eu-west-1:123456789012:certificate-authority/cadaae4b-26c7-4c57-9ba1-f00d4e20beb2"
+	testZone  = "Business App\\Kubernetes"
+)
+
+// fakeKube keeps objects in memory like the API server does: reads return copies, status updates require
+// the current resourceVersion and bump it.
+type fakeKube struct {
+	sync.Mutex
+	objects map[string][]byte
+	version int
+}
+
+func newFakeKube() *fakeKube {
+	return &fakeKube{objects: map[string][]byte{}}
+}
+
+func objectKey(kind, namespace, name string) string {
+	return kind + "/" + namespace + "/" + name
+}
+
+func (k *fakeKube) put(t *testing.T, kind string, meta *objectMeta, obj interface{}) {
+	k.Lock()
+	defer k.Unlock()
+	k.version++
+	meta.ResourceVersion = strconv.Itoa(k.version)
+	b, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.objects[objectKey(kind, meta.Namespace, meta.Name)] = b
+}
+
+func (k *fakeKube) get(key string, out interface{}) error {
+	k.Lock()
+	defer k.Unlock()
+	b, ok := k.objects[key]
+	if !ok {
+		return errNotFound
+	}
+	return json.Unmarshal(b, out)
+}
+
+func (k *fakeKube) update(kind string, meta objectMeta, obj interface{}) error {
+	k.Lock()
+	defer k.Unlock()
+	key := objectKey(kind, meta.Namespace, meta.Name)
+	var current struct {
+		Metadata objectMeta `json:"metadata"`
+	}
+	b, ok := k.objects[key]
+	if !ok {
+		return errNotFound
+	}
+	_ = json.Unmarshal(b, &current)
+	if current.Metadata.ResourceVersion != meta.ResourceVersion {
+		return errConflict
+	}
+	k.version++
+	b, _ = json.Marshal(obj)
+	var m map[string]interface{}
+	_ = json.Unmarshal(b, &m)
+	m["metadata"].(map[string]interface{})["resourceVersion"] = strconv.Itoa(k.version)
+	k.objects[key], _ = json.Marshal(m)
+	return nil
+}
+
+func (k *fakeKube) list(kind string, each func([]byte) error) error {
+	k.Lock()
+	var items [][]byte
+	for key, b := range k.objects {
+		if len(key) > len(kind) && key[:len(kind)+1] == kind+"/" {
+			items = append(items, b)
+		}
+	}
+	k.Unlock()
+	for _, b := range items {
+		if err := each(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (k *fakeKube) ListIssuers(ctx context.Context, kind string) ([]issuer, error) {
+	var issuers []issuer
+	err := k.list(kind, func(b []byte) error {
+		var iss issuer
+		issuers = append(issuers, iss)
+		return json.Unmarshal(b, &issuers[len(issuers)-1])
+	})
+	return issuers, err
+}
+
+func (k *fakeKube) GetIssuer(ctx context.Context, kind, namespace, name string) (issuer, error) {
+	var iss issuer
+	err := k.get(objectKey(kind, namespace, name), &iss)
+	return iss, err
+}
+
+func (k *fakeKube) UpdateIssuerStatus(ctx context.Context, iss issuer) error {
+	return k.update(iss.Kind, iss.Metadata, iss)
+}
+
+func (k *fakeKube) ListCertificateRequests(ctx context.Context) ([]certificateRequest, error) {
+	var requests []certificateRequest
+	err := k.list("CertificateRequest", func(b []byte) error {
+		var cr certificateRequest
+		requests = append(requests, cr)
+		return json.Unmarshal(b, &requests[len(requests)-1])
+	})
+	return requests, err
+}
+
+func (k *fakeKube) UpdateCertificateRequestStatus(ctx context.Context, cr certificateRequest) error {
+	return k.update("CertificateRequest", cr.Metadata, cr)
+}
+
+func (k *fakeKube) certificateRequest(t *testing.T, namespace, name string) certificateRequest {
+	var cr certificateRequest
+	if err := k.get(objectKey("CertificateRequest", namespace, name), &cr); err != nil {
+		t.Fatal(err)
+	}
+	return cr
+}
+
+// fakeSigner signs with a local CA and records the requests.
+type fakeSigner struct {
+	caCert  *x509.Certificate
+	caKey   *ecdsa.PrivateKey
+	issued  map[string]string
+	tokens  []string
+	days    []int64
+	missing map[string]bool
+}
+
+func newFakeSigner(t *testing.T) *fakeSigner {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Private CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &fakeSigner{caCert: cert, caKey: key, issued: map[string]string{}, missing: map[string]bool{}}
+}
+
+func (s *fakeSigner) caPEM() string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.caCert.Raw}))
+}
+
+func (s *fakeSigner) CACertificate(ctx context.Context, caArn string) (string, string, error) {
+	if s.missing[caArn] {
+		return "", "", fmt.Errorf("ResourceNotFoundException: %s", caArn)
+	}
+	return s.caPEM(), "", nil
+}
+
+func (s *fakeSigner) Sign(ctx context.Context, spec issuerSpec, csr []byte, validityDays int64, token string) (string, string, string, error) {
+	s.tokens = append(s.tokens, token)
+	s.days = append(s.days, validityDays)
+	if certPEM, ok := s.issued[token]; ok {
+		return spec.CertificateAuthorityArn + "/certificate/" + token, certPEM, s.caPEM(), nil
+	}
+	parsed, err := common.ParseCSR(csr)
+	if err != nil {
+		return "", "", "", err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(int64(len(s.tokens) + 1)),
+		Subject:      parsed.Subject,
+		DNSNames:     parsed.DNSNames,
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Duration(validityDays) * 24 * time.Hour),
+	}, s.caCert, parsed.PublicKey, s.caKey)
+	if err != nil {
+		return "", "", "", err
+	}
+	certPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	s.issued[token] = certPEM
+	return spec.CertificateAuthorityArn + "/certificate/" + token, certPEM, s.caPEM(), nil
+}
+
+var testPolicy = endpoint.Policy{
+	SubjectCNRegexes: []string{`^.*\.example\.com$`},
+	SubjectORegexes:  []string{".*"},
+	SubjectOURegexes: []string{".*"},
+	SubjectSTRegexes: []string{".*"},
+	SubjectLRegexes:  []string{".*"},
+	SubjectCRegexes:  []string{".*"},
+	DnsSanRegExs:     []string{`^.*\.example\.com$`},
+}
+
+func createCSR(t *testing.T, cn string) []byte {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: cn},
+		DNSNames: []string{cn},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+}
+
+func controllerTestSetup(t *testing.T) (*controller, *fakeKube, *fakeSigner, func()) {
+	origGetPolicy, origReport := getPolicy, reportToInventory
+	getPolicy = func(name string) (endpoint.Policy, error) {
+		if name != testZone {
+			return endpoint.Policy{}, common.PolicyNotFound
+		}
+		return testPolicy, nil
+	}
+	reportToInventory = func(r common.InventoryRecord) error { return nil }
+	kube, s := newFakeKube(), newFakeSigner(t)
+	c := &controller{kube: kube, signer: s, now: time.Now}
+	return c, kube, s, func() {
+		getPolicy, reportToInventory = origGetPolicy, origReport
+	}
+}
+
+func addIssuer(t *testing.T, kube *fakeKube, kind, namespace, name string, spec issuerSpec) {
+	iss := issuer{
+		APIVersion: issuerGroup + "/" + issuerVersion,
+		Kind:       kind,
+		Metadata:   objectMeta{Name: name, Namespace: namespace, Generation: 1},
+		Spec:       spec,
+	}
+	kube.put(t, kind, &iss.Metadata, &iss)
+}
+
+func addCertificateRequest(t *testing.T, kube *fakeKube, name string, ref issuerRef, csr []byte, approved bool) {
+	cr := certificateRequest{
+		APIVersion: "cert-manager.io/v1",
+		Kind:       "CertificateRequest",
+		Metadata:   objectMeta{Name: name, Namespace: "apps", UID: "uid-" + name},
+		Spec:       certificateRequestSpec{Request: csr, IssuerRef: ref, Duration: "2160h0m0s"},
+	}
+	if approved {
+		cr.Status.Conditions = []condition{{Type: conditionApproved, Status: conditionTrue, Reason: "cert-manager.io"}}
+	}
+	kube.put(t, "CertificateRequest", &cr.Metadata, &cr)
+}
+
+func readyCondition(t *testing.T, conditions []condition) condition {
+	c, ok := findCondition(conditions, conditionReady)
+	if !ok {
+		t.Fatal("Ready condition is not set")
+	}
+	return c
+}
+
+func TestReconcileIssuers(t *testing.T) {
+	c, kube, s, cleanup := controllerTestSetup(t)
+	defer cleanup()
+	otherCA := testCAArn + "-other"
+	s.missing[otherCA] = true
+	addIssuer(t, kube, kindIssuer, "apps", "good", issuerSpec{Zone: testZone, CertificateAuthorityArn: testCAArn})
+	addIssuer(t, kube, kindIssuer, "apps", "no-policy", issuerSpec{Zone: "Unknown", CertificateAuthorityArn: testCAArn})
+	addIssuer(t, kube, kindIssuer, "apps", "no-ca", issuerSpec{Zone: testZone, CertificateAuthorityArn: otherCA})
+	addIssuer(t, kube, kindClusterIssuer, "", "cluster", issuerSpec{Zone: testZone, CertificateAuthorityArn: testCAArn})
+
+	if err := c.reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"good": conditionTrue, "no-policy": conditionFalse, "no-ca": conditionFalse}
+	for name, status := range expected {
+		iss, _ := kube.GetIssuer(context.Background(), kindIssuer, "apps", name)
+		if ready := readyCondition(t, iss.Status.Conditions); ready.Status != status || ready.ObservedGeneration != 1 {
+			t.Fatalf("issuer %s should have Ready %s, got %+v", name, status, ready)
+		}
+	}
+	iss, _ := kube.GetIssuer(context.Background(), kindClusterIssuer, "", "cluster")
+	if ready := readyCondition(t, iss.Status.Conditions); ready.Status != conditionTrue {
+		t.Fatalf("cluster issuer should be ready, got %+v", ready)
+	}
+
+	// unchanged status is not written again
+	version := iss.Metadata.ResourceVersion
+	if err := c.reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	iss, _ = kube.GetIssuer(context.Background(), kindClusterIssuer, "", "cluster")
+	if iss.Metadata.ResourceVersion != version {
+		t.Fatal("issuer status should be updated only when it changes")
+	}
+}
+
+func TestReconcileCertificateRequests(t *testing.T) {
+	c, kube, s, cleanup := controllerTestSetup(t)
+	defer cleanup()
+	addIssuer(t, kube, kindIssuer, "apps", "venafi", issuerSpec{Zone: testZone, CertificateAuthorityArn: testCAArn})
+	addIssuer(t, kube, kindClusterIssuer, "", "venafi-cluster", issuerSpec{Zone: testZone, CertificateAuthorityArn: testCAArn})
+
+	ref := issuerRef{Name: "venafi", Kind: kindIssuer, Group: issuerGroup}
+	addCertificateRequest(t, kube, "web", ref, createCSR(t, "web.example.com"), true)
+	addCertificateRequest(t, kube, "cluster-web", issuerRef{Name: "venafi-cluster", Kind: kindClusterIssuer, Group: issuerGroup}, createCSR(t, "api.example.com"), true)
+	addCertificateRequest(t, kube, "violation", ref, createCSR(t, "web.example.org"), true)
+	addCertificateRequest(t, kube, "unapproved", ref, createCSR(t, "web.example.com"), false)
+	addCertificateRequest(t, kube, "missing-issuer", issuerRef{Name: "other", Group: issuerGroup}, createCSR(t, "web.example.com"), true)
+	addCertificateRequest(t, kube, "other-group", issuerRef{Name: "venafi", Kind: kindIssuer, Group: "cert-manager.io"}, createCSR(t, "web.example.com"), true)
+	denied := certificateRequest{
+		Metadata: objectMeta{Name: "denied", Namespace: "apps", UID: "denied"},
+		Spec:     certificateRequestSpec{Request: createCSR(t, "web.example.com"), IssuerRef: ref},
+		Status:   certificateRequestStatus{Conditions: []condition{{Type: conditionDenied, Status: conditionTrue}}},
+	}
+	kube.put(t, "CertificateRequest", &denied.Metadata, &denied)
+
+	// issuers are reconciled first, so requests are signed in the same pass
+	ctx := context.Background()
+	if err := c.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"web", "cluster-web"} {
+		cr := kube.certificateRequest(t, "apps", name)
+		if ready := readyCondition(t, cr.Status.Conditions); ready.Status != conditionTrue || ready.Reason != reasonIssued {
+			t.Fatalf("request %s should be issued, got %+v", name, ready)
+		}
+		block, rest := pem.Decode(cr.Status.Certificate)
+		if block == nil {
+			t.Fatalf("request %s has no certificate", name)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = cert.CheckSignatureFrom(s.caCert); err != nil {
+			t.Fatalf("certificate should be signed by the CA: %s", err)
+		}
+		if chain, _ := pem.Decode(rest); chain == nil || string(cr.Status.CA) != s.caPEM() {
+			t.Fatalf("request %s should have CA chain and CA", name)
+		}
+	}
+	if s.days[0] != 90 {
+		t.Fatalf("2160h duration should be 90 days, got %d", s.days[0])
+	}
+
+	expected := map[string]string{"violation": reasonFailed, "missing-issuer": reasonPending, "denied": reasonDenied}
+	for name, reason := range expected {
+		cr := kube.certificateRequest(t, "apps", name)
+		if ready := readyCondition(t, cr.Status.Conditions); ready.Status != conditionFalse || ready.Reason != reason {
+			t.Fatalf("request %s should be %s, got %+v", name, reason, ready)
+		}
+		if (reason == reasonFailed || reason == reasonDenied) && cr.Status.FailureTime == "" {
+			t.Fatalf("request %s should have failure time", name)
+		}
+	}
+	for _, name := range []string{"unapproved", "other-group"} {
+		if _, ok := findCondition(kube.certificateRequest(t, "apps", name).Status.Conditions, conditionReady); ok {
+			t.Fatalf("request %s should be left alone", name)
+		}
+	}
+
+	// issued and failed requests are not signed again
+	signed := len(s.tokens)
+	if err := c.reconcile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.tokens) != signed {
+		t.Fatalf("finished requests should not be signed again, got %d signatures", len(s.tokens)-signed)
+	}
+}
+
+func TestSetCondition(t *testing.T) {
+	first := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	conditions, changed := setCondition(nil, condition{Type: conditionReady, Status: conditionFalse, Reason: reasonPending}, first)
+	if !changed || len(conditions) != 1 {
+		t.Fatal("new condition should be added")
+	}
+	conditions, changed = setCondition(conditions, condition{Type: conditionReady, Status: conditionFalse, Reason: reasonPending}, first.Add(time.Hour))
+	if changed {
+		t.Fatal("the same condition should not be changed")
+	}
+	conditions, changed = setCondition(conditions, condition{Type: conditionReady, Status: conditionFalse, Reason: reasonFailed}, first.Add(time.Hour))
+	if !changed || conditions[0].LastTransitionTime != first.Format(time.RFC3339) {
+		t.Fatalf("transition time should be kept while status is the same, got %+v", conditions[0])
+	}
+	conditions, _ = setCondition(conditions, condition{Type: conditionReady, Status: conditionTrue, Reason: reasonIssued}, first.Add(time.Hour))
+	if conditions[0].LastTransitionTime != first.Add(time.Hour).Format(time.RFC3339) {
+		t.Fatalf("transition time should change with status, got %+v", conditions[0])
+	}
+}
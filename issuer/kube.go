@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	issuerGroup   = "awspca.venafi.com"
+	issuerVersion = "v1alpha1"
+
+	kindIssuer        = "Issuer"
+	kindClusterIssuer = "ClusterIssuer"
+
+	certManagerAPI = "/apis/cert-manager.io/v1"
+
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+var (
+	errNotFound = errors.New("not found")
+	errConflict = errors.New("object has been modified")
+)
+
+type objectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace,omitempty"`
+	UID             string            `json:"uid,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Generation      int64             `json:"generation,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+}
+
+// condition is the status condition shared by issuers and certificate requests.
+type condition struct {
+	Type               string `json:"type"`
+	Status             string `json:"status"`
+	Reason             string `json:"reason,omitempty"`
+	Message            string `json:"message,omitempty"`
+	LastTransitionTime string `json:"lastTransitionTime,omitempty"`
+	ObservedGeneration int64  `json:"observedGeneration,omitempty"`
+}
+
+// issuerSpec references the Venafi zone which policy certificates are checked against and the ACM-PCA
+// certificate authority which issues them.
+type issuerSpec struct {
+	Zone                    string `json:"zone"`
+	CertificateAuthorityArn string `json:"certificateAuthorityArn"`
+	// SigningAlgorithm overrides the algorithm chosen from the CA key type
+	SigningAlgorithm string `json:"signingAlgorithm,omitempty"`
+}
+
+type issuerStatus struct {
+	Conditions []condition `json:"conditions,omitempty"`
+}
+
+// issuer is Issuer or ClusterIssuer resource of the awspca.venafi.com group.
+type issuer struct {
+	APIVersion string       `json:"apiVersion"`
+	Kind       string       `json:"kind"`
+	Metadata   objectMeta   `json:"metadata"`
+	Spec       issuerSpec   `json:"spec"`
+	Status     issuerStatus `json:"status,omitempty"`
+}
+
+type issuerRef struct {
+	Name  string `json:"name"`
+	Kind  string `json:"kind,omitempty"`
+	Group string `json:"group,omitempty"`
+}
+
+type certificateRequestSpec struct {
+	// Request is PEM encoded CSR
+	Request   []byte    `json:"request"`
+	IssuerRef issuerRef `json:"issuerRef"`
+	// Duration is Go duration string, such as "2160h0m0s"
+	Duration string   `json:"duration,omitempty"`
+	IsCA     bool     `json:"isCA,omitempty"`
+	Usages   []string `json:"usages,omitempty"`
+}
+
+type certificateRequestStatus struct {
+	Conditions  []condition `json:"conditions,omitempty"`
+	Certificate []byte      `json:"certificate,omitempty"`
+	CA          []byte      `json:"ca,omitempty"`
+	FailureTime string      `json:"failureTime,omitempty"`
+}
+
+// certificateRequest is cert-manager CertificateRequest resource. Only fields used by the controller are kept,
+// the status subresource is replaced as a whole, so unknown status fields would be lost.
+type certificateRequest struct {
+	APIVersion string                   `json:"apiVersion"`
+	Kind       string                   `json:"kind"`
+	Metadata   objectMeta               `json:"metadata"`
+	Spec       certificateRequestSpec   `json:"spec"`
+	Status     certificateRequestStatus `json:"status,omitempty"`
+}
+
+// kubeClient is the part of Kubernetes API used by the controller. Tests replace it with a fake.
+type kubeClient interface {
+	ListIssuers(ctx context.Context, kind string) ([]issuer, error)
+	GetIssuer(ctx context.Context, kind, namespace, name string) (issuer, error)
+	UpdateIssuerStatus(ctx context.Context, iss issuer) error
+	ListCertificateRequests(ctx context.Context) ([]certificateRequest, error)
+	UpdateCertificateRequestStatus(ctx context.Context, cr certificateRequest) error
+}
+
+// restKubeClient calls Kubernetes REST API with the service account credentials of the pod.
+type restKubeClient struct {
+	host   string
+	token  string
+	client *http.Client
+}
+
+// newInClusterKubeClient returns client for the API server of the cluster the controller runs in.
+func newInClusterKubeClient() (*restKubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set, controller has to run in cluster")
+	}
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("can't read service account token: %s", err)
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("can't read cluster CA: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("cluster CA file has no certificates")
+	}
+	return &restKubeClient{
+		host:  "https://" + net.JoinHostPort(host, port),
+		token: strings.TrimSpace(string(token)),
+		client: &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}},
+	}, nil
+}
+
+func issuerPath(kind, namespace, name string) string {
+	path := "/apis/" + issuerGroup + "/" + issuerVersion
+	if kind == kindClusterIssuer {
+		path += "/clusterissuers"
+	} else {
+		if namespace != "" {
+			path += "/namespaces/" + namespace
+		}
+		path += "/issuers"
+	}
+	if name != "" {
+		path += "/" + name
+	}
+	return path
+}
+
+func (c *restKubeClient) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		body, err = json.Marshal(in)
+		if err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, c.host+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return errNotFound
+	case resp.StatusCode == http.StatusConflict:
+		return errConflict
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("%s %s returned %d: %s", method, path, resp.StatusCode, b)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
+
+func (c *restKubeClient) ListIssuers(ctx context.Context, kind string) ([]issuer, error) {
+	var list struct {
+		Items []issuer `json:"items"`
+	}
+	err := c.do(ctx, http.MethodGet, issuerPath(kind, "", ""), nil, &list)
+	for i := range list.Items {
+		// list items don't have kind and apiVersion
+		list.Items[i].Kind = kind
+		list.Items[i].APIVersion = issuerGroup + "/" + issuerVersion
+	}
+	return list.Items, err
+}
+
+func (c *restKubeClient) GetIssuer(ctx context.Context, kind, namespace, name string) (issuer, error) {
+	var iss issuer
+	err := c.do(ctx, http.MethodGet, issuerPath(kind, namespace, name), nil, &iss)
+	return iss, err
+}
+
+func (c *restKubeClient) UpdateIssuerStatus(ctx context.Context, iss issuer) error {
+	return c.do(ctx, http.MethodPut, issuerPath(iss.Kind, iss.Metadata.Namespace, iss.Metadata.Name)+"/status", iss, nil)
+}
+
+func (c *restKubeClient) ListCertificateRequests(ctx context.Context) ([]certificateRequest, error) {
+	var list struct {
+		Items []certificateRequest `json:"items"`
+	}
+	err := c.do(ctx, http.MethodGet, certManagerAPI+"/certificaterequests", nil, &list)
+	for i := range list.Items {
+		list.Items[i].Kind = "CertificateRequest"
+		list.Items[i].APIVersion = "cert-manager.io/v1"
+	}
+	return list.Items, err
+}
+
+func (c *restKubeClient) UpdateCertificateRequestStatus(ctx context.Context, cr certificateRequest) error {
+	path := fmt.Sprintf("%s/namespaces/%s/certificaterequests/%s/status", certManagerAPI, cr.Metadata.Namespace, cr.Metadata.Name)
+	return c.do(ctx, http.MethodPut, path, cr, nil)
+}
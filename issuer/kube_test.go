@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRESTKubeClient(t *testing.T) {
+	var updated []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/apis/awspca.venafi.com/v1alpha1/clusterissuers":
+			_, _ = w.Write([]byte(`{"items":[{"metadata":{"name":"venafi","resourceVersion":"7"},"spec":{"zone":"Default","certificateAuthorityArn":"arn"}}]}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/apis/awspca.venafi.com/v1alpha1/namespaces/apps/issuers/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodPut && r.URL.Path == "/apis/awspca.venafi.com/v1alpha1/clusterissuers/venafi/status":
+			w.WriteHeader(http.StatusConflict)
+		case r.Method == http.MethodPut && r.URL.Path == "/apis/cert-manager.io/v1/namespaces/apps/certificaterequests/web/status":
+			b, _ := ioutil.ReadAll(r.Body)
+			var cr certificateRequest
+			if err := json.Unmarshal(b, &cr); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			updated = append(updated, string(cr.Status.Certificate))
+			_, _ = w.Write(b)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	kube := &restKubeClient{host: srv.URL, token: "test-token", client: srv.Client()}
+	ctx := context.Background()
+
+	issuers, err := kube.ListIssuers(ctx, kindClusterIssuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issuers) != 1 || issuers[0].Kind != kindClusterIssuer || issuers[0].Spec.Zone != "Default" {
+		t.Fatalf("unexpected cluster issuers: %+v", issuers)
+	}
+	if _, err = kube.GetIssuer(ctx, kindIssuer, "apps", "missing"); err != errNotFound {
+		t.Fatalf("missing issuer should return errNotFound, got %v", err)
+	}
+	if err = kube.UpdateIssuerStatus(ctx, issuers[0]); err != errConflict {
+		t.Fatalf("stale issuer update should return errConflict, got %v", err)
+	}
+	cr := certificateRequest{Metadata: objectMeta{Name: "web", Namespace: "apps"}}
+	cr.Status.Certificate = []byte("certificate")
+	if err = kube.UpdateCertificateRequestStatus(ctx, cr); err != nil {
+		t.Fatal(err)
+	}
+	if len(updated) != 1 || updated[0] != "certificate" {
+		t.Fatalf("certificate request status should be updated, got %v", updated)
+	}
+}
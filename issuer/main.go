@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws/external"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const defaultResyncInterval = 10 * time.Second
+
+// resyncInterval returns RESYNC_INTERVAL Go duration or the default.
+func resyncInterval() time.Duration {
+	s := os.Getenv("RESYNC_INTERVAL")
+	if s == "" {
+		return defaultResyncInterval
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		log.Printf("Ignoring bad RESYNC_INTERVAL value %q", s)
+		return defaultResyncInterval
+	}
+	return d
+}
+
+func main() {
+	log.Println("Starting cert-manager issuer controller.")
+	kube, err := newInClusterKubeClient()
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	awsCfg, err := external.LoadDefaultAWSConfig()
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	c := &controller{kube: kube, signer: newPCASigner(awsCfg), now: time.Now}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-stop
+		log.Println("Stopping cert-manager issuer controller.")
+		cancel()
+	}()
+	c.run(ctx, resyncInterval())
+}
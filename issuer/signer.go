@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/arn"
+	"github.com/aws/aws-sdk-go-v2/service/acmpca"
+	"sync"
+	"time"
+)
+
+const (
+	issueWaitDelay    = time.Second
+	issueWaitAttempts = 60
+)
+
+// signer issues certificates for policy-checked CSRs. Tests replace it with a fake.
+type signer interface {
+	// CACertificate returns PEM encoded certificate of the CA and its chain.
+	CACertificate(ctx context.Context, caArn string) (string, string, error)
+	// Sign issues the certificate and returns its ARN and PEM encoded certificate and chain. Requests with
+	// the same token return the same certificate.
+	Sign(ctx context.Context, spec issuerSpec, csr []byte, validityDays int64, token string) (certArn, cert, chain string, err error)
+}
+
+// pcaSigner issues certificates with ACM-PCA. The CA region is taken from its ARN, so one controller can serve
+// issuers of CAs in different regions.
+type pcaSigner struct {
+	sync.Mutex
+	cfg     aws.Config
+	clients map[string]*acmpca.Client
+}
+
+func newPCASigner(cfg aws.Config) *pcaSigner {
+	return &pcaSigner{cfg: cfg, clients: map[string]*acmpca.Client{}}
+}
+
+func (s *pcaSigner) client(caArn string) (*acmpca.Client, error) {
+	parsed, err := arn.Parse(caArn)
+	if err != nil {
+		return nil, fmt.Errorf("bad certificate authority ARN %q: %s", caArn, err)
+	}
+	s.Lock()
+	defer s.Unlock()
+	cli, ok := s.clients[parsed.Region]
+	if !ok {
+		cfg := s.cfg.Copy()
+		cfg.Region = parsed.Region
+		cli = acmpca.New(cfg)
+		s.clients[parsed.Region] = cli
+	}
+	return cli, nil
+}
+
+func (s *pcaSigner) CACertificate(ctx context.Context, caArn string) (string, string, error) {
+	cli, err := s.client(caArn)
+	if err != nil {
+		return "", "", err
+	}
+	resp, err := cli.GetCertificateAuthorityCertificateRequest(&acmpca.GetCertificateAuthorityCertificateInput{
+		CertificateAuthorityArn: aws.String(caArn),
+	}).Send(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	return aws.StringValue(resp.Certificate), aws.StringValue(resp.CertificateChain), nil
+}
+
+// signingAlgorithm returns ACM-PCA signing algorithm for the CA key type, ACM-PCA signs with the CA key.
+func (s *pcaSigner) signingAlgorithm(ctx context.Context, spec issuerSpec) (acmpca.SigningAlgorithm, error) {
+	if spec.SigningAlgorithm != "" {
+		return acmpca.SigningAlgorithm(spec.SigningAlgorithm), nil
+	}
+	certPEM, _, err := s.CACertificate(ctx, spec.CertificateAuthorityArn)
+	if err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		return "", fmt.Errorf("CA certificate is not PEM encoded")
+	}
+	ca, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	switch ca.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		return acmpca.SigningAlgorithmSha256withecdsa, nil
+	case *rsa.PublicKey:
+		return acmpca.SigningAlgorithmSha256withrsa, nil
+	}
+	return "", fmt.Errorf("unsupported CA key type %T", ca.PublicKey)
+}
+
+func (s *pcaSigner) Sign(ctx context.Context, spec issuerSpec, csr []byte, validityDays int64, token string) (string, string, string, error) {
+	cli, err := s.client(spec.CertificateAuthorityArn)
+	if err != nil {
+		return "", "", "", err
+	}
+	alg, err := s.signingAlgorithm(ctx, spec)
+	if err != nil {
+		return "", "", "", fmt.Errorf("can't get certificate authority: %s", err)
+	}
+	issued, err := cli.IssueCertificateRequest(&acmpca.IssueCertificateInput{
+		CertificateAuthorityArn: aws.String(spec.CertificateAuthorityArn),
+		Csr:                     csr,
+		SigningAlgorithm:        alg,
+		Validity:                &acmpca.Validity{Type: acmpca.ValidityPeriodTypeDays, Value: aws.Int64(validityDays)},
+		IdempotencyToken:        aws.String(token),
+	}).Send(ctx)
+	if err != nil {
+		return "", "", "", err
+	}
+	get := &acmpca.GetCertificateInput{
+		CertificateArn:          issued.CertificateArn,
+		CertificateAuthorityArn: aws.String(spec.CertificateAuthorityArn),
+	}
+	err = cli.WaitUntilCertificateIssued(ctx, get, aws.WithWaiterMaxAttempts(issueWaitAttempts),
+		aws.WithWaiterDelay(aws.ConstantWaiterDelay(issueWaitDelay)))
+	if err != nil {
+		return "", "", "", fmt.Errorf("certificate %s is not issued: %s", aws.StringValue(issued.CertificateArn), err)
+	}
+	resp, err := cli.GetCertificateRequest(get).Send(ctx)
+	if err != nil {
+		return "", "", "", err
+	}
+	return aws.StringValue(issued.CertificateArn), aws.StringValue(resp.Certificate), aws.StringValue(resp.CertificateChain), nil
+}
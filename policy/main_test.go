@@ -11,7 +11,7 @@ import (
 
 func TestHandleRequestCloud(t *testing.T) {
 	var err error
-	vcertConnector, err = getConnection("", "", "", "", "", os.Getenv("CLOUDAPIKEY"), "")
+	vcertConnector, err = common.GetConnection("", "", "", "", "", os.Getenv("CLOUDAPIKEY"), "")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -28,7 +28,7 @@ func TestHandleRequestTPP(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	vcertConnector, err = getConnection(os.Getenv("TPPURL"), os.Getenv("TPPUSER"), os.Getenv("TPPPASSWORD"), "", "", "", base64.StdEncoding.EncodeToString(trustBundle))
+	vcertConnector, err = common.GetConnection(os.Getenv("TPPURL"), os.Getenv("TPPUSER"), os.Getenv("TPPPASSWORD"), "", "", "", base64.StdEncoding.EncodeToString(trustBundle))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -45,7 +45,7 @@ func TestHandleRequestTPPToken(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	vcertConnector, err = getConnection(os.Getenv("TPP_TOKEN_URL"), "", "", os.Getenv("TPP_ACCESS_TOKEN"), os.Getenv("TPP_REFRESH_TOKEN"), "", base64.StdEncoding.EncodeToString(trustBundle))
+	vcertConnector, err = common.GetConnection(os.Getenv("TPP_TOKEN_URL"), "", "", os.Getenv("TPP_ACCESS_TOKEN"), os.Getenv("TPP_REFRESH_TOKEN"), "", base64.StdEncoding.EncodeToString(trustBundle))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,1121 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/acmpca"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	acmePrefix        = "/acme"
+	acmeDirectoryPath = "/directory"
+	acmeNoncePath     = "/new-nonce"
+	acmeAccountPath   = "/new-account"
+	acmeOrderPath     = "/new-order"
+	acmeRevokePath    = "/revoke-cert"
+
+	acmeNonceTTL = time.Hour
+	acmeOrderTTL = 7 * 24 * time.Hour
+	// acmeAccountTTL is effectively forever, accounts are only deactivated
+	acmeAccountTTL = 100 * 365 * 24 * time.Hour
+
+	acmeIssueWait = 5 * time.Second
+
+	acmeProblemPrefix = "urn:ietf:params:acme:error:"
+)
+
+// ACME object statuses (RFC 8555 section 7.1.6).
+const (
+	acmeStatusPending     = "pending"
+	acmeStatusReady       = "ready"
+	acmeStatusProcessing  = "processing"
+	acmeStatusValid       = "valid"
+	acmeStatusInvalid     = "invalid"
+	acmeStatusDeactivated = "deactivated"
+)
+
+// ACME store object kinds.
+const (
+	acmeKindNonce       = "nonce"
+	acmeKindAccount     = "account"
+	acmeKindAccountKey  = "account-key"
+	acmeKindOrder       = "order"
+	acmeKindAuthz       = "authz"
+	acmeKindCertificate = "certificate"
+)
+
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+	// retryAfter is sent as Retry-After header of rateLimited problems
+	retryAfter string
+}
+
+func (p *acmeProblem) Error() string {
+	return p.Detail
+}
+
+func acmeError(status int, problem, format string, args ...interface{}) *acmeProblem {
+	return &acmeProblem{Type: acmeProblemPrefix + problem, Detail: fmt.Sprintf(format, args...), Status: status}
+}
+
+// acmeEABKey is External Account Binding key issued to ACME users out of band. Accounts registered with it
+// request certificates from its zone.
+type acmeEABKey struct {
+	// HMACKey is base64url encoded
+	HMACKey string `json:"HMACKey"`
+	Zone    string `json:"Zone"`
+}
+
+type acmeAccount struct {
+	ID         string     `json:"id"`
+	Status     string     `json:"status"`
+	Contact    []string   `json:"contact,omitempty"`
+	Key        jsonWebKey `json:"key"`
+	Zone       string     `json:"zone,omitempty"`
+	EABKeyID   string     `json:"eabKeyId,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	Thumbprint string     `json:"thumbprint"`
+}
+
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type acmeOrder struct {
+	ID             string           `json:"id"`
+	AccountID      string           `json:"accountId"`
+	Status         string           `json:"status"`
+	Expires        time.Time        `json:"expires"`
+	Identifiers    []acmeIdentifier `json:"identifiers"`
+	Authorizations []string         `json:"authorizations"`
+	Error          *acmeProblem     `json:"error,omitempty"`
+	CertificateArn string           `json:"certificateArn,omitempty"`
+}
+
+type acmeChallenge struct {
+	Type      string       `json:"type"`
+	Token     string       `json:"token"`
+	Status    string       `json:"status"`
+	Validated *time.Time   `json:"validated,omitempty"`
+	Error     *acmeProblem `json:"error,omitempty"`
+}
+
+type acmeAuthz struct {
+	ID         string          `json:"id"`
+	AccountID  string          `json:"accountId"`
+	OrderID    string          `json:"orderId"`
+	Status     string          `json:"status"`
+	Expires    time.Time       `json:"expires"`
+	Identifier acmeIdentifier  `json:"identifier"`
+	Wildcard   bool            `json:"wildcard,omitempty"`
+	Challenges []acmeChallenge `json:"challenges"`
+}
+
+// acmeCertificate links issued certificate serial to the account for revocation.
+type acmeCertificate struct {
+	AccountID      string `json:"accountId"`
+	CertificateArn string `json:"certificateArn"`
+}
+
+// acmeServer implements ACME (RFC 8555) on top of the request handler, so finalized orders go through the same zone
+// policy check, audit and limits as IssueCertificate requests.
+type acmeServer struct {
+	store        common.ACMEStore
+	caArn        string
+	baseURL      string
+	validityDays int64
+	eabKeys      map[string]acmeEABKey
+	// httpGet and lookupTXT are used to validate http-01 and dns-01 challenges
+	httpGet   func(url string) ([]byte, error)
+	lookupTXT func(name string) ([]string, error)
+}
+
+// newACMEServerFromEnv returns ACME server for ACME_CA_ARN or nil if ACME is disabled.
+func newACMEServerFromEnv() (*acmeServer, error) {
+	caArn := os.Getenv("ACME_CA_ARN")
+	if caArn == "" {
+		return nil, nil
+	}
+	s := &acmeServer{
+		store:        common.NewACMEStoreFromEnv(),
+		caArn:        caArn,
+		baseURL:      strings.TrimSuffix(os.Getenv("ACME_BASE_URL"), "/"),
+		validityDays: 90,
+		httpGet:      acmeHTTPGet,
+		lookupTXT:    net.LookupTXT,
+	}
+	if s.store == nil {
+		log.Println("ACME_TABLE is not set, ACME state is kept in memory")
+		s.store = common.NewMemoryACMEStore()
+	}
+	if v := os.Getenv("ACME_VALIDITY_DAYS"); v != "" {
+		days, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || days < 1 {
+			return nil, fmt.Errorf("bad ACME_VALIDITY_DAYS value %q", v)
+		}
+		s.validityDays = days
+	}
+	if f := os.Getenv("ACME_EAB_KEYS_FILE"); f != "" {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("can't read ACME_EAB_KEYS_FILE: %s", err)
+		}
+		err = json.Unmarshal(b, &s.eabKeys)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse ACME_EAB_KEYS_FILE: %s", err)
+		}
+	}
+	return s, nil
+}
+
+// acmeBlockedNetworks are private, loopback, link-local and other non-public networks http-01 validation doesn't
+// connect to, so challenges can't be used to reach the metadata service or internal hosts of the server.
+var acmeBlockedNetworks = parseNetworks(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+	"192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/3",
+	"::/128", "::1/128", "64:ff9b::/96", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = n
+	}
+	return networks
+}
+
+// publicAddress reports whether the address is outside of acmeBlockedNetworks.
+func publicAddress(ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	for _, n := range acmeBlockedNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// dialPublic refuses connections to non-public addresses. It's checked after name resolution, for every
+// connection including redirects, so names resolving or rebinding to private addresses are refused too.
+func dialPublic(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicAddress(ip) {
+		return fmt.Errorf("%s is not a public address", host)
+	}
+	return nil
+}
+
+func acmeHTTPGet(url string) ([]byte, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: dialPublic}
+	cli := http.Client{Timeout: 10 * time.Second, Transport: &http.Transport{DialContext: dialer.DialContext}}
+	resp, err := cli.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
+}
+
+func newACMEID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (s *acmeServer) url(r *http.Request, path string) string {
+	base := s.baseURL
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host + acmePrefix
+	}
+	return base + path
+}
+
+func (s *acmeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, acmePrefix)
+	w.Header().Set("Link", fmt.Sprintf("<%s>;rel=\"index\"", s.url(r, acmeDirectoryPath)))
+	if err := s.setNonce(w); err != nil {
+		s.writeProblem(w, acmeError(http.StatusInternalServerError, "serverInternal", "can't create nonce: %s", err))
+		return
+	}
+	switch {
+	case path == acmeDirectoryPath && r.Method == http.MethodGet:
+		s.directory(w, r)
+		return
+	case path == acmeNoncePath && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		w.Header().Set("Cache-Control", "no-store")
+		if r.Method == http.MethodGet {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	case r.Method != http.MethodPost:
+		s.writeProblem(w, acmeError(http.StatusMethodNotAllowed, "malformed", "method %s is not allowed", r.Method))
+		return
+	}
+
+	var err error
+	switch parts := strings.Split(strings.Trim(path, "/"), "/"); {
+	case path == acmeAccountPath:
+		err = s.newAccount(w, r)
+	case path == acmeOrderPath:
+		err = s.newOrder(w, r)
+	case path == acmeRevokePath:
+		err = s.revoke(w, r)
+	case len(parts) == 2 && parts[0] == "account":
+		err = s.account(w, r, parts[1])
+	case len(parts) == 2 && parts[0] == "order":
+		err = s.order(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "order" && parts[2] == "finalize":
+		err = s.finalize(w, r, parts[1])
+	case len(parts) == 2 && parts[0] == "authz":
+		err = s.authz(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "chall":
+		err = s.challenge(w, r, parts[1], parts[2])
+	case len(parts) == 2 && parts[0] == "cert":
+		err = s.certificate(w, r, parts[1])
+	default:
+		err = acmeError(http.StatusNotFound, "malformed", "unknown resource %s", path)
+	}
+	if err != nil {
+		problem, ok := err.(*acmeProblem)
+		if !ok {
+			log.Println("ACME error:", err)
+			problem = acmeError(http.StatusInternalServerError, "serverInternal", "%s", err)
+		}
+		s.writeProblem(w, problem)
+	}
+}
+
+func (s *acmeServer) setNonce(w http.ResponseWriter) error {
+	nonce := newACMEID()
+	err := s.store.Put(acmeKindNonce, nonce, struct{}{}, time.Now().Add(acmeNonceTTL))
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Replay-Nonce", nonce)
+	return nil
+}
+
+func (s *acmeServer) writeProblem(w http.ResponseWriter, p *acmeProblem) {
+	if p.retryAfter != "" {
+		w.Header().Set("Retry-After", p.retryAfter)
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	_ = json.NewEncoder(w).Encode(p)
+}
+
+func writeACMEJSON(w http.ResponseWriter, status int, location string, v interface{}) error {
+	if location != "" {
+		w.Header().Set("Location", location)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
+
+func (s *acmeServer) directory(w http.ResponseWriter, r *http.Request) {
+	_ = writeACMEJSON(w, http.StatusOK, "", map[string]interface{}{
+		"newNonce":   s.url(r, acmeNoncePath),
+		"newAccount": s.url(r, acmeAccountPath),
+		"newOrder":   s.url(r, acmeOrderPath),
+		"revokeCert": s.url(r, acmeRevokePath),
+		"meta": map[string]interface{}{
+			"externalAccountRequired": len(s.eabKeys) > 0,
+		},
+	})
+}
+
+// acmeRequest is verified JWS request.
+type acmeRequest struct {
+	header  jwsHeader
+	payload []byte
+	// account is set for requests signed with kid
+	account *acmeAccount
+}
+
+// postAsGet reports whether the request is POST-as-GET with empty payload.
+func (req acmeRequest) postAsGet() bool {
+	return len(req.payload) == 0
+}
+
+// verifyRequest checks JWS of POST request: URL, nonce and signature. Only new-account requests are signed with jwk,
+// other requests are signed with the account key referenced by kid.
+func (s *acmeServer) verifyRequest(r *http.Request, path string, withJWK bool) (req acmeRequest, msg jwsMessage, err error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRequestBodySize))
+	if err != nil {
+		return req, msg, acmeError(http.StatusBadRequest, "malformed", "can't read request: %s", err)
+	}
+	err = json.Unmarshal(body, &msg)
+	if err != nil {
+		return req, msg, acmeError(http.StatusBadRequest, "malformed", "request is not JWS: %s", err)
+	}
+	req.header, err = msg.header()
+	if err != nil {
+		return req, msg, acmeError(http.StatusBadRequest, "malformed", "%s", err)
+	}
+	if req.header.URL != s.url(r, path) {
+		return req, msg, acmeError(http.StatusUnauthorized, "unauthorized", "JWS url %s doesn't match request URL", req.header.URL)
+	}
+	ok, err := s.store.Take(acmeKindNonce, req.header.Nonce)
+	if err != nil {
+		return req, msg, err
+	}
+	if !ok {
+		return req, msg, acmeError(http.StatusBadRequest, "badNonce", "nonce %q is not valid", req.header.Nonce)
+	}
+
+	var key jsonWebKey
+	switch {
+	case withJWK && req.header.JWK != nil && req.header.Kid == "":
+		key = *req.header.JWK
+	case !withJWK && req.header.JWK == nil && req.header.Kid != "":
+		id := strings.TrimPrefix(req.header.Kid, s.url(r, "/account/"))
+		var account acmeAccount
+		err = s.store.Get(acmeKindAccount, id, &account)
+		if err == common.ACMEObjectNotFound {
+			return req, msg, acmeError(http.StatusBadRequest, "accountDoesNotExist", "account %s doesn't exist", req.header.Kid)
+		} else if err != nil {
+			return req, msg, err
+		}
+		if account.Status != acmeStatusValid {
+			return req, msg, acmeError(http.StatusUnauthorized, "unauthorized", "account is %s", account.Status)
+		}
+		req.account = &account
+		key = account.Key
+	default:
+		return req, msg, acmeError(http.StatusBadRequest, "malformed", "request should be signed with exactly one of jwk or kid")
+	}
+	pub, err := key.publicKey()
+	if err != nil {
+		return req, msg, acmeError(http.StatusBadRequest, "badPublicKey", "%s", err)
+	}
+	err = msg.verify(req.header.Alg, pub)
+	if err != nil {
+		return req, msg, acmeError(http.StatusBadRequest, "badSignatureAlgorithm", "%s", err)
+	}
+	req.payload, err = msg.payload()
+	if err != nil {
+		return req, msg, acmeError(http.StatusBadRequest, "malformed", "bad payload encoding")
+	}
+	return req, msg, nil
+}
+
+func (s *acmeServer) accountView(r *http.Request, a acmeAccount) interface{} {
+	return map[string]interface{}{
+		"status":  a.Status,
+		"contact": a.Contact,
+		"orders":  s.url(r, "/account/"+a.ID+"/orders"),
+	}
+}
+
+func (s *acmeServer) newAccount(w http.ResponseWriter, r *http.Request) error {
+	req, _, err := s.verifyRequest(r, acmeAccountPath, true)
+	if err != nil {
+		return err
+	}
+	var payload struct {
+		Contact                []string    `json:"contact"`
+		OnlyReturnExisting     bool        `json:"onlyReturnExisting"`
+		ExternalAccountBinding *jwsMessage `json:"externalAccountBinding"`
+	}
+	err = json.Unmarshal(req.payload, &payload)
+	if err != nil {
+		return acmeError(http.StatusBadRequest, "malformed", "bad account request: %s", err)
+	}
+	key := *req.header.JWK
+	thumbprint := key.thumbprint()
+
+	var existing string
+	err = s.store.Get(acmeKindAccountKey, thumbprint, &existing)
+	if err == nil {
+		var account acmeAccount
+		err = s.store.Get(acmeKindAccount, existing, &account)
+		if err != nil {
+			return err
+		}
+		return writeACMEJSON(w, http.StatusOK, s.url(r, "/account/"+account.ID), s.accountView(r, account))
+	} else if err != common.ACMEObjectNotFound {
+		return err
+	}
+	if payload.OnlyReturnExisting {
+		return acmeError(http.StatusBadRequest, "accountDoesNotExist", "no account for the key")
+	}
+
+	account := acmeAccount{
+		ID:         newACMEID(),
+		Status:     acmeStatusValid,
+		Contact:    payload.Contact,
+		Key:        key,
+		CreatedAt:  time.Now().UTC(),
+		Thumbprint: thumbprint,
+	}
+	if len(s.eabKeys) > 0 {
+		if payload.ExternalAccountBinding == nil {
+			return acmeError(http.StatusUnauthorized, "externalAccountRequired", "external account binding is required")
+		}
+		account.EABKeyID, account.Zone, err = s.verifyEAB(r, *payload.ExternalAccountBinding, thumbprint)
+		if err != nil {
+			return err
+		}
+	}
+	err = s.store.Put(acmeKindAccount, account.ID, account, time.Now().Add(acmeAccountTTL))
+	if err == nil {
+		err = s.store.Put(acmeKindAccountKey, thumbprint, account.ID, time.Now().Add(acmeAccountTTL))
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("ACME account %s registered, zone %q", account.ID, account.Zone)
+	return writeACMEJSON(w, http.StatusCreated, s.url(r, "/account/"+account.ID), s.accountView(r, account))
+}
+
+// verifyEAB checks that External Account Binding is signed with a known key and binds the account key.
+func (s *acmeServer) verifyEAB(r *http.Request, eab jwsMessage, thumbprint string) (kid, zone string, err error) {
+	h, err := eab.header()
+	if err != nil {
+		return "", "", acmeError(http.StatusBadRequest, "malformed", "external account binding: %s", err)
+	}
+	key, ok := s.eabKeys[h.Kid]
+	if h.Alg != "HS256" || !ok || h.URL != s.url(r, acmeAccountPath) || h.Nonce != "" {
+		return "", "", acmeError(http.StatusUnauthorized, "unauthorized", "external account binding is not valid")
+	}
+	hmacKey, err := b64.DecodeString(key.HMACKey)
+	if err == nil {
+		err = eab.verifyHMAC(hmacKey)
+	}
+	if err != nil {
+		return "", "", acmeError(http.StatusUnauthorized, "unauthorized", "%s", err)
+	}
+	var bound jsonWebKey
+	payload, err := eab.payload()
+	if err == nil {
+		err = json.Unmarshal(payload, &bound)
+	}
+	if err != nil || bound.thumbprint() != thumbprint {
+		return "", "", acmeError(http.StatusUnauthorized, "unauthorized", "external account binding is for another key")
+	}
+	return h.Kid, key.Zone, nil
+}
+
+func (s *acmeServer) account(w http.ResponseWriter, r *http.Request, id string) error {
+	req, _, err := s.verifyRequest(r, "/account/"+id, false)
+	if err != nil {
+		return err
+	}
+	if req.account.ID != id {
+		return acmeError(http.StatusUnauthorized, "unauthorized", "account doesn't match the key")
+	}
+	if !req.postAsGet() {
+		var payload struct {
+			Contact []string `json:"contact"`
+			Status  string   `json:"status"`
+		}
+		err = json.Unmarshal(req.payload, &payload)
+		if err != nil {
+			return acmeError(http.StatusBadRequest, "malformed", "bad account update: %s", err)
+		}
+		if payload.Contact != nil {
+			req.account.Contact = payload.Contact
+		}
+		switch payload.Status {
+		case "":
+		case acmeStatusDeactivated:
+			req.account.Status = acmeStatusDeactivated
+		default:
+			return acmeError(http.StatusBadRequest, "malformed", "account status can only be changed to deactivated")
+		}
+		err = s.store.Put(acmeKindAccount, id, req.account, time.Now().Add(acmeAccountTTL))
+		if err != nil {
+			return err
+		}
+	}
+	return writeACMEJSON(w, http.StatusOK, "", s.accountView(r, *req.account))
+}
+
+func (s *acmeServer) orderView(r *http.Request, o acmeOrder) interface{} {
+	authzs := make([]string, len(o.Authorizations))
+	for i, id := range o.Authorizations {
+		authzs[i] = s.url(r, "/authz/"+id)
+	}
+	v := map[string]interface{}{
+		"status":         o.Status,
+		"expires":        o.Expires.Format(time.RFC3339),
+		"identifiers":    o.Identifiers,
+		"authorizations": authzs,
+		"finalize":       s.url(r, "/order/"+o.ID+"/finalize"),
+	}
+	if o.Error != nil {
+		v["error"] = o.Error
+	}
+	if o.Status == acmeStatusValid {
+		v["certificate"] = s.url(r, "/cert/"+o.ID)
+	}
+	return v
+}
+
+func (s *acmeServer) newOrder(w http.ResponseWriter, r *http.Request) error {
+	req, _, err := s.verifyRequest(r, acmeOrderPath, false)
+	if err != nil {
+		return err
+	}
+	var payload struct {
+		Identifiers []acmeIdentifier `json:"identifiers"`
+	}
+	err = json.Unmarshal(req.payload, &payload)
+	if err != nil || len(payload.Identifiers) == 0 {
+		return acmeError(http.StatusBadRequest, "malformed", "order should have identifiers")
+	}
+	for i, id := range payload.Identifiers {
+		if id.Type != "dns" {
+			return acmeError(http.StatusBadRequest, "unsupportedIdentifier", "identifier type %s is not supported", id.Type)
+		}
+		payload.Identifiers[i].Value = strings.ToLower(strings.TrimSuffix(id.Value, "."))
+		if !validDNSName(payload.Identifiers[i].Value) {
+			return acmeError(http.StatusBadRequest, "rejectedIdentifier", "%q is not a DNS name", id.Value)
+		}
+	}
+	err = s.checkIdentifiers(r.Context(), req.account, payload.Identifiers)
+	if err != nil {
+		return err
+	}
+
+	expires := time.Now().Add(acmeOrderTTL).UTC()
+	order := acmeOrder{
+		ID:          newACMEID(),
+		AccountID:   req.account.ID,
+		Status:      acmeStatusPending,
+		Expires:     expires,
+		Identifiers: payload.Identifiers,
+	}
+	for _, id := range payload.Identifiers {
+		authz := acmeAuthz{
+			ID:         newACMEID(),
+			AccountID:  req.account.ID,
+			OrderID:    order.ID,
+			Status:     acmeStatusPending,
+			Expires:    expires,
+			Identifier: id,
+		}
+		if strings.HasPrefix(id.Value, "*.") {
+			// wildcards can only be validated with DNS (RFC 8555 section 7.1.3)
+			authz.Identifier.Value = strings.TrimPrefix(id.Value, "*.")
+			authz.Wildcard = true
+			authz.Challenges = []acmeChallenge{{Type: "dns-01", Token: newACMEID(), Status: acmeStatusPending}}
+		} else {
+			authz.Challenges = []acmeChallenge{
+				{Type: "http-01", Token: newACMEID(), Status: acmeStatusPending},
+				{Type: "dns-01", Token: newACMEID(), Status: acmeStatusPending},
+			}
+		}
+		err = s.store.Put(acmeKindAuthz, authz.ID, authz, expires)
+		if err != nil {
+			return err
+		}
+		order.Authorizations = append(order.Authorizations, authz.ID)
+	}
+	err = s.store.Put(acmeKindOrder, order.ID, order, expires)
+	if err != nil {
+		return err
+	}
+	return writeACMEJSON(w, http.StatusCreated, s.url(r, "/order/"+order.ID), s.orderView(r, order))
+}
+
+// checkIdentifiers rejects identifiers the zone of the account doesn't allow before any challenge is solved.
+// Accounts without zone are checked in the zone the selection rules give for the identifiers, the zone
+// finalization is expected to resolve from the CSR with the same names.
+func (s *acmeServer) checkIdentifiers(ctx context.Context, account *acmeAccount, ids []acmeIdentifier) error {
+	zone := account.Zone
+	if zone == "" {
+		var request events.APIGatewayProxyRequest
+		request.RequestContext.Identity.Caller = "acme-account:" + account.ID
+		zr := zoneRequest{CertificateAuthorityArn: s.caArn}
+		for _, id := range ids {
+			zr.Domains = append(zr.Domains, id.Value)
+		}
+		selection, err := resolveZone(ctx, request, zr)
+		if err != nil {
+			return acmeError(http.StatusBadRequest, "rejectedIdentifier", "%s", err)
+		}
+		zone = selection.Zone
+	}
+	policy, err := cachedPolicy(zone)
+	if err != nil {
+		return acmeError(http.StatusInternalServerError, "serverInternal", "can't get policy of zone %s: %s", zone, err)
+	}
+	for _, id := range ids {
+		if v := common.CheckDomainNames(policy, id.Value, []string{id.Value}); len(v) > 0 {
+			return acmeError(http.StatusBadRequest, "rejectedIdentifier", "%s", v)
+		}
+	}
+	return nil
+}
+
+// validDNSName reports whether the identifier is a DNS name, optionally with a leading wildcard label. IP
+// literals, ports and numeric top level labels, which resolvers read as addresses, are rejected.
+func validDNSName(name string) bool {
+	name = strings.TrimPrefix(name, "*.")
+	if name == "" || len(name) > 253 || net.ParseIP(name) != nil {
+		return false
+	}
+	labels := strings.Split(name, ".")
+	for _, l := range labels {
+		if len(l) == 0 || len(l) > 63 || l[0] == '-' || l[len(l)-1] == '-' {
+			return false
+		}
+		for _, c := range l {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return false
+			}
+		}
+	}
+	tld := labels[len(labels)-1]
+	return strings.Trim(tld, "0123456789") != ""
+}
+
+// loadOrder loads the order of the account and updates its status from authorizations and issuance.
+func (s *acmeServer) loadOrder(ctx context.Context, account *acmeAccount, id string) (acmeOrder, error) {
+	var order acmeOrder
+	err := s.store.Get(acmeKindOrder, id, &order)
+	if err == common.ACMEObjectNotFound || (err == nil && order.AccountID != account.ID) {
+		return order, acmeError(http.StatusNotFound, "malformed", "order %s doesn't exist", id)
+	} else if err != nil {
+		return order, err
+	}
+	changed := false
+	switch order.Status {
+	case acmeStatusPending:
+		ready := true
+		for _, authzID := range order.Authorizations {
+			var authz acmeAuthz
+			err = s.store.Get(acmeKindAuthz, authzID, &authz)
+			if err != nil {
+				return order, err
+			}
+			switch authz.Status {
+			case acmeStatusValid:
+			case acmeStatusPending:
+				ready = false
+			default:
+				order.Status, changed = acmeStatusInvalid, true
+				order.Error = acmeError(http.StatusForbidden, "unauthorized", "authorization for %s is %s", authz.Identifier.Value, authz.Status)
+			}
+		}
+		if ready && order.Status == acmeStatusPending {
+			order.Status, changed = acmeStatusReady, true
+		}
+	case acmeStatusProcessing:
+		if certificateIssued(ctx, s.caArn, order.CertificateArn, 0) {
+			order.Status, changed = acmeStatusValid, true
+		}
+	}
+	if changed {
+		err = s.store.Put(acmeKindOrder, order.ID, order, order.Expires)
+	}
+	return order, err
+}
+
+func (s *acmeServer) order(w http.ResponseWriter, r *http.Request, id string) error {
+	req, _, err := s.verifyRequest(r, "/order/"+id, false)
+	if err != nil {
+		return err
+	}
+	order, err := s.loadOrder(r.Context(), req.account, id)
+	if err != nil {
+		return err
+	}
+	return writeACMEJSON(w, http.StatusOK, "", s.orderView(r, order))
+}
+
+func (s *acmeServer) authzView(r *http.Request, a acmeAuthz) interface{} {
+	challenges := make([]interface{}, len(a.Challenges))
+	for i, c := range a.Challenges {
+		v := map[string]interface{}{
+			"type":   c.Type,
+			"url":    s.url(r, "/chall/"+a.ID+"/"+c.Type),
+			"token":  c.Token,
+			"status": c.Status,
+		}
+		if c.Validated != nil {
+			v["validated"] = c.Validated.Format(time.RFC3339)
+		}
+		if c.Error != nil {
+			v["error"] = c.Error
+		}
+		challenges[i] = v
+	}
+	return map[string]interface{}{
+		"status":     a.Status,
+		"expires":    a.Expires.Format(time.RFC3339),
+		"identifier": a.Identifier,
+		"wildcard":   a.Wildcard,
+		"challenges": challenges,
+	}
+}
+
+func (s *acmeServer) loadAuthz(account *acmeAccount, id string) (acmeAuthz, error) {
+	var authz acmeAuthz
+	err := s.store.Get(acmeKindAuthz, id, &authz)
+	if err == common.ACMEObjectNotFound || (err == nil && authz.AccountID != account.ID) {
+		return authz, acmeError(http.StatusNotFound, "malformed", "authorization %s doesn't exist", id)
+	}
+	return authz, err
+}
+
+func (s *acmeServer) authz(w http.ResponseWriter, r *http.Request, id string) error {
+	req, _, err := s.verifyRequest(r, "/authz/"+id, false)
+	if err != nil {
+		return err
+	}
+	authz, err := s.loadAuthz(req.account, id)
+	if err != nil {
+		return err
+	}
+	if !req.postAsGet() {
+		var payload struct {
+			Status string `json:"status"`
+		}
+		err = json.Unmarshal(req.payload, &payload)
+		if err != nil || payload.Status != acmeStatusDeactivated {
+			return acmeError(http.StatusBadRequest, "malformed", "authorization status can only be changed to deactivated")
+		}
+		authz.Status = acmeStatusDeactivated
+		err = s.store.Put(acmeKindAuthz, authz.ID, authz, authz.Expires)
+		if err != nil {
+			return err
+		}
+	}
+	return writeACMEJSON(w, http.StatusOK, "", s.authzView(r, authz))
+}
+
+// keyAuthorization returns the challenge response expected from the account (RFC 8555 section 8.1).
+func keyAuthorization(token string, account *acmeAccount) string {
+	return token + "." + account.Thumbprint
+}
+
+func (s *acmeServer) challenge(w http.ResponseWriter, r *http.Request, authzID, typ string) error {
+	req, _, err := s.verifyRequest(r, "/chall/"+authzID+"/"+typ, false)
+	if err != nil {
+		return err
+	}
+	authz, err := s.loadAuthz(req.account, authzID)
+	if err != nil {
+		return err
+	}
+	i := -1
+	for j, c := range authz.Challenges {
+		if c.Type == typ {
+			i = j
+		}
+	}
+	if i < 0 {
+		return acmeError(http.StatusNotFound, "malformed", "challenge %s doesn't exist", typ)
+	}
+	// an empty object requests validation, POST-as-GET only fetches the challenge
+	if !req.postAsGet() && authz.Status == acmeStatusPending && authz.Challenges[i].Status == acmeStatusPending {
+		c := &authz.Challenges[i]
+		err = s.validateChallenge(c.Type, authz.Identifier.Value, keyAuthorization(c.Token, req.account))
+		if err != nil {
+			log.Printf("ACME %s challenge for %s failed: %s", c.Type, authz.Identifier.Value, err)
+			c.Status, authz.Status = acmeStatusInvalid, acmeStatusInvalid
+			c.Error = acmeError(http.StatusForbidden, challengeProblem(c.Type), "%s", err)
+		} else {
+			now := time.Now().UTC()
+			c.Status, authz.Status, c.Validated = acmeStatusValid, acmeStatusValid, &now
+		}
+		err = s.store.Put(acmeKindAuthz, authz.ID, authz, authz.Expires)
+		if err != nil {
+			return err
+		}
+	}
+	c := authz.Challenges[i]
+	w.Header().Add("Link", fmt.Sprintf("<%s>;rel=\"up\"", s.url(r, "/authz/"+authz.ID)))
+	return writeACMEJSON(w, http.StatusOK, "", map[string]interface{}{
+		"type":   c.Type,
+		"url":    s.url(r, "/chall/"+authz.ID+"/"+c.Type),
+		"token":  c.Token,
+		"status": c.Status,
+		"error":  c.Error,
+	})
+}
+
+func challengeProblem(typ string) string {
+	if typ == "dns-01" {
+		return "dns"
+	}
+	return "connection"
+}
+
+// validateChallenge checks that the response of http-01 or dns-01 challenge is provisioned (RFC 8555 section 8.3, 8.4).
+func (s *acmeServer) validateChallenge(typ, domain, keyAuth string) error {
+	switch typ {
+	case "http-01":
+		token := strings.SplitN(keyAuth, ".", 2)[0]
+		body, err := s.httpGet(fmt.Sprintf("http://%s/.well-known/acme-challenge/%s", domain, token))
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(string(body)) != keyAuth {
+			return fmt.Errorf("key authorization served for %s doesn't match", domain)
+		}
+		return nil
+	case "dns-01":
+		sum := sha256.Sum256([]byte(keyAuth))
+		expected := b64.EncodeToString(sum[:])
+		records, err := s.lookupTXT("_acme-challenge." + domain)
+		if err != nil {
+			return err
+		}
+		for _, r := range records {
+			if r == expected {
+				return nil
+			}
+		}
+		return fmt.Errorf("no TXT record with key authorization digest for _acme-challenge.%s", domain)
+	}
+	return fmt.Errorf("unsupported challenge %s", typ)
+}
+
+// csrIdentifiers returns sorted unique DNS names of the CSR.
+func csrIdentifiers(csr *x509.CertificateRequest) []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, n := range append([]string{csr.Subject.CommonName}, csr.DNSNames...) {
+		n = strings.ToLower(n)
+		if n != "" && !seen[n] {
+			seen[n] = true
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func orderIdentifiers(o acmeOrder) []string {
+	names := make([]string, len(o.Identifiers))
+	for i, id := range o.Identifiers {
+		names[i] = id.Value
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *acmeServer) finalize(w http.ResponseWriter, r *http.Request, id string) error {
+	ctx := r.Context()
+	req, _, err := s.verifyRequest(r, "/order/"+id+"/finalize", false)
+	if err != nil {
+		return err
+	}
+	order, err := s.loadOrder(ctx, req.account, id)
+	if err != nil {
+		return err
+	}
+	if order.Status != acmeStatusReady {
+		return acmeError(http.StatusForbidden, "orderNotReady", "order is %s", order.Status)
+	}
+	var payload struct {
+		CSR string `json:"csr"`
+	}
+	err = json.Unmarshal(req.payload, &payload)
+	if err != nil {
+		return acmeError(http.StatusBadRequest, "malformed", "bad finalize request: %s", err)
+	}
+	der, err := b64.DecodeString(payload.CSR)
+	if err != nil {
+		return acmeError(http.StatusBadRequest, "badCSR", "bad CSR encoding")
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil || csr.CheckSignature() != nil {
+		return acmeError(http.StatusBadRequest, "badCSR", "can't parse CSR")
+	}
+	// only dns identifiers are authorized, other SANs would be issued without proof of control
+	if len(csr.IPAddresses) > 0 || len(csr.EmailAddresses) > 0 || len(csr.URIs) > 0 {
+		return acmeError(http.StatusBadRequest, "badCSR", "CSR can only have DNS names, IP, email and URI SANs are not supported")
+	}
+	if strings.Join(csrIdentifiers(csr), ",") != strings.Join(orderIdentifiers(order), ",") {
+		return acmeError(http.StatusBadRequest, "badCSR", "CSR names %v don't match order identifiers %v",
+			csrIdentifiers(csr), orderIdentifiers(order))
+	}
+
+	arn, problem := s.issue(ctx, req.account, order, der)
+	if problem != nil {
+		if problem.Status == http.StatusForbidden {
+			order.Status, order.Error = acmeStatusInvalid, problem
+			if err := s.store.Put(acmeKindOrder, order.ID, order, order.Expires); err != nil {
+				return err
+			}
+		}
+		return problem
+	}
+	order.Status, order.CertificateArn = acmeStatusProcessing, arn
+	if certificateIssued(ctx, s.caArn, arn, acmeIssueWait) {
+		order.Status = acmeStatusValid
+	}
+	err = s.store.Put(acmeKindOrder, order.ID, order, order.Expires)
+	if err != nil {
+		return err
+	}
+	return writeACMEJSON(w, http.StatusOK, s.url(r, "/order/"+order.ID), s.orderView(r, order))
+}
+
+// issue sends the CSR through the IssueCertificate handler as the account.
+func (s *acmeServer) issue(ctx context.Context, account *acmeAccount, order acmeOrder, csr []byte) (string, *acmeProblem) {
+	arn, resp, err := enroll(ctx, enrollment{
+		Caller:           "acme-account:" + account.ID,
+		Zones:            account.Zone,
+		Zone:             account.Zone,
+		CAArn:            s.caArn,
+		CSR:              csr,
+		ValidityDays:     s.validityDays,
+		IdempotencyToken: order.ID,
+	})
+	if err != nil {
+		return "", acmeError(http.StatusInternalServerError, "serverInternal", "%s", err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return arn, nil
+	case http.StatusBadRequest, http.StatusForbidden, http.StatusUnprocessableEntity:
+		return "", acmeError(http.StatusForbidden, "badCSR", "%s", handlerMessage(resp))
+	case http.StatusTooManyRequests:
+		p := acmeError(http.StatusTooManyRequests, "rateLimited", "%s", handlerMessage(resp))
+		p.retryAfter = resp.Headers["Retry-After"]
+		return "", p
+	default:
+		return "", acmeError(http.StatusInternalServerError, "serverInternal", "%s", handlerMessage(resp))
+	}
+}
+
+func (s *acmeServer) certificate(w http.ResponseWriter, r *http.Request, orderID string) error {
+	req, _, err := s.verifyRequest(r, "/cert/"+orderID, false)
+	if err != nil {
+		return err
+	}
+	order, err := s.loadOrder(r.Context(), req.account, orderID)
+	if err != nil {
+		return err
+	}
+	if order.Status != acmeStatusValid {
+		return acmeError(http.StatusNotFound, "malformed", "certificate of order %s is not issued", orderID)
+	}
+	certPEM, chainPEM, err := issuedCertificate(r.Context(), s.caArn, order.CertificateArn)
+	if err != nil {
+		return err
+	}
+	leaf, err := parseCertificatePEM(certPEM)
+	if err != nil {
+		return err
+	}
+	err = s.store.Put(acmeKindCertificate, formatSerial(leaf), acmeCertificate{
+		AccountID:      req.account.ID,
+		CertificateArn: order.CertificateArn,
+	}, leaf.NotAfter)
+	if err != nil {
+		return err
+	}
+	chain := strings.TrimSpace(certPEM) + "\n"
+	if c := strings.TrimSpace(chainPEM); c != "" {
+		chain += c + "\n"
+	}
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	_, err = io.WriteString(w, chain)
+	return err
+}
+
+// revoke revokes a certificate of the account. Revocation requests signed with the certificate key are not supported.
+func (s *acmeServer) revoke(w http.ResponseWriter, r *http.Request) error {
+	req, _, err := s.verifyRequest(r, acmeRevokePath, false)
+	if err != nil {
+		return err
+	}
+	var payload struct {
+		Certificate string `json:"certificate"`
+		Reason      int    `json:"reason"`
+	}
+	err = json.Unmarshal(req.payload, &payload)
+	if err != nil {
+		return acmeError(http.StatusBadRequest, "malformed", "bad revocation request: %s", err)
+	}
+	der, err := b64.DecodeString(payload.Certificate)
+	if err != nil {
+		return acmeError(http.StatusBadRequest, "malformed", "bad certificate encoding")
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return acmeError(http.StatusBadRequest, "malformed", "can't parse certificate")
+	}
+	var issued acmeCertificate
+	err = s.store.Get(acmeKindCertificate, formatSerial(cert), &issued)
+	if err == common.ACMEObjectNotFound || (err == nil && issued.AccountID != req.account.ID) {
+		return acmeError(http.StatusForbidden, "unauthorized", "certificate wasn't issued to the account")
+	} else if err != nil {
+		return err
+	}
+	reason, ok := acmeRevocationReasons[payload.Reason]
+	if !ok {
+		return acmeError(http.StatusBadRequest, "badRevocationReason", "unsupported revocation reason %d", payload.Reason)
+	}
+	cli, err := awsClients()
+	if err != nil {
+		return err
+	}
+	_, err = cli.acmpca.RevokeCertificateRequest(&acmpca.RevokeCertificateInput{
+		CertificateAuthorityArn: aws.String(s.caArn),
+		CertificateSerial:       aws.String(formatSerial(cert)),
+		RevocationReason:        reason,
+	}).Send(r.Context())
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// acmeRevocationReasons maps RFC 5280 reason codes to ACM-PCA revocation reasons.
+var acmeRevocationReasons = map[int]acmpca.RevocationReason{
+	0:  acmpca.RevocationReasonUnspecified,
+	1:  acmpca.RevocationReasonKeyCompromise,
+	2:  acmpca.RevocationReasonCertificateAuthorityCompromise,
+	3:  acmpca.RevocationReasonAffiliationChanged,
+	4:  acmpca.RevocationReasonSuperseded,
+	5:  acmpca.RevocationReasonCessationOfOperation,
+	9:  acmpca.RevocationReasonPrivilegeWithdrawn,
+	10: acmpca.RevocationReasonAACompromise,
+}
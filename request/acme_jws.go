@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// jsonWebKey is the public part of RSA, EC or Ed25519 JWK (RFC 7517).
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+// jwsMessage is flattened JWS JSON serialization used by ACME (RFC 8555 section 6.2).
+type jwsMessage struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+type jwsHeader struct {
+	Alg   string      `json:"alg"`
+	Nonce string      `json:"nonce"`
+	URL   string      `json:"url"`
+	Kid   string      `json:"kid"`
+	JWK   *jsonWebKey `json:"jwk"`
+}
+
+var b64 = base64.RawURLEncoding
+
+func (m jwsMessage) header() (h jwsHeader, err error) {
+	b, err := b64.DecodeString(m.Protected)
+	if err != nil {
+		return h, fmt.Errorf("bad protected header encoding: %s", err)
+	}
+	err = json.Unmarshal(b, &h)
+	if err != nil {
+		return h, fmt.Errorf("bad protected header: %s", err)
+	}
+	return h, nil
+}
+
+func (m jwsMessage) payload() ([]byte, error) {
+	return b64.DecodeString(m.Payload)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := b64.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("bad key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("bad RSA exponent")
+		}
+		if n.BitLen() < 2048 {
+			return nil, errors.New("RSA key is shorter than 2048 bits")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		x, err := b64.DecodeString(k.X)
+		if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("bad Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// thumbprint returns RFC 7638 SHA-256 thumbprint of the key.
+func (k jsonWebKey) thumbprint() string {
+	var members string
+	switch k.Kty {
+	case "RSA":
+		members = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, k.E, k.N)
+	case "EC":
+		members = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, k.Crv, k.X, k.Y)
+	default:
+		members = fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q}`, k.Crv, k.Kty, k.X)
+	}
+	sum := sha256.Sum256([]byte(members))
+	return b64.EncodeToString(sum[:])
+}
+
+// verify checks JWS signature with the key. The algorithm has to match the key type.
+func (m jwsMessage) verify(alg string, key crypto.PublicKey) error {
+	sig, err := b64.DecodeString(m.Signature)
+	if err != nil {
+		return errors.New("bad signature encoding")
+	}
+	input := []byte(m.Protected + "." + m.Payload)
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			break
+		}
+		sum := sha256.Sum256(input)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig)
+	case *ecdsa.PublicKey:
+		var digest []byte
+		switch {
+		case alg == "ES256" && pub.Curve == elliptic.P256():
+			sum := sha256.Sum256(input)
+			digest = sum[:]
+		case alg == "ES384" && pub.Curve == elliptic.P384():
+			sum := sha512.Sum384(input)
+			digest = sum[:]
+		default:
+			return fmt.Errorf("algorithm %s doesn't match the key", alg)
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("bad signature length")
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("signature verification failed")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			break
+		}
+		if !ed25519.Verify(pub, input, sig) {
+			return errors.New("signature verification failed")
+		}
+		return nil
+	}
+	return fmt.Errorf("algorithm %s doesn't match the key", alg)
+}
+
+// verifyHMAC checks HS256 signature of External Account Binding JWS (RFC 8555 section 7.3.4).
+func (m jwsMessage) verifyHMAC(key []byte) error {
+	sig, err := b64.DecodeString(m.Signature)
+	if err != nil {
+		return errors.New("bad signature encoding")
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(m.Protected + "." + m.Payload))
+	if !hmac.Equal(mac.Sum(nil), sig) {
+		return errors.New("external account binding signature verification failed")
+	}
+	return nil
+}
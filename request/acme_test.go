@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/Venafi/vcert/v4/pkg/certificate"
+	"github.com/Venafi/vcert/v4/pkg/endpoint"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// acmeTestClient is a minimal ACME client signing requests with ES256 account key.
+type acmeTestClient struct {
+	t       *testing.T
+	key     *ecdsa.PrivateKey
+	kid     string
+	nonce   string
+	lastLoc string
+}
+
+func (c *acmeTestClient) jwk() jsonWebKey {
+	size := (c.key.Curve.Params().BitSize + 7) / 8
+	pad := func(b []byte) []byte { return append(make([]byte, size-len(b)), b...) }
+	return jsonWebKey{Kty: "EC", Crv: "P-256", X: b64.EncodeToString(pad(c.key.X.Bytes())), Y: b64.EncodeToString(pad(c.key.Y.Bytes()))}
+}
+
+func (c *acmeTestClient) sign(protected map[string]interface{}, payload []byte) jwsMessage {
+	h, _ := json.Marshal(protected)
+	m := jwsMessage{Protected: b64.EncodeToString(h), Payload: b64.EncodeToString(payload)}
+	sum := sha256.Sum256([]byte(m.Protected + "." + m.Payload))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, sum[:])
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	pad := func(b []byte) []byte { return append(make([]byte, 32-len(b)), b...) }
+	m.Signature = b64.EncodeToString(append(pad(r.Bytes()), pad(s.Bytes())...))
+	return m
+}
+
+// post sends JWS request signed with kid or, before the account is created, with jwk. nil payload is POST-as-GET.
+func (c *acmeTestClient) post(url string, payload interface{}) (*http.Response, []byte) {
+	var p []byte
+	if payload != nil {
+		p, _ = json.Marshal(payload)
+	}
+	protected := map[string]interface{}{"alg": "ES256", "nonce": c.nonce, "url": url}
+	if c.kid != "" {
+		protected["kid"] = c.kid
+	} else {
+		protected["jwk"] = c.jwk()
+	}
+	body, _ := json.Marshal(c.sign(protected, p))
+	resp, err := http.Post(url, "application/jose+json", bytes.NewReader(body))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	c.nonce = resp.Header.Get("Replay-Nonce")
+	c.lastLoc = resp.Header.Get("Location")
+	return resp, b
+}
+
+func (c *acmeTestClient) expect(status int, url string, payload interface{}, v interface{}) {
+	resp, b := c.post(url, payload)
+	if resp.StatusCode != status {
+		c.t.Fatalf("%s returned %d instead of %d: %s", url, resp.StatusCode, status, b)
+	}
+	if v != nil {
+		if err := json.Unmarshal(b, v); err != nil {
+			c.t.Fatalf("can't parse %s response %s: %s", url, b, err)
+		}
+	}
+}
+
+func (c *acmeTestClient) expectProblem(url string, payload interface{}, problem string) {
+	resp, b := c.post(url, payload)
+	var p acmeProblem
+	_ = json.Unmarshal(b, &p)
+	if p.Type != acmeProblemPrefix+problem || resp.Header.Get("Content-Type") != "application/problem+json" {
+		c.t.Fatalf("%s should fail with %s, got %d: %s", url, problem, resp.StatusCode, b)
+	}
+}
+
+func (c *acmeTestClient) eab(kid string, hmacKey []byte, url string) jwsMessage {
+	h, _ := json.Marshal(map[string]string{"alg": "HS256", "kid": kid, "url": url})
+	p, _ := json.Marshal(c.jwk())
+	m := jwsMessage{Protected: b64.EncodeToString(h), Payload: b64.EncodeToString(p)}
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write([]byte(m.Protected + "." + m.Payload))
+	m.Signature = b64.EncodeToString(mac.Sum(nil))
+	return m
+}
+
+func TestACMEIssuance(t *testing.T) {
+	f := newFakeACMPCA(t)
+	defer f.server.Close()
+	_, zones, cleanup := proxyTestSetup(t, f)
+	defer cleanup()
+
+	hmacKey := []byte("0123456789abcdef0123456789abcdef")
+	served := map[string]string{}
+	acme := &acmeServer{
+		store:        common.NewMemoryACMEStore(),
+		caArn:        testCAArn,
+		validityDays: 90,
+		eabKeys:      map[string]acmeEABKey{"kid-1": {HMACKey: b64.EncodeToString(hmacKey), Zone: "acme-zone"}},
+		httpGet: func(url string) ([]byte, error) {
+			if v, ok := served[url]; ok {
+				return []byte(v), nil
+			}
+			return nil, fmt.Errorf("%s returned 404 Not Found", url)
+		},
+	}
+	srv := httptest.NewServer(&requestServer{acme: acme})
+	defer srv.Close()
+	base := srv.URL + acmePrefix
+
+	resp, err := http.Get(base + acmeDirectoryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dir map[string]interface{}
+	_ = json.NewDecoder(resp.Body).Decode(&dir)
+	resp.Body.Close()
+	if dir["newAccount"] != base+acmeAccountPath || dir["meta"].(map[string]interface{})["externalAccountRequired"] != true {
+		t.Fatalf("unexpected directory: %v", dir)
+	}
+	resp, err = http.Head(base + acmeNoncePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c := &acmeTestClient{t: t, key: key, nonce: resp.Header.Get("Replay-Nonce")}
+
+	c.expectProblem(base+acmeAccountPath, map[string]interface{}{"termsOfServiceAgreed": true}, "externalAccountRequired")
+	c.expectProblem(base+acmeAccountPath, map[string]interface{}{
+		"externalAccountBinding": c.eab("kid-1", []byte("wrong key"), base+acmeAccountPath),
+	}, "unauthorized")
+	c.expect(http.StatusCreated, base+acmeAccountPath, map[string]interface{}{
+		"contact":                []string{"mailto:admin@example.com"},
+		"externalAccountBinding": c.eab("kid-1", hmacKey, base+acmeAccountPath),
+	}, nil)
+	c.kid = c.lastLoc
+
+	nonce := c.nonce
+	c.expectProblem(base+acmeOrderPath, map[string]interface{}{
+		"identifiers": []acmeIdentifier{{Type: "dns", Value: "www.example.org"}},
+	}, "rejectedIdentifier")
+	c.nonce = nonce
+	c.expectProblem(base+acmeOrderPath, map[string]interface{}{}, "badNonce")
+
+	var order struct {
+		Status         string
+		Authorizations []string
+		Finalize       string
+		Certificate    string
+	}
+	c.expect(http.StatusCreated, base+acmeOrderPath, map[string]interface{}{
+		"identifiers": []acmeIdentifier{{Type: "dns", Value: "www.example.com"}},
+	}, &order)
+	orderURL := c.lastLoc
+	if order.Status != acmeStatusPending || len(order.Authorizations) != 1 {
+		t.Fatalf("unexpected new order: %+v", order)
+	}
+
+	certKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "www.example.com"},
+		DNSNames: []string{"www.example.com"},
+	}, certKey)
+	finalize := map[string]string{"csr": b64.EncodeToString(der)}
+	c.expectProblem(order.Finalize, finalize, "orderNotReady")
+
+	var authz struct {
+		Status     string
+		Challenges []struct{ Type, URL, Token string }
+	}
+	c.expect(http.StatusOK, order.Authorizations[0], nil, &authz)
+	var challURL string
+	for _, ch := range authz.Challenges {
+		if ch.Type == "http-01" {
+			challURL = ch.URL
+			thumbprint := c.jwk().thumbprint()
+			served["http://www.example.com/.well-known/acme-challenge/"+ch.Token] = ch.Token + "." + thumbprint
+		}
+	}
+	var chall struct{ Status string }
+	c.expect(http.StatusOK, challURL, map[string]interface{}{}, &chall)
+	if chall.Status != acmeStatusValid {
+		t.Fatalf("http-01 challenge should be valid, got %s", chall.Status)
+	}
+	c.expect(http.StatusOK, orderURL, nil, &order)
+	if order.Status != acmeStatusReady {
+		t.Fatalf("order should be ready after validation, got %s", order.Status)
+	}
+
+	c.expect(http.StatusOK, order.Finalize, finalize, &order)
+	if order.Status != acmeStatusValid || order.Certificate == "" {
+		t.Fatalf("order should be valid after finalization, got %+v", order)
+	}
+	if (*zones)[len(*zones)-1] != "acme-zone" {
+		t.Fatalf("certificate should be requested from the account zone, zones: %v", *zones)
+	}
+	if n := len(f.certs); n != 1 {
+		t.Fatalf("one certificate should be issued, got %d", n)
+	}
+
+	resp, chain := c.post(order.Certificate, nil)
+	if resp.Header.Get("Content-Type") != "application/pem-certificate-chain" {
+		t.Fatalf("unexpected certificate response %d: %s", resp.StatusCode, chain)
+	}
+	block, _ := pem.Decode(chain)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	want, _ := x509.MarshalPKIXPublicKey(certKey.Public())
+	if !bytes.Equal(got, want) {
+		t.Fatal("certificate should be issued for the CSR key")
+	}
+
+	c.expect(http.StatusOK, base+acmeRevokePath, map[string]interface{}{"certificate": b64.EncodeToString(cert.Raw), "reason": 4}, nil)
+	if len(f.revoked) != 1 || f.revoked[0] != formatSerial(cert) {
+		t.Fatalf("certificate should be revoked through ACM-PCA, revoked: %v", f.revoked)
+	}
+}
+
+func TestACMEFinalizeRejectsPolicyViolation(t *testing.T) {
+	f := newFakeACMPCA(t)
+	defer f.server.Close()
+	_, _, cleanup := proxyTestSetup(t, f)
+	defer cleanup()
+
+	acme := &acmeServer{
+		store:        common.NewMemoryACMEStore(),
+		caArn:        testCAArn,
+		validityDays: 90,
+		lookupTXT: func(name string) ([]string, error) {
+			return nil, fmt.Errorf("no such host %s", name)
+		},
+	}
+	srv := httptest.NewServer(&requestServer{acme: acme})
+	defer srv.Close()
+	base := srv.URL + acmePrefix
+	resp, err := http.Head(base + acmeNoncePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c := &acmeTestClient{t: t, key: key, nonce: resp.Header.Get("Replay-Nonce")}
+	c.expect(http.StatusCreated, base+acmeAccountPath, map[string]interface{}{}, nil)
+	c.kid = c.lastLoc
+
+	// without zone binding the names are checked in the zone of the selection rules
+	for _, value := range []string{"www.example.org", "169.254.169.254", "www.example.com:8080", "127.1", "a..example.com"} {
+		c.expectProblem(base+acmeOrderPath, map[string]interface{}{
+			"identifiers": []acmeIdentifier{{Type: "dns", Value: value}},
+		}, "rejectedIdentifier")
+	}
+	// and the CSR by the IssueCertificate handler at finalization
+	getPolicy = func(zone string) (endpoint.Policy, error) {
+		p := verifyTestPolicy
+		p.AllowedKeyConfigurations = []endpoint.AllowedKeyConfiguration{{KeyType: certificate.KeyTypeRSA, KeySizes: []int{2048}}}
+		return p, nil
+	}
+	var order struct {
+		Authorizations []string
+		Finalize       string
+	}
+	c.expect(http.StatusCreated, base+acmeOrderPath, map[string]interface{}{
+		"identifiers": []acmeIdentifier{{Type: "dns", Value: "www.example.com"}},
+	}, &order)
+	orderURL := c.lastLoc
+	var authz struct {
+		Challenges []struct{ Type, URL string }
+	}
+	c.expect(http.StatusOK, order.Authorizations[0], nil, &authz)
+	for _, ch := range authz.Challenges {
+		if ch.Type == "dns-01" {
+			var chall struct{ Status string }
+			c.expect(http.StatusOK, ch.URL, map[string]interface{}{}, &chall)
+			if chall.Status != acmeStatusInvalid {
+				t.Fatalf("dns-01 challenge without TXT record should be invalid, got %s", chall.Status)
+			}
+		}
+	}
+	var o struct{ Status string }
+	c.expect(http.StatusOK, orderURL, nil, &o)
+	if o.Status != acmeStatusInvalid {
+		t.Fatalf("order with failed authorization should be invalid, got %s", o.Status)
+	}
+
+	// validate authorization directly to reach finalization
+	var a acmeAuthz
+	id := order.Authorizations[0][strings.LastIndex(order.Authorizations[0], "/")+1:]
+	_ = acme.store.Get(acmeKindAuthz, id, &a)
+	a.Status = acmeStatusValid
+	_ = acme.store.Put(acmeKindAuthz, id, a, a.Expires)
+	var stored acmeOrder
+	orderID := orderURL[strings.LastIndex(orderURL, "/")+1:]
+	_ = acme.store.Get(acmeKindOrder, orderID, &stored)
+	stored.Status, stored.Error = acmeStatusPending, nil
+	_ = acme.store.Put(acmeKindOrder, orderID, stored, stored.Expires)
+
+	certKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	// SANs other than DNS names are not authorized by the order
+	uri, _ := url.Parse("spiffe://example.com/www")
+	for _, tmpl := range []x509.CertificateRequest{
+		{IPAddresses: []net.IP{net.ParseIP("10.0.0.1")}},
+		{EmailAddresses: []string{"admin@example.com"}},
+		{URIs: []*url.URL{uri}},
+	} {
+		tmpl.Subject, tmpl.DNSNames = pkix.Name{CommonName: "www.example.com"}, []string{"www.example.com"}
+		der, _ := x509.CreateCertificateRequest(rand.Reader, &tmpl, certKey)
+		c.expectProblem(order.Finalize, map[string]string{"csr": b64.EncodeToString(der)}, "badCSR")
+	}
+	c.expect(http.StatusOK, orderURL, nil, &o)
+	if o.Status != acmeStatusReady || len(f.certs) != 0 {
+		t.Fatalf("CSR with other SANs should be rejected without certificate, got %s", o.Status)
+	}
+
+	der, _ := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "www.example.com"},
+		DNSNames: []string{"www.example.com"},
+	}, certKey)
+	c.expectProblem(order.Finalize, map[string]string{"csr": b64.EncodeToString(der)}, "badCSR")
+	c.expect(http.StatusOK, orderURL, nil, &o)
+	if o.Status != acmeStatusInvalid || len(f.certs) != 0 {
+		t.Fatalf("order violating zone policy should be invalid without certificate, got %s", o.Status)
+	}
+}
+
+func TestACMEChallengeAddresses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "key-authorization")
+	}))
+	defer srv.Close()
+	if _, err := acmeHTTPGet(srv.URL + "/.well-known/acme-challenge/token"); err == nil || !strings.Contains(err.Error(), "not a public address") {
+		t.Fatalf("http-01 validation should not connect to loopback address, got %v", err)
+	}
+	for addr, public := range map[string]bool{
+		"169.254.169.254":  false,
+		"10.1.2.3":         false,
+		"100.64.0.1":       false,
+		"::1":              false,
+		"::ffff:127.0.0.1": false,
+		"fd00::1":          false,
+		"8.8.8.8":          true,
+		"2001:4860::8888":  true,
+	} {
+		if got := publicAddress(net.ParseIP(addr)); got != public {
+			t.Errorf("publicAddress(%s) = %v, expected %v", addr, got, public)
+		}
+	}
+}
+
+func TestValidDNSName(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"www.example.com":   true,
+		"*.example.com":     true,
+		"xn--bcher-kva.com": true,
+		"localhost":         true,
+		"*.*.example.com":   false,
+		"example.com:80":    false,
+		"10.0.0.1":          false,
+		"::1":               false,
+		"0x7f.1":            false,
+		"-bad.example.com":  false,
+		"www.example.com/x": false,
+		"":                  false,
+	} {
+		if got := validDNSName(name); got != valid {
+			t.Errorf("validDNSName(%q) = %v, expected %v", name, got, valid)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/aws/aws-lambda-go/events"
+	"log"
+	"net/http"
+	"time"
+)
+
+const venafiQueryAuditLog = "VenafiQueryAuditLog"
+
+var auditStore common.AuditStore
+
+type auditedHandler func(request events.APIGatewayProxyRequest, audit *common.AuditRecord) (events.APIGatewayProxyResponse, error)
+
+type VenafiQueryAuditLogInput struct {
+	Zone       string    `json:"Zone"`
+	Principal  string    `json:"Principal"`
+	From       time.Time `json:"From"`
+	To         time.Time `json:"To"`
+	MaxResults int       `json:"MaxResults"`
+	NextToken  string    `json:"NextToken"`
+}
+
+type VenafiQueryAuditLogResponse struct {
+	Records   []common.AuditRecord `json:"Records"`
+	NextToken string               `json:"NextToken,omitempty"`
+}
+
+// audited runs issuance handler and writes its decision to the audit store.
+func audited(request events.APIGatewayProxyRequest, target string, handler auditedHandler) (events.APIGatewayProxyResponse, error) {
+	audit := common.AuditRecord{
+		ID:        common.NewAuditRecordID(),
+		Time:      time.Now().UTC(),
+		Principal: callerPrincipal(request),
+		SourceIP:  request.RequestContext.Identity.SourceIP,
+		Target:    target,
+	}
+	resp, err := handler(request, &audit)
+	if audit.ZoneRule != "" {
+		if resp.Headers == nil {
+			resp.Headers = map[string]string{}
+		}
+		resp.Headers[zoneHeader] = audit.Zone
+		resp.Headers[zoneSelectedByHeader] = audit.ZoneRule
+	}
+	if auditStore == nil {
+		return resp, err
+	}
+	switch {
+	case err == nil && resp.StatusCode == http.StatusOK:
+		audit.Decision = common.AuditDecisionApproved
+	case err == nil && resp.StatusCode == http.StatusForbidden:
+		audit.Decision = common.AuditDecisionRejected
+	case err == nil && resp.StatusCode == http.StatusTooManyRequests:
+		audit.Decision = common.AuditDecisionThrottled
+	default:
+		audit.Decision = common.AuditDecisionError
+	}
+	if audit.Zone == "" {
+		audit.Zone = defaultZone
+	}
+	saveErr := auditStore.Save(audit)
+	if saveErr != nil {
+		log.Println("Can't save audit record:", saveErr)
+	}
+	return resp, err
+}
+
+// callerPrincipal returns IAM identity of the caller as resolved by API Gateway authorizer.
+func callerPrincipal(request events.APIGatewayProxyRequest) string {
+	identity := request.RequestContext.Identity
+	switch {
+	case identity.UserArn != "":
+		return identity.UserArn
+	case identity.Caller != "":
+		return identity.Caller
+	case identity.AccessKey != "":
+		return identity.AccessKey
+	default:
+		return "anonymous"
+	}
+}
+
+// describeCSR returns subject and all SANs of PEM CSR for audit purposes.
+func describeCSR(csrPEM []byte) (subject string, sans []string) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil {
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return
+	}
+	sans = append(sans, csr.DNSNames...)
+	for _, ip := range csr.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	sans = append(sans, csr.EmailAddresses...)
+	for _, uri := range csr.URIs {
+		sans = append(sans, uri.String())
+	}
+	return csr.Subject.String(), sans
+}
+
+func queryAuditLog(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if auditStore == nil {
+		return clientError(http.StatusNotImplemented, "Audit is not enabled. Set AUDIT_TABLE to enable it.")
+	}
+	var input VenafiQueryAuditLogInput
+	err := json.Unmarshal([]byte(request.Body), &input)
+	if err != nil {
+		return clientError(http.StatusUnprocessableEntity, fmt.Sprintf(errUnmarshalJson, venafiQueryAuditLog, err))
+	}
+	zones := allowedZones(request)
+	if input.Zone != "" {
+		if err = authorizeZone(request, input.Zone); err != nil {
+			return clientError(http.StatusForbidden, err.Error())
+		}
+	} else if len(zones) == 1 {
+		input.Zone = zones[0]
+	}
+	records, next, err := auditStore.Query(common.AuditQuery{
+		Zone:      input.Zone,
+		Principal: input.Principal,
+		From:      input.From,
+		To:        input.To,
+		Limit:     input.MaxResults,
+		NextToken: input.NextToken,
+	})
+	if err != nil {
+		return clientError(http.StatusFailedDependency, fmt.Sprintf("Failed to query audit log: %s", err))
+	}
+	if zones != nil {
+		// pages of principals restricted to some zones may be shorter than MaxResults
+		allowed := records[:0]
+		for _, r := range records {
+			if containsString(zones, r.Zone) {
+				allowed = append(allowed, r)
+			}
+		}
+		records = allowed
+	}
+	return jsonResponse(venafiQueryAuditLog, VenafiQueryAuditLogResponse{Records: records, NextToken: next})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/aws/aws-lambda-go/events"
+	"net/http"
+	"testing"
+)
+
+func TestAuditedRecordsDecisions(t *testing.T) {
+	store := common.NewMemoryAuditStore()
+	auditStore = store
+	defer func() { auditStore = nil }()
+
+	request := events.APIGatewayProxyRequest{
+		Headers: map[string]string{"X-Amz-Target": acmpcaIssueCertificate},
+	}
+	request.RequestContext.Identity.UserArn = "arn:aws:iam::123456789012:user/alice"
+
+	approve := func(request events.APIGatewayProxyRequest, audit *common.AuditRecord) (events.APIGatewayProxyResponse, error) {
+		audit.Zone = "zone1"
+		audit.CertificateArn = "arn:cert"
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusOK}, nil
+	}
+	reject := func(request events.APIGatewayProxyRequest, audit *common.AuditRecord) (events.APIGatewayProxyResponse, error) {
+		audit.Zone = "zone1"
+		audit.Violations = []string{"common name is not allowed"}
+		return clientError(http.StatusForbidden, audit.Violations[0])
+	}
+	_, _ = audited(request, acmpcaIssueCertificate, approve)
+	_, _ = audited(request, acmpcaIssueCertificate, reject)
+
+	resp, err := ACMPCAHandler(events.APIGatewayProxyRequest{
+		Headers: map[string]string{"X-Amz-Target": venafiQueryAuditLog},
+		Body:    `{"Zone": "zone1", "Principal": "arn:aws:iam::123456789012:user/alice"}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf(wrongResponseCode, resp.StatusCode, resp.Body)
+	}
+	var out VenafiQueryAuditLogResponse
+	err = json.Unmarshal([]byte(resp.Body), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(out.Records))
+	}
+	if out.Records[0].Decision != common.AuditDecisionApproved || out.Records[0].CertificateArn != "arn:cert" {
+		t.Fatalf("bad approved record: %+v", out.Records[0])
+	}
+	if out.Records[1].Decision != common.AuditDecisionRejected || len(out.Records[1].Violations) != 1 {
+		t.Fatalf("bad rejected record: %+v", out.Records[1])
+	}
+	if out.Records[1].Target != acmpcaIssueCertificate {
+		t.Fatalf("target should be recorded, got %q", out.Records[1].Target)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/aws/aws-lambda-go/events"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	venafiBatchIssueCertificates = "VenafiBatchIssueCertificates"
+
+	defaultBatchMaxRequests = 100
+	defaultBatchConcurrency = 10
+	// defaultACMPCABatchRate and defaultACMBatchRate are requests per second, below default IssueCertificate
+	// and RequestCertificate quotas so the batch leaves room for other callers
+	defaultACMPCABatchRate = 20
+	defaultACMBatchRate    = 4
+	// batchTimeBudget is how long a batch may take, under the request Lambda timeout of 28 seconds and API Gateway
+	// integration timeout of 29 seconds, e.g. 100 ACM requests at 4 per second
+	batchTimeBudget = 25 * time.Second
+)
+
+// VenafiBatchIssueCertificatesInput has up to BATCH_MAX_REQUESTS requests. Every request has either
+// IssueCertificate body of ACM-PCA or RequestCertificate body of ACM, the same as for single requests.
+type VenafiBatchIssueCertificatesInput struct {
+	Requests []VenafiBatchRequest `json:"Requests"`
+}
+
+type VenafiBatchRequest struct {
+	IssueCertificate   json.RawMessage `json:"IssueCertificate,omitempty"`
+	RequestCertificate json.RawMessage `json:"RequestCertificate,omitempty"`
+}
+
+// VenafiBatchResult is the outcome of one request of the batch, in the order of the requests. Decision is
+// the audit log decision: APPROVED requests have CertificateArn, REJECTED and THROTTLED ones have Violations.
+type VenafiBatchResult struct {
+	Index          int      `json:"Index"`
+	Target         string   `json:"Target"`
+	Decision       string   `json:"Decision"`
+	CertificateArn string   `json:"CertificateArn,omitempty"`
+	Zone           string   `json:"Zone,omitempty"`
+	Violations     []string `json:"Violations,omitempty"`
+	Error          string   `json:"Error,omitempty"`
+	AuditRecordId  string   `json:"AuditRecordId"`
+}
+
+type VenafiBatchIssueCertificatesResponse struct {
+	Results   []VenafiBatchResult `json:"Results"`
+	Approved  int                 `json:"Approved"`
+	Rejected  int                 `json:"Rejected"`
+	Throttled int                 `json:"Throttled"`
+	Failed    int                 `json:"Failed"`
+}
+
+// pacer spaces calls by interval, shared by concurrent workers of all batches in the container.
+type pacer struct {
+	sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newPacer(perSecond int) *pacer {
+	return &pacer{interval: time.Second / time.Duration(perSecond)}
+}
+
+// wait blocks until the next call is allowed.
+func (p *pacer) wait() {
+	p.Lock()
+	now := time.Now()
+	if p.next.Before(now) {
+		p.next = now
+	}
+	at := p.next
+	p.next = p.next.Add(p.interval)
+	p.Unlock()
+	time.Sleep(time.Until(at))
+}
+
+var (
+	batchMaxRequests = defaultBatchMaxRequests
+	batchConcurrency = defaultBatchConcurrency
+	batchPacers      = map[string]*pacer{}
+	batchPacersMu    sync.Mutex
+)
+
+func positiveEnv(name string, def int) int {
+	s := os.Getenv(name)
+	if s == "" {
+		return def
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v <= 0 {
+		log.Printf("Ignoring bad %s value %q", name, s)
+		return def
+	}
+	return v
+}
+
+func initBatch() {
+	batchMaxRequests = positiveEnv("BATCH_MAX_REQUESTS", defaultBatchMaxRequests)
+	batchConcurrency = positiveEnv("BATCH_CONCURRENCY", defaultBatchConcurrency)
+	rates := map[string]int{
+		acmpcaIssueCertificate: positiveEnv("BATCH_ACMPCA_RATE", defaultACMPCABatchRate),
+		acmRequestCertificate:  positiveEnv("BATCH_ACM_RATE", defaultACMBatchRate),
+	}
+	batchPacersMu.Lock()
+	defer batchPacersMu.Unlock()
+	for target, rate := range rates {
+		// pacers are kept between invocations unless the rate changes
+		if p, ok := batchPacers[target]; !ok || p.interval != newPacer(rate).interval {
+			batchPacers[target] = newPacer(rate)
+		}
+	}
+}
+
+// venafiBatchIssueCertificatesRequest sends every request of the batch through its single request handler,
+// so each one is checked against its zone policy, limited and audited separately. Requests are issued
+// concurrently and paced to stay within ACM and ACM-PCA request quotas. A failed request doesn't fail the batch.
+func venafiBatchIssueCertificatesRequest(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var input VenafiBatchIssueCertificatesInput
+	err := json.Unmarshal([]byte(request.Body), &input)
+	if err != nil {
+		return clientError(http.StatusUnprocessableEntity, fmt.Sprintf(errUnmarshalJson, venafiBatchIssueCertificates, err))
+	}
+	switch {
+	case len(input.Requests) == 0:
+		return clientError(http.StatusUnprocessableEntity, "Requests should not be empty")
+	case len(input.Requests) > batchMaxRequests:
+		return clientError(http.StatusUnprocessableEntity, fmt.Sprintf("Batch has %d requests, at most %d are allowed", len(input.Requests), batchMaxRequests))
+	}
+	counts := map[string]int{}
+	for i, r := range input.Requests {
+		if (len(r.IssueCertificate) == 0) == (len(r.RequestCertificate) == 0) {
+			return clientError(http.StatusUnprocessableEntity, fmt.Sprintf("Request %d should have either IssueCertificate or RequestCertificate", i))
+		}
+		counts[r.target()]++
+	}
+	// the batch has to finish before Lambda and API Gateway time out, otherwise the results are lost
+	if d := batchDuration(counts); d > batchTimeBudget {
+		return clientError(http.StatusUnprocessableEntity, fmt.Sprintf("Batch would take up to %s at the batch rate, more than %s allowed",
+			d, batchTimeBudget))
+	}
+
+	results := make([]VenafiBatchResult, len(input.Requests))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < batchConcurrency && w < len(input.Requests); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = batchIssue(request, i, input.Requests[i])
+			}
+		}()
+	}
+	for i := range input.Requests {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	out := VenafiBatchIssueCertificatesResponse{Results: results}
+	for _, r := range results {
+		switch r.Decision {
+		case common.AuditDecisionApproved:
+			out.Approved++
+		case common.AuditDecisionRejected:
+			out.Rejected++
+		case common.AuditDecisionThrottled:
+			out.Throttled++
+		default:
+			out.Failed++
+		}
+	}
+	log.Printf("Batch of %d requests: %d approved, %d rejected, %d throttled, %d failed",
+		len(results), out.Approved, out.Rejected, out.Throttled, out.Failed)
+	return jsonResponse(venafiBatchIssueCertificates, out)
+}
+
+func (r VenafiBatchRequest) target() string {
+	if len(r.RequestCertificate) > 0 {
+		return acmRequestCertificate
+	}
+	return acmpcaIssueCertificate
+}
+
+// batchDuration estimates how long requests of the batch take at most. Calls of each target are paced separately,
+// and with verification of issued certificates every worker waits up to VERIFY_WAIT_SECONDS for each ACM-PCA
+// certificate it issues.
+func batchDuration(counts map[string]int) time.Duration {
+	var longest time.Duration
+	for target, count := range counts {
+		d := time.Duration(count) * batchPacer(target).interval
+		if target == acmpcaIssueCertificate && verifyIssued {
+			rounds := (count + batchConcurrency - 1) / batchConcurrency
+			d += time.Duration(rounds) * verifyWaitTimeout
+		}
+		if d > longest {
+			longest = d
+		}
+	}
+	return longest
+}
+
+func batchPacer(target string) *pacer {
+	batchPacersMu.Lock()
+	defer batchPacersMu.Unlock()
+	return batchPacers[target]
+}
+
+// batchIssue runs one request of the batch with the caller identity of the batch request. Only the ACM and ACM-PCA
+// calls are paced, requests rejected before them don't wait.
+func batchIssue(request events.APIGatewayProxyRequest, index int, r VenafiBatchRequest) VenafiBatchResult {
+	target, handler, body := r.target(), issueACMPCACertificate, r.IssueCertificate
+	if target == acmRequestCertificate {
+		handler, body = requestACMCertificate, r.RequestCertificate
+	}
+
+	item := request
+	item.Body = string(body)
+	var record common.AuditRecord
+	resp, err := audited(item, target, func(request events.APIGatewayProxyRequest, audit *common.AuditRecord) (events.APIGatewayProxyResponse, error) {
+		resp, err := handler(request, audit, batchPacer(target).wait)
+		record = *audit
+		return resp, err
+	})
+	result := VenafiBatchResult{
+		Index:          index,
+		Target:         target,
+		CertificateArn: record.CertificateArn,
+		Zone:           record.Zone,
+		Violations:     record.Violations,
+		AuditRecordId:  record.ID,
+	}
+	switch {
+	case err != nil:
+		result.Decision, result.Error = common.AuditDecisionError, err.Error()
+	case resp.StatusCode == http.StatusOK:
+		result.Decision = common.AuditDecisionApproved
+	case resp.StatusCode == http.StatusForbidden:
+		result.Decision = common.AuditDecisionRejected
+	case resp.StatusCode == http.StatusTooManyRequests:
+		result.Decision = common.AuditDecisionThrottled
+	default:
+		result.Decision = common.AuditDecisionError
+	}
+	if resp.StatusCode != http.StatusOK && err == nil {
+		var e struct {
+			Message string `json:"message"`
+		}
+		_ = json.Unmarshal([]byte(resp.Body), &e)
+		result.Error = e.Message
+	}
+	return result
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/aws/aws-lambda-go/events"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBatchIssueCertificates(t *testing.T) {
+	f := newFakeACMPCA(t)
+	defer f.server.Close()
+	_, _, cleanup := proxyTestSetup(t, f)
+	defer cleanup()
+
+	issue := func(csr []byte) string {
+		return fmt.Sprintf(`{"IssueCertificate": {"CertificateAuthorityArn": "%s", "Csr": "%s", "SigningAlgorithm": "SHA256WITHRSA",
+			"Validity": {"Type": "DAYS", "Value": 1}}}`, testCAArn, base64.StdEncoding.EncodeToString(csr))
+	}
+	call := func(requests ...string) events.APIGatewayProxyResponse {
+		resp, err := ACMPCAHandler(events.APIGatewayProxyRequest{
+			Headers: map[string]string{"X-Amz-Target": venafiBatchIssueCertificates},
+			Body:    fmt.Sprintf(`{"Requests": [%s]}`, strings.Join(requests, ",")),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := call(issue(createCSR("www.example.com")), issue(createCSR("test.example.org")), issue([]byte("not a csr")),
+		issue(createCSR("api.example.com")))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf(wrongResponseCode, resp.StatusCode, resp.Body)
+	}
+	var out VenafiBatchIssueCertificatesResponse
+	if err := json.Unmarshal([]byte(resp.Body), &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Results) != 4 || out.Approved != 2 || out.Rejected != 1 || out.Failed != 1 {
+		t.Fatalf("unexpected batch results: %s", resp.Body)
+	}
+	for i, decision := range []string{common.AuditDecisionApproved, common.AuditDecisionRejected, common.AuditDecisionError, common.AuditDecisionApproved} {
+		r := out.Results[i]
+		if r.Index != i || r.Decision != decision || r.Target != acmpcaIssueCertificate || r.AuditRecordId == "" {
+			t.Fatalf("unexpected result %d: %+v", i, r)
+		}
+		if _, issued := f.certs[r.CertificateArn]; issued != (decision == common.AuditDecisionApproved) {
+			t.Fatalf("result %d should have certificate ARN only when approved: %+v", i, r)
+		}
+	}
+	if len(out.Results[1].Violations) != 1 || out.Results[1].Error == "" || out.Results[2].Error == "" {
+		t.Fatalf("rejected and failed requests should be explained: %+v", out.Results)
+	}
+	records, _, err := auditStore.Query(common.AuditQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 {
+		t.Fatalf("every request of the batch should be audited, got %d records", len(records))
+	}
+
+	// rejected requests don't wait for the pacer
+	_ = os.Setenv("BATCH_ACMPCA_RATE", "1")
+	defer os.Unsetenv("BATCH_ACMPCA_RATE")
+	requests := []string{issue(createCSR("a.example.org")), issue(createCSR("b.example.org")), issue(createCSR("c.example.org")),
+		issue(createCSR("www.example.com"))}
+	start := time.Now()
+	resp = call(requests...)
+	if err := json.Unmarshal([]byte(resp.Body), &out); err != nil || out.Approved != 1 || out.Rejected != 3 {
+		t.Fatalf("unexpected batch results: %s", resp.Body)
+	}
+	if elapsed := time.Since(start); elapsed > 900*time.Millisecond {
+		t.Fatalf("only the approved request should be paced, the batch took %s", elapsed)
+	}
+
+	// the batch has to be issued at the rate before API Gateway times out
+	_ = os.Setenv("BATCH_ACM_RATE", "1")
+	defer os.Unsetenv("BATCH_ACM_RATE")
+	requests = make([]string, 26)
+	for i := range requests {
+		requests[i] = `{"RequestCertificate": {"DomainName": "www.example.com"}}`
+	}
+	if resp := call(requests...); resp.StatusCode != http.StatusUnprocessableEntity || !strings.Contains(resp.Body, "26s") {
+		t.Fatalf(wrongResponseCode, resp.StatusCode, resp.Body)
+	}
+
+	// waiting for issued certificates counts too, 3 verifications by one worker take up to 30 seconds
+	defer initVerification()
+	for k, v := range map[string]string{"VERIFY_ISSUED_CERTIFICATE": "true", "VERIFY_WAIT_SECONDS": "10", "BATCH_CONCURRENCY": "1"} {
+		_ = os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+	csr := issue(createCSR("www.example.com"))
+	if resp := call(csr, csr, csr); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf(wrongResponseCode, resp.StatusCode, resp.Body)
+	}
+
+	_ = os.Setenv("BATCH_MAX_REQUESTS", "2")
+	defer os.Unsetenv("BATCH_MAX_REQUESTS")
+	tooMany := issue(createCSR("www.example.com"))
+	for _, requests := range [][]string{nil, {`{}`}, {tooMany, tooMany, tooMany},
+		{`{"IssueCertificate": {}, "RequestCertificate": {}}`}} {
+		if resp := call(requests...); resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Fatalf(wrongResponseCode, resp.StatusCode, resp.Body)
+		}
+	}
+}
+
+func TestPacer(t *testing.T) {
+	p := newPacer(100)
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		p.wait()
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("6 calls at 100 per second should take at least 50ms, took %s", elapsed)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/Venafi/vcert/v4/pkg/endpoint"
+	"github.com/aws/aws-sdk-go-v2/service/acm"
+	"github.com/aws/aws-sdk-go-v2/service/acmpca"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPolicyCacheTTL         = time.Minute
+	defaultPolicyCacheNegativeTTL = 10 * time.Second
+)
+
+// policyCache keeps zone policies between requests served by the same container. Missing policies are cached
+// for negativeTTL, other errors are not cached. Zero TTL disables caching.
+type policyCache struct {
+	sync.Mutex
+	ttl         time.Duration
+	negativeTTL time.Duration
+	now         func() time.Time
+	entries     map[string]policyCacheEntry
+	hits        int64
+	misses      int64
+}
+
+type policyCacheEntry struct {
+	policy  endpoint.Policy
+	err     error
+	expires time.Time
+}
+
+func newPolicyCache(ttl, negativeTTL time.Duration) *policyCache {
+	return &policyCache{
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		now:         time.Now,
+		entries:     map[string]policyCacheEntry{},
+	}
+}
+
+var policies *policyCache
+
+func initPolicyCache() {
+	ttl := durationFromEnv("POLICY_CACHE_TTL", defaultPolicyCacheTTL)
+	negativeTTL := durationFromEnv("POLICY_CACHE_NEGATIVE_TTL", defaultPolicyCacheNegativeTTL)
+	if policies == nil || policies.ttl != ttl || policies.negativeTTL != negativeTTL {
+		policies = newPolicyCache(ttl, negativeTTL)
+	}
+	// a zone tag change of a certificate authority takes effect within the same time as a policy change
+	if caTags == nil || caTags.ttl != ttl {
+		caTags = newCATagCache(ttl)
+	}
+}
+
+// durationFromEnv returns Go duration from the environment variable. Zero is allowed.
+func durationFromEnv(name string, def time.Duration) time.Duration {
+	s := os.Getenv(name)
+	if s == "" {
+		return def
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		log.Printf("Ignoring bad %s value %q", name, s)
+		return def
+	}
+	return d
+}
+
+// get returns the policy of the zone from the cache or loads it with getPolicy.
+func (c *policyCache) get(zone string) (endpoint.Policy, error) {
+	c.Lock()
+	e, ok := c.entries[zone]
+	if ok && c.now().Before(e.expires) {
+		c.hits++
+		c.Unlock()
+		putMetric("PolicyCacheHit", 1)
+		return e.policy, e.err
+	}
+	c.misses++
+	c.Unlock()
+	putMetric("PolicyCacheMiss", 1)
+
+	policy, err := getPolicy(zone)
+	ttl := c.ttl
+	if err == common.PolicyNotFound {
+		ttl = c.negativeTTL
+	} else if err != nil {
+		return policy, err
+	}
+	if ttl > 0 {
+		c.Lock()
+		c.entries[zone] = policyCacheEntry{policy: policy, err: err, expires: c.now().Add(ttl)}
+		c.Unlock()
+	}
+	return policy, err
+}
+
+// cachedPolicy returns the zone policy through the container policy cache.
+func cachedPolicy(zone string) (endpoint.Policy, error) {
+	if policies == nil {
+		return getPolicy(zone)
+	}
+	return policies.get(zone)
+}
+
+// caTagCache keeps zone tags of certificate authorities between requests served by the same container, so the
+// tag zone rule doesn't call ListTags on every issuance. Untagged certificate authorities are cached too, errors are
+// not. Zero TTL disables caching.
+type caTagCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	now     func() time.Time
+	entries map[string]caTagCacheEntry
+}
+
+type caTagCacheEntry struct {
+	zone    string
+	expires time.Time
+}
+
+func newCATagCache(ttl time.Duration) *caTagCache {
+	return &caTagCache{ttl: ttl, now: time.Now, entries: map[string]caTagCacheEntry{}}
+}
+
+var caTags *caTagCache
+
+// get returns the zone tag of the certificate authority from the cache or loads it with caZoneTag.
+func (c *caTagCache) get(ctx context.Context, caArn string) (string, error) {
+	c.Lock()
+	e, ok := c.entries[caArn]
+	c.Unlock()
+	if ok && c.now().Before(e.expires) {
+		return e.zone, nil
+	}
+	zone, err := caZoneTag(ctx, caArn)
+	if err != nil {
+		return "", err
+	}
+	if c.ttl > 0 {
+		c.Lock()
+		c.entries[caArn] = caTagCacheEntry{zone: zone, expires: c.now().Add(c.ttl)}
+		c.Unlock()
+	}
+	return zone, nil
+}
+
+// cachedCAZoneTag returns the zone tag of the certificate authority through the container cache.
+func cachedCAZoneTag(ctx context.Context, caArn string) (string, error) {
+	if caTags == nil {
+		return caZoneTag(ctx, caArn)
+	}
+	return caTags.get(ctx, caArn)
+}
+
+// awsClientSet holds ACM, ACM-PCA and KMS clients. They are built once per container because loading AWS config
+// resolves credentials and region on every call.
+type awsClientSet struct {
+	acm    *acm.Client
+	acmpca *acmpca.Client
+	kms    *kms.Client
+}
+
+var (
+	clientsMu sync.Mutex
+	clients   *awsClientSet
+)
+
+func awsClients() (*awsClientSet, error) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	if clients != nil {
+		return clients, nil
+	}
+	awsCfg, err := loadAWSConfig()
+	if err != nil {
+		return nil, err
+	}
+	clients = &awsClientSet{acm: acm.New(awsCfg), acmpca: acmpca.New(awsCfg), kms: kms.New(awsCfg)}
+	return clients, nil
+}
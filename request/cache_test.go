@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/Venafi/vcert/v4/pkg/endpoint"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/external"
+	"testing"
+	"time"
+)
+
+// fakePolicyBackend replaces getPolicy with a table whose policies can be changed between calls.
+type fakePolicyBackend struct {
+	policies map[string]endpoint.Policy
+	err      error
+	loads    int
+}
+
+func (b *fakePolicyBackend) get(zone string) (endpoint.Policy, error) {
+	b.loads++
+	if b.err != nil {
+		return endpoint.Policy{}, b.err
+	}
+	p, ok := b.policies[zone]
+	if !ok {
+		return p, common.PolicyNotFound
+	}
+	return p, nil
+}
+
+func TestPolicyCacheStaleness(t *testing.T) {
+	backend := &fakePolicyBackend{policies: map[string]endpoint.Policy{"zone1": {AllowKeyReuse: false}}}
+	getPolicy = backend.get
+	defer func() { getPolicy = common.GetPolicy }()
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newPolicyCache(time.Minute, 10*time.Second)
+	c.now = func() time.Time { return now }
+
+	if _, err := c.get("zone1"); err != nil {
+		t.Fatal(err)
+	}
+	// the table changes, but the cached policy is served until TTL
+	backend.policies["zone1"] = endpoint.Policy{AllowKeyReuse: true}
+	now = now.Add(59 * time.Second)
+	if p, _ := c.get("zone1"); p.AllowKeyReuse {
+		t.Fatal("policy should be served from cache within TTL")
+	}
+	now = now.Add(time.Second)
+	if p, _ := c.get("zone1"); !p.AllowKeyReuse {
+		t.Fatal("policy should be reloaded after TTL")
+	}
+	if backend.loads != 2 || c.hits != 1 || c.misses != 2 {
+		t.Fatalf("unexpected loads %d, hits %d, misses %d", backend.loads, c.hits, c.misses)
+	}
+
+	// missing policy is cached for negative TTL only
+	if _, err := c.get("zone2"); err != common.PolicyNotFound {
+		t.Fatalf("expected policy not found, got %v", err)
+	}
+	backend.policies["zone2"] = endpoint.Policy{}
+	now = now.Add(9 * time.Second)
+	if _, err := c.get("zone2"); err != common.PolicyNotFound {
+		t.Fatal("missing policy should be cached within negative TTL")
+	}
+	now = now.Add(time.Second)
+	if _, err := c.get("zone2"); err != nil {
+		t.Fatalf("policy should be reloaded after negative TTL: %s", err)
+	}
+
+	// other errors are not cached
+	backend.err = errors.New("throttled")
+	loads := backend.loads
+	for i := 0; i < 2; i++ {
+		if _, err := c.get("zone3"); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+	if backend.loads != loads+2 {
+		t.Fatal("errors should not be cached")
+	}
+
+	// zero TTL disables caching
+	backend.err = nil
+	c = newPolicyCache(0, 0)
+	loads = backend.loads
+	_, _ = c.get("zone1")
+	_, _ = c.get("zone1")
+	if backend.loads != loads+2 {
+		t.Fatal("policy should not be cached with zero TTL")
+	}
+}
+
+func TestCATagCache(t *testing.T) {
+	f := newFakeACMPCA(t)
+	defer f.server.Close()
+	_, _, cleanup := proxyTestSetup(t, f)
+	defer cleanup()
+	f.tags = map[string]string{zoneTagKey: "tagged-zone"}
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newCATagCache(time.Minute)
+	c.now = func() time.Time { return now }
+	for i := 0; i < 3; i++ {
+		if zone, err := c.get(context.Background(), testCAArn); err != nil || zone != "tagged-zone" {
+			t.Fatalf("unexpected zone %q: %v", zone, err)
+		}
+	}
+	if f.listTagsCalls != 1 {
+		t.Fatalf("tags should be listed once within TTL, listed %d times", f.listTagsCalls)
+	}
+	f.tags = nil
+	now = now.Add(time.Minute)
+	if zone, _ := c.get(context.Background(), testCAArn); zone != "" || f.listTagsCalls != 2 {
+		t.Fatalf("tags should be reloaded after TTL, got zone %q", zone)
+	}
+	if zone, _ := c.get(context.Background(), testCAArn); zone != "" || f.listTagsCalls != 2 {
+		t.Fatal("untagged certificate authority should be cached")
+	}
+}
+
+func TestAWSClientsBuiltOnce(t *testing.T) {
+	loads := 0
+	loadAWSConfig = func(...external.Config) (aws.Config, error) {
+		loads++
+		return aws.Config{Region: "eu-west-1"}, nil
+	}
+	clients = nil
+	defer func() {
+		loadAWSConfig = external.LoadDefaultAWSConfig
+		clients = nil
+	}()
+	first, err := awsClients()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := awsClients()
+	if loads != 1 || first != second {
+		t.Fatalf("clients should be built once, config loaded %d times", loads)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/acmpca"
+	"net/http"
+	"time"
+)
+
+// enrollment is a certificate request received over an enrollment protocol (ACME, EST, SCEP). It's sent through
+// the IssueCertificate handler, so it's checked against the zone policy, audited and limited the same way
+// as API requests.
+type enrollment struct {
+	Caller string
+	// Zones the caller may request certificates from, comma separated. Empty allows any zone.
+	Zones string
+	// Zone is requested zone, zone selection rules apply when it's empty
+	Zone         string
+	CAArn        string
+	CSR          []byte
+	ValidityDays int64
+	// NotAfter, when set, is the end of validity instead of ValidityDays, for validities that aren't whole days
+	NotAfter         time.Time
+	IdempotencyToken string
+}
+
+// enroll issues the certificate for DER encoded CSR of the enrollment. It returns the certificate ARN, or
+// the handler response when the request is rejected.
+func enroll(ctx context.Context, e enrollment) (string, events.APIGatewayProxyResponse, error) {
+	alg, err := caSigningAlgorithm(ctx, e.CAArn)
+	if err != nil {
+		return "", events.APIGatewayProxyResponse{}, fmt.Errorf("can't get certificate authority: %s", err)
+	}
+	in := acmpca.IssueCertificateInput{
+		CertificateAuthorityArn: aws.String(e.CAArn),
+		Csr:                     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: e.CSR}),
+		SigningAlgorithm:        alg,
+		Validity:                &acmpca.Validity{Type: acmpca.ValidityPeriodTypeDays, Value: aws.Int64(e.ValidityDays)},
+	}
+	if !e.NotAfter.IsZero() {
+		in.Validity = &acmpca.Validity{Type: acmpca.ValidityPeriodTypeAbsolute, Value: aws.Int64(e.NotAfter.Unix())}
+	}
+	if e.IdempotencyToken != "" {
+		in.IdempotencyToken = aws.String(e.IdempotencyToken)
+	}
+	body, err := json.Marshal(ACMPCAIssueCertificateRequest{IssueCertificateInput: in, VenafiZone: e.Zone})
+	if err != nil {
+		return "", events.APIGatewayProxyResponse{}, err
+	}
+	request := events.APIGatewayProxyRequest{
+		Headers: map[string]string{"X-Amz-Target": acmpcaIssueCertificate},
+		Body:    string(body),
+	}
+	request.RequestContext.Identity.Caller = e.Caller
+	if e.Zones != "" {
+		request.RequestContext.Authorizer = map[string]interface{}{authorizerZones: e.Zones}
+	}
+	initHandler()
+	resp, err := audited(request, acmpcaIssueCertificate, venafiACMPCAIssueCertificateRequest)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return "", resp, err
+	}
+	var out struct {
+		CertificateArn string `json:"CertificateArn"`
+	}
+	err = json.Unmarshal([]byte(resp.Body), &out)
+	return out.CertificateArn, resp, err
+}
+
+// handlerMessage returns the error message of the handler response.
+func handlerMessage(resp events.APIGatewayProxyResponse) string {
+	var out struct {
+		Message string `json:"message"`
+	}
+	_ = json.Unmarshal([]byte(resp.Body), &out)
+	return out.Message
+}
+
+// caSigningAlgorithm returns ACM-PCA signing algorithm for the CA key type. ACM-PCA signs with the CA key,
+// so the algorithm follows the CA and not the CSR.
+func caSigningAlgorithm(ctx context.Context, caArn string) (acmpca.SigningAlgorithm, error) {
+	certPEM, _, err := caCertificate(ctx, caArn)
+	if err != nil {
+		return "", err
+	}
+	ca, err := parseCertificatePEM(certPEM)
+	if err != nil {
+		return "", err
+	}
+	switch ca.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		return acmpca.SigningAlgorithmSha256withecdsa, nil
+	case *rsa.PublicKey:
+		return acmpca.SigningAlgorithmSha256withrsa, nil
+	}
+	return "", fmt.Errorf("unsupported CA key type %T", ca.PublicKey)
+}
+
+// caCertificate returns PEM encoded certificate of the CA and its chain.
+func caCertificate(ctx context.Context, caArn string) (string, string, error) {
+	cli, err := awsClients()
+	if err != nil {
+		return "", "", err
+	}
+	resp, err := cli.acmpca.GetCertificateAuthorityCertificateRequest(&acmpca.GetCertificateAuthorityCertificateInput{
+		CertificateAuthorityArn: aws.String(caArn),
+	}).Send(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	return aws.StringValue(resp.Certificate), aws.StringValue(resp.CertificateChain), nil
+}
+
+// certificateIssued waits up to wait for the certificate. ACM-PCA issues certificates asynchronously.
+func certificateIssued(ctx context.Context, caArn, arn string, wait time.Duration) bool {
+	cli, err := awsClients()
+	if err != nil {
+		return false
+	}
+	attempts := int(wait / verifyWaitDelay)
+	if attempts < 1 {
+		attempts = 1
+	}
+	err = cli.acmpca.WaitUntilCertificateIssued(ctx, &acmpca.GetCertificateInput{
+		CertificateArn:          aws.String(arn),
+		CertificateAuthorityArn: aws.String(caArn),
+	}, aws.WithWaiterMaxAttempts(attempts), aws.WithWaiterDelay(aws.ConstantWaiterDelay(verifyWaitDelay)))
+	return err == nil
+}
+
+// issuedCertificate returns PEM encoded issued certificate and its chain.
+func issuedCertificate(ctx context.Context, caArn, arn string) (string, string, error) {
+	cli, err := awsClients()
+	if err != nil {
+		return "", "", err
+	}
+	resp, err := cli.acmpca.GetCertificateRequest(&acmpca.GetCertificateInput{
+		CertificateArn:          aws.String(arn),
+		CertificateAuthorityArn: aws.String(caArn),
+	}).Send(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	return aws.StringValue(resp.Certificate), aws.StringValue(resp.CertificateChain), nil
+}
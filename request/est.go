@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	estPrefix = "/.well-known/est"
+
+	estCACerts        = "cacerts"
+	estSimpleEnroll   = "simpleenroll"
+	estSimpleReenroll = "simplereenroll"
+
+	estIssueWait  = 10 * time.Second
+	estRetryAfter = "10"
+)
+
+// estUser is a device account for HTTP basic authentication. Zones limits zones the user can enroll in,
+// any zone is allowed when it's empty.
+type estUser struct {
+	Username string   `json:"Username"`
+	Password string   `json:"Password"`
+	Zones    []string `json:"Zones"`
+}
+
+// estServer implements EST (RFC 7030) simple enrollment on top of the request handler. EST labels are mapped
+// to Venafi zones and enrollment requests go through the same zone policy check, audit and limits as
+// IssueCertificate requests.
+type estServer struct {
+	caArn        string
+	validityDays int64
+	// labels maps EST labels to zones, "" is the label of requests without one
+	labels map[string]string
+	users  map[string]estUser
+	// clientZones are the zones of TLS client certificates
+	clientZones certificateZones
+}
+
+// newESTServerFromEnv returns EST server for EST_CA_ARN or nil if EST is disabled.
+func newESTServerFromEnv() (*estServer, error) {
+	caArn := os.Getenv("EST_CA_ARN")
+	if caArn == "" {
+		return nil, nil
+	}
+	s := &estServer{caArn: caArn, validityDays: 365, labels: map[string]string{}, users: map[string]estUser{}}
+	var err error
+	if s.clientZones, err = certificateZonesFromEnv(); err != nil {
+		return nil, err
+	}
+	if v := os.Getenv("EST_VALIDITY_DAYS"); v != "" {
+		days, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || days < 1 {
+			return nil, fmt.Errorf("bad EST_VALIDITY_DAYS value %q", v)
+		}
+		s.validityDays = days
+	}
+	if v := os.Getenv("EST_LABELS"); v != "" {
+		err := json.Unmarshal([]byte(v), &s.labels)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse EST_LABELS: %s", err)
+		}
+	}
+	if f := os.Getenv("EST_USERS_FILE"); f != "" {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("can't read EST_USERS_FILE: %s", err)
+		}
+		var users []estUser
+		err = json.Unmarshal(b, &users)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse EST_USERS_FILE: %s", err)
+		}
+		for _, u := range users {
+			if u.Username == "" || u.Password == "" {
+				return nil, fmt.Errorf("EST_USERS_FILE has entry without Username or Password")
+			}
+			s.users[u.Username] = u
+		}
+	}
+	return s, nil
+}
+
+func (s *estServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, estPrefix), "/"), "/")
+	label, op := "", parts[len(parts)-1]
+	switch len(parts) {
+	case 1:
+	case 2:
+		label = parts[0]
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	zone, ok := s.labels[label]
+	if !ok && label != "" {
+		http.Error(w, fmt.Sprintf("unknown EST label %s", label), http.StatusNotFound)
+		return
+	}
+	switch {
+	case op == estCACerts && r.Method == http.MethodGet:
+		s.caCerts(w, r)
+	case (op == estSimpleEnroll || op == estSimpleReenroll) && r.Method == http.MethodPost:
+		s.enroll(w, r, zone, op == estSimpleReenroll)
+	case op == estCACerts || op == estSimpleEnroll || op == estSimpleReenroll:
+		http.Error(w, fmt.Sprintf("method %s is not allowed", r.Method), http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writePKCS7(w http.ResponseWriter, certs []*x509.Certificate) {
+	b, err := pkcs7CertsOnly(certs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pkcs7-mime; smime-type=certs-only")
+	w.Header().Set("Content-Transfer-Encoding", "base64")
+	w.WriteHeader(http.StatusOK)
+	_, _ = io.WriteString(w, base64.StdEncoding.EncodeToString(b))
+}
+
+// parseCertificates returns all certificates of PEM bundles.
+func parseCertificates(bundles ...string) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for _, bundle := range bundles {
+		rest := []byte(bundle)
+		for {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, cert)
+		}
+	}
+	return certs, nil
+}
+
+// caCerts returns the CA certificate and its chain (RFC 7030 section 4.1).
+func (s *estServer) caCerts(w http.ResponseWriter, r *http.Request) {
+	ca, chain, err := caCertificate(r.Context(), s.caArn)
+	var certs []*x509.Certificate
+	if err == nil {
+		certs, err = parseCertificates(ca, chain)
+	}
+	if err != nil {
+		log.Println("Can't get EST CA certificates:", err)
+		http.Error(w, "can't get CA certificates", http.StatusInternalServerError)
+		return
+	}
+	writePKCS7(w, certs)
+}
+
+// authenticate returns the caller and the zones it can enroll in. Verified TLS client certificates identify the
+// caller only when TLS_CLIENT_ZONES maps them to zones, otherwise HTTP basic authentication is required.
+func (s *estServer) authenticate(r *http.Request) (caller string, zones []string, ok bool) {
+	if caller, zones, ok = s.clientZones.identify(r); ok {
+		return caller, zones, true
+	}
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return "", nil, false
+	}
+	u, known := s.users[username]
+	// compare hashes, so the time doesn't depend on the password length either
+	want, got := sha256.Sum256([]byte(u.Password)), sha256.Sum256([]byte(password))
+	if !known || subtle.ConstantTimeCompare(want[:], got[:]) != 1 {
+		return "", nil, false
+	}
+	return "est-user:" + username, u.Zones, true
+}
+
+// readCSR reads base64 encoded PKCS#10 request body.
+func readCSR(r *http.Request) (*x509.CertificateRequest, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRequestBodySize))
+	if err != nil {
+		return nil, err
+	}
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(body)), ""))
+	if err != nil {
+		return nil, fmt.Errorf("request body is not base64 encoded PKCS#10")
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse PKCS#10 request: %s", err)
+	}
+	if err = csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("bad PKCS#10 request signature: %s", err)
+	}
+	return csr, nil
+}
+
+// enroll handles simpleenroll and simplereenroll (RFC 7030 section 4.2).
+func (s *estServer) enroll(w http.ResponseWriter, r *http.Request, zone string, reenroll bool) {
+	caller, zones, ok := s.authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="EST"`)
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+	csr, err := readCSR(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if reenroll {
+		// the renewed certificate has to keep the identity of the certificate the client authenticated with
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, "re-enrollment requires the current certificate as TLS client certificate", http.StatusForbidden)
+			return
+		}
+		current := r.TLS.VerifiedChains[0][0]
+		if current.Subject.String() != csr.Subject.String() || !reflect.DeepEqual(current.DNSNames, csr.DNSNames) {
+			http.Error(w, "re-enrollment request subject doesn't match the current certificate", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// the same CSR of the same caller gets the same certificate, so retries after 202 don't issue again
+	sum := sha256.Sum256(csr.Raw)
+	arn, resp, err := enroll(r.Context(), enrollment{
+		Caller:           caller,
+		Zones:            strings.Join(zones, ","),
+		Zone:             zone,
+		CAArn:            s.caArn,
+		CSR:              csr.Raw,
+		ValidityDays:     s.validityDays,
+		IdempotencyToken: hex.EncodeToString(sum[:16]),
+	})
+	switch {
+	case err != nil:
+		log.Println("EST enrollment error:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	case resp.StatusCode == http.StatusTooManyRequests:
+		w.Header().Set("Retry-After", resp.Headers["Retry-After"])
+		http.Error(w, handlerMessage(resp), http.StatusServiceUnavailable)
+		return
+	case resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusForbidden ||
+		resp.StatusCode == http.StatusUnprocessableEntity:
+		http.Error(w, handlerMessage(resp), http.StatusBadRequest)
+		return
+	case resp.StatusCode != http.StatusOK:
+		http.Error(w, handlerMessage(resp), http.StatusInternalServerError)
+		return
+	}
+
+	if !certificateIssued(r.Context(), s.caArn, arn, estIssueWait) {
+		w.Header().Set("Retry-After", estRetryAfter)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	certPEM, _, err := issuedCertificate(r.Context(), s.caArn, arn)
+	var certs []*x509.Certificate
+	if err == nil {
+		certs, err = parseCertificates(certPEM)
+	}
+	if err != nil {
+		log.Println("Can't get EST certificate:", err)
+		http.Error(w, "can't get issued certificate", http.StatusInternalServerError)
+		return
+	}
+	writePKCS7(w, certs)
+}
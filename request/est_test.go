@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// parsePKCS7Certs returns certificates of base64 encoded PKCS#7 certs-only response.
+func parsePKCS7Certs(t *testing.T, body []byte) []*x509.Certificate {
+	der, err := base64.StdEncoding.DecodeString(string(body))
+	if err != nil {
+		t.Fatalf("response is not base64: %s", body)
+	}
+	return pkcs7Certs(t, der)
+}
+
+func pkcs7Certs(t *testing.T, der []byte) []*x509.Certificate {
+	var ci pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil || !ci.ContentType.Equal(oidPKCS7SignedData) {
+		t.Fatalf("response is not PKCS#7 signed data: %v", err)
+	}
+	var sd pkcs7SignedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		t.Fatal(err)
+	}
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certs
+}
+
+func estCSR(t *testing.T, key *ecdsa.PrivateKey, cn string) string {
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: cn},
+		DNSNames: []string{cn},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(der)
+}
+
+func TestESTEnrollment(t *testing.T) {
+	f := newFakeACMPCA(t)
+	defer f.server.Close()
+	_, zones, cleanup := proxyTestSetup(t, f)
+	defer cleanup()
+
+	est := &estServer{
+		caArn:        testCAArn,
+		validityDays: 1,
+		labels:       map[string]string{"iot": "iot-zone"},
+		users: map[string]estUser{
+			"device":  {Username: "device", Password: "secret", Zones: []string{"iot-zone"}},
+			"printer": {Username: "printer", Password: "secret", Zones: []string{"printers"}},
+		},
+	}
+	srv := httptest.NewUnstartedServer(&requestServer{est: est})
+	pool := x509.NewCertPool()
+	pool.AddCert(f.caCert)
+	srv.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: pool}
+	srv.StartTLS()
+	defer srv.Close()
+
+	send := func(cli *http.Client, method, path, user, body string) (int, []byte) {
+		req, _ := http.NewRequest(method, srv.URL+estPrefix+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/pkcs10")
+		if user != "" {
+			req.SetBasicAuth(user, "secret")
+		}
+		resp, err := cli.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, b
+	}
+	cli := srv.Client()
+
+	status, body := send(cli, http.MethodGet, "/cacerts", "", "")
+	if status != http.StatusOK {
+		t.Fatalf("cacerts returned %d: %s", status, body)
+	}
+	if certs := parsePKCS7Certs(t, body); len(certs) != 1 || !certs[0].Equal(f.caCert) {
+		t.Fatalf("cacerts should return the CA certificate, got %d certificates", len(certs))
+	}
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	csr := estCSR(t, key, "device1.example.com")
+	if status, _ := send(cli, http.MethodPost, "/iot/simpleenroll", "", csr); status != http.StatusUnauthorized {
+		t.Fatalf("enrollment without credentials should be rejected, got %d", status)
+	}
+	if status, _ := send(cli, http.MethodPost, "/unknown/simpleenroll", "device", csr); status != http.StatusNotFound {
+		t.Fatalf("enrollment with unknown label should be rejected, got %d", status)
+	}
+	if status, _ := send(cli, http.MethodPost, "/iot/simpleenroll", "printer", csr); status != http.StatusBadRequest {
+		t.Fatalf("enrollment in zone the user can't use should be rejected, got %d", status)
+	}
+	if status, _ := send(cli, http.MethodPost, "/iot/simpleenroll", "device", estCSR(t, key, "device1.example.org")); status != http.StatusBadRequest {
+		t.Fatalf("enrollment violating zone policy should be rejected, got %d", status)
+	}
+
+	status, body = send(cli, http.MethodPost, "/iot/simpleenroll", "device", csr)
+	if status != http.StatusOK {
+		t.Fatalf("simpleenroll returned %d: %s", status, body)
+	}
+	issued := parsePKCS7Certs(t, body)
+	if len(issued) != 1 || issued[0].Subject.CommonName != "device1.example.com" {
+		t.Fatalf("unexpected enrolled certificates: %v", issued)
+	}
+	if (*zones)[len(*zones)-1] != "iot-zone" {
+		t.Fatalf("EST label should select the zone, zones: %v", *zones)
+	}
+
+	if status, _ := send(cli, http.MethodPost, "/iot/simplereenroll", "device", csr); status != http.StatusForbidden {
+		t.Fatalf("re-enrollment without client certificate should be rejected, got %d", status)
+	}
+	// a new transport, so connections made without the client certificate aren't reused
+	transport := cli.Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = []tls.Certificate{{Certificate: [][]byte{issued[0].Raw}, PrivateKey: key}}
+	tlsCli := &http.Client{Transport: transport}
+	newKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	// client certificates are only accepted with a zone mapping
+	if status, _ := send(tlsCli, http.MethodPost, "/iot/simplereenroll", "", estCSR(t, newKey, "device1.example.com")); status != http.StatusUnauthorized {
+		t.Fatalf("client certificate without zone mapping should be rejected, got %d", status)
+	}
+	est.clientZones = certificateZones{"dns:device1.example.com": {"printers"}}
+	if status, _ := send(tlsCli, http.MethodPost, "/iot/simplereenroll", "", estCSR(t, newKey, "device1.example.com")); status != http.StatusBadRequest {
+		t.Fatalf("client certificate should only enroll in its zones, got %d", status)
+	}
+	est.clientZones = certificateZones{"dns:device1.example.com": {"iot-zone"}}
+	if status, _ := send(tlsCli, http.MethodPost, "/iot/simplereenroll", "", estCSR(t, newKey, "device2.example.com")); status != http.StatusBadRequest {
+		t.Fatalf("re-enrollment for another subject should be rejected, got %d", status)
+	}
+	status, body = send(tlsCli, http.MethodPost, "/iot/simplereenroll", "", estCSR(t, newKey, "device1.example.com"))
+	if status != http.StatusOK {
+		t.Fatalf("simplereenroll returned %d: %s", status, body)
+	}
+	if renewed := parsePKCS7Certs(t, body); renewed[0].SerialNumber.Cmp(issued[0].SerialNumber) == 0 {
+		t.Fatal("re-enrollment should issue a new certificate")
+	}
+}
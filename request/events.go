@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// eventEnvelope has just enough of the event to tell which integration invoked the lambda.
+type eventEnvelope struct {
+	Version        string `json:"version"`
+	RequestContext struct {
+		ELB  json.RawMessage `json:"elb"`
+		HTTP json.RawMessage `json:"http"`
+	} `json:"requestContext"`
+}
+
+// HandleEvent accepts API Gateway REST API (v1), HTTP API (v2), Lambda function URL and ALB target group events,
+// serves them with ACMPCAHandler and answers in the format of the invoking integration.
+func HandleEvent(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	var envelope eventEnvelope
+	err := json.Unmarshal(payload, &envelope)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse event: %s", err)
+	}
+
+	switch {
+	case len(envelope.RequestContext.ELB) > 0:
+		var event events.ALBTargetGroupRequest
+		err = json.Unmarshal(payload, &event)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := handleProxyRequest(proxyRequestFromALB(event))
+		return albResponse(resp, event.MultiValueHeaders != nil), err
+	case strings.HasPrefix(envelope.Version, "2.") && len(envelope.RequestContext.HTTP) > 0:
+		// function URLs use the same payload format as HTTP API v2
+		var event events.APIGatewayV2HTTPRequest
+		err = json.Unmarshal(payload, &event)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := handleProxyRequest(proxyRequestFromV2(event))
+		return v2Response(resp), err
+	default:
+		var event events.APIGatewayProxyRequest
+		err = json.Unmarshal(payload, &event)
+		if err != nil {
+			return nil, err
+		}
+		return handleProxyRequest(event)
+	}
+}
+
+func handleProxyRequest(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if request.IsBase64Encoded {
+		body, err := base64.StdEncoding.DecodeString(request.Body)
+		if err != nil {
+			return clientError(http.StatusBadRequest, fmt.Sprintf("Can't decode base64 request body: %s", err))
+		}
+		request.Body = string(body)
+		request.IsBase64Encoded = false
+	}
+	return ACMPCAHandler(request)
+}
+
+func proxyRequestFromV2(e events.APIGatewayV2HTTPRequest) events.APIGatewayProxyRequest {
+	request := events.APIGatewayProxyRequest{
+		Path:                  e.RawPath,
+		HTTPMethod:            e.RequestContext.HTTP.Method,
+		Headers:               e.Headers,
+		QueryStringParameters: e.QueryStringParameters,
+		PathParameters:        e.PathParameters,
+		StageVariables:        e.StageVariables,
+		Body:                  e.Body,
+		IsBase64Encoded:       e.IsBase64Encoded,
+	}
+	if q, err := url.ParseQuery(e.RawQueryString); err == nil {
+		request.MultiValueQueryStringParameters = q
+	}
+	rc := &request.RequestContext
+	rc.AccountID = e.RequestContext.AccountID
+	rc.Stage = e.RequestContext.Stage
+	rc.RequestID = e.RequestContext.RequestID
+	rc.APIID = e.RequestContext.APIID
+	rc.HTTPMethod = e.RequestContext.HTTP.Method
+	rc.ResourcePath = e.RequestContext.HTTP.Path
+	rc.Identity.SourceIP = e.RequestContext.HTTP.SourceIP
+	rc.Identity.UserAgent = e.RequestContext.HTTP.UserAgent
+	if a := e.RequestContext.Authorizer; a != nil {
+		if a.IAM != nil {
+			rc.Identity.AccountID = a.IAM.AccountID
+			rc.Identity.AccessKey = a.IAM.AccessKey
+			rc.Identity.Caller = a.IAM.CallerID
+			rc.Identity.User = a.IAM.UserID
+			rc.Identity.UserArn = a.IAM.UserARN
+		}
+		if a.Lambda != nil {
+			rc.Authorizer = a.Lambda
+		}
+	}
+	return request
+}
+
+func proxyRequestFromALB(e events.ALBTargetGroupRequest) events.APIGatewayProxyRequest {
+	request := events.APIGatewayProxyRequest{
+		Path:                            e.Path,
+		HTTPMethod:                      e.HTTPMethod,
+		Headers:                         e.Headers,
+		MultiValueHeaders:               e.MultiValueHeaders,
+		QueryStringParameters:           e.QueryStringParameters,
+		MultiValueQueryStringParameters: e.MultiValueQueryStringParameters,
+		Body:                            e.Body,
+		IsBase64Encoded:                 e.IsBase64Encoded,
+	}
+	request.RequestContext.HTTPMethod = e.HTTPMethod
+	request.RequestContext.ResourcePath = e.Path
+	request.RequestContext.Identity.UserAgent = headerValue(request, "User-Agent")
+	// ALB appends the client address to X-Forwarded-For
+	if xff := headerValues(request, "X-Forwarded-For"); len(xff) > 0 {
+		addrs := strings.Split(xff[len(xff)-1], ",")
+		request.RequestContext.Identity.SourceIP = strings.TrimSpace(addrs[len(addrs)-1])
+	}
+	return request
+}
+
+func v2Response(resp events.APIGatewayProxyResponse) events.APIGatewayV2HTTPResponse {
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode:        resp.StatusCode,
+		Headers:           withContentType(resp.Headers),
+		MultiValueHeaders: resp.MultiValueHeaders,
+		Body:              resp.Body,
+		IsBase64Encoded:   resp.IsBase64Encoded,
+	}
+}
+
+// albResponse answers in the header format of the target group: ALB only uses multiValueHeaders when
+// multi value headers are enabled and only headers otherwise.
+func albResponse(resp events.APIGatewayProxyResponse, multiValue bool) events.ALBTargetGroupResponse {
+	out := events.ALBTargetGroupResponse{
+		StatusCode:        resp.StatusCode,
+		StatusDescription: fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode)),
+		Body:              resp.Body,
+		IsBase64Encoded:   resp.IsBase64Encoded,
+	}
+	headers := withContentType(resp.Headers)
+	if !multiValue {
+		out.Headers = headers
+		return out
+	}
+	out.MultiValueHeaders = make(map[string][]string, len(headers)+len(resp.MultiValueHeaders))
+	for k, v := range resp.MultiValueHeaders {
+		out.MultiValueHeaders[k] = v
+	}
+	for k, v := range headers {
+		out.MultiValueHeaders[k] = []string{v}
+	}
+	return out
+}
+
+func withContentType(headers map[string]string) map[string]string {
+	out := make(map[string]string, len(headers)+1)
+	for k, v := range headers {
+		out[k] = v
+	}
+	if _, ok := out["Content-Type"]; !ok {
+		out["Content-Type"] = "application/json"
+	}
+	return out
+}
+
+// headerValues looks header up case-insensitively, since HTTP API and function URLs lowercase header names.
+func headerValues(request events.APIGatewayProxyRequest, name string) []string {
+	for k, v := range request.MultiValueHeaders {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	for k, v := range request.Headers {
+		if strings.EqualFold(k, name) {
+			return []string{v}
+		}
+	}
+	return nil
+}
+
+func headerValue(request events.APIGatewayProxyRequest, name string) string {
+	if v := headerValues(request, name); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func queryValues(request events.APIGatewayProxyRequest) url.Values {
+	q := url.Values{}
+	for k, v := range request.MultiValueQueryStringParameters {
+		q[k] = v
+	}
+	for k, v := range request.QueryStringParameters {
+		if _, ok := q[k]; !ok {
+			q.Set(k, v)
+		}
+	}
+	return q
+}
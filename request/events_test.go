@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/aws/aws-lambda-go/events"
+	"net/http"
+	"testing"
+)
+
+func TestHandleEventFormats(t *testing.T) {
+	store := common.NewMemoryAuditStore()
+	_ = store.Save(common.AuditRecord{ID: "1", Zone: "zone1", Decision: common.AuditDecisionApproved})
+	auditStore = store
+	defer func() { auditStore = nil }()
+
+	body := base64.StdEncoding.EncodeToString([]byte(`{"Zone": "zone1"}`))
+
+	v2 := `{
+		"version": "2.0",
+		"rawPath": "/",
+		"headers": {"x-amz-target": "` + venafiQueryAuditLog + `"},
+		"requestContext": {
+			"http": {"method": "POST", "path": "/", "sourceIp": "192.0.2.10"},
+			"authorizer": {"iam": {"userArn": "arn:aws:iam::123456789012:user/alice", "accessKey": "AKIDEXAMPLE"}}
+		},
+		"body": "` + body + `",
+		"isBase64Encoded": true
+	}`
+	resp, err := HandleEvent(context.Background(), json.RawMessage(v2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2Resp, ok := resp.(events.APIGatewayV2HTTPResponse)
+	if !ok {
+		t.Fatalf("expected HTTP API response, got %T", resp)
+	}
+	if v2Resp.StatusCode != http.StatusOK || v2Resp.Headers["Content-Type"] != "application/json" {
+		t.Fatalf("unexpected response: %+v", v2Resp)
+	}
+	var out VenafiQueryAuditLogResponse
+	err = json.Unmarshal([]byte(v2Resp.Body), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Records) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(out.Records))
+	}
+
+	alb := `{
+		"requestContext": {"elb": {"targetGroupArn": "arn:aws:elasticloadbalancing:eu-west-1:123456789012:targetgroup/tg/1"}},
+		"httpMethod": "POST",
+		"path": "/",
+		"multiValueHeaders": {"x-amz-target": ["` + venafiQueryAuditLog + `"], "x-forwarded-for": ["198.51.100.1, 192.0.2.10"]},
+		"body": "{\"Zone\": \"zone1\"}",
+		"isBase64Encoded": false
+	}`
+	resp, err = HandleEvent(context.Background(), json.RawMessage(alb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	albResp, ok := resp.(events.ALBTargetGroupResponse)
+	if !ok {
+		t.Fatalf("expected ALB response, got %T", resp)
+	}
+	if albResp.StatusCode != http.StatusOK || albResp.StatusDescription != "200 OK" {
+		t.Fatalf("unexpected response: %+v", albResp)
+	}
+	if albResp.Headers != nil || len(albResp.MultiValueHeaders["Content-Type"]) != 1 {
+		t.Fatalf("multi value target group should get only multi value headers: %+v", albResp)
+	}
+
+	v1 := `{"httpMethod": "POST", "headers": {"x-amz-target": "Unknown"}, "body": "{}"}`
+	resp, err = HandleEvent(context.Background(), json.RawMessage(v1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1Resp, ok := resp.(events.APIGatewayProxyResponse)
+	if !ok {
+		t.Fatalf("expected REST API response, got %T", resp)
+	}
+	if v1Resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", v1Resp.StatusCode)
+	}
+}
+
+func TestProxyRequestConversion(t *testing.T) {
+	request := proxyRequestFromALB(events.ALBTargetGroupRequest{
+		HTTPMethod: http.MethodPost,
+		Path:       "/",
+		Headers:    map[string]string{"x-forwarded-for": "198.51.100.1, 192.0.2.10", "user-agent": "aws-cli"},
+	})
+	if request.RequestContext.Identity.SourceIP != "192.0.2.10" {
+		t.Fatalf("source IP should be the address ALB appended, got %s", request.RequestContext.Identity.SourceIP)
+	}
+	if headerValue(request, "User-Agent") != "aws-cli" {
+		t.Fatal("headers should be looked up case-insensitively")
+	}
+
+	var e events.APIGatewayV2HTTPRequest
+	e.RawPath = "/"
+	e.RawQueryString = "a=1&a=2"
+	e.RequestContext.Authorizer = &events.APIGatewayV2HTTPRequestContextAuthorizerDescription{
+		Lambda: map[string]interface{}{authorizerZones: "zone1"},
+	}
+	request = proxyRequestFromV2(e)
+	if len(request.MultiValueQueryStringParameters["a"]) != 2 {
+		t.Fatalf("query should be parsed from raw query string: %v", request.MultiValueQueryStringParameters)
+	}
+	if authorizeZone(request, "zone2") == nil {
+		t.Fatal("lambda authorizer zones should be enforced")
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"log"
+	"os"
+	"time"
+)
+
+// idempotentReplayHeader is set on responses which return the result of an earlier request.
+const idempotentReplayHeader = "X-Venafi-Idempotent-Replay"
+
+var (
+	idempotencyStore  common.IdempotencyStore
+	idempotencyWindow = time.Hour
+)
+
+func initIdempotency() {
+	idempotencyWindow = time.Hour
+	if s := os.Getenv("IDEMPOTENCY_WINDOW"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			log.Printf("Ignoring bad IDEMPOTENCY_WINDOW value %q", s)
+		} else {
+			idempotencyWindow = d
+		}
+	}
+	if idempotencyStore == nil {
+		idempotencyStore = common.NewIdempotencyStoreFromEnv()
+	}
+}
+
+// issuanceKey identifies an issuance request for deduplication. IdempotencyToken is scoped to the caller and
+// certificate authority as in ACM-PCA. Without the token, the same CSR from the same caller to the same zone and
+// certificate authority with the same issuance parameters is considered a replay.
+func issuanceKey(request events.APIGatewayProxyRequest, certRequest ACMPCAIssueCertificateRequest, csr []byte) string {
+	h := sha256.New()
+	write := func(parts ...string) {
+		for _, p := range parts {
+			h.Write([]byte(p))
+			h.Write([]byte{0})
+		}
+	}
+	caArn := aws.StringValue(certRequest.CertificateAuthorityArn)
+	if token := aws.StringValue(certRequest.IdempotencyToken); token != "" {
+		write("token", callerPrincipal(request), caArn, token)
+	} else {
+		var validity string
+		if v := certRequest.Validity; v != nil {
+			validity = fmt.Sprintf("%s %d", v.Type, aws.Int64Value(v.Value))
+		}
+		write("csr", callerPrincipal(request), certRequest.VenafiZone, caArn, validity,
+			string(certRequest.SigningAlgorithm), aws.StringValue(certRequest.TemplateArn))
+		h.Write(csr)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// previousIssuance returns the record of the certificate issued for key within the idempotency window.
+// Lookup failures are only logged, the request is then handled as a new one.
+func previousIssuance(key string) (common.IdempotencyRecord, bool) {
+	if idempotencyStore == nil {
+		return common.IdempotencyRecord{}, false
+	}
+	r, ok, err := idempotencyStore.Lookup(key)
+	if err != nil {
+		log.Println("Can't look up idempotency record:", err)
+		return common.IdempotencyRecord{}, false
+	}
+	return r, ok
+}
+
+// recordIssuance saves the result of the request. violations are set for certificates that failed verification.
+func recordIssuance(key, certificateArn, zone string, violations []string) {
+	if idempotencyStore == nil {
+		return
+	}
+	err := idempotencyStore.Save(common.IdempotencyRecord{
+		Key:            key,
+		CertificateArn: certificateArn,
+		Zone:           zone,
+		Violations:     violations,
+		Expires:        time.Now().Add(idempotencyWindow).Unix(),
+	})
+	if err != nil {
+		log.Println("Can't save idempotency record:", err)
+	}
+}
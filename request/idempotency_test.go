@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/aws/aws-lambda-go/events"
+	"net/http"
+	"testing"
+)
+
+func TestIdempotentIssueCertificate(t *testing.T) {
+	f := newFakeACMPCA(t)
+	defer f.server.Close()
+	_, _, cleanup := proxyTestSetup(t, f)
+	defer cleanup()
+	idempotencyStore = common.NewMemoryIdempotencyStore()
+	defer func() { idempotencyStore = nil }()
+
+	issue := func(cn, token, principal string) events.APIGatewayProxyResponse {
+		body := fmt.Sprintf(`{
+			"CertificateAuthorityArn": "%s",
+			"Csr": "%s",
+			"IdempotencyToken": "%s",
+			"SigningAlgorithm": "SHA256WITHRSA",
+			"Validity": {"Type": "DAYS", "Value": 1}
+		}`, testCAArn, base64.StdEncoding.EncodeToString(createCSR(cn)), token)
+		request := events.APIGatewayProxyRequest{
+			Headers: map[string]string{"X-Amz-Target": acmpcaIssueCertificate},
+			Body:    body,
+		}
+		request.RequestContext.Identity.UserArn = principal
+		resp, err := ACMPCAHandler(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf(wrongResponseCode, resp.StatusCode, resp.Body)
+		}
+		return resp
+	}
+	arn := func(resp events.APIGatewayProxyResponse) string {
+		var out ACMPCAIssueCertificateResponse
+		if err := json.Unmarshal([]byte(resp.Body), &out); err != nil {
+			t.Fatal(err)
+		}
+		return out.CertificateArn
+	}
+	const alice, bob = "arn:aws:iam::123456789012:user/alice", "arn:aws:iam::123456789012:user/bob"
+
+	// the same token returns the first certificate even for another CSR
+	first := issue("www.example.com", "token1", alice)
+	replay := issue("api.example.com", "token1", alice)
+	if arn(replay) != arn(first) || replay.Headers[idempotentReplayHeader] != "true" {
+		t.Fatalf("token replay should return %s, got %s", arn(first), arn(replay))
+	}
+	if first.Headers[idempotentReplayHeader] != "" {
+		t.Fatal("first request should not be marked as replay")
+	}
+	// tokens are scoped to the caller
+	if arn(issue("www.example.com", "token1", bob)) == arn(first) {
+		t.Fatal("other caller should not get the certificate of the same token")
+	}
+
+	// without token the same CSR, zone and caller is a replay
+	csr := createCSR("db.example.com")
+	noToken := func(days int) events.APIGatewayProxyResponse {
+		body := fmt.Sprintf(`{"CertificateAuthorityArn": "%s", "Csr": "%s", "SigningAlgorithm": "SHA256WITHRSA",
+			"Validity": {"Type": "DAYS", "Value": %d}}`, testCAArn, base64.StdEncoding.EncodeToString(csr), days)
+		request := events.APIGatewayProxyRequest{Headers: map[string]string{"X-Amz-Target": acmpcaIssueCertificate}, Body: body}
+		request.RequestContext.Identity.UserArn = alice
+		resp, err := ACMPCAHandler(request)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected response %d %s: %v", resp.StatusCode, resp.Body, err)
+		}
+		return resp
+	}
+	if arn(noToken(1)) != arn(noToken(1)) {
+		t.Fatal("same CSR should return the same certificate")
+	}
+	// but not with other issuance parameters
+	if arn(noToken(30)) == arn(noToken(1)) {
+		t.Fatal("same CSR with other validity should return a new certificate")
+	}
+
+	if len(f.certs) != 4 {
+		t.Fatalf("expected 4 issued certificates, got %d", len(f.certs))
+	}
+
+	records, _, err := auditStore.Query(common.AuditQuery{Principal: alice})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 6 || records[1].CertificateArn != arn(first) || records[1].Decision != common.AuditDecisionApproved {
+		t.Fatalf("replays should be audited with the previous certificate, got %+v", records)
+	}
+}
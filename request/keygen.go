@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/acmpca"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	venafiIssueWithKeyGeneration = "VenafiIssueWithKeyGeneration"
+
+	// keyGenerationIssueWait is how long the certificate is waited for before only its ARN is returned
+	keyGenerationIssueWait = 10 * time.Second
+
+	PrivateKeyEncryptionPassphrase = "PKCS8-PBES2-AES256"
+	PrivateKeyEncryptionKMS        = "KMS"
+
+	minPassphraseLength = 8
+)
+
+// VenafiIssueWithKeyGenerationInput is IssueCertificate request without CSR. The key pair is generated by the
+// handler with KeyAlgorithm, or the first key configuration the zone policy allows when it's empty.
+// SubjectAlternativeNames may hold DNS names, IP addresses, email addresses and URIs. The private key is returned
+// encrypted either with Passphrase or with KMS key KmsKeyId.
+type VenafiIssueWithKeyGenerationInput struct {
+	CertificateAuthorityArn *string                 `json:"CertificateAuthorityArn"`
+	TemplateArn             *string                 `json:"TemplateArn"`
+	SigningAlgorithm        acmpca.SigningAlgorithm `json:"SigningAlgorithm"`
+	Validity                *acmpca.Validity        `json:"Validity"`
+	Subject                 acmpca.ASN1Subject      `json:"Subject"`
+	SubjectAlternativeNames []string                `json:"SubjectAlternativeNames"`
+	KeyAlgorithm            acmpca.KeyAlgorithm     `json:"KeyAlgorithm"`
+	Passphrase              string                  `json:"Passphrase"`
+	KmsKeyId                string                  `json:"KmsKeyId"`
+	VenafiZone              string                  `json:"VenafiZone"`
+}
+
+// VenafiIssueWithKeyGenerationResponse has the certificate and its chain when ACM-PCA issued it in time,
+// otherwise they can be fetched later with GetCertificate. PrivateKey is encrypted PKCS#8 PEM with
+// PKCS8-PBES2-AES256 encryption and base64 KMS ciphertext of PKCS#8 DER with KMS encryption.
+type VenafiIssueWithKeyGenerationResponse struct {
+	CertificateArn       string `json:"CertificateArn"`
+	Certificate          string `json:"Certificate,omitempty"`
+	CertificateChain     string `json:"CertificateChain,omitempty"`
+	PrivateKey           string `json:"PrivateKey"`
+	PrivateKeyEncryption string `json:"PrivateKeyEncryption"`
+}
+
+// keyAlgorithmConfiguration returns key type and size of ACM-PCA key algorithm, empty algorithm is chosen
+// by the policy.
+func keyAlgorithmConfiguration(alg acmpca.KeyAlgorithm) (string, int, error) {
+	switch alg {
+	case "":
+		return "", 0, nil
+	case acmpca.KeyAlgorithmRsa2048:
+		return common.KeyTypeRSA, 2048, nil
+	case acmpca.KeyAlgorithmRsa4096:
+		return common.KeyTypeRSA, 4096, nil
+	case acmpca.KeyAlgorithmEcPrime256v1:
+		return common.KeyTypeEC, 256, nil
+	case acmpca.KeyAlgorithmEcSecp384r1:
+		return common.KeyTypeEC, 384, nil
+	}
+	return "", 0, fmt.Errorf("unsupported KeyAlgorithm %s", alg)
+}
+
+// subjectName converts ACM-PCA subject to pkix.Name, only attributes the policy checks are supported.
+func subjectName(s acmpca.ASN1Subject) pkix.Name {
+	values := func(v *string) []string {
+		if aws.StringValue(v) == "" {
+			return nil
+		}
+		return []string{*v}
+	}
+	return pkix.Name{
+		CommonName:         aws.StringValue(s.CommonName),
+		Organization:       values(s.Organization),
+		OrganizationalUnit: values(s.OrganizationalUnit),
+		Country:            values(s.Country),
+		Locality:           values(s.Locality),
+		Province:           values(s.State),
+	}
+}
+
+// certificateRequestTemplate sorts SANs by their type.
+func certificateRequestTemplate(subject pkix.Name, sans []string) (*x509.CertificateRequest, error) {
+	tmpl := &x509.CertificateRequest{Subject: subject}
+	for _, san := range sans {
+		switch {
+		case net.ParseIP(san) != nil:
+			tmpl.IPAddresses = append(tmpl.IPAddresses, net.ParseIP(san))
+		case strings.Contains(san, "://"):
+			u, err := url.Parse(san)
+			if err != nil {
+				return nil, fmt.Errorf("bad URI %s: %s", san, err)
+			}
+			tmpl.URIs = append(tmpl.URIs, u)
+		case strings.Contains(san, "@"):
+			tmpl.EmailAddresses = append(tmpl.EmailAddresses, san)
+		default:
+			tmpl.DNSNames = append(tmpl.DNSNames, san)
+		}
+	}
+	return tmpl, nil
+}
+
+// venafiIssueWithKeyGenerationRequest generates the key pair and sends its CSR through IssueCertificate handler,
+// so the request is checked, limited and audited the same way.
+func venafiIssueWithKeyGenerationRequest(request events.APIGatewayProxyRequest, audit *common.AuditRecord) (events.APIGatewayProxyResponse, error) {
+	ctx := context.TODO()
+	var input VenafiIssueWithKeyGenerationInput
+	err := json.Unmarshal([]byte(request.Body), &input)
+	if err != nil {
+		return clientError(http.StatusUnprocessableEntity, fmt.Sprintf(errUnmarshalJson, venafiIssueWithKeyGeneration, err))
+	}
+	switch {
+	case input.Passphrase == "" && input.KmsKeyId == "", input.Passphrase != "" && input.KmsKeyId != "":
+		return clientError(http.StatusUnprocessableEntity, "Either Passphrase or KmsKeyId should be provided")
+	case input.Passphrase != "" && len(input.Passphrase) < minPassphraseLength:
+		return clientError(http.StatusUnprocessableEntity, fmt.Sprintf("Passphrase should be at least %d characters long", minPassphraseLength))
+	case input.CertificateAuthorityArn == nil:
+		return clientError(http.StatusUnprocessableEntity, "CertificateAuthorityArn should be provided")
+	}
+	keyType, keySize, err := keyAlgorithmConfiguration(input.KeyAlgorithm)
+	if err != nil {
+		return clientError(http.StatusUnprocessableEntity, err.Error())
+	}
+	tmpl, err := certificateRequestTemplate(subjectName(input.Subject), input.SubjectAlternativeNames)
+	if err != nil {
+		return clientError(http.StatusUnprocessableEntity, err.Error())
+	}
+
+	// the key has to match the policy of the zone the request ends up in
+	domains := append([]string{tmpl.Subject.CommonName}, tmpl.DNSNames...)
+	zone, err := resolveZone(ctx, request, zoneRequest{
+		Zone:                    input.VenafiZone,
+		CertificateAuthorityArn: aws.StringValue(input.CertificateAuthorityArn),
+		TemplateArn:             aws.StringValue(input.TemplateArn),
+		Domains:                 domains,
+	})
+	if err != nil {
+		return clientError(http.StatusBadRequest, err.Error())
+	}
+	policy, err := cachedPolicy(zone.Zone)
+	if err == common.PolicyNotFound {
+		return handlePolicyNotFound(zone.Zone)
+	} else if err != nil {
+		return clientError(http.StatusFailedDependency, fmt.Sprintf("Failed to get policy from database: %s", err))
+	}
+	key, err := common.GenerateKey(policy, keyType, keySize)
+	if err != nil {
+		audit.Zone, audit.Violations = zone.Zone, []string{err.Error()}
+		return clientError(http.StatusForbidden, err.Error())
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+	if err != nil {
+		return clientError(http.StatusUnprocessableEntity, fmt.Sprintf("Can't create certificate request: %s", err))
+	}
+
+	// the key is encrypted before issuance, so no certificate is issued for a key that can't be delivered
+	caArn := aws.StringValue(input.CertificateAuthorityArn)
+	var out VenafiIssueWithKeyGenerationResponse
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err == nil && input.KmsKeyId != "" {
+		out.PrivateKeyEncryption = PrivateKeyEncryptionKMS
+		out.PrivateKey, err = kmsEncrypt(ctx, input.KmsKeyId, der, kmsEncryptionContext(caArn, key.Public()))
+	} else if err == nil {
+		out.PrivateKeyEncryption = PrivateKeyEncryptionPassphrase
+		var encrypted []byte
+		encrypted, err = common.EncryptPrivateKey(key, input.Passphrase)
+		out.PrivateKey = string(encrypted)
+	}
+	if err != nil {
+		return clientError(http.StatusInternalServerError, fmt.Sprintf("Can't encrypt private key: %s", err))
+	}
+
+	if input.SigningAlgorithm == "" {
+		input.SigningAlgorithm, err = caSigningAlgorithm(ctx, aws.StringValue(input.CertificateAuthorityArn))
+		if err != nil {
+			return clientError(http.StatusBadRequest, fmt.Sprintf("Can't get certificate authority: %s", err))
+		}
+	}
+	// no idempotency token, ACM-PCA would return the certificate of the previous key for it
+	body, err := json.Marshal(ACMPCAIssueCertificateRequest{
+		IssueCertificateInput: acmpca.IssueCertificateInput{
+			CertificateAuthorityArn: input.CertificateAuthorityArn,
+			Csr:                     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr}),
+			SigningAlgorithm:        input.SigningAlgorithm,
+			Validity:                input.Validity,
+		},
+		TemplateArn: input.TemplateArn,
+		VenafiZone:  zone.Zone,
+	})
+	if err != nil {
+		return clientError(http.StatusInternalServerError, err.Error())
+	}
+	issueRequest := request
+	issueRequest.Body = string(body)
+	resp, err := venafiACMPCAIssueCertificateRequest(issueRequest, audit)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	var issued ACMPCAIssueCertificateResponse
+	if err = json.Unmarshal([]byte(resp.Body), &issued); err != nil {
+		return clientError(http.StatusInternalServerError, err.Error())
+	}
+
+	out.CertificateArn = issued.CertificateArn
+	if certificateIssued(ctx, caArn, issued.CertificateArn, keyGenerationIssueWait) {
+		out.Certificate, out.CertificateChain, err = issuedCertificate(ctx, caArn, issued.CertificateArn)
+		if err != nil {
+			log.Printf("Can't get certificate %s: %s", issued.CertificateArn, err)
+		}
+	}
+	generated, err := jsonResponse(venafiIssueWithKeyGeneration, out)
+	if err == nil {
+		generated.Headers = resp.Headers
+	}
+	return generated, err
+}
+
+// kmsEncryptionContext binds KMS ciphertext of the private key to the certificate authority and the public key,
+// both known before the certificate is issued. PublicKeySha256 is hex SHA-256 of DER SubjectPublicKeyInfo, so it
+// can be computed from the certificate to decrypt the key.
+func kmsEncryptionContext(caArn string, pub interface{}) map[string]string {
+	spki, _ := x509.MarshalPKIXPublicKey(pub)
+	sum := sha256.Sum256(spki)
+	return map[string]string{"CertificateAuthorityArn": caArn, "PublicKeySha256": hex.EncodeToString(sum[:])}
+}
+
+// kmsEncrypt returns base64 KMS ciphertext of the private key encrypted with the encryption context.
+func kmsEncrypt(ctx context.Context, keyID string, plaintext []byte, encryptionContext map[string]string) (string, error) {
+	cli, err := awsClients()
+	if err != nil {
+		return "", err
+	}
+	resp, err := cli.kms.EncryptRequest(&kms.EncryptInput{
+		KeyId:             aws.String(keyID),
+		Plaintext:         plaintext,
+		EncryptionContext: encryptionContext,
+	}).Send(ctx)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(resp.CiphertextBlob), nil
+}
+
+// redactedFields are request body fields which are never logged.
+var redactedFields = []string{"Passphrase"}
+
+// redactBody returns the request body for logging with redactedFields replaced at any depth. Bodies that aren't
+// JSON are not logged, they could have the fields in a form that can't be redacted.
+func redactBody(body string) string {
+	var v interface{}
+	if body == "" {
+		return body
+	} else if err := json.Unmarshal([]byte(body), &v); err != nil {
+		return fmt.Sprintf("<%d bytes, not JSON>", len(body))
+	}
+	var redact func(v interface{})
+	redact = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for name, value := range v {
+				if containsString(redactedFields, name) {
+					v[name] = "REDACTED"
+				} else {
+					redact(value)
+				}
+			}
+		case []interface{}:
+			for _, value := range v {
+				redact(value)
+			}
+		}
+	}
+	redact(v)
+	b, _ := json.Marshal(v)
+	return string(b)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/Venafi/vcert/v4/pkg/certificate"
+	"github.com/Venafi/vcert/v4/pkg/endpoint"
+	"github.com/aws/aws-lambda-go/events"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIssueWithKeyGeneration(t *testing.T) {
+	f := newFakeACMPCA(t)
+	defer f.server.Close()
+	_, _, cleanup := proxyTestSetup(t, f)
+	defer cleanup()
+
+	call := func(fields string) events.APIGatewayProxyResponse {
+		body := fmt.Sprintf(`{"CertificateAuthorityArn": "%s", "SigningAlgorithm": "SHA256WITHRSA",
+			"Validity": {"Type": "DAYS", "Value": 1},
+			"Subject": {"CommonName": "www.example.com", "Organization": "Venafi Inc.", "Country": "US"},
+			"SubjectAlternativeNames": ["www.example.com", "api.example.com"], %s}`, testCAArn, fields)
+		resp, err := ACMPCAHandler(events.APIGatewayProxyRequest{
+			Headers: map[string]string{"X-Amz-Target": venafiIssueWithKeyGeneration},
+			Body:    body,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	issued := func(resp events.APIGatewayProxyResponse) (VenafiIssueWithKeyGenerationResponse, *x509.Certificate) {
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf(wrongResponseCode, resp.StatusCode, resp.Body)
+		}
+		var out VenafiIssueWithKeyGenerationResponse
+		if err := json.Unmarshal([]byte(resp.Body), &out); err != nil {
+			t.Fatal(err)
+		}
+		block, _ := pem.Decode([]byte(out.Certificate))
+		if block == nil || out.CertificateChain == "" {
+			t.Fatalf("certificate and chain should be returned: %s", resp.Body)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out, cert
+	}
+
+	out, cert := issued(call(`"Passphrase": "correct horse battery"`))
+	if out.PrivateKeyEncryption != PrivateKeyEncryptionPassphrase || strings.Contains(out.PrivateKey, "BEGIN PRIVATE KEY") {
+		t.Fatalf("private key should be encrypted with the passphrase: %s", out.PrivateKey)
+	}
+	if _, err := common.DecryptPrivateKey([]byte(out.PrivateKey), "wrong passphrase"); err == nil {
+		t.Fatal("private key should not be decrypted with wrong passphrase")
+	}
+	key, err := common.DecryptPrivateKey([]byte(out.PrivateKey), "correct horse battery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(key.Public(), cert.PublicKey) {
+		t.Fatal("private key doesn't match the certificate")
+	}
+
+	out, cert = issued(call(`"KmsKeyId": "alias/certificates", "KeyAlgorithm": "EC_prime256v1"`))
+	if out.PrivateKeyEncryption != PrivateKeyEncryptionKMS {
+		t.Fatalf("private key should be encrypted with KMS: %s", out.PrivateKeyEncryption)
+	}
+	spki, _ := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	sum := sha256.Sum256(spki)
+	if len(f.kmsContexts) != 1 || f.kmsContexts[0]["CertificateAuthorityArn"] != testCAArn ||
+		f.kmsContexts[0]["PublicKeySha256"] != hex.EncodeToString(sum[:]) {
+		t.Fatalf("KMS encryption context should be the CA ARN and public key digest: %v", f.kmsContexts)
+	}
+	der, err := base64.StdEncoding.DecodeString(out.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ecKey, ok := parsed.(*ecdsa.PrivateKey); !ok || !reflect.DeepEqual(ecKey.Public(), cert.PublicKey) {
+		t.Fatal("EC private key doesn't match the certificate")
+	}
+
+	for _, fields := range []string{`"VenafiZone": "default"`, `"Passphrase": "short"`, `"Passphrase": "correct horse battery", "KmsKeyId": "alias/certificates"`,
+		`"Passphrase": "correct horse battery", "KeyAlgorithm": "RSA_1024"`} {
+		if resp := call(fields); resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Fatalf(wrongResponseCode, resp.StatusCode, resp.Body)
+		}
+	}
+
+	// no certificate is issued when the key can't be encrypted
+	issuedBefore := len(f.certs)
+	f.kmsError = true
+	if resp := call(`"KmsKeyId": "alias/denied"`); resp.StatusCode != http.StatusInternalServerError || len(f.certs) != issuedBefore {
+		t.Fatalf("certificate should not be issued without encrypted key, got %d %s", resp.StatusCode, resp.Body)
+	}
+	f.kmsError = false
+
+	getPolicy = func(zone string) (endpoint.Policy, error) {
+		p := verifyTestPolicy
+		p.AllowedKeyConfigurations = []endpoint.AllowedKeyConfiguration{
+			{KeyType: certificate.KeyTypeECDSA, KeyCurves: []certificate.EllipticCurve{certificate.EllipticCurveP384}},
+		}
+		return p, nil
+	}
+	policies = nil
+	resp := call(`"Passphrase": "correct horse battery", "KeyAlgorithm": "RSA_2048"`)
+	if resp.StatusCode != http.StatusForbidden || !strings.Contains(resp.Body, "not allowed") {
+		t.Fatalf(wrongResponseCode, resp.StatusCode, resp.Body)
+	}
+	// the policy chooses the key when there is no KeyAlgorithm
+	_, cert = issued(call(`"Passphrase": "correct horse battery"`))
+	if pub, ok := cert.PublicKey.(*ecdsa.PublicKey); !ok || pub.Curve.Params().BitSize != 384 {
+		t.Fatalf("key should be EC P-384, got %T", cert.PublicKey)
+	}
+}
+
+func TestRedactBody(t *testing.T) {
+	for body, expected := range map[string]string{
+		`{"Passphrase": "secret", "KmsKeyId": "alias/k"}`:    `{"KmsKeyId":"alias/k","Passphrase":"REDACTED"}`,
+		`{"Requests": [{"Body": {"Passphrase": "secret"}}]}`: `{"Requests":[{"Body":{"Passphrase":"REDACTED"}}]}`,
+		`{"Passphrase": "secret"`:                            "<23 bytes, not JSON>",
+		"":                                                   "",
+	} {
+		if got := redactBody(body); got != expected {
+			t.Errorf("redactBody(%s) = %s, expected %s", body, got, expected)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/Venafi/vcert/v4/pkg/endpoint"
+	"log"
+	"os"
+	"time"
+)
+
+const defaultKeyReuseLookback = 365 * 24 * time.Hour
+
+var (
+	keyUsageStore    common.KeyUsageStore
+	keyReuseLookback = defaultKeyReuseLookback
+)
+
+func initKeyReuse() {
+	keyReuseLookback = defaultKeyReuseLookback
+	if s := os.Getenv("KEY_REUSE_LOOKBACK"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			log.Printf("Ignoring bad KEY_REUSE_LOOKBACK value %q", s)
+		} else {
+			keyReuseLookback = d
+		}
+	}
+	if keyUsageStore == nil {
+		keyUsageStore = common.NewKeyUsageStoreFromEnv()
+	}
+}
+
+// checkKeyReuse returns violation if the zone doesn't allow key reuse and the CSR key was certified in the zone
+// within the lookback window.
+func checkKeyReuse(policy endpoint.Policy, zone string, csr []byte) (common.PolicyViolations, error) {
+	if policy.AllowKeyReuse || keyUsageStore == nil {
+		return nil, nil
+	}
+	fingerprint, err := common.PublicKeyFingerprint(csr)
+	if err != nil {
+		return nil, err
+	}
+	r, ok, err := keyUsageStore.Lookup(zone, fingerprint, time.Now().Add(-keyReuseLookback))
+	if err != nil || !ok {
+		return nil, err
+	}
+	return common.PolicyViolations{fmt.Sprintf("public key %s was already used for certificate %s, key reuse is not allowed in zone %s",
+		fingerprint, r.CertificateArn, zone)}, nil
+}
+
+// recordKeyUsage saves fingerprint of issued certificate key. Keys are recorded in every zone, so reuse is detected
+// after the zone policy starts disallowing it. Failures are only logged because the certificate is already issued.
+func recordKeyUsage(zone string, csr []byte, certificateArn string) {
+	if keyUsageStore == nil {
+		return
+	}
+	fingerprint, err := common.PublicKeyFingerprint(csr)
+	if err == nil {
+		now := time.Now().UTC()
+		err = keyUsageStore.Save(common.KeyUsageRecord{
+			Zone:           zone,
+			Fingerprint:    fingerprint,
+			CertificateArn: certificateArn,
+			Time:           now,
+			Expires:        now.Add(keyReuseLookback).Unix(),
+		})
+	}
+	if err != nil {
+		log.Println("Can't record key usage:", err)
+	}
+}
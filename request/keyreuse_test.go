@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/Venafi/vcert/v4/pkg/endpoint"
+	"github.com/aws/aws-lambda-go/events"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func createCSRWithKey(t *testing.T, key crypto.Signer, cn string) []byte {
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: cn, Organization: []string{"Venafi Inc."}, Country: []string{"US"}},
+		DNSNames: []string{cn},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+}
+
+func TestKeyReusePrevention(t *testing.T) {
+	f := newFakeACMPCA(t)
+	defer f.server.Close()
+	_, _, cleanup := proxyTestSetup(t, f)
+	defer cleanup()
+	keyUsageStore = common.NewMemoryKeyUsageStore()
+	defer func() { keyUsageStore = nil }()
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	call := func(target string, csr []byte) events.APIGatewayProxyResponse {
+		body := fmt.Sprintf(`{"CertificateAuthorityArn": "%s", "Csr": "%s", "SigningAlgorithm": "SHA256WITHECDSA",
+			"Validity": {"Type": "DAYS", "Value": 1}}`, testCAArn, base64.StdEncoding.EncodeToString(csr))
+		resp, err := ACMPCAHandler(events.APIGatewayProxyRequest{
+			Headers: map[string]string{"X-Amz-Target": target},
+			Body:    body,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := call(acmpcaIssueCertificate, createCSRWithKey(t, key, "www.example.com")); resp.StatusCode != http.StatusOK {
+		t.Fatalf(wrongResponseCode, resp.StatusCode, resp.Body)
+	}
+	// the same key with another subject is rejected
+	reused := createCSRWithKey(t, key, "api.example.com")
+	resp := call(acmpcaIssueCertificate, reused)
+	if resp.StatusCode != http.StatusForbidden || !strings.Contains(resp.Body, "key reuse is not allowed") {
+		t.Fatalf(wrongResponseCode, resp.StatusCode, resp.Body)
+	}
+	resp = call(venafiValidateCertificateRequest, reused)
+	var validation VenafiValidateCertificateRequestResponse
+	_ = json.Unmarshal([]byte(resp.Body), &validation)
+	if validation.Valid || len(validation.Violations) != 1 {
+		t.Fatalf("validation should report key reuse: %s", resp.Body)
+	}
+	if resp := call(acmpcaIssueCertificate, createCSRWithKey(t, otherKey, "api.example.com")); resp.StatusCode != http.StatusOK {
+		t.Fatalf(wrongResponseCode, resp.StatusCode, resp.Body)
+	}
+
+	// outside of the lookback window
+	_ = os.Setenv("KEY_REUSE_LOOKBACK", "1ns")
+	resp = call(acmpcaIssueCertificate, reused)
+	_ = os.Unsetenv("KEY_REUSE_LOOKBACK")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("key should be allowed after lookback window: %d %s", resp.StatusCode, resp.Body)
+	}
+
+	// zone allows key reuse
+	getPolicy = func(zone string) (endpoint.Policy, error) {
+		p := verifyTestPolicy
+		p.AllowKeyReuse = true
+		return p, nil
+	}
+	policies = nil
+	if resp := call(acmpcaIssueCertificate, reused); resp.StatusCode != http.StatusOK {
+		t.Fatalf(wrongResponseCode, resp.StatusCode, resp.Body)
+	}
+	if len(f.certs) != 4 {
+		t.Fatalf("expected 4 issued certificates, got %d", len(f.certs))
+	}
+}
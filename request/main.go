@@ -9,12 +9,15 @@ import (
 	"github.com/Venafi/vcert/v4/pkg/certificate"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/aws/external"
 	"github.com/aws/aws-sdk-go-v2/service/acm"
 	"github.com/aws/aws-sdk-go-v2/service/acmpca"
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 )
 
 type venafiError string
@@ -33,14 +36,25 @@ const (
 
 var defaultZone = "Default"
 
+// loadAWSConfig and getPolicy are variables so tests can replace AWS and DynamoDB backends.
+// Handlers use them through awsClients and cachedPolicy.
+var (
+	loadAWSConfig = external.LoadDefaultAWSConfig
+	getPolicy     = common.GetPolicy
+)
+
 type ACMPCAIssueCertificateRequest struct {
 	acmpca.IssueCertificateInput
-	VenafiZone string `json:"VenafiZone"`
+	// TemplateArn is not a part of the SDK IssueCertificateInput yet, it's added to the forwarded request body
+	TemplateArn *string `json:"TemplateArn"`
+	VenafiZone  string  `json:"VenafiZone"`
 }
 
 type VenafiRequestCertificateInput struct {
 	acm.RequestCertificateInput
-	VenafiZone string `json:"VenafiZone"`
+	// Tags are not a part of the SDK RequestCertificateInput yet, they are added to the certificate after request
+	Tags       []acm.Tag `json:"Tags"`
+	VenafiZone string    `json:"VenafiZone"`
 }
 
 type ACMPCAIssueCertificateResponse struct {
@@ -58,15 +72,32 @@ type ACMPCAGetCertificateResponse struct {
 func ACMPCAHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 
 	ctx := context.TODO()
-	target := request.Headers["X-Amz-Target"]
+	target := normalizeTarget(headerValue(request, "X-Amz-Target"))
 	log.Println("ACMPCAHandler started. Parsing header", target)
-	log.Printf("Request: %s", request.Body)
+	log.Printf("Request: %s", redactBody(request.Body))
 	initHandler()
+	request, err := authenticate(request)
+	if err != nil {
+		log.Println("Request authentication failed:", err)
+		return clientError(http.StatusForbidden, fmt.Sprintf("Request signature verification failed: %s", err))
+	}
 	switch target {
 	case acmpcaIssueCertificate:
-		return venafiACMPCAIssueCertificateRequest(request)
+		return audited(request, target, venafiACMPCAIssueCertificateRequest)
 	case acmRequestCertificate:
-		return venafiACMRequestCertificate(request)
+		return audited(request, target, venafiACMRequestCertificate)
+	case venafiIssueWithKeyGeneration:
+		return audited(request, target, venafiIssueWithKeyGenerationRequest)
+	case venafiBatchIssueCertificates:
+		return venafiBatchIssueCertificatesRequest(request)
+	case venafiQueryAuditLog:
+		return queryAuditLog(request)
+	case venafiValidateCertificateRequest:
+		return venafiValidateRequest(request)
+	case venafiGetPolicy:
+		return venafiDescribePolicy(request)
+	case venafiListPolicies:
+		return venafiListPoliciesNames(request)
 	case acmDescribeCertificate, acmExportCertificate, acmGetCertificate, acmListCertificates, acmRenewCertificate,
 		acmpcaGetCertificate, acmpcaGetCertificateAuthorityCertificate, acmpcaListCertificateAuthorities,
 		acmpcaRevokeCertificate:
@@ -78,7 +109,13 @@ func ACMPCAHandler(request events.APIGatewayProxyRequest) (events.APIGatewayProx
 
 }
 
-func venafiACMPCAIssueCertificateRequest(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+func venafiACMPCAIssueCertificateRequest(request events.APIGatewayProxyRequest, audit *common.AuditRecord) (events.APIGatewayProxyResponse, error) {
+	return issueACMPCACertificate(request, audit, nil)
+}
+
+// issueACMPCACertificate checks and issues ACM-PCA certificate. pace, when set, is called right before the
+// IssueCertificate call, so only requests that reach ACM-PCA wait for it.
+func issueACMPCACertificate(request events.APIGatewayProxyRequest, audit *common.AuditRecord, pace func()) (events.APIGatewayProxyResponse, error) {
 
 	log.Println("Requesting ACMP CA certificate")
 	var err error
@@ -95,49 +132,165 @@ func venafiACMPCAIssueCertificateRequest(request events.APIGatewayProxyRequest)
 	if err != nil {
 		return clientError(http.StatusUnprocessableEntity, "Can't parse certificate request")
 	}
+	audit.Subject, audit.SANs = describeCSR(req.GetCSR())
 	//TODO: add SigningAlgorithm validation
 
-	if certRequest.VenafiZone == "" {
-		certRequest.VenafiZone = defaultZone
+	zone, err := resolveZone(ctx, request, zoneRequest{
+		Zone:                    certRequest.VenafiZone,
+		CertificateAuthorityArn: aws.StringValue(certRequest.CertificateAuthorityArn),
+		TemplateArn:             aws.StringValue(certRequest.TemplateArn),
+		Domains:                 csrDomains(req.GetCSR()),
+	})
+	if err != nil {
+		return clientError(http.StatusBadRequest, err.Error())
 	}
-	policy, err := common.GetPolicy(certRequest.VenafiZone)
+	certRequest.VenafiZone = zone.Zone
+	audit.Zone, audit.ZoneRule = zone.Zone, zone.Rule
+	err = authorizeZone(request, certRequest.VenafiZone)
+	if err != nil {
+		audit.Violations = []string{err.Error()}
+		return clientError(http.StatusForbidden, err.Error())
+	}
+	idempotencyKey := issuanceKey(request, certRequest, req.GetCSR())
+	if previous, ok := previousIssuance(idempotencyKey); ok {
+		arn := previous.CertificateArn
+		audit.CertificateArn = arn
+		if len(previous.Violations) > 0 {
+			audit.Violations = previous.Violations
+			return clientError(http.StatusForbidden, fmt.Sprintf("Certificate %s issued for the same request earlier violates policy: %s",
+				arn, strings.Join(previous.Violations, "; ")))
+		}
+		log.Printf("Returning certificate %s issued for the same request earlier", arn)
+		resp, err := sdkResponse(acmpcaIssueCertificate, &acmpca.IssueCertificateOutput{CertificateArn: aws.String(arn)})
+		resp.Headers[idempotentReplayHeader] = "true"
+		return resp, err
+	}
+	if certRequest.SigningAlgorithm == "" {
+		certRequest.SigningAlgorithm, err = caSigningAlgorithm(ctx, aws.StringValue(certRequest.CertificateAuthorityArn))
+		if err != nil {
+			return clientError(http.StatusBadRequest, fmt.Sprintf("Can't get certificate authority: %s", err))
+		}
+	}
+	policy, err := cachedPolicy(certRequest.VenafiZone)
 	if err == common.PolicyNotFound {
 		return handlePolicyNotFound(certRequest.VenafiZone)
 	} else if err != nil {
 		return clientError(http.StatusFailedDependency, fmt.Sprintf("Failed to get policy from database: %s", err))
 	}
 
+	audit.PolicyVersion = common.PolicyVersion(policy)
+
 	//TODO: also validate SigningAlgorithm from request
-	err = policy.ValidateCertificateRequest(&req)
+	if normalizeSubject {
+		template, err := passthroughTemplate(aws.StringValue(certRequest.TemplateArn))
+		if err != nil {
+			return clientError(http.StatusBadRequest, err.Error())
+		}
+		certRequest.TemplateArn = aws.String(template)
+	}
+	subject, violations, err := common.ValidateCSR(policy, req.GetCSR(), normalizeSubject)
 	if err != nil {
-		return clientError(http.StatusForbidden, err.Error())
+		return clientError(http.StatusUnprocessableEntity, "Can't parse certificate request")
+	}
+	if normalizeSubject {
+		audit.Subject = subject.String()
+	}
+	if len(violations) == 0 {
+		violations, err = checkKeyReuse(policy, certRequest.VenafiZone, req.GetCSR())
+		if err != nil {
+			return clientError(http.StatusFailedDependency, fmt.Sprintf("Failed to check key reuse: %s", err))
+		}
+	}
+	if len(violations) > 0 {
+		audit.Violations = violations
+		return clientError(http.StatusForbidden, violations.Error())
+	}
+
+	usage, err := checkRateLimits(audit.Principal, certRequest.VenafiZone, time.Now())
+	if exceeded, ok := err.(rateLimitExceeded); ok {
+		audit.Violations = []string{exceeded.Error()}
+		return throttled(exceeded)
+	} else if err != nil {
+		return clientError(http.StatusFailedDependency, fmt.Sprintf("Failed to check rate limits: %s", err))
 	}
 
 	//Issuing ACM certificate
-	awsCfg, err := external.LoadDefaultAWSConfig()
+	cli, err := awsClients()
 	if err != nil {
+		usage.refund()
 		return clientError(http.StatusInternalServerError, fmt.Sprintf("Error loading client: %s", err))
 	}
-	acmCli := acmpca.New(awsCfg)
+	acmCli := cli.acmpca
 	caReqInput := acmCli.IssueCertificateRequest(&certRequest.IssueCertificateInput)
+	if certRequest.TemplateArn != nil {
+		caReqInput.Handlers.Build.PushBack(addBodyField("TemplateArn", *certRequest.TemplateArn))
+	}
+	if normalizeSubject {
+		caReqInput.Handlers.Build.PushBack(addBodyField("ApiPassthrough", apiPassthrough(subject)))
+	}
 
+	if pace != nil {
+		pace()
+	}
 	csrResp, err := caReqInput.Send(ctx)
 	if err != nil {
-		return clientError(http.StatusInternalServerError, fmt.Sprintf("Could not get certificate response: %s", err))
+		// ACM-PCA didn't issue the certificate, so it doesn't count against the limits
+		usage.refund()
+		return backendError(acmpcaIssueCertificate, err)
 	}
 
-	respoBodyJSON, err := json.Marshal(csrResp)
-	if err != nil {
-		return clientError(http.StatusUnprocessableEntity, fmt.Sprintf("Error marshaling response JSON for target %s: %s", acmpcaIssueCertificate, err))
+	audit.CertificateArn = *csrResp.CertificateArn
+	verification := ""
+	if verifyIssued {
+		verification = verificationVerified
+		err = verifyIssuedCertificate(ctx, acmCli, *certRequest.CertificateAuthorityArn, *csrResp.CertificateArn, policy)
+		switch e := err.(type) {
+		case nil:
+		case issuedCertificateViolation:
+			// replays are rejected the same way instead of returning the revoked certificate
+			audit.Violations = e.violations()
+			recordIssuance(idempotencyKey, *csrResp.CertificateArn, certRequest.VenafiZone, audit.Violations)
+			return clientError(http.StatusForbidden, fmt.Sprintf("%s. Certificate was revoked.", e))
+		case unrevokedCertificateViolation:
+			// the certificate is valid although it doesn't comply, it's only recorded as a used key
+			log.Println(e)
+			audit.Violations = e.violations()
+			recordIssuance(idempotencyKey, *csrResp.CertificateArn, certRequest.VenafiZone, audit.Violations)
+			recordKeyUsage(certRequest.VenafiZone, req.GetCSR(), *csrResp.CertificateArn)
+			return clientError(http.StatusInternalServerError, e.Error())
+		default:
+			// the certificate may still be issued, the caller gets its ARN and can check it later
+			log.Printf("Could not verify issued certificate: %s", err)
+			verification = verificationPending
+		}
 	}
 
-	return events.APIGatewayProxyResponse{
-		Body:       string(respoBodyJSON),
-		StatusCode: http.StatusOK,
-	}, nil
+	recordIssuance(idempotencyKey, *csrResp.CertificateArn, certRequest.VenafiZone, nil)
+	recordKeyUsage(certRequest.VenafiZone, req.GetCSR(), *csrResp.CertificateArn)
+	reportToInventory(common.InventoryRecord{
+		Source:                  common.InventorySourceACMPCA,
+		CertificateArn:          *csrResp.CertificateArn,
+		CertificateAuthorityArn: *certRequest.CertificateAuthorityArn,
+		Zone:                    certRequest.VenafiZone,
+	})
+
+	resp, err := sdkResponse(acmpcaIssueCertificate, csrResp)
+	if normalizeSubject {
+		resp.Headers[subjectHeader] = subject.String()
+	}
+	if verification != "" {
+		resp.Headers[verificationHeader] = verification
+	}
+	return resp, err
+}
+
+func venafiACMRequestCertificate(request events.APIGatewayProxyRequest, audit *common.AuditRecord) (events.APIGatewayProxyResponse, error) {
+	return requestACMCertificate(request, audit, nil)
 }
 
-func venafiACMRequestCertificate(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+// requestACMCertificate checks and requests ACM certificate. pace, when set, is called right before the
+// RequestCertificate call.
+func requestACMCertificate(request events.APIGatewayProxyRequest, audit *common.AuditRecord, pace func()) (events.APIGatewayProxyResponse, error) {
 	log.Println("Starting RequestCertificate")
 	ctx := context.TODO()
 	var certRequest VenafiRequestCertificateInput
@@ -147,50 +300,84 @@ func venafiACMRequestCertificate(request events.APIGatewayProxyRequest) (events.
 		return clientError(http.StatusUnprocessableEntity, fmt.Sprintf("Error unmarshaling JSON: %s", err))
 	}
 
-	var req certificate.Request
-	req.Subject = pkix.Name{CommonName: *certRequest.DomainName}
-	req.DNSNames = certRequest.SubjectAlternativeNames
+	audit.Subject = pkix.Name{CommonName: aws.StringValue(certRequest.DomainName)}.String()
+	audit.SANs = certRequest.SubjectAlternativeNames
 
-	if certRequest.VenafiZone == "" {
-		certRequest.VenafiZone = defaultZone
+	zone, err := resolveZone(ctx, request, zoneRequest{
+		Zone:                    certRequest.VenafiZone,
+		Tags:                    tagsMap(certRequest.Tags),
+		CertificateAuthorityArn: aws.StringValue(certRequest.CertificateAuthorityArn),
+		Domains:                 append([]string{aws.StringValue(certRequest.DomainName)}, certRequest.SubjectAlternativeNames...),
+	})
+	if err != nil {
+		return clientError(http.StatusBadRequest, err.Error())
 	}
-	policy, err := common.GetPolicy(certRequest.VenafiZone)
+	certRequest.VenafiZone = zone.Zone
+	audit.Zone, audit.ZoneRule = zone.Zone, zone.Rule
+	err = authorizeZone(request, certRequest.VenafiZone)
+	if err != nil {
+		audit.Violations = []string{err.Error()}
+		return clientError(http.StatusForbidden, err.Error())
+	}
+	policy, err := cachedPolicy(certRequest.VenafiZone)
 	if err == common.PolicyNotFound {
 		return handlePolicyNotFound(certRequest.VenafiZone)
 	} else if err != nil {
 		log.Println(err)
 		return clientError(http.StatusFailedDependency, fmt.Sprintf("Failed to get policy from database: %s", err))
 	}
-	err = policy.SimpleValidateCertificateRequest(req)
-	if err != nil {
-		log.Println(err)
-		return clientError(http.StatusForbidden, err.Error())
+	audit.PolicyVersion = common.PolicyVersion(policy)
+	violations := common.CheckDomainNames(policy, aws.StringValue(certRequest.DomainName), certRequest.SubjectAlternativeNames)
+	if len(violations) > 0 {
+		log.Println(violations)
+		audit.Violations = violations
+		return clientError(http.StatusForbidden, violations.Error())
 	}
-	awsCfg, err := external.LoadDefaultAWSConfig()
+	usage, err := checkRateLimits(audit.Principal, certRequest.VenafiZone, time.Now())
+	if exceeded, ok := err.(rateLimitExceeded); ok {
+		audit.Violations = []string{exceeded.Error()}
+		return throttled(exceeded)
+	} else if err != nil {
+		return clientError(http.StatusFailedDependency, fmt.Sprintf("Failed to check rate limits: %s", err))
+	}
+
+	cli, err := awsClients()
 	if err != nil {
 		log.Println("Error loading client", err)
+		usage.refund()
 		return clientError(http.StatusInternalServerError, fmt.Sprintf("Can`t load client config: %v", err))
 	}
-	acmCli := acm.New(awsCfg)
+	acmCli := cli.acm
 
 	caReqInput := acmCli.RequestCertificateRequest(&certRequest.RequestCertificateInput)
 
+	if pace != nil {
+		pace()
+	}
 	certResp, err := caReqInput.Send(ctx)
 	if err != nil {
 		log.Println(err)
-		return clientError(http.StatusInternalServerError, fmt.Sprintf("Could not get certificate response: %s", err))
+		usage.refund()
+		return backendError(acmRequestCertificate, err)
 	}
 
-	respoBodyJSON, err := json.Marshal(certResp)
-	if err != nil {
-		log.Println(err)
-		return clientError(http.StatusUnprocessableEntity, fmt.Sprintf("Error marshaling response JSON: %s", err))
+	audit.CertificateArn = *certResp.CertificateArn
+	if len(certRequest.Tags) > 0 {
+		_, err = acmCli.AddTagsToCertificateRequest(&acm.AddTagsToCertificateInput{
+			CertificateArn: certResp.CertificateArn,
+			Tags:           certRequest.Tags,
+		}).Send(ctx)
+		if err != nil {
+			log.Printf("Can't tag certificate %s: %s", *certResp.CertificateArn, err)
+		}
 	}
+	reportToInventory(common.InventoryRecord{
+		Source:         common.InventorySourceACM,
+		CertificateArn: *certResp.CertificateArn,
+		Zone:           certRequest.VenafiZone,
+	})
 
-	return events.APIGatewayProxyResponse{
-		Body:       string(respoBodyJSON),
-		StatusCode: http.StatusOK,
-	}, nil
+	return sdkResponse(acmRequestCertificate, certResp)
 }
 
 func handlePolicyNotFound(venafiZone string) (events.APIGatewayProxyResponse, error) {
@@ -208,19 +395,21 @@ func handlePolicyNotFound(venafiZone string) (events.APIGatewayProxyResponse, er
 
 }
 
+// reportToInventory queues issued certificate for import into Venafi inventory. Failures are only logged
+// because the certificate is already issued.
+func reportToInventory(record common.InventoryRecord) {
+	if !common.InventoryEnabled() {
+		return
+	}
+	log.Printf("Queueing certificate %s for Venafi inventory import", record.CertificateArn)
+	err := common.EnqueueInventoryRecord(record)
+	if err != nil {
+		log.Println("Can't queue certificate for inventory import:", err)
+	}
+}
+
 func clientError(status int, body string) (events.APIGatewayProxyResponse, error) {
-	//TODO: try to make error compatible with aws cli commands
-	temp := struct {
-		Msg string `json:"msg"`
-	}{
-		body,
-	}
-	b, _ := json.Marshal(temp)
-
-	return events.APIGatewayProxyResponse{
-		StatusCode: status,
-		Body:       string(b),
-	}, nil
+	return awsErrorResponse(status, errorCode(status), body), nil
 }
 
 func initHandler() {
@@ -229,8 +418,28 @@ func initHandler() {
 		defaultZone = d
 	}
 	log.Printf("Default zone is: %s", defaultZone)
+	initVerification()
+	initSigV4Verification()
+	initZoneRules()
+	initIdempotency()
+	initRateLimits()
+	initKeyReuse()
+	initNormalization()
+	initPolicyCache()
+	initBatch()
+	if auditStore == nil {
+		auditStore = common.NewAuditStoreFromEnv()
+	}
 }
 
 func main() {
-	lambda.Start(ACMPCAHandler)
+	// LISTEN_ADDR runs the handler as a standalone HTTP server, e.g. in ECS, on EC2 or locally
+	if addr := os.Getenv("LISTEN_ADDR"); addr != "" {
+		err := runServer(addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	lambda.Start(HandleEvent)
 }
@@ -12,6 +12,7 @@ import (
 	"fmt"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go-v2/aws/external"
+	"github.com/aws/aws-sdk-go-v2/private/protocol/json/jsonutil"
 	"github.com/aws/aws-sdk-go-v2/service/acmpca"
 	"go/types"
 	"log"
@@ -254,9 +255,15 @@ func getACMPCAArn(t *testing.T) string {
 	if err != nil {
 		t.Fatalf("Request returned error: %s", err)
 	}
+	if arnListReq.StatusCode != 200 {
+		t.Fatalf(wrongResponseCode, arnListReq.StatusCode, arnListReq.Body)
+	}
 	var arn string
-	listArn := &acmpca.ListCertificateAuthoritiesResponse{}
-	err = json.Unmarshal([]byte(arnListReq.Body), listArn)
+	listArn := &acmpca.ListCertificateAuthoritiesOutput{}
+	err = jsonutil.UnmarshalJSON(listArn, strings.NewReader(arnListReq.Body))
+	if err != nil {
+		t.Fatalf("Cant process response json: %s", err)
+	}
 	for _, ca := range listArn.CertificateAuthorities {
 		if ca.Status == "ACTIVE" {
 			arn = *ca.Arn
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// putMetric writes a count metric in CloudWatch embedded metric format to the log, so CloudWatch extracts it from
+// Lambda logs without extra API calls. Metrics are written only when METRICS_NAMESPACE is set.
+func putMetric(name string, value float64) {
+	namespace := os.Getenv("METRICS_NAMESPACE")
+	if namespace == "" {
+		return
+	}
+	b, err := json.Marshal(map[string]interface{}{
+		"_aws": map[string]interface{}{
+			"Timestamp": time.Now().UnixNano() / int64(time.Millisecond),
+			"CloudWatchMetrics": []interface{}{map[string]interface{}{
+				"Namespace":  namespace,
+				"Dimensions": [][]string{{}},
+				"Metrics":    []interface{}{map[string]string{"Name": name, "Unit": "Count"}},
+			}},
+		},
+		name: value,
+	})
+	if err != nil {
+		return
+	}
+	// embedded metric format has to be the whole log line, without the standard logger prefix
+	_, _ = os.Stdout.Write(append(b, '\n'))
+}
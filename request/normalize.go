@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/x509/pkix"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	// apiPassthroughTemplateArn is used for normalized requests without TemplateArn. ACM-PCA takes the subject
+	// from ApiPassthrough only with APIPassthrough and APICSRPassthrough templates.
+	apiPassthroughTemplateArn = "arn:aws:acm-pca:::template/EndEntityCertificate_APIPassthrough/V1"
+	// subjectHeader is returned with the subject of normalized requests.
+	subjectHeader = "X-Venafi-Subject"
+)
+
+var normalizeSubject bool
+
+func initNormalization() {
+	normalizeSubject = os.Getenv("NORMALIZE_SUBJECT") == "true"
+}
+
+// apiPassthroughFamilies are suffixes of ACM-PCA template names that take ApiPassthrough, e.g.
+// EndEntityCertificate_APIPassthrough/V1 and BlankEndEntityCertificate_APICSRPassthrough/V1. CSRPassthrough
+// templates ignore it.
+var apiPassthroughFamilies = []string{"APIPassthrough", "APICSRPassthrough"}
+
+// passthroughTemplate returns the template to issue normalized request with.
+func passthroughTemplate(templateArn string) (string, error) {
+	if templateArn == "" {
+		return apiPassthroughTemplateArn, nil
+	}
+	// arn:aws:acm-pca:::template/<name>_<family>/V<version>
+	name := templateArn
+	if i := strings.LastIndex(name, "/"); i > 0 {
+		name = name[:i]
+	}
+	if i := strings.LastIndex(name, "_"); i >= 0 && containsString(apiPassthroughFamilies, name[i+1:]) {
+		return templateArn, nil
+	}
+	return "", fmt.Errorf("template %s doesn't support API passthrough required for subject normalization", templateArn)
+}
+
+// apiPassthrough returns ACM-PCA ApiPassthrough value which replaces the CSR subject.
+func apiPassthrough(subject pkix.Name) map[string]interface{} {
+	s := map[string]string{}
+	set := func(name string, values []string) {
+		if len(values) > 0 {
+			s[name] = values[0]
+		}
+	}
+	if subject.CommonName != "" {
+		s["CommonName"] = subject.CommonName
+	}
+	set("Organization", subject.Organization)
+	set("OrganizationalUnit", subject.OrganizationalUnit)
+	set("Country", subject.Country)
+	set("Locality", subject.Locality)
+	set("State", subject.Province)
+	return map[string]interface{}{"Subject": s}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/Venafi/vcert/v4/pkg/endpoint"
+	"github.com/aws/aws-lambda-go/events"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestSubjectNormalization(t *testing.T) {
+	f := newFakeACMPCA(t)
+	defer f.server.Close()
+	_, _, cleanup := proxyTestSetup(t, f)
+	defer cleanup()
+	getPolicy = func(zone string) (endpoint.Policy, error) {
+		p := verifyTestPolicy
+		p.SubjectORegexes = []string{`^Venafi Inc\.$`}
+		p.SubjectCRegexes = []string{`^US$`}
+		p.SubjectOURegexes = []string{`^(Engineering)?$`}
+		return p, nil
+	}
+
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	der, _ := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{
+		CommonName:         "www.example.com",
+		Organization:       []string{"Other Inc."},
+		OrganizationalUnit: []string{"Sales"},
+		Locality:           []string{"Salt Lake City"},
+	}}, key)
+	csr := base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+	call := func(target, template string) events.APIGatewayProxyResponse {
+		body := fmt.Sprintf(`{"CertificateAuthorityArn": "%s", "Csr": "%s", "SigningAlgorithm": "SHA256WITHRSA",
+			"Validity": {"Type": "DAYS", "Value": 1}%s}`, testCAArn, csr, template)
+		resp, err := ACMPCAHandler(events.APIGatewayProxyRequest{
+			Headers: map[string]string{"X-Amz-Target": target},
+			Body:    body,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := call(acmpcaIssueCertificate, ""); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("CSR should be rejected without normalization: %d %s", resp.StatusCode, resp.Body)
+	}
+
+	_ = os.Setenv("NORMALIZE_SUBJECT", "true")
+	defer os.Unsetenv("NORMALIZE_SUBJECT")
+	expected := "CN=www.example.com,O=Venafi Inc.,L=Salt Lake City,C=US"
+
+	resp := call(venafiValidateCertificateRequest, "")
+	var validation VenafiValidateCertificateRequestResponse
+	_ = json.Unmarshal([]byte(resp.Body), &validation)
+	if !validation.Valid || validation.Subject != expected {
+		t.Fatalf("validation should report normalized subject: %s", resp.Body)
+	}
+
+	resp = call(acmpcaIssueCertificate, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf(wrongResponseCode, resp.StatusCode, resp.Body)
+	}
+	if resp.Headers[subjectHeader] != expected {
+		t.Fatalf("expected subject %s, got %s", expected, resp.Headers[subjectHeader])
+	}
+	var out ACMPCAIssueCertificateResponse
+	_ = json.Unmarshal([]byte(resp.Body), &out)
+	cert, err := parseCertificatePEM(string(f.certs[out.CertificateArn]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Subject.String() != expected {
+		t.Fatalf("certificate should be issued with normalized subject, got %s", cert.Subject)
+	}
+	if len(f.templateArns) != 1 || f.templateArns[0] != apiPassthroughTemplateArn {
+		t.Fatalf("API passthrough template should be used, got %v", f.templateArns)
+	}
+
+	resp = call(acmpcaIssueCertificate, `, "TemplateArn": "arn:aws:acm-pca:::template/EndEntityCertificate/V1"`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("template without API passthrough should be rejected: %d %s", resp.StatusCode, resp.Body)
+	}
+}
+
+func TestPassthroughTemplate(t *testing.T) {
+	for arn, ok := range map[string]bool{
+		"": true,
+		"arn:aws:acm-pca:::template/EndEntityCertificate_APIPassthrough/V1":                 true,
+		"arn:aws:acm-pca:::template/EndEntityClientAuthCertificate_APIPassthrough/V1":       true,
+		"arn:aws:acm-pca:::template/BlankEndEntityCertificate_APICSRPassthrough/V1":         true,
+		"arn:aws:acm-pca:::template/SubordinateCACertificate_PathLen0_APICSRPassthrough/V1": true,
+		"arn:aws:acm-pca:::template/EndEntityCertificate_CSRPassthrough/V1":                 false,
+		"arn:aws:acm-pca:::template/EndEntityCertificate/V1":                                false,
+		"arn:aws:acm-pca:::template/APIPassthroughLike/V1":                                  false,
+	} {
+		template, err := passthroughTemplate(arn)
+		if (err == nil) != ok {
+			t.Fatalf("template %q: unexpected error %v", arn, err)
+		}
+		if ok && arn != "" && template != arn {
+			t.Fatalf("template %q should be kept, got %s", arn, template)
+		}
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/aws/aws-lambda-go/events"
-	"github.com/aws/aws-sdk-go-v2/aws/external"
 	"github.com/aws/aws-sdk-go-v2/service/acm"
 	"github.com/aws/aws-sdk-go-v2/service/acmpca"
 	"net/http"
@@ -31,15 +30,12 @@ const (
 
 func passThru(request events.APIGatewayProxyRequest, ctx context.Context, target string) (events.APIGatewayProxyResponse, error) {
 
-	var respoBodyJSON []byte
-	var err error
-
-	awsCfg, err := external.LoadDefaultAWSConfig()
+	cli, err := awsClients()
 	if err != nil {
 		return clientError(http.StatusInternalServerError, fmt.Sprintf("Error loading client: %s", err))
 	}
-	acmpcaCli := acmpca.New(awsCfg)
-	acmCli := acm.New(awsCfg)
+	acmpcaCli := cli.acmpca
+	acmCli := cli.acm
 
 	switch target {
 	case acmDescribeCertificate:
@@ -53,9 +49,9 @@ func passThru(request events.APIGatewayProxyRequest, ctx context.Context, target
 		var doRequestResponse *acm.DescribeCertificateResponse
 		doRequestResponse, err = doRequest.Send(ctx)
 		if err != nil {
-			return clientError(http.StatusInternalServerError, fmt.Sprintf(errNoResponse, target, err))
+			return backendError(target, err)
 		}
-		respoBodyJSON, err = json.Marshal(doRequestResponse)
+		return sdkResponse(target, doRequestResponse)
 	case acmExportCertificate:
 		var req = &acm.ExportCertificateInput{}
 		err = json.Unmarshal([]byte(request.Body), req)
@@ -67,9 +63,9 @@ func passThru(request events.APIGatewayProxyRequest, ctx context.Context, target
 		var doRequestResponse *acm.ExportCertificateResponse
 		doRequestResponse, err = doRequest.Send(ctx)
 		if err != nil {
-			return clientError(http.StatusInternalServerError, fmt.Sprintf(errNoResponse, target, err))
+			return backendError(target, err)
 		}
-		respoBodyJSON, err = json.Marshal(doRequestResponse)
+		return sdkResponse(target, doRequestResponse)
 	case acmGetCertificate:
 		var req = &acm.GetCertificateInput{}
 		err = json.Unmarshal([]byte(request.Body), req)
@@ -81,9 +77,9 @@ func passThru(request events.APIGatewayProxyRequest, ctx context.Context, target
 		var doRequestResponse *acm.GetCertificateResponse
 		doRequestResponse, err = doRequest.Send(ctx)
 		if err != nil {
-			return clientError(http.StatusInternalServerError, fmt.Sprintf(errNoResponse, target, err))
+			return backendError(target, err)
 		}
-		respoBodyJSON, err = json.Marshal(doRequestResponse)
+		return sdkResponse(target, doRequestResponse)
 	case acmListCertificates:
 		var req = &acm.ListCertificatesInput{}
 		err = json.Unmarshal([]byte(request.Body), req)
@@ -95,9 +91,9 @@ func passThru(request events.APIGatewayProxyRequest, ctx context.Context, target
 		var doRequestResponse *acm.ListCertificatesResponse
 		doRequestResponse, err = doRequest.Send(ctx)
 		if err != nil {
-			return clientError(http.StatusInternalServerError, fmt.Sprintf(errNoResponse, target, err))
+			return backendError(target, err)
 		}
-		respoBodyJSON, err = json.Marshal(doRequestResponse)
+		return sdkResponse(target, doRequestResponse)
 	case acmRenewCertificate:
 		var req = &acm.RenewCertificateInput{}
 		err = json.Unmarshal([]byte(request.Body), req)
@@ -109,9 +105,9 @@ func passThru(request events.APIGatewayProxyRequest, ctx context.Context, target
 		var doRequestResponse *acm.RenewCertificateResponse
 		doRequestResponse, err = doRequest.Send(ctx)
 		if err != nil {
-			return clientError(http.StatusInternalServerError, fmt.Sprintf(errNoResponse, target, err))
+			return backendError(target, err)
 		}
-		respoBodyJSON, err = json.Marshal(doRequestResponse)
+		return sdkResponse(target, doRequestResponse)
 
 	case acmpcaGetCertificateAuthorityCertificate:
 		var req = &acmpca.GetCertificateAuthorityCertificateInput{}
@@ -124,9 +120,9 @@ func passThru(request events.APIGatewayProxyRequest, ctx context.Context, target
 		var doRequestResponse *acmpca.GetCertificateAuthorityCertificateResponse
 		doRequestResponse, err = doRequest.Send(ctx)
 		if err != nil {
-			return clientError(http.StatusInternalServerError, fmt.Sprintf(errNoResponse, target, err))
+			return backendError(target, err)
 		}
-		respoBodyJSON, err = json.Marshal(doRequestResponse)
+		return sdkResponse(target, doRequestResponse)
 	case acmpcaRevokeCertificate:
 		var req = &acmpca.RevokeCertificateInput{}
 		err = json.Unmarshal([]byte(request.Body), req)
@@ -138,9 +134,9 @@ func passThru(request events.APIGatewayProxyRequest, ctx context.Context, target
 		var doRequestResponse *acmpca.RevokeCertificateResponse
 		doRequestResponse, err = doRequest.Send(ctx)
 		if err != nil {
-			return clientError(http.StatusInternalServerError, fmt.Sprintf(errNoResponse, target, err))
+			return backendError(target, err)
 		}
-		respoBodyJSON, err = json.Marshal(doRequestResponse)
+		return sdkResponse(target, doRequestResponse)
 
 	case acmpcaGetCertificate:
 		var req = &acmpca.GetCertificateInput{}
@@ -153,9 +149,9 @@ func passThru(request events.APIGatewayProxyRequest, ctx context.Context, target
 		var doRequestResponse *acmpca.GetCertificateResponse
 		doRequestResponse, err = doRequest.Send(ctx)
 		if err != nil {
-			return clientError(http.StatusInternalServerError, fmt.Sprintf(errNoResponse, target, err))
+			return backendError(target, err)
 		}
-		respoBodyJSON, err = json.Marshal(doRequestResponse)
+		return sdkResponse(target, doRequestResponse)
 	case acmpcaListCertificateAuthorities:
 		var req = &acmpca.ListCertificateAuthoritiesInput{}
 		err = json.Unmarshal([]byte(request.Body), req)
@@ -167,18 +163,10 @@ func passThru(request events.APIGatewayProxyRequest, ctx context.Context, target
 		var doRequestResponse *acmpca.ListCertificateAuthoritiesResponse
 		doRequestResponse, err = doRequest.Send(ctx)
 		if err != nil {
-			return clientError(http.StatusInternalServerError, fmt.Sprintf(errNoResponse, target, err))
+			return backendError(target, err)
 		}
-		respoBodyJSON, err = json.Marshal(doRequestResponse)
+		return sdkResponse(target, doRequestResponse)
 	default:
 		return clientError(http.StatusUnprocessableEntity, fmt.Sprintf("Don't know hot to pass thru target: %s", target))
 	}
-
-	if err != nil {
-		return clientError(http.StatusUnprocessableEntity, fmt.Sprintf("Error marshaling response JSON for target %s: %s", target, err))
-	}
-	return events.APIGatewayProxyResponse{
-		Body:       string(respoBodyJSON),
-		StatusCode: http.StatusOK,
-	}, nil
 }
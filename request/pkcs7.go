@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+)
+
+var (
+	oidPKCS7Data          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidPKCS7SignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidPKCS7EnvelopedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+
+	oidAttributeContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidAttributeMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidAttributeSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+
+	oidRSAEncryption = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidSHA1          = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA512        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+
+	oidDESEDE3CBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+	oidAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// pkcs7ContentInfo is PKCS#7 ContentInfo (RFC 2315 section 7).
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+// pkcs7SignedData is PKCS#7 SignedData (RFC 2315 section 9.1). Sets are kept raw.
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      pkcs7ContentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      asn1.RawValue
+}
+
+type pkcs7IssuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+// pkcs7SignerInfo is PKCS#7 SignerInfo (RFC 2315 section 9.2). Attribute sets are kept raw, because the signature
+// covers their exact encoding.
+type pkcs7SignerInfo struct {
+	Version                   int
+	IssuerAndSerial           pkcs7IssuerAndSerial
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttributes asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type pkcs7Attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+// pkcs7EnvelopedData is PKCS#7 EnvelopedData (RFC 2315 section 10.1).
+type pkcs7EnvelopedData struct {
+	Version              int
+	RecipientInfos       []pkcs7RecipientInfo `asn1:"set"`
+	EncryptedContentInfo pkcs7EncryptedContentInfo
+}
+
+type pkcs7RecipientInfo struct {
+	Version                int
+	IssuerAndSerial        pkcs7IssuerAndSerial
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type pkcs7EncryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+func asn1Set(elements ...[]byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: bytes.Join(elements, nil)}
+}
+
+// explicitContent wraps the content into [0] of ContentInfo. encoding/asn1 doesn't add explicit tags to raw values.
+func explicitContent(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+// pkcs7CertsOnly returns degenerate SignedData without signers carrying the certificates, the "certs-only"
+// format EST and SCEP return certificates in.
+func pkcs7CertsOnly(certs []*x509.Certificate) ([]byte, error) {
+	var raw [][]byte
+	for _, c := range certs {
+		raw = append(raw, c.Raw)
+	}
+	sd, err := asn1.Marshal(pkcs7SignedData{
+		Version:          1,
+		DigestAlgorithms: asn1Set(),
+		ContentInfo:      pkcs7ContentInfo{ContentType: oidPKCS7Data},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: bytes.Join(raw, nil)},
+		SignerInfos:      asn1Set(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(pkcs7ContentInfo{ContentType: oidPKCS7SignedData, Content: explicitContent(sd)})
+}
+
+// newPKCS7Attribute returns an attribute with a single value.
+func newPKCS7Attribute(oid asn1.ObjectIdentifier, value interface{}) (pkcs7Attribute, error) {
+	v, err := asn1.Marshal(value)
+	if err != nil {
+		return pkcs7Attribute{}, err
+	}
+	return pkcs7Attribute{Type: oid, Values: asn1Set(v)}, nil
+}
+
+// encodeAttributes returns DER SET OF the attributes, sorted as DER requires.
+func encodeAttributes(attrs []pkcs7Attribute) ([]byte, error) {
+	encoded := make([][]byte, len(attrs))
+	for i, a := range attrs {
+		b, err := asn1.Marshal(a)
+		if err != nil {
+			return nil, err
+		}
+		encoded[i] = b
+	}
+	sort.Slice(encoded, func(i, j int) bool { return bytes.Compare(encoded[i], encoded[j]) < 0 })
+	return asn1.Marshal(asn1Set(encoded...))
+}
+
+// pkcs7Sign returns SignedData with the content signed by RSA key with SHA-256. The attributes are added to
+// authenticated attributes next to content type, signing time and message digest.
+func pkcs7Sign(content []byte, cert *x509.Certificate, key *rsa.PrivateKey, attrs []pkcs7Attribute) ([]byte, error) {
+	digest := sha256.Sum256(content)
+	for _, a := range []struct {
+		oid   asn1.ObjectIdentifier
+		value interface{}
+	}{
+		{oidAttributeContentType, oidPKCS7Data},
+		{oidAttributeSigningTime, time.Now().UTC()},
+		{oidAttributeMessageDigest, digest[:]},
+	} {
+		attr, err := newPKCS7Attribute(a.oid, a.value)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, attr)
+	}
+	signed, err := encodeAttributes(attrs)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(signed)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return nil, err
+	}
+	var set asn1.RawValue
+	if _, err = asn1.Unmarshal(signed, &set); err != nil {
+		return nil, err
+	}
+	si, err := asn1.Marshal(pkcs7SignerInfo{
+		Version:                   1,
+		IssuerAndSerial:           pkcs7IssuerAndSerial{Issuer: asn1.RawValue{FullBytes: cert.RawIssuer}, Serial: cert.SerialNumber},
+		DigestAlgorithm:           pkix.AlgorithmIdentifier{Algorithm: oidSHA256},
+		AuthenticatedAttributes:   asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: set.Bytes},
+		DigestEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue},
+		EncryptedDigest:           sig,
+	})
+	if err != nil {
+		return nil, err
+	}
+	digestAlg, err := asn1.Marshal(pkix.AlgorithmIdentifier{Algorithm: oidSHA256})
+	if err != nil {
+		return nil, err
+	}
+	sd := pkcs7SignedData{
+		Version:          1,
+		DigestAlgorithms: asn1Set(digestAlg),
+		ContentInfo:      pkcs7ContentInfo{ContentType: oidPKCS7Data},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: cert.Raw},
+		SignerInfos:      asn1Set(si),
+	}
+	if content != nil {
+		octets, err := asn1.Marshal(content)
+		if err != nil {
+			return nil, err
+		}
+		sd.ContentInfo.Content = explicitContent(octets)
+	}
+	b, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(pkcs7ContentInfo{ContentType: oidPKCS7SignedData, Content: explicitContent(b)})
+}
+
+// pkcs7Message is verified SignedData.
+type pkcs7Message struct {
+	Content []byte
+	Signer  *x509.Certificate
+	// Attributes are the first values of authenticated attributes by OID
+	Attributes map[string]asn1.RawValue
+}
+
+func digestHash(oid asn1.ObjectIdentifier) (crypto.Hash, error) {
+	switch {
+	case oid.Equal(oidSHA1):
+		return crypto.SHA1, nil
+	case oid.Equal(oidSHA256):
+		return crypto.SHA256, nil
+	case oid.Equal(oidSHA512):
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("unsupported digest algorithm %s", oid)
+}
+
+func hashSum(h crypto.Hash, b []byte) []byte {
+	switch h {
+	case crypto.SHA1:
+		sum := sha1.Sum(b)
+		return sum[:]
+	case crypto.SHA512:
+		sum := sha512.Sum512(b)
+		return sum[:]
+	}
+	sum := sha256.Sum256(b)
+	return sum[:]
+}
+
+// pkcs7Verify parses SignedData and verifies RSA signature of its first signer with the signer certificate
+// carried in the message. The certificate itself is not verified, SCEP requesters use self-signed ones.
+func pkcs7Verify(der []byte) (*pkcs7Message, error) {
+	var ci pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil {
+		return nil, fmt.Errorf("can't parse PKCS#7: %s", err)
+	}
+	if !ci.ContentType.Equal(oidPKCS7SignedData) {
+		return nil, fmt.Errorf("PKCS#7 content is %s, not signed data", ci.ContentType)
+	}
+	var sd pkcs7SignedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, fmt.Errorf("can't parse signed data: %s", err)
+	}
+	m := &pkcs7Message{Attributes: map[string]asn1.RawValue{}}
+	if len(sd.ContentInfo.Content.Bytes) > 0 {
+		if _, err := asn1.Unmarshal(sd.ContentInfo.Content.Bytes, &m.Content); err != nil {
+			return nil, fmt.Errorf("can't parse signed content: %s", err)
+		}
+	}
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse signed data certificates: %s", err)
+	}
+	var si pkcs7SignerInfo
+	if _, err = asn1.Unmarshal(sd.SignerInfos.Bytes, &si); err != nil {
+		return nil, fmt.Errorf("can't parse signer info: %s", err)
+	}
+	for _, c := range certs {
+		if c.SerialNumber.Cmp(si.IssuerAndSerial.Serial) == 0 && bytes.Equal(c.RawIssuer, si.IssuerAndSerial.Issuer.FullBytes) {
+			m.Signer = c
+		}
+	}
+	if m.Signer == nil {
+		return nil, errors.New("signer certificate is not in the message")
+	}
+	pub, ok := m.Signer.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("signer key is not RSA")
+	}
+	h, err := digestHash(si.DigestAlgorithm.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	signed := m.Content
+	if len(si.AuthenticatedAttributes.Bytes) > 0 {
+		// the signature covers attributes encoded as SET, not as [0]
+		signed, err = asn1.Marshal(asn1Set(si.AuthenticatedAttributes.Bytes))
+		if err != nil {
+			return nil, err
+		}
+		for rest := si.AuthenticatedAttributes.Bytes; len(rest) > 0; {
+			var a pkcs7Attribute
+			if rest, err = asn1.Unmarshal(rest, &a); err != nil {
+				return nil, fmt.Errorf("can't parse authenticated attributes: %s", err)
+			}
+			var v asn1.RawValue
+			if _, err = asn1.Unmarshal(a.Values.Bytes, &v); err == nil {
+				m.Attributes[a.Type.String()] = v
+			}
+		}
+		var digest []byte
+		if _, err = asn1.Unmarshal(m.Attributes[oidAttributeMessageDigest.String()].FullBytes, &digest); err != nil ||
+			!bytes.Equal(digest, hashSum(h, m.Content)) {
+			return nil, errors.New("message digest doesn't match the content")
+		}
+	}
+	if err = rsa.VerifyPKCS1v15(pub, h, hashSum(h, signed), si.EncryptedDigest); err != nil {
+		return nil, fmt.Errorf("signature verification failed: %s", err)
+	}
+	return m, nil
+}
+
+// contentCipher returns block cipher and key size of PKCS#7 content encryption algorithm.
+func contentCipher(oid asn1.ObjectIdentifier) (func([]byte) (cipher.Block, error), int, error) {
+	switch {
+	case oid.Equal(oidAES128CBC):
+		return aes.NewCipher, 16, nil
+	case oid.Equal(oidAES192CBC):
+		return aes.NewCipher, 24, nil
+	case oid.Equal(oidAES256CBC):
+		return aes.NewCipher, 32, nil
+	case oid.Equal(oidDESEDE3CBC):
+		return des.NewTripleDESCipher, 24, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported content encryption algorithm %s", oid)
+}
+
+// pkcs7Envelope returns EnvelopedData with the content encrypted for the RSA recipient certificate.
+func pkcs7Envelope(content []byte, recipient *x509.Certificate, alg asn1.ObjectIdentifier) ([]byte, error) {
+	pub, ok := recipient.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("recipient key is not RSA")
+	}
+	newCipher, keySize, err := contentCipher(alg)
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, keySize)
+	if _, err = rand.Read(key); err != nil {
+		return nil, err
+	}
+	block, err := newCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, block.BlockSize())
+	if _, err = rand.Read(iv); err != nil {
+		return nil, err
+	}
+	padding := block.BlockSize() - len(content)%block.BlockSize()
+	ciphertext := append(append([]byte{}, content...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, ciphertext)
+
+	encryptedKey, err := rsa.EncryptPKCS1v15(rand.Reader, pub, key)
+	if err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+	ed, err := asn1.Marshal(pkcs7EnvelopedData{
+		Version: 0,
+		RecipientInfos: []pkcs7RecipientInfo{{
+			Version:                0,
+			IssuerAndSerial:        pkcs7IssuerAndSerial{Issuer: asn1.RawValue{FullBytes: recipient.RawIssuer}, Serial: recipient.SerialNumber},
+			KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue},
+			EncryptedKey:           encryptedKey,
+		}},
+		EncryptedContentInfo: pkcs7EncryptedContentInfo{
+			ContentType:                oidPKCS7Data,
+			ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: alg, Parameters: asn1.RawValue{FullBytes: params}},
+			EncryptedContent:           asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: ciphertext},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(pkcs7ContentInfo{ContentType: oidPKCS7EnvelopedData, Content: explicitContent(ed)})
+}
+
+// errPKCS7Decryption is returned for every failure to decrypt the content with the key, so RSA and padding
+// failures can't be told apart (RFC 3218 section 2.3.2).
+var errPKCS7Decryption = errors.New("can't decrypt enveloped data")
+
+// pkcs7Decrypt decrypts EnvelopedData for the recipient certificate with its RSA key and returns the content and
+// its encryption algorithm.
+func pkcs7Decrypt(der []byte, recipient *x509.Certificate, key *rsa.PrivateKey) ([]byte, asn1.ObjectIdentifier, error) {
+	var ci pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil {
+		return nil, nil, fmt.Errorf("can't parse PKCS#7: %s", err)
+	}
+	if !ci.ContentType.Equal(oidPKCS7EnvelopedData) {
+		return nil, nil, fmt.Errorf("PKCS#7 content is %s, not enveloped data", ci.ContentType)
+	}
+	var ed pkcs7EnvelopedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+		return nil, nil, fmt.Errorf("can't parse enveloped data: %s", err)
+	}
+	var ri *pkcs7RecipientInfo
+	for i, r := range ed.RecipientInfos {
+		if r.IssuerAndSerial.Serial != nil && r.IssuerAndSerial.Serial.Cmp(recipient.SerialNumber) == 0 &&
+			bytes.Equal(r.IssuerAndSerial.Issuer.FullBytes, recipient.RawIssuer) {
+			ri = &ed.RecipientInfos[i]
+		}
+	}
+	if ri == nil {
+		return nil, nil, errors.New("enveloped data has no recipient info for the certificate")
+	}
+	eci := ed.EncryptedContentInfo
+	alg := eci.ContentEncryptionAlgorithm.Algorithm
+	newCipher, keySize, err := contentCipher(alg)
+	if err != nil {
+		return nil, nil, err
+	}
+	var iv []byte
+	if _, err = asn1.Unmarshal(eci.ContentEncryptionAlgorithm.Parameters.FullBytes, &iv); err != nil || len(iv) != aes.BlockSize && len(iv) != des.BlockSize {
+		return nil, nil, errors.New("bad content encryption IV")
+	}
+	ciphertext := eci.EncryptedContent.Bytes
+	if eci.EncryptedContent.IsCompound {
+		// BER constructed OCTET STRING split into chunks
+		ciphertext = nil
+		for rest := eci.EncryptedContent.Bytes; len(rest) > 0; {
+			var chunk []byte
+			if rest, err = asn1.Unmarshal(rest, &chunk); err != nil {
+				return nil, nil, fmt.Errorf("can't parse encrypted content: %s", err)
+			}
+			ciphertext = append(ciphertext, chunk...)
+		}
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%len(iv) != 0 {
+		return nil, nil, errors.New("bad encrypted content length")
+	}
+
+	// a key that doesn't decrypt leaves the random one in place, and the content then fails the padding check
+	// like any other wrong key
+	contentKey := make([]byte, keySize)
+	if _, err = rand.Read(contentKey); err != nil {
+		return nil, nil, err
+	}
+	if err = rsa.DecryptPKCS1v15SessionKey(rand.Reader, key, ri.EncryptedKey, contentKey); err != nil {
+		return nil, nil, errPKCS7Decryption
+	}
+	block, err := newCipher(contentKey)
+	if err != nil || block.BlockSize() != len(iv) {
+		return nil, nil, errPKCS7Decryption
+	}
+	content := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(content, ciphertext)
+	padding, ok := pkcs7Padding(content, block.BlockSize())
+	if !ok {
+		return nil, nil, errPKCS7Decryption
+	}
+	return content[:len(content)-padding], alg, nil
+}
+
+// pkcs7Padding returns the padding length of the decrypted content. It takes the same time for any padding.
+func pkcs7Padding(content []byte, blockSize int) (int, bool) {
+	padding := int(content[len(content)-1])
+	good := subtle.ConstantTimeLessOrEq(1, padding) & subtle.ConstantTimeLessOrEq(padding, blockSize)
+	for i := 0; i < blockSize; i++ {
+		inPadding := subtle.ConstantTimeLessOrEq(i+1, padding)
+		good &= subtle.ConstantTimeByteEq(content[len(content)-1-i], byte(padding)) | (inPadding ^ 1)
+	}
+	return padding, good == 1
+}
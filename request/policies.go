@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/aws/aws-lambda-go/events"
+	"net/http"
+)
+
+const (
+	venafiGetPolicy      = "VenafiGetPolicy"
+	venafiListPolicies   = "VenafiListPolicies"
+	defaultPoliciesLimit = 100
+)
+
+type VenafiGetPolicyInput struct {
+	VenafiZone string `json:"VenafiZone"`
+}
+
+type VenafiListPoliciesInput struct {
+	MaxResults int    `json:"MaxResults"`
+	NextToken  string `json:"NextToken"`
+}
+
+type VenafiListPoliciesResponse struct {
+	Zones     []string `json:"Zones"`
+	NextToken string   `json:"NextToken,omitempty"`
+}
+
+func venafiDescribePolicy(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var input VenafiGetPolicyInput
+	err := json.Unmarshal([]byte(request.Body), &input)
+	if err != nil {
+		return clientError(http.StatusUnprocessableEntity, fmt.Sprintf(errUnmarshalJson, venafiGetPolicy, err))
+	}
+	if input.VenafiZone == "" {
+		input.VenafiZone = defaultZone
+	}
+	if err := authorizeZone(request, input.VenafiZone); err != nil {
+		return clientError(http.StatusForbidden, err.Error())
+	}
+	record, err := common.GetPolicyRecord(input.VenafiZone)
+	if err == common.PolicyNotFound {
+		return clientError(http.StatusNotFound, fmt.Sprintf("Policy %s not exist in database.", input.VenafiZone))
+	} else if err == common.PolicyFoundButEmpty {
+		return clientError(http.StatusFailedDependency, fmt.Sprintf("Policy %s is not synchronized by policy lambda yet.", input.VenafiZone))
+	} else if err != nil {
+		return clientError(http.StatusFailedDependency, fmt.Sprintf("Failed to get policy from database: %s", err))
+	}
+	return jsonResponse(venafiGetPolicy, common.DescribePolicy(record))
+}
+
+func venafiListPoliciesNames(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var input VenafiListPoliciesInput
+	if request.Body != "" {
+		err := json.Unmarshal([]byte(request.Body), &input)
+		if err != nil {
+			return clientError(http.StatusUnprocessableEntity, fmt.Sprintf(errUnmarshalJson, venafiListPolicies, err))
+		}
+	}
+	if input.MaxResults <= 0 {
+		input.MaxResults = defaultPoliciesLimit
+	}
+	names, next, err := common.ListPoliciesNames(input.MaxResults, input.NextToken)
+	if err != nil {
+		return clientError(http.StatusFailedDependency, fmt.Sprintf("Failed to list policies: %s", err))
+	}
+	if zones := allowedZones(request); zones != nil {
+		allowed := names[:0]
+		for _, name := range names {
+			if containsString(zones, name) {
+				allowed = append(allowed, name)
+			}
+		}
+		names = allowed
+	}
+	return jsonResponse(venafiListPolicies, VenafiListPoliciesResponse{Zones: names, NextToken: next})
+}
+
+func jsonResponse(target string, v interface{}) (events.APIGatewayProxyResponse, error) {
+	respoBodyJSON, err := json.Marshal(v)
+	if err != nil {
+		return clientError(http.StatusUnprocessableEntity, fmt.Sprintf("Error marshaling response JSON for target %s: %s", target, err))
+	}
+	return events.APIGatewayProxyResponse{
+		Body:       string(respoBodyJSON),
+		StatusCode: http.StatusOK,
+	}, nil
+}
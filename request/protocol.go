@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/private/protocol/json/jsonutil"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// amzJSONContentType is the content type of the AWS JSON 1.1 protocol ACM and ACM-PCA use.
+const amzJSONContentType = "application/x-amz-json-1.1"
+
+// sdkTargetPrefixes are X-Amz-Target prefixes sent by AWS CLI and SDKs, e.g. ACMPrivateCA.IssueCertificate.
+// The handler historically names the targets without the dot.
+var sdkTargetPrefixes = []string{"ACMPrivateCA.", "CertificateManager."}
+
+// normalizeTarget converts target sent by AWS CLI and SDKs to the handler target name.
+func normalizeTarget(target string) string {
+	for _, prefix := range sdkTargetPrefixes {
+		if strings.HasPrefix(target, prefix) {
+			return strings.TrimSuffix(prefix, ".") + strings.TrimPrefix(target, prefix)
+		}
+	}
+	return target
+}
+
+// errorCode returns AWS error code the SDKs expect in __type for the response status.
+func errorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		return "ValidationException"
+	case http.StatusForbidden:
+		return "AccessDeniedException"
+	case http.StatusNotFound:
+		return "ResourceNotFoundException"
+	case http.StatusMethodNotAllowed:
+		return "UnknownOperationException"
+	case http.StatusNotImplemented:
+		return "NotImplementedException"
+	case http.StatusFailedDependency:
+		return "RequestFailedException"
+	case http.StatusTooManyRequests:
+		return "ThrottlingException"
+	default:
+		return "InternalFailure"
+	}
+}
+
+// awsErrorResponse builds JSON 1.1 error response. msg duplicates the message for clients of the earlier format.
+func awsErrorResponse(status int, code, message string) events.APIGatewayProxyResponse {
+	b, _ := json.Marshal(struct {
+		Type    string `json:"__type"`
+		Message string `json:"message"`
+		Msg     string `json:"msg"`
+	}{code, message, message})
+	return events.APIGatewayProxyResponse{
+		StatusCode: status,
+		Headers: map[string]string{
+			"Content-Type":     amzJSONContentType,
+			"X-Amzn-ErrorType": code,
+		},
+		Body: string(b),
+	}
+}
+
+// backendError passes ACM or ACM-PCA error through with its status and code, so SDK callers get the same error
+// as from the service itself.
+func backendError(target string, err error) (events.APIGatewayProxyResponse, error) {
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() >= 400 {
+		return awsErrorResponse(reqErr.StatusCode(), reqErr.Code(), reqErr.Message()), nil
+	}
+	return clientError(http.StatusInternalServerError, fmt.Sprintf(errNoResponse, target, err))
+}
+
+// sdkResponse serializes ACM or ACM-PCA response the way the service does: unset fields are omitted,
+// timestamps are epoch seconds and blobs are base64.
+func sdkResponse(target string, resp interface{}) (events.APIGatewayProxyResponse, error) {
+	v := reflect.Indirect(reflect.ValueOf(resp))
+	// SDK responses embed the operation output next to unexported response metadata
+	if v.Kind() == reflect.Struct && v.NumField() > 0 && v.Type().Field(0).Anonymous {
+		v = v.Field(0)
+	}
+	b, err := jsonutil.BuildJSON(v.Interface())
+	if err != nil {
+		return clientError(http.StatusInternalServerError, fmt.Sprintf("Error marshaling response JSON for target %s: %s", target, err))
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Headers:    map[string]string{"Content-Type": amzJSONContentType},
+		Body:       string(b),
+	}, nil
+}
+
+// addBodyField returns SDK build handler which adds a field the SDK version in use doesn't know yet
+// to the JSON request body.
+func addBodyField(name string, value interface{}) func(*aws.Request) {
+	return func(r *aws.Request) {
+		var body map[string]interface{}
+		b, err := ioutil.ReadAll(r.Body)
+		if err == nil {
+			err = json.Unmarshal(b, &body)
+		}
+		if err != nil {
+			r.Error = fmt.Errorf("can't add %s to request body: %s", name, err)
+			return
+		}
+		body[name] = value
+		b, _ = json.Marshal(body)
+		r.SetBufferBody(b)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/Venafi/vcert/v4/pkg/endpoint"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/aws/external"
+	"github.com/aws/aws-sdk-go-v2/service/acmpca"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// proxyTestSetup runs the request server in front of fake ACM-PCA and returns unmodified SDK client of the server
+// and the list of zones the handler loaded policies for.
+func proxyTestSetup(t *testing.T, f *fakeACMPCA) (*acmpca.Client, *[]string, func()) {
+	var zones []string
+	loadAWSConfig = func(...external.Config) (aws.Config, error) { return f.config(), nil }
+	getPolicy = func(zone string) (endpoint.Policy, error) {
+		zones = append(zones, zone)
+		return verifyTestPolicy, nil
+	}
+	auditStore = common.NewMemoryAuditStore()
+	clients, policies, caTags = nil, nil, nil
+	srv := httptest.NewServer(&requestServer{})
+
+	cfg := f.config()
+	cfg.EndpointResolver = aws.ResolveWithEndpointURL(srv.URL)
+	cleanup := func() {
+		srv.Close()
+		loadAWSConfig = external.LoadDefaultAWSConfig
+		getPolicy = common.GetPolicy
+		auditStore = nil
+		clients, policies, caTags = nil, nil, nil
+	}
+	return acmpca.New(cfg), &zones, cleanup
+}
+
+func TestSDKCompatibleProxy(t *testing.T) {
+	f := newFakeACMPCA(t)
+	defer f.server.Close()
+	f.tags = map[string]string{zoneTagKey: "tagged-zone"}
+	cli, zones, cleanup := proxyTestSetup(t, f)
+	defer cleanup()
+	ctx := context.Background()
+
+	issued, err := cli.IssueCertificateRequest(&acmpca.IssueCertificateInput{
+		CertificateAuthorityArn: aws.String(testCAArn),
+		Csr:                     createCSR("www.example.com"),
+		SigningAlgorithm:        acmpca.SigningAlgorithmSha256withrsa,
+		Validity:                &acmpca.Validity{Type: acmpca.ValidityPeriodTypeDays, Value: aws.Int64(1)},
+	}).Send(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.certs[aws.StringValue(issued.CertificateArn)]; !ok {
+		t.Fatalf("unexpected certificate ARN %s", aws.StringValue(issued.CertificateArn))
+	}
+	if len(*zones) != 1 || (*zones)[0] != "tagged-zone" {
+		t.Fatalf("zone should be taken from CA tag, policies loaded for: %v", *zones)
+	}
+
+	// the SDK requires SigningAlgorithm, cert-cli leaves it out so the algorithm of the CA key is used
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	resp, err := ACMPCAHandler(events.APIGatewayProxyRequest{
+		Headers: map[string]string{"X-Amz-Target": acmpcaIssueCertificate},
+		Body: fmt.Sprintf(`{"CertificateAuthorityArn": "%s", "Csr": "%s", "Validity": {"Type": "DAYS", "Value": 1}}`,
+			testCAArn, base64.StdEncoding.EncodeToString(createCSRWithKey(t, ecKey, "api.example.com"))),
+	})
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("certificate should be issued without signing algorithm, got %v %d %s", err, resp.StatusCode, resp.Body)
+	}
+	if got := f.signingAlgorithms[len(f.signingAlgorithms)-1]; got != string(acmpca.SigningAlgorithmSha256withrsa) {
+		t.Fatalf("signing algorithm should follow the RSA CA key, got %s", got)
+	}
+
+	got, err := cli.GetCertificateRequest(&acmpca.GetCertificateInput{
+		CertificateArn:          issued.CertificateArn,
+		CertificateAuthorityArn: aws.String(testCAArn),
+	}).Send(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := parseCertificatePEM(aws.StringValue(got.Certificate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Subject.CommonName != "www.example.com" {
+		t.Fatalf("unexpected certificate CN %s", cert.Subject.CommonName)
+	}
+
+	_, err = cli.IssueCertificateRequest(&acmpca.IssueCertificateInput{
+		CertificateAuthorityArn: aws.String(testCAArn),
+		Csr:                     createCSR("www.example.org"),
+		SigningAlgorithm:        acmpca.SigningAlgorithmSha256withrsa,
+		Validity:                &acmpca.Validity{Type: acmpca.ValidityPeriodTypeDays, Value: aws.Int64(1)},
+	}).Send(ctx)
+	reqErr, ok := err.(awserr.RequestFailure)
+	if !ok {
+		t.Fatalf("expected request failure, got %v", err)
+	}
+	if reqErr.StatusCode() != http.StatusForbidden || reqErr.Code() != "AccessDeniedException" {
+		t.Fatalf("unexpected error: %d %s", reqErr.StatusCode(), reqErr.Code())
+	}
+
+	_, err = cli.GetCertificateRequest(&acmpca.GetCertificateInput{
+		CertificateArn:          aws.String(testCAArn + "/certificate/ff"),
+		CertificateAuthorityArn: aws.String(testCAArn),
+	}).Send(ctx)
+	if reqErr, ok := err.(awserr.RequestFailure); !ok || reqErr.Code() != "ResourceNotFoundException" {
+		t.Fatalf("backend error should be passed through, got %v", err)
+	}
+}
+
+func TestProxyZoneResolution(t *testing.T) {
+	f := newFakeACMPCA(t)
+	defer f.server.Close()
+	cli, zones, cleanup := proxyTestSetup(t, f)
+	defer cleanup()
+
+	issue := func(cli *acmpca.Client) {
+		_, err := cli.IssueCertificateRequest(&acmpca.IssueCertificateInput{
+			CertificateAuthorityArn: aws.String(testCAArn),
+			Csr:                     createCSR("www.example.com"),
+			SigningAlgorithm:        acmpca.SigningAlgorithmSha256withrsa,
+			Validity:                &acmpca.Validity{Type: acmpca.ValidityPeriodTypeDays, Value: aws.Int64(1)},
+		}).Send(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// no tag, header or mapping
+	issue(cli)
+
+	// zone from identity mapping of the verified SigV4 principal
+	sigV4Verifier = staticCredentials{"AKID": {AccessKeyID: "AKID", SecretAccessKey: "SECRET", Principal: testPrincipal}}
+	defer func() { sigV4Verifier = nil }()
+	_ = os.Setenv("PRINCIPAL_ZONES", `{"`+testPrincipal+`": "mapped-zone"}`)
+	defer os.Unsetenv("PRINCIPAL_ZONES")
+	issue(cli)
+
+	// zone from header
+	withHeader := acmpca.New(cli.Config)
+	withHeader.Handlers.Build.PushBack(func(r *aws.Request) {
+		r.HTTPRequest.Header.Set(zoneHeader, "header-zone")
+	})
+	issue(withHeader)
+
+	expected := []string{defaultZone, "mapped-zone", "header-zone"}
+	if len(*zones) != len(expected) {
+		t.Fatalf("expected zones %v, got %v", expected, *zones)
+	}
+	for i := range expected {
+		if (*zones)[i] != expected[i] {
+			t.Fatalf("expected zones %v, got %v", expected, *zones)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/aws/aws-lambda-go/events"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"time"
+)
+
+// issuanceLimits are the maximum numbers of issued certificates per window. Zero means no limit.
+type issuanceLimits struct {
+	PerMinute int64 `json:"PerMinute"`
+	PerHour   int64 `json:"PerHour"`
+	PerDay    int64 `json:"PerDay"`
+	PerMonth  int64 `json:"PerMonth"`
+}
+
+// rateLimitConfig is RATE_LIMITS value. Principal and Zone apply to every caller and zone without own limits.
+type rateLimitConfig struct {
+	Principal  issuanceLimits            `json:"Principal"`
+	Zone       issuanceLimits            `json:"Zone"`
+	Principals map[string]issuanceLimits `json:"Principals"`
+	Zones      map[string]issuanceLimits `json:"Zones"`
+}
+
+// rateLimitExceeded is returned when an issuance would exceed a limit.
+type rateLimitExceeded struct {
+	Scope      string
+	Name       string
+	Limit      int64
+	Window     string
+	RetryAfter time.Duration
+}
+
+func (e rateLimitExceeded) Error() string {
+	return fmt.Sprintf("Limit of %d certificates per %s for %s %s exceeded, retry after %s",
+		e.Limit, e.Window, e.Scope, e.Name, e.RetryAfter)
+}
+
+// retryAfterSeconds is Retry-After header value, rounded up so clients don't retry before the window ends.
+func (e rateLimitExceeded) retryAfterSeconds() string {
+	return fmt.Sprint(int64(math.Ceil(e.RetryAfter.Seconds())))
+}
+
+var (
+	rateLimits   *rateLimitConfig
+	counterStore common.CounterStore
+)
+
+func initRateLimits() {
+	rateLimits = nil
+	s := os.Getenv("RATE_LIMITS")
+	if s == "" {
+		return
+	}
+	var cfg rateLimitConfig
+	err := json.Unmarshal([]byte(s), &cfg)
+	if err != nil {
+		log.Printf("Ignoring bad RATE_LIMITS value: %s", err)
+		return
+	}
+	rateLimits = &cfg
+	if counterStore == nil {
+		counterStore = common.NewCounterStoreFromEnv()
+	}
+	if counterStore == nil {
+		log.Println("RATE_LIMITS_TABLE is not set, rate limits are counted per container")
+		counterStore = common.NewMemoryCounterStore()
+	}
+}
+
+// rateLimitUsage is the counters an issuance was counted in.
+type rateLimitUsage []string
+
+// refund takes back the issuance from the counters when the backend didn't issue the certificate.
+func (u rateLimitUsage) refund() {
+	for _, key := range u {
+		if err := counterStore.Decrement(key); err != nil {
+			log.Printf("Can't refund rate limit counter %s: %s", key, err)
+		}
+	}
+}
+
+// checkRateLimits counts one issuance for the principal and the zone and returns the counters to refund if it
+// isn't issued. A request over any limit is taken back from the counters it has already passed, so throttled
+// requests don't use up quotas.
+func checkRateLimits(principal, zone string, now time.Time) (rateLimitUsage, error) {
+	if rateLimits == nil || counterStore == nil {
+		return nil, nil
+	}
+	var usage rateLimitUsage
+	principalLimits, ok := rateLimits.Principals[principal]
+	if !ok {
+		principalLimits = rateLimits.Principal
+	}
+	zoneLimits, ok := rateLimits.Zones[zone]
+	if !ok {
+		zoneLimits = rateLimits.Zone
+	}
+	for _, w := range limitWindows {
+		for _, scope := range []struct {
+			name, value string
+			limits      issuanceLimits
+		}{
+			{"principal", principal, principalLimits},
+			{"zone", zone, zoneLimits},
+		} {
+			limit := w.limit(scope.limits)
+			if limit <= 0 {
+				continue
+			}
+			start, end := w.bounds(now)
+			key := fmt.Sprintf("%s#%s#%s#%s", scope.name, scope.value, w.name, start.Format(time.RFC3339))
+			ok, err := counterStore.Increment(key, limit, end)
+			if err != nil {
+				usage.refund()
+				return nil, err
+			}
+			if !ok {
+				usage.refund()
+				return nil, rateLimitExceeded{
+					Scope:      scope.name,
+					Name:       scope.value,
+					Limit:      limit,
+					Window:     w.name,
+					RetryAfter: end.Sub(now),
+				}
+			}
+			usage = append(usage, key)
+		}
+	}
+	return usage, nil
+}
+
+type limitWindow struct {
+	name   string
+	limit  func(issuanceLimits) int64
+	bounds func(now time.Time) (start, end time.Time)
+}
+
+// limitWindows are fixed UTC windows ordered from the shortest.
+var limitWindows = []limitWindow{
+	{"minute", func(l issuanceLimits) int64 { return l.PerMinute }, func(now time.Time) (time.Time, time.Time) {
+		start := now.UTC().Truncate(time.Minute)
+		return start, start.Add(time.Minute)
+	}},
+	{"hour", func(l issuanceLimits) int64 { return l.PerHour }, func(now time.Time) (time.Time, time.Time) {
+		start := now.UTC().Truncate(time.Hour)
+		return start, start.Add(time.Hour)
+	}},
+	{"day", func(l issuanceLimits) int64 { return l.PerDay }, func(now time.Time) (time.Time, time.Time) {
+		y, m, d := now.UTC().Date()
+		start := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 0, 1)
+	}},
+	{"month", func(l issuanceLimits) int64 { return l.PerMonth }, func(now time.Time) (time.Time, time.Time) {
+		y, m, _ := now.UTC().Date()
+		start := time.Date(y, m, 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0)
+	}},
+}
+
+// throttled returns ThrottlingException with Retry-After hint.
+func throttled(e rateLimitExceeded) (events.APIGatewayProxyResponse, error) {
+	resp, err := clientError(http.StatusTooManyRequests, e.Error())
+	resp.Headers["Retry-After"] = e.retryAfterSeconds()
+	return resp, err
+}
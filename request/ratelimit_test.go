@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/aws/aws-lambda-go/events"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCheckRateLimits(t *testing.T) {
+	counterStore = common.NewMemoryCounterStore()
+	defer func() { counterStore = nil }()
+	_ = os.Setenv("RATE_LIMITS", `{
+		"Principal": {"PerMinute": 2},
+		"Zone": {"PerDay": 3},
+		"Principals": {"batch": {"PerMinute": 10}},
+		"Zones": {"unlimited": {}}
+	}`)
+	defer os.Unsetenv("RATE_LIMITS")
+	initRateLimits()
+	defer func() { rateLimits = nil }()
+
+	// far in the future so counters are not expired by the memory store
+	now := time.Date(2100, 1, 1, 10, 0, 30, 0, time.UTC)
+	for i := 0; i < 2; i++ {
+		if _, err := checkRateLimits("alice", "zone1", now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := checkRateLimits("alice", "zone1", now)
+	exceeded, ok := err.(rateLimitExceeded)
+	if !ok {
+		t.Fatalf("third request in a minute should be throttled, got %v", err)
+	}
+	if exceeded.Scope != "principal" || exceeded.Window != "minute" || exceeded.retryAfterSeconds() != "30" {
+		t.Fatalf("unexpected limit: %+v", exceeded)
+	}
+
+	// next minute the principal passes, but the zone daily quota is used up by the third issuance
+	now = now.Add(time.Minute)
+	if _, err := checkRateLimits("alice", "zone1", now); err != nil {
+		t.Fatal(err)
+	}
+	_, err = checkRateLimits("batch", "zone1", now)
+	exceeded, ok = err.(rateLimitExceeded)
+	if !ok || exceeded.Scope != "zone" || exceeded.Window != "day" {
+		t.Fatalf("zone quota should be exceeded, got %v", err)
+	}
+	if exceeded.RetryAfter != 13*time.Hour+58*time.Minute+30*time.Second {
+		t.Fatalf("retry should be after the end of the day, got %s", exceeded.RetryAfter)
+	}
+
+	// retries against the exhausted zone don't use up the principal limit
+	for i := 0; i < 9; i++ {
+		if _, err := checkRateLimits("batch", "zone1", now); err == nil {
+			t.Fatal("zone quota should stay exceeded")
+		}
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := checkRateLimits("batch", "unlimited", now); err != nil {
+			t.Fatalf("principal override should apply: %s", err)
+		}
+	}
+}
+
+func TestIssueCertificateThrottled(t *testing.T) {
+	f := newFakeACMPCA(t)
+	defer f.server.Close()
+	_, _, cleanup := proxyTestSetup(t, f)
+	defer cleanup()
+	counterStore = common.NewMemoryCounterStore()
+	defer func() { counterStore = nil }()
+	_ = os.Setenv("RATE_LIMITS", `{"Principal": {"PerHour": 1}}`)
+	defer os.Unsetenv("RATE_LIMITS")
+
+	issue := func() events.APIGatewayProxyResponse {
+		body := fmt.Sprintf(`{"CertificateAuthorityArn": "%s", "Csr": "%s", "SigningAlgorithm": "SHA256WITHRSA",
+			"Validity": {"Type": "DAYS", "Value": 1}}`, testCAArn, base64.StdEncoding.EncodeToString(createCSR("www.example.com")))
+		resp, err := ACMPCAHandler(events.APIGatewayProxyRequest{
+			Headers: map[string]string{"X-Amz-Target": acmpcaIssueCertificate},
+			Body:    body,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	// a certificate ACM-PCA fails to issue doesn't count against the limit
+	f.issueError = true
+	if resp := issue(); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf(wrongResponseCode, resp.StatusCode, resp.Body)
+	}
+	f.issueError = false
+	if resp := issue(); resp.StatusCode != http.StatusOK {
+		t.Fatalf(wrongResponseCode, resp.StatusCode, resp.Body)
+	}
+	resp := issue()
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Headers["X-Amzn-ErrorType"] != "ThrottlingException" {
+		t.Fatalf(wrongResponseCode, resp.StatusCode, resp.Body)
+	}
+	if resp.Headers["Retry-After"] == "" {
+		t.Fatal("throttled response should have Retry-After header")
+	}
+	if len(f.certs) != 1 {
+		t.Fatalf("throttled request should not be issued, got %d certificates", len(f.certs))
+	}
+	records, _, _ := auditStore.Query(common.AuditQuery{})
+	if len(records) != 3 || records[2].Decision != common.AuditDecisionThrottled {
+		t.Fatalf("throttled request should be audited, got %+v", records)
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	scepPath = "/scep"
+
+	scepIssueWait = 20 * time.Second
+
+	// SCEP message types and statuses (RFC 8894 section 3.2.1)
+	scepMessageCertRep  = "3"
+	scepMessagePKCSReq  = "19"
+	scepStatusSuccess   = "0"
+	scepStatusFailure   = "2"
+	scepFailBadCheck    = "1"
+	scepFailBadRequest  = "2"
+	scepCapabilities    = "POSTPKIOperation\nSHA-256\nSHA-512\nAES\nSCEPStandard\n"
+	scepCertRepMIMEType = "application/x-pki-message"
+)
+
+var (
+	oidSCEPMessageType    = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 2}
+	oidSCEPPKIStatus      = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 3}
+	oidSCEPFailInfo       = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 4}
+	oidSCEPSenderNonce    = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 5}
+	oidSCEPRecipientNonce = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 6}
+	oidSCEPTransactionID  = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 7}
+
+	oidChallengePassword = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 7}
+)
+
+// scepServer implements SCEP (RFC 8894) PKCSReq enrollment on top of the request handler. ACM-PCA keeps the CA key,
+// so requests are encrypted to and responses signed by a separate RA certificate. The challenge password of the CSR
+// selects the zone, and the CSR goes through the same zone policy check, audit and limits as IssueCertificate
+// requests.
+type scepServer struct {
+	caArn        string
+	validityDays int64
+	raCert       *x509.Certificate
+	raKey        *rsa.PrivateKey
+	// challenges maps zones to their challenge passwords
+	challenges map[string]string
+}
+
+// newSCEPServerFromEnv returns SCEP server for SCEP_CA_ARN or nil if SCEP is disabled.
+func newSCEPServerFromEnv() (*scepServer, error) {
+	caArn := os.Getenv("SCEP_CA_ARN")
+	if caArn == "" {
+		return nil, nil
+	}
+	s := &scepServer{caArn: caArn, validityDays: 365}
+	if v := os.Getenv("SCEP_VALIDITY_DAYS"); v != "" {
+		days, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || days < 1 {
+			return nil, fmt.Errorf("bad SCEP_VALIDITY_DAYS value %q", v)
+		}
+		s.validityDays = days
+	}
+	pair, err := tls.LoadX509KeyPair(os.Getenv("SCEP_RA_CERT_FILE"), os.Getenv("SCEP_RA_KEY_FILE"))
+	if err != nil {
+		return nil, fmt.Errorf("can't load SCEP RA certificate: %s", err)
+	}
+	key, ok := pair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("SCEP RA key has to be RSA")
+	}
+	s.raKey = key
+	s.raCert, err = x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(os.Getenv("SCEP_CHALLENGES_FILE"))
+	if err != nil {
+		return nil, fmt.Errorf("can't read SCEP_CHALLENGES_FILE: %s", err)
+	}
+	err = json.Unmarshal(b, &s.challenges)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse SCEP_CHALLENGES_FILE: %s", err)
+	}
+	seen := map[string]bool{}
+	for zone, password := range s.challenges {
+		if password == "" || seen[password] {
+			return nil, fmt.Errorf("challenge password of zone %s is empty or used by another zone", zone)
+		}
+		seen[password] = true
+	}
+	return s, nil
+}
+
+func (s *scepServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch op := r.URL.Query().Get("operation"); op {
+	case "GetCACaps":
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = io.WriteString(w, scepCapabilities)
+	case "GetCACert":
+		s.caCert(w, r)
+	case "PKIOperation":
+		s.pkiOperation(w, r)
+	default:
+		http.Error(w, fmt.Sprintf("unsupported operation %q", op), http.StatusBadRequest)
+	}
+}
+
+// caCert returns the RA certificate followed by the CA certificate and its chain.
+func (s *scepServer) caCert(w http.ResponseWriter, r *http.Request) {
+	ca, chain, err := caCertificate(r.Context(), s.caArn)
+	var certs []*x509.Certificate
+	if err == nil {
+		certs, err = parseCertificates(ca, chain)
+	}
+	var b []byte
+	if err == nil {
+		b, err = pkcs7CertsOnly(append([]*x509.Certificate{s.raCert}, certs...))
+	}
+	if err != nil {
+		log.Println("Can't get SCEP CA certificates:", err)
+		http.Error(w, "can't get CA certificates", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-x509-ca-ra-cert")
+	_, _ = w.Write(b)
+}
+
+// csrInfo is PKCS#10 CertificationRequestInfo (RFC 2986 section 4.1). x509.CertificateRequest doesn't expose
+// attributes with string values, such as the challenge password.
+type csrInfo struct {
+	Version    int
+	Subject    asn1.RawValue
+	PublicKey  asn1.RawValue
+	Attributes []pkcs7Attribute `asn1:"tag:0"`
+}
+
+func challengePassword(csr *x509.CertificateRequest) (string, error) {
+	var info csrInfo
+	if _, err := asn1.Unmarshal(csr.RawTBSCertificateRequest, &info); err != nil {
+		return "", err
+	}
+	for _, a := range info.Attributes {
+		if a.Type.Equal(oidChallengePassword) {
+			var password string
+			_, err := asn1.Unmarshal(a.Values.Bytes, &password)
+			return password, err
+		}
+	}
+	return "", nil
+}
+
+// challengeZone returns the zone of the challenge password.
+func (s *scepServer) challengeZone(password string) (string, bool) {
+	for zone, p := range s.challenges {
+		if subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1 {
+			return zone, true
+		}
+	}
+	return "", false
+}
+
+// checkSigner accepts signer certificates of the CSR key, which requesters self-sign for the initial enrollment,
+// and certificates issued by the CA, which sign renewal requests (RFC 8894 section 2.3). Other certificates only
+// prove possession of some key.
+func (s *scepServer) checkSigner(ctx context.Context, signer *x509.Certificate, csr *x509.CertificateRequest) error {
+	if bytes.Equal(signer.RawSubjectPublicKeyInfo, csr.RawSubjectPublicKeyInfo) {
+		return nil
+	}
+	ca, chain, err := caCertificate(ctx, s.caArn)
+	var certs []*x509.Certificate
+	if err == nil {
+		certs, err = parseCertificates(ca, chain)
+	}
+	if err != nil {
+		return fmt.Errorf("can't get CA certificates: %s", err)
+	}
+	roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+	for i, c := range certs {
+		if i == len(certs)-1 {
+			roots.AddCert(c)
+		} else {
+			intermediates.AddCert(c)
+		}
+	}
+	_, err = signer.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+	if err != nil {
+		return fmt.Errorf("signer certificate is neither issued by the CA nor for the CSR key: %s", err)
+	}
+	return nil
+}
+
+// scepRequest is the verified PKIOperation message.
+type scepRequest struct {
+	message       *pkcs7Message
+	transactionID asn1.RawValue
+	senderNonce   asn1.RawValue
+}
+
+func readPKIMessage(r *http.Request) ([]byte, error) {
+	if r.Method == http.MethodGet {
+		// base64 "+" is decoded as space when the client doesn't escape it
+		msg := strings.Replace(r.URL.Query().Get("message"), " ", "+", -1)
+		return base64.StdEncoding.DecodeString(msg)
+	}
+	return ioutil.ReadAll(io.LimitReader(r.Body, maxRequestBodySize))
+}
+
+func (s *scepServer) pkiOperation(w http.ResponseWriter, r *http.Request) {
+	der, err := readPKIMessage(r)
+	if err != nil {
+		http.Error(w, "can't read SCEP message", http.StatusBadRequest)
+		return
+	}
+	m, err := pkcs7Verify(der)
+	if err != nil {
+		log.Println("Bad SCEP message:", err)
+		http.Error(w, "bad SCEP message", http.StatusBadRequest)
+		return
+	}
+	req := scepRequest{
+		message:       m,
+		transactionID: m.Attributes[oidSCEPTransactionID.String()],
+		senderNonce:   m.Attributes[oidSCEPSenderNonce.String()],
+	}
+	var messageType string
+	_, _ = asn1.Unmarshal(m.Attributes[oidSCEPMessageType.String()].FullBytes, &messageType)
+	if messageType != scepMessagePKCSReq {
+		s.reply(w, req, nil, nil, scepFailBadRequest, fmt.Errorf("unsupported SCEP message type %q", messageType))
+		return
+	}
+	// decryption, CSR and signer failures get the same failInfo, so they can't be told apart
+	csrDER, alg, err := pkcs7Decrypt(m.Content, s.raCert, s.raKey)
+	var csr *x509.CertificateRequest
+	if err == nil {
+		csr, err = x509.ParseCertificateRequest(csrDER)
+	}
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	if err == nil {
+		err = s.checkSigner(r.Context(), m.Signer, csr)
+	}
+	if err != nil {
+		s.reply(w, req, nil, nil, scepFailBadCheck, fmt.Errorf("bad PKCSReq: %s", err))
+		return
+	}
+	password, err := challengePassword(csr)
+	zone, ok := s.challengeZone(password)
+	if err != nil || !ok {
+		s.reply(w, req, nil, nil, scepFailBadRequest, fmt.Errorf("challenge password doesn't match any zone"))
+		return
+	}
+
+	// retries of the same CSR get the same certificate
+	sum := sha256.Sum256(csr.Raw)
+	arn, resp, err := enroll(r.Context(), enrollment{
+		Caller:           "scep-client:" + m.Signer.Subject.String(),
+		Zones:            zone,
+		Zone:             zone,
+		CAArn:            s.caArn,
+		CSR:              csr.Raw,
+		ValidityDays:     s.validityDays,
+		IdempotencyToken: hex.EncodeToString(sum[:16]),
+	})
+	if err == nil && resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%s", handlerMessage(resp))
+	}
+	if err == nil && !certificateIssued(r.Context(), s.caArn, arn, scepIssueWait) {
+		err = fmt.Errorf("certificate %s is not issued yet", arn)
+	}
+	var certs []*x509.Certificate
+	if err == nil {
+		var certPEM string
+		certPEM, _, err = issuedCertificate(r.Context(), s.caArn, arn)
+		if err == nil {
+			certs, err = parseCertificates(certPEM)
+		}
+	}
+	if err != nil {
+		s.reply(w, req, nil, nil, scepFailBadRequest, err)
+		return
+	}
+	s.reply(w, req, certs, alg, "", nil)
+}
+
+// reply writes CertRep message with the certificates encrypted for the requester, or failure with failInfo
+// when certs are nil.
+func (s *scepServer) reply(w http.ResponseWriter, req scepRequest, certs []*x509.Certificate, alg asn1.ObjectIdentifier, failInfo string, reason error) {
+	status := scepStatusSuccess
+	if certs == nil {
+		log.Println("SCEP request failed:", reason)
+		status = scepStatusFailure
+	}
+	nonce := make([]byte, 16)
+	_, _ = rand.Read(nonce)
+	var attrs []pkcs7Attribute
+	var err error
+	add := func(oid asn1.ObjectIdentifier, value interface{}) {
+		if err != nil {
+			return
+		}
+		var a pkcs7Attribute
+		a, err = newPKCS7Attribute(oid, value)
+		attrs = append(attrs, a)
+	}
+	add(oidSCEPMessageType, scepMessageCertRep)
+	add(oidSCEPPKIStatus, status)
+	add(oidSCEPSenderNonce, nonce)
+	if len(req.transactionID.FullBytes) > 0 {
+		add(oidSCEPTransactionID, req.transactionID)
+	}
+	if len(req.senderNonce.FullBytes) > 0 {
+		add(oidSCEPRecipientNonce, req.senderNonce)
+	}
+	if certs == nil {
+		add(oidSCEPFailInfo, failInfo)
+	}
+
+	var content []byte
+	if err == nil && certs != nil {
+		content, err = pkcs7CertsOnly(certs)
+		if err == nil {
+			content, err = pkcs7Envelope(content, req.message.Signer, alg)
+		}
+	}
+	var b []byte
+	if err == nil {
+		b, err = pkcs7Sign(content, s.raCert, s.raKey, attrs)
+	}
+	if err != nil {
+		log.Println("Can't create SCEP response:", err)
+		http.Error(w, "can't create SCEP response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", scepCertRepMIMEType)
+	_, _ = w.Write(b)
+}
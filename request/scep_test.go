@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func selfSignedRSA(t *testing.T, cn string) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+// scepCSR returns DER CSR with the challenge password attribute, which x509.CreateCertificateRequest can't add.
+func scepCSR(t *testing.T, key *rsa.PrivateKey, cn, password string) []byte {
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: cn},
+		DNSNames: []string{cn},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, _ := x509.ParseCertificateRequest(der)
+	var info csrInfo
+	if _, err = asn1.Unmarshal(csr.RawTBSCertificateRequest, &info); err != nil {
+		t.Fatal(err)
+	}
+	challenge, _ := newPKCS7Attribute(oidChallengePassword, password)
+	info.Attributes = append(info.Attributes, challenge)
+	tbs, err := asn1.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(tbs)
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	der, err = asn1.Marshal(struct {
+		Info      asn1.RawValue
+		Algorithm pkix.AlgorithmIdentifier
+		Signature asn1.BitString
+	}{
+		Info:      asn1.RawValue{FullBytes: tbs},
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}, Parameters: asn1.NullRawValue},
+		Signature: asn1.BitString{Bytes: sig, BitLength: len(sig) * 8},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestSCEPEnrollment(t *testing.T) {
+	f := newFakeACMPCA(t)
+	defer f.server.Close()
+	_, zones, cleanup := proxyTestSetup(t, f)
+	defer cleanup()
+
+	raCert, raKey := selfSignedRSA(t, "SCEP RA")
+	scep := &scepServer{
+		caArn:        testCAArn,
+		validityDays: 1,
+		raCert:       raCert,
+		raKey:        raKey,
+		challenges:   map[string]string{"mdm-zone": "mdm-secret"},
+	}
+	srv := httptest.NewServer(&requestServer{scep: scep})
+	defer srv.Close()
+
+	get := func(op string) []byte {
+		resp, err := http.Get(srv.URL + scepPath + "?operation=" + op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s returned %d: %s", op, resp.StatusCode, b)
+		}
+		return b
+	}
+	if caps := get("GetCACaps"); !bytes.Contains(caps, []byte("POSTPKIOperation")) || bytes.Contains(caps, []byte("SHA-1")) || bytes.Contains(caps, []byte("DES3")) {
+		t.Fatalf("unexpected capabilities: %s", caps)
+	}
+	certs := pkcs7Certs(t, get("GetCACert"))
+	if len(certs) != 2 || !certs[0].Equal(raCert) || !certs[1].Equal(f.caCert) {
+		t.Fatalf("GetCACert should return RA and CA certificates, got %d certificates", len(certs))
+	}
+
+	clientCert, clientKey := selfSignedRSA(t, "device-42")
+	envelope := func(csr []byte, alg asn1.ObjectIdentifier) []byte {
+		enveloped, err := pkcs7Envelope(csr, raCert, alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return enveloped
+	}
+	// pkiOperation sends PKCSReq signed with the signer certificate and returns pkiStatus, failInfo and the issued
+	// certificates
+	pkiOperation := func(enveloped []byte, signerCert *x509.Certificate, signerKey *rsa.PrivateKey) (string, string, []*x509.Certificate) {
+		messageType, _ := newPKCS7Attribute(oidSCEPMessageType, scepMessagePKCSReq)
+		transaction, _ := newPKCS7Attribute(oidSCEPTransactionID, "transaction-1")
+		senderNonce, _ := newPKCS7Attribute(oidSCEPSenderNonce, []byte("0123456789abcdef"))
+		attrs := []pkcs7Attribute{messageType, transaction, senderNonce}
+		msg, err := pkcs7Sign(enveloped, signerCert, signerKey, attrs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.Post(srv.URL+scepPath+"?operation=PKIOperation", "application/x-pki-message", bytes.NewReader(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		rep, err := pkcs7Verify(b)
+		if err != nil {
+			t.Fatalf("can't verify CertRep: %s", err)
+		}
+		if !rep.Signer.Equal(raCert) {
+			t.Fatal("CertRep should be signed by RA")
+		}
+		var status, failInfo, transactionID string
+		var recipientNonce []byte
+		_, _ = asn1.Unmarshal(rep.Attributes[oidSCEPPKIStatus.String()].FullBytes, &status)
+		_, _ = asn1.Unmarshal(rep.Attributes[oidSCEPFailInfo.String()].FullBytes, &failInfo)
+		_, _ = asn1.Unmarshal(rep.Attributes[oidSCEPTransactionID.String()].FullBytes, &transactionID)
+		_, _ = asn1.Unmarshal(rep.Attributes[oidSCEPRecipientNonce.String()].FullBytes, &recipientNonce)
+		if transactionID != "transaction-1" || string(recipientNonce) != "0123456789abcdef" {
+			t.Fatalf("CertRep should echo transaction ID and nonce, got %q and %q", transactionID, recipientNonce)
+		}
+		if status != scepStatusSuccess {
+			return status, failInfo, nil
+		}
+		content, _, err := pkcs7Decrypt(rep.Content, signerCert, signerKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return status, failInfo, pkcs7Certs(t, content)
+	}
+
+	if status, failInfo, _ := pkiOperation(envelope(scepCSR(t, clientKey, "device42.example.com", "wrong"), oidAES128CBC), clientCert, clientKey); status != scepStatusFailure || failInfo != scepFailBadRequest {
+		t.Fatalf("wrong challenge password should fail with badRequest, got %s/%s", status, failInfo)
+	}
+	if status, _, _ := pkiOperation(envelope(scepCSR(t, clientKey, "device42.example.org", "mdm-secret"), oidAES128CBC), clientCert, clientKey); status != scepStatusFailure {
+		t.Fatalf("CSR violating zone policy should fail, got %s", status)
+	}
+	if (*zones)[len(*zones)-1] != "mdm-zone" {
+		t.Fatalf("challenge password should select the zone, zones: %v", *zones)
+	}
+
+	var issued []*x509.Certificate
+	for _, alg := range []asn1.ObjectIdentifier{oidAES256CBC, oidDESEDE3CBC} {
+		var status, failInfo string
+		status, failInfo, issued = pkiOperation(envelope(scepCSR(t, clientKey, "device42.example.com", "mdm-secret"), alg), clientCert, clientKey)
+		if status != scepStatusSuccess || len(issued) != 1 {
+			t.Fatalf("enrollment with %s should succeed, got %s/%s", alg, status, failInfo)
+		}
+		if issued[0].Subject.CommonName != "device42.example.com" {
+			t.Fatalf("unexpected certificate subject %s", issued[0].Subject)
+		}
+	}
+
+	// renewal is signed with the certificate issued by the CA for the old key
+	_, renewalKey := selfSignedRSA(t, "device-42")
+	if status, failInfo, renewed := pkiOperation(envelope(scepCSR(t, renewalKey, "device42.example.com", "mdm-secret"), oidAES128CBC), issued[0], clientKey); status != scepStatusSuccess || len(renewed) != 1 {
+		t.Fatalf("renewal signed with the issued certificate should succeed, got %s/%s", status, failInfo)
+	}
+
+	// wrong signer, wrong recipient and undecryptable key all get the same failInfo
+	otherCert, otherKey := selfSignedRSA(t, "device-43")
+	csr := scepCSR(t, clientKey, "device42.example.com", "mdm-secret")
+	otherRecipient, err := pkcs7Envelope(csr, otherCert, oidAES128CBC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, operation := range map[string]func() (string, string, []*x509.Certificate){
+		"signer for another key": func() (string, string, []*x509.Certificate) {
+			return pkiOperation(envelope(csr, oidAES128CBC), otherCert, otherKey)
+		},
+		"another recipient": func() (string, string, []*x509.Certificate) {
+			return pkiOperation(otherRecipient, clientCert, clientKey)
+		},
+		"corrupted key": func() (string, string, []*x509.Certificate) {
+			return pkiOperation(corruptEncryptedKey(t, envelope(csr, oidAES128CBC)), clientCert, clientKey)
+		},
+	} {
+		if status, failInfo, _ := operation(); status != scepStatusFailure || failInfo != scepFailBadCheck {
+			t.Fatalf("%s should fail with badMessageCheck, got %s/%s", name, status, failInfo)
+		}
+	}
+}
+
+// corruptEncryptedKey flips a bit of the encrypted content key of the first recipient.
+func corruptEncryptedKey(t *testing.T, der []byte) []byte {
+	var ci pkcs7ContentInfo
+	var ed pkcs7EnvelopedData
+	if _, err := asn1.Unmarshal(der, &ci); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+		t.Fatal(err)
+	}
+	ed.RecipientInfos[0].EncryptedKey[0] ^= 1
+	b, err := asn1.Marshal(ed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if der, err = asn1.Marshal(pkcs7ContentInfo{ContentType: oidPKCS7EnvelopedData, Content: explicitContent(b)}); err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestPKCS7DecryptRecipient(t *testing.T) {
+	raCert, raKey := selfSignedRSA(t, "SCEP RA")
+	otherCert, _ := selfSignedRSA(t, "other")
+	var infos []pkcs7RecipientInfo
+	var eci pkcs7EncryptedContentInfo
+	for _, cert := range []*x509.Certificate{otherCert, raCert} {
+		der, err := pkcs7Envelope([]byte("content"), cert, oidAES128CBC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ci pkcs7ContentInfo
+		var ed pkcs7EnvelopedData
+		_, _ = asn1.Unmarshal(der, &ci)
+		_, _ = asn1.Unmarshal(ci.Content.Bytes, &ed)
+		infos = append(infos, ed.RecipientInfos[0])
+		eci = ed.EncryptedContentInfo
+	}
+	// the content is encrypted with the RA key, which comes second
+	b, err := asn1.Marshal(pkcs7EnvelopedData{RecipientInfos: infos, EncryptedContentInfo: eci})
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := asn1.Marshal(pkcs7ContentInfo{ContentType: oidPKCS7EnvelopedData, Content: explicitContent(b)})
+	content, _, err := pkcs7Decrypt(der, raCert, raKey)
+	if err != nil || string(content) != "content" {
+		t.Fatalf("should decrypt content for the second recipient, got %q, %v", content, err)
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	healthPath         = "/healthz"
+	readyPath          = "/readyz"
+	maxRequestBodySize = 1 << 20
+	shutdownTimeout    = 15 * time.Second
+	// defaultShutdownDrain is how long the server keeps serving with failing /readyz after SIGTERM, so load
+	// balancers stop sending requests before the listener is closed
+	defaultShutdownDrain = 10 * time.Second
+)
+
+// requestServer serves the request handler over plain HTTP(S), for running outside of Lambda.
+type requestServer struct {
+	shuttingDown int32
+	// clientZones maps verified client certificates to the zones they can use
+	clientZones certificateZones
+	// acme serves ACME protocol under /acme/ when it's enabled
+	acme http.Handler
+	// est serves EST enrollment under /.well-known/est/ when it's enabled
+	est http.Handler
+	// scep serves SCEP at /scep when it's enabled
+	scep http.Handler
+	// vault serves Vault PKI compatible API under /v1/ when it's enabled
+	vault http.Handler
+}
+
+func (s *requestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case healthPath:
+		w.WriteHeader(http.StatusOK)
+		return
+	case readyPath:
+		if atomic.LoadInt32(&s.shuttingDown) == 1 {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if s.acme != nil && strings.HasPrefix(r.URL.Path, acmePrefix+"/") {
+		s.acme.ServeHTTP(w, r)
+		return
+	}
+	if s.est != nil && strings.HasPrefix(r.URL.Path, estPrefix+"/") {
+		s.est.ServeHTTP(w, r)
+		return
+	}
+	if s.scep != nil && (r.URL.Path == scepPath || strings.HasPrefix(r.URL.Path, scepPath+"/")) {
+		s.scep.ServeHTTP(w, r)
+		return
+	}
+	if s.vault != nil && strings.HasPrefix(r.URL.Path, vaultPrefix) {
+		s.vault.ServeHTTP(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeProxyResponse(w, mustClientError(http.StatusMethodNotAllowed, fmt.Sprintf("Method %s is not allowed", r.Method)))
+		return
+	}
+	request, err := proxyRequestFromHTTP(r)
+	if err != nil {
+		writeProxyResponse(w, mustClientError(http.StatusBadRequest, err.Error()))
+		return
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		caller, zones, ok := s.clientZones.identify(r)
+		if !ok {
+			writeProxyResponse(w, mustClientError(http.StatusForbidden, "Client certificate is not mapped to any zone"))
+			return
+		}
+		request.RequestContext.Identity.Caller = caller
+		if len(zones) > 0 {
+			request.RequestContext.Authorizer = map[string]interface{}{authorizerZones: strings.Join(zones, ",")}
+		}
+	}
+	resp, err := ACMPCAHandler(request)
+	if err != nil {
+		log.Println("Handler error:", err)
+		resp = mustClientError(http.StatusInternalServerError, err.Error())
+	}
+	writeProxyResponse(w, resp)
+}
+
+// proxyRequestFromHTTP translates HTTP request into API Gateway proxy event the handler expects.
+func proxyRequestFromHTTP(r *http.Request) (events.APIGatewayProxyRequest, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRequestBodySize+1))
+	if err != nil {
+		return events.APIGatewayProxyRequest{}, fmt.Errorf("can't read request body: %s", err)
+	}
+	if len(body) > maxRequestBodySize {
+		return events.APIGatewayProxyRequest{}, fmt.Errorf("request body is larger than %d bytes", maxRequestBodySize)
+	}
+	request := events.APIGatewayProxyRequest{
+		Path:                            r.URL.Path,
+		HTTPMethod:                      r.Method,
+		Headers:                         make(map[string]string, len(r.Header)),
+		MultiValueHeaders:               r.Header,
+		QueryStringParameters:           make(map[string]string),
+		MultiValueQueryStringParameters: r.URL.Query(),
+		Body:                            string(body),
+	}
+	for k, v := range r.Header {
+		request.Headers[k] = v[0]
+	}
+	// net/http moves Host out of the header map, but it's a part of the signed request
+	request.Headers["Host"] = r.Host
+	for k, v := range r.URL.Query() {
+		request.QueryStringParameters[k] = v[0]
+	}
+	identity := &request.RequestContext.Identity
+	identity.SourceIP, _, _ = net.SplitHostPort(r.RemoteAddr)
+	identity.UserAgent = r.UserAgent()
+	// the principal comes only from client certificates mapped in ServeHTTP and from verified SigV4 signatures
+	// in authenticate, the Authorization header alone is not a proof of identity
+	request.RequestContext.HTTPMethod = r.Method
+	request.RequestContext.ResourcePath = r.URL.Path
+	return request, nil
+}
+
+func writeProxyResponse(w http.ResponseWriter, resp events.APIGatewayProxyResponse) {
+	for k, v := range resp.Headers {
+		w.Header().Set(k, v)
+	}
+	for k, values := range resp.MultiValueHeaders {
+		for _, v := range values {
+			w.Header().Add(k, v)
+		}
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = w.Write([]byte(resp.Body))
+}
+
+func mustClientError(status int, body string) events.APIGatewayProxyResponse {
+	resp, _ := clientError(status, body)
+	return resp
+}
+
+// anyZone in certificateZones allows the certificate to use every zone.
+const anyZone = "*"
+
+// certificateZones maps verified TLS client certificates to the zones they can use. Keys are subjects
+// (e.g. "CN=router1,O=Example") or SANs with their type, "dns:", "email:", "ip:" or "uri:".
+type certificateZones map[string][]string
+
+// certificateZonesFromEnv reads TLS_CLIENT_ZONES JSON object.
+func certificateZonesFromEnv() (certificateZones, error) {
+	var m certificateZones
+	if s := os.Getenv("TLS_CLIENT_ZONES"); s != "" {
+		if err := json.Unmarshal([]byte(s), &m); err != nil {
+			return nil, fmt.Errorf("can't parse TLS_CLIENT_ZONES: %s", err)
+		}
+	}
+	return m, nil
+}
+
+// identify returns the subject and the zones of the verified client certificate of the request. Zones of the
+// subject and all SANs are joined, nil zones allow every zone. Certificates without a mapping are not accepted,
+// TLS_CLIENT_CA_FILE may also issue certificates that shouldn't enroll in any zone.
+func (m certificateZones) identify(r *http.Request) (caller string, zones []string, ok bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", nil, false
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	keys := []string{cert.Subject.String()}
+	for _, v := range cert.DNSNames {
+		keys = append(keys, "dns:"+v)
+	}
+	for _, v := range cert.EmailAddresses {
+		keys = append(keys, "email:"+v)
+	}
+	for _, v := range cert.IPAddresses {
+		keys = append(keys, "ip:"+v.String())
+	}
+	for _, v := range cert.URIs {
+		keys = append(keys, "uri:"+v.String())
+	}
+	any := false
+	for _, k := range keys {
+		for _, z := range m[k] {
+			ok = true
+			if z == anyZone {
+				any = true
+			} else if !containsString(zones, z) {
+				zones = append(zones, z)
+			}
+		}
+	}
+	if !ok {
+		log.Printf("Client certificate %s has no TLS_CLIENT_ZONES mapping", cert.Subject)
+		return "", nil, false
+	} else if any {
+		zones = nil
+	}
+	return cert.Subject.String(), zones, true
+}
+
+// serverTLSConfig loads server certificate and, when TLS_CLIENT_CA_FILE is set, requires client certificates
+// issued by that CA.
+func serverTLSConfig() (*tls.Config, error) {
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if certFile == "" || keyFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if caFile := os.Getenv("TLS_CLIENT_CA_FILE"); caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("failed to parse client CA bundle %s", caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// runServer serves the handler on addr until SIGINT or SIGTERM, then drains in-flight requests. It doesn't start
+// without client certificates or SigV4 verification unless ALLOW_UNAUTHENTICATED is "true", since every caller
+// could then request certificates in every zone.
+func runServer(addr string) error {
+	tlsConfig, err := serverTLSConfig()
+	if err != nil {
+		return err
+	}
+	clientCertificates := tlsConfig != nil && tlsConfig.ClientCAs != nil
+	if !clientCertificates && os.Getenv("SIGV4_CREDENTIALS_FILE") == "" && os.Getenv("ALLOW_UNAUTHENTICATED") != "true" {
+		return fmt.Errorf("no authentication is configured, set TLS_CLIENT_CA_FILE or SIGV4_CREDENTIALS_FILE, " +
+			"or ALLOW_UNAUTHENTICATED=true to accept anonymous requests")
+	}
+	clientZones, err := certificateZonesFromEnv()
+	if err != nil {
+		return err
+	}
+	handler := &requestServer{clientZones: clientZones}
+	acme, err := newACMEServerFromEnv()
+	if err != nil {
+		return err
+	}
+	if acme != nil {
+		initHandler()
+		handler.acme = acme
+		log.Printf("ACME directory is served at %s%s", acmePrefix, acmeDirectoryPath)
+	}
+	est, err := newESTServerFromEnv()
+	if err != nil {
+		return err
+	}
+	if est != nil {
+		initHandler()
+		handler.est = est
+		log.Printf("EST enrollment is served at %s", estPrefix)
+	}
+	scep, err := newSCEPServerFromEnv()
+	if err != nil {
+		return err
+	}
+	if scep != nil {
+		initHandler()
+		handler.scep = scep
+		log.Printf("SCEP is served at %s", scepPath)
+	}
+	vault, err := newVaultServerFromEnv()
+	if err != nil {
+		return err
+	}
+	if vault != nil {
+		initHandler()
+		handler.vault = vault
+		log.Printf("Vault PKI API is served at %s%s", vaultPrefix, vault.mount)
+	}
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      60 * time.Second,
+		IdleTimeout:       120 * time.Second,
+	}
+
+	drain := shutdownDrainFromEnv()
+	done := make(chan error, 1)
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-stop
+		log.Printf("Received %s, shutting down in %s", sig, drain)
+		done <- handler.shutdown(server, drain)
+	}()
+
+	log.Printf("Starting request server on %s", addr)
+	if tlsConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	return <-done
+}
+
+// shutdownDrainFromEnv reads SHUTDOWN_DRAIN_SECONDS, zero closes the listener right away.
+func shutdownDrainFromEnv() time.Duration {
+	s := os.Getenv("SHUTDOWN_DRAIN_SECONDS")
+	if s == "" {
+		return defaultShutdownDrain
+	}
+	seconds, err := strconv.Atoi(s)
+	if err != nil || seconds < 0 {
+		log.Printf("Ignoring bad SHUTDOWN_DRAIN_SECONDS value %q", s)
+		return defaultShutdownDrain
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// shutdown fails /readyz while still serving for drain, then stops accepting connections and waits for in-flight
+// requests.
+func (s *requestServer) shutdown(server *http.Server, drain time.Duration) error {
+	atomic.StoreInt32(&s.shuttingDown, 1)
+	time.Sleep(drain)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return server.Shutdown(ctx)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRequestServerHealth(t *testing.T) {
+	s := &requestServer{}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	for _, path := range []string{healthPath, readyPath} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d", path, resp.StatusCode)
+		}
+	}
+
+	atomic.StoreInt32(&s.shuttingDown, 1)
+	resp, err := http.Get(srv.URL + readyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("ready check should fail on shutdown, got %d", resp.StatusCode)
+	}
+}
+
+func TestRequestServerRouting(t *testing.T) {
+	store := common.NewMemoryAuditStore()
+	_ = store.Save(common.AuditRecord{ID: "1", Zone: "zone1", Decision: common.AuditDecisionApproved})
+	auditStore = store
+	defer func() { auditStore = nil }()
+
+	srv := httptest.NewServer(&requestServer{})
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("GET should not be allowed, got %d", resp.StatusCode)
+	}
+
+	post := func(target, body string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/", strings.NewReader(body))
+		req.Header.Set("X-Amz-Target", target)
+		req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp = post(venafiQueryAuditLog, `{"Zone": "zone1"}`)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var out VenafiQueryAuditLogResponse
+	err = json.NewDecoder(resp.Body).Decode(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Records) != 1 || out.Records[0].ID != "1" {
+		t.Fatalf("unexpected records: %+v", out.Records)
+	}
+
+	resp = post("CertificateManager.Unknown", `{}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("unknown target should not be allowed, got %d", resp.StatusCode)
+	}
+}
+
+func TestProxyRequestIdentity(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("{}"))
+	r.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20200101/us-east-1/acm-pca/aws4_request, SignedHeaders=host, Signature=abc")
+	request, err := proxyRequestFromHTTP(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal := callerPrincipal(request); principal != "anonymous" {
+		t.Fatalf("unverified Authorization header should not set the principal, got %s", principal)
+	}
+}
+
+func TestCertificateZones(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "router1"}, DNSNames: []string{"router1.example.com"}}
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	m := certificateZones{"CN=router1": {"routers", "network"}, "dns:router1.example.com": {"routers", "edge"}}
+	if _, _, ok := m.identify(r); ok {
+		t.Fatal("unverified client certificate should not be accepted")
+	}
+
+	r.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+	caller, zones, ok := m.identify(r)
+	if !ok || caller != "CN=router1" || !reflect.DeepEqual(zones, []string{"routers", "network", "edge"}) {
+		t.Fatalf("zones of subject and SANs should be joined, got %s %v %v", caller, zones, ok)
+	}
+	if _, zones, ok = (certificateZones{"dns:router1.example.com": {anyZone}}).identify(r); !ok || zones != nil {
+		t.Fatalf("%s should allow every zone, got %v", anyZone, zones)
+	}
+	if _, _, ok = (certificateZones{"dns:router2.example.com": {"routers"}}).identify(r); ok {
+		t.Fatal("client certificate without mapping should not be accepted")
+	}
+}
+
+func TestRequestServerClientCertificate(t *testing.T) {
+	store := common.NewMemoryAuditStore()
+	auditStore = store
+	defer func() { auditStore = nil }()
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "router1"}}
+	s := &requestServer{clientZones: certificateZones{"CN=router1": {"zone1"}}}
+
+	post := func(zone string, cert *x509.Certificate) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"Zone": "`+zone+`"}`))
+		r.Header.Set("X-Amz-Target", venafiQueryAuditLog)
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	if w := post("zone1", cert); w.Code != http.StatusOK {
+		t.Fatalf("mapped certificate should use its zone, got %d %s", w.Code, w.Body)
+	}
+	if w := post("zone2", cert); w.Code != http.StatusForbidden {
+		t.Fatalf("mapped certificate should not use other zones, got %d %s", w.Code, w.Body)
+	}
+	if w := post("zone1", &x509.Certificate{Subject: pkix.Name{CommonName: "router2"}}); w.Code != http.StatusForbidden {
+		t.Fatalf("certificate without mapping should be refused, got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestRunServerRequiresAuthentication(t *testing.T) {
+	if err := runServer("127.0.0.1:0"); err == nil || !strings.Contains(err.Error(), "ALLOW_UNAUTHENTICATED") {
+		t.Fatalf("server without authentication should not start, got %v", err)
+	}
+}
+
+func TestRequestServerShutdownDrain(t *testing.T) {
+	handler := &requestServer{}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: handler}
+	go func() { _ = server.Serve(l) }()
+	ready := func() (int, error) {
+		resp, err := http.Get("http://" + l.Addr().String() + readyPath)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- handler.shutdown(server, 300*time.Millisecond) }()
+	time.Sleep(100 * time.Millisecond)
+	if status, err := ready(); err != nil || status != http.StatusServiceUnavailable {
+		t.Fatalf("ready check should fail while draining, got %d %v", status, err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ready(); err == nil {
+		t.Fatal("server should stop accepting connections after draining")
+	}
+}
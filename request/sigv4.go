@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat = "20060102T150405Z"
+	sigV4MaxSkew    = 15 * time.Minute
+
+	// authorizerPrincipal and authorizerZones are set in request context authorizer after successful
+	// signature verification, the same way API Gateway custom authorizers pass their context.
+	authorizerPrincipal = "principalId"
+	authorizerZones     = "venafiZones"
+)
+
+// sigV4Verifier is set when the handler has to verify SigV4 signatures itself, i.e. it's not behind
+// API Gateway with AWS_IAM authorization.
+var sigV4Verifier credentialResolver
+
+// sigV4Credential is an access key accepted by the handler. Zones lists Venafi zones the principal can request
+// certificates from, any zone is allowed when it's empty.
+type sigV4Credential struct {
+	AccessKeyID     string   `json:"AccessKeyId"`
+	SecretAccessKey string   `json:"SecretAccessKey"`
+	Principal       string   `json:"Principal"`
+	Zones           []string `json:"Zones"`
+}
+
+type credentialResolver interface {
+	ResolveCredential(accessKeyID string) (sigV4Credential, error)
+}
+
+// staticCredentials resolves access keys from a fixed list, e.g. loaded from SIGV4_CREDENTIALS_FILE.
+type staticCredentials map[string]sigV4Credential
+
+func (c staticCredentials) ResolveCredential(accessKeyID string) (sigV4Credential, error) {
+	cred, ok := c[accessKeyID]
+	if !ok {
+		return cred, fmt.Errorf("unknown access key %s", accessKeyID)
+	}
+	return cred, nil
+}
+
+func loadCredentialsFile(path string) (staticCredentials, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []sigV4Credential
+	err = json.Unmarshal(b, &list)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse credentials file %s: %s", path, err)
+	}
+	creds := make(staticCredentials, len(list))
+	for _, c := range list {
+		if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+			return nil, fmt.Errorf("credentials file %s has entry without AccessKeyId or SecretAccessKey", path)
+		}
+		if c.Principal == "" {
+			c.Principal = c.AccessKeyID
+		}
+		creds[c.AccessKeyID] = c
+	}
+	return creds, nil
+}
+
+func initSigV4Verification() {
+	path := os.Getenv("SIGV4_CREDENTIALS_FILE")
+	if path == "" || sigV4Verifier != nil {
+		return
+	}
+	creds, err := loadCredentialsFile(path)
+	if err != nil {
+		// fail closed: without credentials no request can be verified
+		log.Println("Can't load SigV4 credentials:", err)
+		creds = staticCredentials{}
+	}
+	sigV4Verifier = creds
+}
+
+// sigV4Authorization is a parsed SigV4 Authorization header.
+type sigV4Authorization struct {
+	AccessKeyID   string
+	Date          string
+	Region        string
+	Service       string
+	SignedHeaders []string
+	Signature     string
+}
+
+func parseSigV4Authorization(header string) (a sigV4Authorization, err error) {
+	if !strings.HasPrefix(header, sigV4Algorithm+" ") {
+		return a, fmt.Errorf("authorization header is not %s", sigV4Algorithm)
+	}
+	for _, part := range strings.Split(strings.TrimPrefix(header, sigV4Algorithm+" "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return a, fmt.Errorf("malformed authorization header component %q", part)
+		}
+		switch kv[0] {
+		case "Credential":
+			scope := strings.Split(kv[1], "/")
+			if len(scope) != 5 || scope[4] != "aws4_request" {
+				return a, fmt.Errorf("malformed credential scope %q", kv[1])
+			}
+			a.AccessKeyID, a.Date, a.Region, a.Service = scope[0], scope[1], scope[2], scope[3]
+		case "SignedHeaders":
+			a.SignedHeaders = strings.Split(kv[1], ";")
+		case "Signature":
+			a.Signature = kv[1]
+		}
+	}
+	if a.AccessKeyID == "" || len(a.SignedHeaders) == 0 || a.Signature == "" {
+		return a, fmt.Errorf("authorization header misses Credential, SignedHeaders or Signature")
+	}
+	return a, nil
+}
+
+// verifySigV4 checks request signature by signing the same canonical request with the secret key
+// of the access key from Authorization header and returns the matched credential.
+func verifySigV4(request events.APIGatewayProxyRequest, resolver credentialResolver, now time.Time) (sigV4Credential, error) {
+	auth, err := parseSigV4Authorization(headerValue(request, "Authorization"))
+	if err != nil {
+		return sigV4Credential{}, err
+	}
+	signTime, err := time.Parse(sigV4TimeFormat, headerValue(request, "X-Amz-Date"))
+	if err != nil {
+		return sigV4Credential{}, fmt.Errorf("missing or malformed X-Amz-Date header")
+	}
+	if signTime.Format("20060102") != auth.Date {
+		return sigV4Credential{}, fmt.Errorf("credential scope date doesn't match X-Amz-Date")
+	}
+	if skew := now.Sub(signTime); skew > sigV4MaxSkew || skew < -sigV4MaxSkew {
+		return sigV4Credential{}, fmt.Errorf("signature is expired or signed in the future")
+	}
+	// the target selects the operation, a signature without it could be replayed against another target
+	if !containsString(auth.SignedHeaders, "x-amz-target") {
+		return sigV4Credential{}, fmt.Errorf("x-amz-target header should be signed")
+	}
+	cred, err := resolver.ResolveCredential(auth.AccessKeyID)
+	if err != nil {
+		return sigV4Credential{}, err
+	}
+
+	body := []byte(request.Body)
+	if hash := headerValue(request, "X-Amz-Content-Sha256"); hash != "" {
+		sum := sha256.Sum256(body)
+		if hash != hex.EncodeToString(sum[:]) {
+			return sigV4Credential{}, fmt.Errorf("X-Amz-Content-Sha256 doesn't match request body")
+		}
+	}
+
+	path := request.Path
+	if path == "" {
+		path = "/"
+	}
+	method := request.HTTPMethod
+	if method == "" {
+		method = http.MethodPost
+	}
+	u := &url.URL{Scheme: "https", Host: headerValue(request, "Host"), Path: path, RawQuery: queryValues(request).Encode()}
+	r, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return sigV4Credential{}, err
+	}
+	for _, h := range auth.SignedHeaders {
+		if h == "host" || h == "x-amz-date" {
+			continue
+		}
+		values := headerValues(request, h)
+		if len(values) == 0 {
+			return sigV4Credential{}, fmt.Errorf("signed header %s is missing", h)
+		}
+		r.Header[http.CanonicalHeaderKey(h)] = values
+	}
+
+	signer := v4.NewSigner(aws.NewStaticCredentialsProvider(cred.AccessKeyID, cred.SecretAccessKey, ""))
+	_, err = signer.Sign(r, bytes.NewReader(body), auth.Service, auth.Region, signTime)
+	if err != nil {
+		return sigV4Credential{}, err
+	}
+	expected, err := parseSigV4Authorization(r.Header.Get("Authorization"))
+	if err != nil {
+		return sigV4Credential{}, err
+	}
+	if strings.Join(expected.SignedHeaders, ";") != strings.Join(auth.SignedHeaders, ";") ||
+		subtle.ConstantTimeCompare([]byte(expected.Signature), []byte(auth.Signature)) != 1 {
+		return sigV4Credential{}, fmt.Errorf("signature does not match")
+	}
+	return cred, nil
+}
+
+// authenticate verifies request signature when SigV4 verification is configured and puts verified principal
+// and its allowed zones into the request context.
+func authenticate(request events.APIGatewayProxyRequest) (events.APIGatewayProxyRequest, error) {
+	if sigV4Verifier == nil {
+		return request, nil
+	}
+	cred, err := verifySigV4(request, sigV4Verifier, time.Now())
+	if err != nil {
+		return request, err
+	}
+	request.RequestContext.Identity.AccessKey = cred.AccessKeyID
+	request.RequestContext.Identity.UserArn = cred.Principal
+	request.RequestContext.Authorizer = map[string]interface{}{
+		authorizerPrincipal: cred.Principal,
+		authorizerZones:     strings.Join(cred.Zones, ","),
+	}
+	return request, nil
+}
+
+// allowedZones returns zones the authenticated principal may use, nil when there are no zone restrictions
+// in authorizer context (e.g. requests authorized by API Gateway IAM).
+func allowedZones(request events.APIGatewayProxyRequest) []string {
+	zones, _ := request.RequestContext.Authorizer[authorizerZones].(string)
+	if zones == "" {
+		return nil
+	}
+	return strings.Split(zones, ",")
+}
+
+// authorizeZone checks that the authenticated principal may use the zone.
+func authorizeZone(request events.APIGatewayProxyRequest, zone string) error {
+	zones := allowedZones(request)
+	if zones == nil || containsString(zones, zone) {
+		return nil
+	}
+	return fmt.Errorf("principal %s is not allowed to request certificates from zone %s",
+		callerPrincipal(request), zone)
+}
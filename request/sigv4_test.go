@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testAccessKey = "AKIDEXAMPLE"
+	testSecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+	testPrincipal = "arn:aws:iam::123456789012:user/alice"
+)
+
+var testCredentials = staticCredentials{
+	testAccessKey: {AccessKeyID: testAccessKey, SecretAccessKey: testSecretKey, Principal: testPrincipal, Zones: []string{"zone1"}},
+}
+
+func signedRequest(t *testing.T, url, target, body, secret string, signTime time.Time) *http.Request {
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "" {
+		req.Header.Set("X-Amz-Target", target)
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	signer := v4.NewSigner(aws.NewStaticCredentialsProvider(testAccessKey, secret, ""))
+	_, err = signer.Sign(req, bytes.NewReader([]byte(body)), "acm-pca", "us-east-1", signTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestSigV4Verification(t *testing.T) {
+	sigV4Verifier = testCredentials
+	store := common.NewMemoryAuditStore()
+	auditStore = store
+	defer func() {
+		sigV4Verifier = nil
+		auditStore = nil
+	}()
+
+	srv := httptest.NewServer(&requestServer{})
+	defer srv.Close()
+
+	const body = `{"Zone": "zone1"}`
+	cases := []struct {
+		name   string
+		req    *http.Request
+		status int
+	}{
+		{"valid", signedRequest(t, srv.URL+"/", venafiQueryAuditLog, body, testSecretKey, time.Now()), http.StatusOK},
+		{"wrong secret", signedRequest(t, srv.URL+"/", venafiQueryAuditLog, body, "wrong", time.Now()), http.StatusForbidden},
+		{"expired", signedRequest(t, srv.URL+"/", venafiQueryAuditLog, body, testSecretKey, time.Now().Add(-time.Hour)), http.StatusForbidden},
+		{"unsigned", func() *http.Request {
+			req, _ := http.NewRequest(http.MethodPost, srv.URL+"/", strings.NewReader(body))
+			req.Header.Set("X-Amz-Target", venafiQueryAuditLog)
+			return req
+		}(), http.StatusForbidden},
+		{"tampered body", func() *http.Request {
+			req := signedRequest(t, srv.URL+"/", venafiQueryAuditLog, body, testSecretKey, time.Now())
+			tampered := `{"Zone": "zone2"}`
+			req.Body, req.ContentLength = ioutil.NopCloser(strings.NewReader(tampered)), int64(len(tampered))
+			return req
+		}(), http.StatusForbidden},
+		{"other zone", signedRequest(t, srv.URL+"/", venafiQueryAuditLog, `{"Zone": "zone2"}`, testSecretKey, time.Now()), http.StatusForbidden},
+		{"unsigned target", func() *http.Request {
+			req := signedRequest(t, srv.URL+"/", "", body, testSecretKey, time.Now())
+			req.Header.Set("X-Amz-Target", venafiQueryAuditLog)
+			return req
+		}(), http.StatusForbidden},
+		{"tampered target", func() *http.Request {
+			req := signedRequest(t, srv.URL+"/", venafiQueryAuditLog, body, testSecretKey, time.Now())
+			req.Header.Set("X-Amz-Target", venafiListPolicies)
+			return req
+		}(), http.StatusForbidden},
+	}
+	for _, c := range cases {
+		resp, err := http.DefaultClient.Do(c.req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("%s: expected %d, got %d", c.name, c.status, resp.StatusCode)
+		}
+	}
+}
+
+func TestAuthenticateSetsPrincipal(t *testing.T) {
+	sigV4Verifier = testCredentials
+	defer func() { sigV4Verifier = nil }()
+
+	req := signedRequest(t, "https://pca.example.com/", acmpcaIssueCertificate, `{}`, testSecretKey, time.Now())
+	event, err := proxyRequestFromHTTP(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err = authenticate(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if callerPrincipal(event) != testPrincipal {
+		t.Fatalf("expected principal %s, got %s", testPrincipal, callerPrincipal(event))
+	}
+	if err := authorizeZone(event, "zone1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := authorizeZone(event, "zone2"); err == nil {
+		t.Fatal("zone2 should not be allowed")
+	}
+	if err := authorizeZone(events.APIGatewayProxyRequest{}, "zone2"); err != nil {
+		t.Fatalf("requests without authorizer context should be allowed: %s", err)
+	}
+}
+
+func TestZoneRestrictedReads(t *testing.T) {
+	store := common.NewMemoryAuditStore()
+	_ = store.Save(common.AuditRecord{ID: "1", Zone: "zone1", Decision: common.AuditDecisionApproved})
+	_ = store.Save(common.AuditRecord{ID: "2", Zone: "zone2", Decision: common.AuditDecisionApproved})
+	_ = store.Save(common.AuditRecord{ID: "3", Zone: "zone3", Decision: common.AuditDecisionApproved})
+	auditStore = store
+	defer func() { auditStore = nil }()
+
+	restricted := func(body string) events.APIGatewayProxyRequest {
+		var request events.APIGatewayProxyRequest
+		request.Body = body
+		request.RequestContext.Identity.UserArn = testPrincipal
+		request.RequestContext.Authorizer = map[string]interface{}{authorizerPrincipal: testPrincipal, authorizerZones: "zone1,zone2"}
+		return request
+	}
+	resp, err := queryAuditLog(restricted(`{}`))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected response %d %s: %v", resp.StatusCode, resp.Body, err)
+	}
+	var out VenafiQueryAuditLogResponse
+	_ = json.Unmarshal([]byte(resp.Body), &out)
+	if len(out.Records) != 2 {
+		t.Fatalf("only records of allowed zones should be returned, got %+v", out.Records)
+	}
+	for name, resp := range map[string]events.APIGatewayProxyResponse{
+		"audit log": mustResponse(queryAuditLog(restricted(`{"Zone": "zone3"}`))),
+		"policy":    mustResponse(venafiDescribePolicy(restricted(`{"VenafiZone": "zone3"}`))),
+		"validate":  mustResponse(venafiValidateRequest(restricted(`{"DomainName": "www.example.com", "VenafiZone": "zone3"}`))),
+	} {
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s of other zone should be forbidden, got %d %s", name, resp.StatusCode, resp.Body)
+		}
+	}
+}
+
+func mustResponse(resp events.APIGatewayProxyResponse, _ error) events.APIGatewayProxyResponse {
+	return resp
+}
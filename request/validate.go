@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/Venafi/vcert/v4/pkg/endpoint"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/acm"
+	"log"
+	"net/http"
+)
+
+const venafiValidateCertificateRequest = "VenafiValidateCertificateRequest"
+
+// VenafiValidateCertificateRequestInput accepts either IssueCertificate body with Csr
+// or RequestCertificate body with DomainName.
+type VenafiValidateCertificateRequestInput struct {
+	Csr                     []byte    `json:"Csr"`
+	DomainName              *string   `json:"DomainName"`
+	SubjectAlternativeNames []string  `json:"SubjectAlternativeNames"`
+	CertificateAuthorityArn *string   `json:"CertificateAuthorityArn"`
+	TemplateArn             *string   `json:"TemplateArn"`
+	Tags                    []acm.Tag `json:"Tags"`
+	VenafiZone              string    `json:"VenafiZone"`
+}
+
+type VenafiValidateCertificateRequestResponse struct {
+	Valid    bool   `json:"Valid"`
+	Zone     string `json:"Zone"`
+	ZoneRule string `json:"ZoneRule"`
+	// Subject is the subject certificate will be issued with when subject normalization is enabled
+	Subject    string          `json:"Subject,omitempty"`
+	Violations []string        `json:"Violations"`
+	Policy     endpoint.Policy `json:"Policy"`
+}
+
+// venafiValidateRequest runs the same validation as IssueCertificate and RequestCertificate targets
+// but never calls ACM or ACM PCA.
+func venafiValidateRequest(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	log.Println("Validating certificate request")
+	var input VenafiValidateCertificateRequestInput
+	err := json.Unmarshal([]byte(request.Body), &input)
+	if err != nil {
+		return clientError(http.StatusUnprocessableEntity, fmt.Sprintf(errUnmarshalJson, venafiValidateCertificateRequest, err))
+	}
+	if len(input.Csr) == 0 && input.DomainName == nil {
+		return clientError(http.StatusUnprocessableEntity, "Either Csr or DomainName should be provided")
+	}
+
+	zr := zoneRequest{
+		Zone:                    input.VenafiZone,
+		CertificateAuthorityArn: aws.StringValue(input.CertificateAuthorityArn),
+		TemplateArn:             aws.StringValue(input.TemplateArn),
+		Tags:                    tagsMap(input.Tags),
+		Domains:                 append([]string{aws.StringValue(input.DomainName)}, input.SubjectAlternativeNames...),
+	}
+	if len(input.Csr) > 0 {
+		zr.Domains = csrDomains(input.Csr)
+	}
+	zone, err := resolveZone(context.TODO(), request, zr)
+	if err != nil {
+		return clientError(http.StatusBadRequest, err.Error())
+	}
+	input.VenafiZone = zone.Zone
+	if err = authorizeZone(request, input.VenafiZone); err != nil {
+		return clientError(http.StatusForbidden, err.Error())
+	}
+	policy, err := cachedPolicy(input.VenafiZone)
+	if err == common.PolicyNotFound {
+		return handlePolicyNotFound(input.VenafiZone)
+	} else if err != nil {
+		return clientError(http.StatusFailedDependency, fmt.Sprintf("Failed to get policy from database: %s", err))
+	}
+
+	var violations common.PolicyViolations
+	var subject string
+	if len(input.Csr) > 0 {
+		var normalized pkix.Name
+		normalized, violations, err = common.ValidateCSR(policy, input.Csr, normalizeSubject)
+		if err != nil {
+			return clientError(http.StatusUnprocessableEntity, "Can't parse certificate request")
+		}
+		if normalizeSubject {
+			subject = normalized.String()
+		}
+		if len(violations) == 0 {
+			violations, err = checkKeyReuse(policy, input.VenafiZone, input.Csr)
+			if err != nil {
+				return clientError(http.StatusFailedDependency, fmt.Sprintf("Failed to check key reuse: %s", err))
+			}
+		}
+	} else {
+		violations = common.CheckDomainNames(policy, aws.StringValue(input.DomainName), input.SubjectAlternativeNames)
+	}
+
+	resp := VenafiValidateCertificateRequestResponse{
+		Valid:      len(violations) == 0,
+		Zone:       input.VenafiZone,
+		ZoneRule:   zone.Rule,
+		Subject:    subject,
+		Violations: violations,
+		Policy:     policy,
+	}
+	if resp.Violations == nil {
+		resp.Violations = []string{}
+	}
+	return jsonResponse(venafiValidateCertificateRequest, resp)
+}
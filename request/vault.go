@@ -0,0 +1,617 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	vaultPrefix = "/v1/"
+
+	vaultDefaultTTL     = 30 * 24 * time.Hour
+	vaultPermissionDeny = "permission denied"
+	// vaultPendingKeyTTL is how long generated keys of certificates that weren't issued in time are kept
+	vaultPendingKeyTTL = time.Hour
+)
+
+var (
+	// vaultIssueWait is how long sign waits for the certificate. issue waits longer, vaultKeyIssueWait, since
+	// the generated key can only be delivered with the certificate.
+	vaultIssueWait    = 20 * time.Second
+	vaultKeyIssueWait = 45 * time.Second
+)
+
+// vaultRole maps Vault PKI role to Venafi zone. KeyType, KeyBits, TTL and MaxTTL have the meaning of the Vault
+// role parameters with the same names.
+type vaultRole struct {
+	Zone    string `json:"Zone"`
+	KeyType string `json:"KeyType"`
+	KeyBits int    `json:"KeyBits"`
+	TTL     string `json:"TTL"`
+	MaxTTL  string `json:"MaxTTL"`
+
+	ttl, maxTTL time.Duration
+}
+
+// vaultToken is a token accepted in X-Vault-Token header. Zones limits zones the token can request certificates
+// from, any zone is allowed when it's empty.
+type vaultToken struct {
+	Token string   `json:"Token"`
+	Name  string   `json:"Name"`
+	Zones []string `json:"Zones"`
+}
+
+// vaultServer implements a subset of Vault PKI secrets engine API: sign/:role, issue/:role, ca/pem and ca_chain.
+// Roles are mapped to zones, and requests go through the same zone policy check, audit and limits as
+// IssueCertificate requests.
+type vaultServer struct {
+	caArn  string
+	mount  string
+	roles  map[string]vaultRole
+	tokens []vaultToken
+	// clientZones are the zones of TLS client certificates
+	clientZones certificateZones
+
+	mu sync.Mutex
+	// pendingKeys are generated keys by request, kept until their certificates are delivered
+	pendingKeys map[string]vaultPendingKey
+}
+
+// vaultPendingKey is a generated key and its CSR. The repeated issue request reuses them, so it gets the
+// certificate issued for the first request instead of a new one.
+type vaultPendingKey struct {
+	key     crypto.Signer
+	csr     []byte
+	expires time.Time
+}
+
+// newVaultServerFromEnv returns Vault PKI server for VAULT_CA_ARN or nil if it's disabled.
+func newVaultServerFromEnv() (*vaultServer, error) {
+	caArn := os.Getenv("VAULT_CA_ARN")
+	if caArn == "" {
+		return nil, nil
+	}
+	s := &vaultServer{caArn: caArn, mount: "pki"}
+	if m := strings.Trim(os.Getenv("VAULT_MOUNT"), "/"); m != "" {
+		s.mount = m
+	}
+	var err error
+	if s.clientZones, err = certificateZonesFromEnv(); err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(os.Getenv("VAULT_ROLES_FILE"))
+	if err != nil {
+		return nil, fmt.Errorf("can't read VAULT_ROLES_FILE: %s", err)
+	}
+	if err = json.Unmarshal(b, &s.roles); err != nil {
+		return nil, fmt.Errorf("can't parse VAULT_ROLES_FILE: %s", err)
+	}
+	for name, role := range s.roles {
+		if role.Zone == "" {
+			return nil, fmt.Errorf("Vault role %s has no Zone", name)
+		}
+		if role.ttl, err = parseVaultTTL(role.TTL); err != nil {
+			return nil, fmt.Errorf("bad TTL of Vault role %s: %s", name, err)
+		}
+		if role.maxTTL, err = parseVaultTTL(role.MaxTTL); err != nil {
+			return nil, fmt.Errorf("bad MaxTTL of Vault role %s: %s", name, err)
+		}
+		s.roles[name] = role
+	}
+	if f := os.Getenv("VAULT_TOKENS_FILE"); f != "" {
+		b, err = ioutil.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("can't read VAULT_TOKENS_FILE: %s", err)
+		}
+		if err = json.Unmarshal(b, &s.tokens); err != nil {
+			return nil, fmt.Errorf("can't parse VAULT_TOKENS_FILE: %s", err)
+		}
+		for _, t := range s.tokens {
+			if t.Token == "" || t.Name == "" {
+				return nil, fmt.Errorf("VAULT_TOKENS_FILE has entry without Token or Name")
+			}
+		}
+	}
+	return s, nil
+}
+
+// parseVaultTTL parses TTL the way Vault does: seconds, or duration with s, m, h or d unit.
+func parseVaultTTL(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if seconds, err := strconv.ParseInt(s, 10, 64); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseInt(strings.TrimSuffix(s, "d"), 10, 64)
+		if err != nil || days < 0 {
+			return 0, fmt.Errorf("bad duration %q", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("bad duration %q", s)
+	}
+	return d, nil
+}
+
+// vaultRequest is the body of sign and issue requests. TTL is string or number of seconds.
+type vaultRequest struct {
+	CSR               string          `json:"csr"`
+	CommonName        string          `json:"common_name"`
+	AltNames          string          `json:"alt_names"`
+	IPSANs            string          `json:"ip_sans"`
+	URISANs           string          `json:"uri_sans"`
+	TTL               json.RawMessage `json:"ttl"`
+	Format            string          `json:"format"`
+	PrivateKeyFormat  string          `json:"private_key_format"`
+	ExcludeCNFromSANs bool            `json:"exclude_cn_from_sans"`
+}
+
+// vaultResponse is Vault API response envelope.
+type vaultResponse struct {
+	RequestID     string                 `json:"request_id"`
+	LeaseID       string                 `json:"lease_id"`
+	Renewable     bool                   `json:"renewable"`
+	LeaseDuration int                    `json:"lease_duration"`
+	Data          map[string]interface{} `json:"data"`
+	WrapInfo      interface{}            `json:"wrap_info"`
+	Warnings      []string               `json:"warnings"`
+	Auth          interface{}            `json:"auth"`
+}
+
+func writeVaultJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeVaultError writes error in Vault format, {"errors": [...]}.
+func writeVaultError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeVaultJSON(w, status, map[string][]string{"errors": {fmt.Sprintf(format, args...)}})
+}
+
+func (s *vaultServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, vaultPrefix+s.mount+"/")
+	if path == r.URL.Path {
+		writeVaultJSON(w, http.StatusNotFound, map[string][]string{"errors": {}})
+		return
+	}
+	parts := strings.Split(path, "/")
+	switch {
+	case (path == "ca/pem" || path == "ca_chain") && r.Method == http.MethodGet:
+		s.caPEM(w, r, path == "ca_chain")
+	case len(parts) == 2 && (parts[0] == "sign" || parts[0] == "issue") &&
+		(r.Method == http.MethodPost || r.Method == http.MethodPut):
+		s.issue(w, r, parts[1], parts[0] == "issue")
+	case len(parts) == 2 && (parts[0] == "sign" || parts[0] == "issue"):
+		writeVaultError(w, http.StatusMethodNotAllowed, "unsupported operation")
+	default:
+		writeVaultJSON(w, http.StatusNotFound, map[string][]string{"errors": {}})
+	}
+}
+
+// caPEM returns the CA certificate, or the CA chain, as PEM like Vault does.
+func (s *vaultServer) caPEM(w http.ResponseWriter, r *http.Request, chain bool) {
+	ca, caChain, err := caCertificate(r.Context(), s.caArn)
+	if err != nil {
+		log.Println("Can't get Vault CA certificate:", err)
+		writeVaultError(w, http.StatusInternalServerError, "can't get CA certificate")
+		return
+	}
+	body := strings.TrimSpace(ca) + "\n"
+	if chain && caChain != "" {
+		body += strings.TrimSpace(caChain) + "\n"
+	}
+	w.Header().Set("Content-Type", "application/pem-certificate-chain")
+	_, _ = io.WriteString(w, body)
+}
+
+// authenticate returns the caller and the zones it can use. Verified TLS client certificates identify the caller
+// only when TLS_CLIENT_ZONES maps them to zones.
+func (s *vaultServer) authenticate(r *http.Request) (caller string, zones []string, ok bool) {
+	token := r.Header.Get("X-Vault-Token")
+	if token == "" && strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if token != "" {
+		got := sha256.Sum256([]byte(token))
+		for _, t := range s.tokens {
+			want := sha256.Sum256([]byte(t.Token))
+			if subtle.ConstantTimeCompare(want[:], got[:]) == 1 {
+				return "vault-token:" + t.Name, t.Zones, true
+			}
+		}
+		return "", nil, false
+	}
+	return s.clientZones.identify(r)
+}
+
+// pendingKey returns the generated key kept for the request.
+func (s *vaultServer) pendingKey(id string) (vaultPendingKey, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.pendingKeys[id]
+	if ok && time.Now().After(p.expires) {
+		delete(s.pendingKeys, id)
+		return p, false
+	}
+	return p, ok
+}
+
+// keepPendingKey keeps the generated key for the repeated request, or drops it when key is nil.
+func (s *vaultServer) keepPendingKey(id string, key crypto.Signer, csr []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for k, p := range s.pendingKeys {
+		if now.After(p.expires) {
+			delete(s.pendingKeys, k)
+		}
+	}
+	if key == nil {
+		delete(s.pendingKeys, id)
+		return
+	}
+	if s.pendingKeys == nil {
+		s.pendingKeys = map[string]vaultPendingKey{}
+	}
+	s.pendingKeys[id] = vaultPendingKey{key: key, csr: csr, expires: now.Add(vaultPendingKeyTTL)}
+}
+
+func splitList(s string) []string {
+	var values []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// requestTTL returns the requested TTL limited by the role.
+func (role vaultRole) requestTTL(raw json.RawMessage) (time.Duration, error) {
+	var ttl time.Duration
+	if len(raw) > 0 && string(raw) != "null" {
+		var v interface{}
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return 0, err
+		}
+		var err error
+		switch v := v.(type) {
+		case float64:
+			ttl = time.Duration(v) * time.Second
+		case string:
+			ttl, err = parseVaultTTL(v)
+		default:
+			err = fmt.Errorf("ttl has to be string or number")
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if ttl == 0 {
+		ttl = role.ttl
+	}
+	if ttl == 0 {
+		ttl = vaultDefaultTTL
+		if role.maxTTL != 0 && role.maxTTL < ttl {
+			ttl = role.maxTTL
+		}
+	}
+	if role.maxTTL != 0 && ttl > role.maxTTL {
+		return 0, fmt.Errorf("ttl %s is larger than max_ttl %s of the role", ttl, role.maxTTL)
+	}
+	return ttl, nil
+}
+
+// requestedNames returns DNS names, IP addresses and URIs of the request. Vault puts the common name into
+// DNS SANs unless exclude_cn_from_sans is set.
+func (req vaultRequest) requestedNames() ([]string, []net.IP, []*url.URL, error) {
+	dnsNames := splitList(req.AltNames)
+	if req.CommonName != "" && !req.ExcludeCNFromSANs && !containsString(dnsNames, req.CommonName) {
+		dnsNames = append([]string{req.CommonName}, dnsNames...)
+	}
+	var ips []net.IP
+	for _, v := range splitList(req.IPSANs) {
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return nil, nil, nil, fmt.Errorf("bad IP address %q", v)
+		}
+		ips = append(ips, ip)
+	}
+	var uris []*url.URL
+	for _, v := range splitList(req.URISANs) {
+		u, err := url.Parse(v)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("bad URI %q", v)
+		}
+		uris = append(uris, u)
+	}
+	return dnsNames, ips, uris, nil
+}
+
+func containsString(values []string, v string) bool {
+	for _, x := range values {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// issue handles sign/:role, where the caller sends CSR, and issue/:role, where the key is generated with the
+// key configuration of the role allowed by the zone policy.
+func (s *vaultServer) issue(w http.ResponseWriter, r *http.Request, roleName string, generateKey bool) {
+	caller, zones, ok := s.authenticate(r)
+	if !ok {
+		writeVaultError(w, http.StatusForbidden, vaultPermissionDeny)
+		return
+	}
+	role, ok := s.roles[roleName]
+	if !ok {
+		writeVaultError(w, http.StatusBadRequest, "unknown role: %s", roleName)
+		return
+	}
+	if len(zones) > 0 && !containsString(zones, role.Zone) {
+		writeVaultError(w, http.StatusForbidden, vaultPermissionDeny)
+		return
+	}
+	var req vaultRequest
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRequestBodySize))
+	if err == nil {
+		err = json.Unmarshal(body, &req)
+	}
+	if err != nil {
+		writeVaultError(w, http.StatusBadRequest, "can't parse request body: %s", err)
+		return
+	}
+	if req.Format == "" {
+		req.Format = "pem"
+	}
+	if req.Format != "pem" && req.Format != "der" && req.Format != "pem_bundle" {
+		writeVaultError(w, http.StatusBadRequest, "unknown format %q", req.Format)
+		return
+	}
+	switch req.PrivateKeyFormat {
+	case "", "der", "pem", "pkcs8":
+	default:
+		writeVaultError(w, http.StatusBadRequest, "unknown private_key_format %q", req.PrivateKeyFormat)
+		return
+	}
+	ttl, err := role.requestTTL(req.TTL)
+	if err != nil {
+		writeVaultError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	dnsNames, ips, uris, err := req.requestedNames()
+	if err != nil {
+		writeVaultError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	policy, err := cachedPolicy(role.Zone)
+	if err == common.PolicyNotFound {
+		writeVaultError(w, http.StatusBadRequest, "policy of zone %s is not found", role.Zone)
+		return
+	} else if err != nil {
+		writeVaultError(w, http.StatusInternalServerError, "can't get policy of zone %s: %s", role.Zone, err)
+		return
+	}
+
+	var key crypto.Signer
+	var csr []byte
+	// the same request of the same caller is a retry of an issue request
+	sum := sha256.Sum256([]byte(caller + "\x00" + roleName + "\x00" + string(body)))
+	pendingID := hex.EncodeToString(sum[:])
+	if p, ok := s.pendingKey(pendingID); ok && generateKey {
+		key, csr = p.key, p.csr
+	} else if generateKey {
+		if req.CommonName == "" {
+			writeVaultError(w, http.StatusBadRequest, "the common_name field is required")
+			return
+		}
+		// fail early with the policy violations instead of generating the key
+		if v := common.CheckDomainNames(policy, req.CommonName, dnsNames); len(v) > 0 {
+			writeVaultError(w, http.StatusBadRequest, "request doesn't match policy of zone %s: %s", role.Zone, v)
+			return
+		}
+		key, err = common.GenerateKey(policy, role.KeyType, role.KeyBits)
+		if err != nil {
+			writeVaultError(w, http.StatusBadRequest, "can't generate key: %s", err)
+			return
+		}
+		csr, err = x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			Subject:     pkix.Name{CommonName: req.CommonName},
+			DNSNames:    dnsNames,
+			IPAddresses: ips,
+			URIs:        uris,
+		}, key)
+		if err != nil {
+			writeVaultError(w, http.StatusInternalServerError, "can't create CSR: %s", err)
+			return
+		}
+	} else {
+		parsed, err := common.ParseCSR([]byte(req.CSR))
+		if err == nil {
+			err = parsed.CheckSignature()
+		}
+		if err != nil {
+			writeVaultError(w, http.StatusBadRequest, "can't parse csr: %s", err)
+			return
+		}
+		// the CSR is signed as it is, requested names have to be a part of it
+		if req.CommonName != "" && req.CommonName != parsed.Subject.CommonName {
+			writeVaultError(w, http.StatusBadRequest, "common_name %s doesn't match CSR common name %s", req.CommonName, parsed.Subject.CommonName)
+			return
+		}
+		for _, name := range splitList(req.AltNames) {
+			if !containsString(parsed.DNSNames, name) {
+				writeVaultError(w, http.StatusBadRequest, "alt_names value %s is not in CSR", name)
+				return
+			}
+		}
+		csr = parsed.Raw
+	}
+
+	sum = sha256.Sum256(csr)
+	// the end of validity is exact, so TTLs that aren't whole days don't exceed max_ttl of the role
+	arn, resp, err := enroll(r.Context(), enrollment{
+		Caller:           caller,
+		Zones:            strings.Join(zones, ","),
+		Zone:             role.Zone,
+		CAArn:            s.caArn,
+		CSR:              csr,
+		NotAfter:         time.Now().Add(ttl),
+		IdempotencyToken: hex.EncodeToString(sum[:16]),
+	})
+	switch {
+	case err != nil:
+		log.Println("Vault issuance error:", err)
+		writeVaultError(w, http.StatusInternalServerError, "%s", err)
+		return
+	case resp.StatusCode == http.StatusTooManyRequests:
+		w.Header().Set("Retry-After", resp.Headers["Retry-After"])
+		writeVaultError(w, http.StatusTooManyRequests, "%s", handlerMessage(resp))
+		return
+	case resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusForbidden ||
+		resp.StatusCode == http.StatusUnprocessableEntity:
+		writeVaultError(w, http.StatusBadRequest, "%s", handlerMessage(resp))
+		return
+	case resp.StatusCode != http.StatusOK:
+		writeVaultError(w, http.StatusInternalServerError, "%s", handlerMessage(resp))
+		return
+	}
+	wait := vaultIssueWait
+	if generateKey {
+		wait = vaultKeyIssueWait
+	}
+	if !certificateIssued(r.Context(), s.caArn, arn, wait) {
+		if generateKey {
+			s.keepPendingKey(pendingID, key, csr)
+		}
+		writeVaultError(w, http.StatusInternalServerError, "certificate %s is not issued yet, repeat the request", arn)
+		return
+	}
+	if generateKey {
+		s.keepPendingKey(pendingID, nil, nil)
+	}
+	certPEM, chainPEM, err := issuedCertificate(r.Context(), s.caArn, arn)
+	var data map[string]interface{}
+	if err == nil {
+		data, err = vaultCertificateData(req, certPEM, chainPEM, key)
+	}
+	if err != nil {
+		log.Println("Can't get Vault certificate:", err)
+		writeVaultError(w, http.StatusInternalServerError, "can't get issued certificate")
+		return
+	}
+	writeVaultJSON(w, http.StatusOK, vaultResponse{RequestID: common.NewAuditRecordID(), Data: data})
+}
+
+// vaultCertificateData returns data of sign and issue responses in the requested format. Key is nil for sign.
+func vaultCertificateData(req vaultRequest, certPEM, chainPEM string, key crypto.Signer) (map[string]interface{}, error) {
+	chain, err := parseCertificates(chainPEM)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := parseCertificatePEM(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	encode := func(c *x509.Certificate) string {
+		if req.Format == "der" {
+			return base64.StdEncoding.EncodeToString(c.Raw)
+		}
+		return strings.TrimSpace(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})))
+	}
+	caChain := make([]string, len(chain))
+	for i, c := range chain {
+		caChain[i] = encode(c)
+	}
+	data := map[string]interface{}{
+		"certificate":   encode(cert),
+		"ca_chain":      caChain,
+		"issuing_ca":    "",
+		"serial_number": formatSerial(cert),
+		"expiration":    cert.NotAfter.Unix(),
+	}
+	if len(chain) > 0 {
+		data["issuing_ca"] = caChain[0]
+	}
+	var keyPEM string
+	if key != nil {
+		keyType, block, err := marshalVaultPrivateKey(key, req.PrivateKeyFormat)
+		if err != nil {
+			return nil, err
+		}
+		data["private_key_type"] = keyType
+		if req.Format == "der" {
+			data["private_key"] = base64.StdEncoding.EncodeToString(block.Bytes)
+		} else {
+			keyPEM = strings.TrimSpace(string(pem.EncodeToMemory(block)))
+			data["private_key"] = keyPEM
+		}
+	}
+	if req.Format == "pem_bundle" {
+		bundle := []string{data["certificate"].(string)}
+		if keyPEM != "" {
+			bundle = append([]string{keyPEM}, bundle...)
+		}
+		if len(chain) > 0 {
+			bundle = append(bundle, caChain[0])
+		}
+		data["certificate"] = strings.Join(bundle, "\n")
+	}
+	return data, nil
+}
+
+// marshalVaultPrivateKey returns Vault key type and PEM block of the key. The "der" private_key_format, which is
+// the default, keeps PKCS#1 and SEC 1 encodings; "pkcs8" converts the key to PKCS#8.
+func marshalVaultPrivateKey(key crypto.Signer, format string) (string, *pem.Block, error) {
+	keyType := common.KeyTypeRSA
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		keyType = common.KeyTypeEC
+	}
+	switch format {
+	case "", "der", "pem":
+	case "pkcs8":
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		return keyType, &pem.Block{Type: "PRIVATE KEY", Bytes: der}, err
+	default:
+		return "", nil, fmt.Errorf("unknown private_key_format %q", format)
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return keyType, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}, nil
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
+		return keyType, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}, err
+	}
+	return "", nil, fmt.Errorf("unsupported key type %T", key)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/aws/aws-sdk-go-v2/service/acmpca"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVaultPKI(t *testing.T) {
+	f := newFakeACMPCA(t)
+	defer f.server.Close()
+	_, zones, cleanup := proxyTestSetup(t, f)
+	defer cleanup()
+
+	vault := &vaultServer{
+		caArn: testCAArn,
+		mount: "pki",
+		roles: map[string]vaultRole{
+			"web": {Zone: "web-zone", maxTTL: 72 * time.Hour},
+			"ec":  {Zone: "ec-zone", KeyType: "ec"},
+		},
+		tokens: []vaultToken{
+			{Token: "s.web", Name: "web-deployer", Zones: []string{"web-zone"}},
+			{Token: "s.admin", Name: "admin"},
+		},
+	}
+	srv := httptest.NewServer(&requestServer{vault: vault})
+	defer srv.Close()
+
+	send := func(method, path, token string, body interface{}) (int, vaultResponse, []string) {
+		b, _ := json.Marshal(body)
+		req, _ := http.NewRequest(method, srv.URL+"/v1/pki/"+path, bytes.NewReader(b))
+		if token != "" {
+			req.Header.Set("X-Vault-Token", token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ = ioutil.ReadAll(resp.Body)
+		var out vaultResponse
+		var errs struct {
+			Errors []string `json:"errors"`
+		}
+		_ = json.Unmarshal(b, &out)
+		_ = json.Unmarshal(b, &errs)
+		return resp.StatusCode, out, errs.Errors
+	}
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	csr := func(cn string) string {
+		der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			Subject:  pkix.Name{CommonName: cn},
+			DNSNames: []string{cn},
+		}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+	}
+	certificate := func(data map[string]interface{}) *x509.Certificate {
+		block, _ := pem.Decode([]byte(data["certificate"].(string)))
+		if block == nil {
+			t.Fatalf("certificate is not PEM: %v", data["certificate"])
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+
+	rejected := []struct {
+		path, token string
+		body        map[string]interface{}
+		status      int
+	}{
+		{"sign/web", "", map[string]interface{}{"csr": csr("www.example.com")}, http.StatusForbidden},
+		{"sign/web", "s.unknown", map[string]interface{}{"csr": csr("www.example.com")}, http.StatusForbidden},
+		{"sign/ec", "s.web", map[string]interface{}{"csr": csr("www.example.com")}, http.StatusForbidden},
+		{"sign/unknown", "s.web", map[string]interface{}{"csr": csr("www.example.com")}, http.StatusBadRequest},
+		{"sign/web", "s.web", map[string]interface{}{"csr": csr("www.example.org")}, http.StatusBadRequest},
+		{"sign/web", "s.web", map[string]interface{}{"csr": csr("www.example.com"), "ttl": "96h"}, http.StatusBadRequest},
+		{"sign/web", "s.web", map[string]interface{}{"csr": csr("www.example.com"), "common_name": "api.example.com"}, http.StatusBadRequest},
+		{"issue/web", "s.web", map[string]interface{}{"common_name": "www.example.org"}, http.StatusBadRequest},
+		{"issue/web", "s.web", map[string]interface{}{}, http.StatusBadRequest},
+	}
+	for _, r := range rejected {
+		if status, _, errs := send(http.MethodPost, r.path, r.token, r.body); status != r.status || len(errs) != 1 {
+			t.Fatalf("%s %v should be rejected with %d, got %d %v", r.path, r.body, r.status, status, errs)
+		}
+	}
+
+	// Vault CLI writes with PUT
+	status, resp, errs := send(http.MethodPut, "sign/web", "s.web", map[string]interface{}{"csr": csr("www.example.com"), "ttl": 3600})
+	if status != http.StatusOK {
+		t.Fatalf("sign returned %d: %v", status, errs)
+	}
+	cert := certificate(resp.Data)
+	if cert.Subject.CommonName != "www.example.com" || resp.Data["serial_number"] != formatSerial(cert) ||
+		resp.Data["issuing_ca"] != strings.TrimSpace(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.caCert.Raw}))) {
+		t.Fatalf("unexpected sign response: %v", resp.Data)
+	}
+	if _, ok := resp.Data["private_key"]; ok {
+		t.Fatal("sign response should not have private key")
+	}
+	// TTL shorter than a day is not rounded up
+	validity := f.validities[len(f.validities)-1]
+	notAfter, _ := validity["Value"].(float64)
+	if validity["Type"] != string(acmpca.ValidityPeriodTypeAbsolute) || math.Abs(notAfter-float64(time.Now().Add(time.Hour).Unix())) > 60 {
+		t.Fatalf("certificate should be valid for the requested TTL, got %v", validity)
+	}
+	if (*zones)[len(*zones)-1] != "web-zone" {
+		t.Fatalf("role should select the zone, zones: %v", *zones)
+	}
+
+	status, resp, errs = send(http.MethodPost, "issue/ec", "s.admin", map[string]interface{}{
+		"common_name": "api.example.com", "alt_names": "api2.example.com", "private_key_format": "pkcs8",
+	})
+	if status != http.StatusOK {
+		t.Fatalf("issue returned %d: %v", status, errs)
+	}
+	cert = certificate(resp.Data)
+	if strings.Join(cert.DNSNames, ",") != "api.example.com,api2.example.com" || resp.Data["private_key_type"] != "ec" {
+		t.Fatalf("unexpected issue response: %v", resp.Data)
+	}
+	block, _ := pem.Decode([]byte(resp.Data["private_key"].(string)))
+	if block == nil || block.Type != "PRIVATE KEY" {
+		t.Fatalf("private key should be PKCS#8 PEM: %v", resp.Data["private_key"])
+	}
+	privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := privateKey.(*ecdsa.PrivateKey).PublicKey
+	if certPub := cert.PublicKey.(*ecdsa.PublicKey); certPub.X.Cmp(pub.X) != 0 || certPub.Y.Cmp(pub.Y) != 0 {
+		t.Fatal("private key doesn't match the certificate")
+	}
+
+	// the key of a certificate that isn't issued in time is kept for the repeated request
+	idempotencyStore = common.NewMemoryIdempotencyStore()
+	defer func() { idempotencyStore = nil }()
+	defer func(wait time.Duration) { vaultKeyIssueWait = wait }(vaultKeyIssueWait)
+	vaultKeyIssueWait = time.Second
+	f.pending = true
+	issueBody := map[string]interface{}{"common_name": "db.example.com"}
+	if status, _, errs = send(http.MethodPost, "issue/web", "s.web", issueBody); status != http.StatusInternalServerError {
+		t.Fatalf("issue should fail until the certificate is issued, got %d %v", status, errs)
+	}
+	issuedCerts := len(f.certs)
+	f.pending = false
+	status, resp, errs = send(http.MethodPost, "issue/web", "s.web", issueBody)
+	if status != http.StatusOK || len(f.certs) != issuedCerts {
+		t.Fatalf("repeated issue should return the pending certificate, got %d %v, %d certificates", status, errs, len(f.certs))
+	}
+	block, _ = pem.Decode([]byte(resp.Data["private_key"].(string)))
+	rsaKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil || certificate(resp.Data).PublicKey.(*rsa.PublicKey).N.Cmp(rsaKey.N) != 0 {
+		t.Fatalf("private key doesn't match the pending certificate: %v", err)
+	}
+	if len(vault.pendingKeys) != 0 {
+		t.Fatal("delivered key should not be kept")
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/v1/pki/ca/pem", nil)
+	caResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caResp.Body.Close()
+	b, _ := ioutil.ReadAll(caResp.Body)
+	if certs, err := parseCertificates(string(b)); err != nil || len(certs) != 1 || !certs[0].Equal(f.caCert) {
+		t.Fatalf("ca/pem should return the CA certificate, got %s", b)
+	}
+}
+
+func TestParseVaultTTL(t *testing.T) {
+	cases := map[string]time.Duration{"": 0, "3600": time.Hour, "72h": 72 * time.Hour, "30d": 30 * 24 * time.Hour, "1h30m": 90 * time.Minute}
+	for s, expected := range cases {
+		if d, err := parseVaultTTL(s); err != nil || d != expected {
+			t.Errorf("%q: expected %s, got %s %v", s, expected, d, err)
+		}
+	}
+	for _, s := range []string{"-1h", "1w", "xd"} {
+		if _, err := parseVaultTTL(s); err == nil {
+			t.Errorf("%q should be rejected", s)
+		}
+	}
+}
+
+func TestVaultClientCertificate(t *testing.T) {
+	vault := &vaultServer{tokens: []vaultToken{{Token: "s.web", Name: "web-deployer", Zones: []string{"web-zone"}}}}
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "deployer"}}
+	r := httptest.NewRequest(http.MethodPost, "/v1/pki/issue/web", nil)
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+	if _, _, ok := vault.authenticate(r); ok {
+		t.Fatal("client certificate without zone mapping should not be accepted")
+	}
+	vault.clientZones = certificateZones{"CN=deployer": {"web-zone"}}
+	if caller, zones, ok := vault.authenticate(r); !ok || caller != "CN=deployer" || len(zones) != 1 || zones[0] != "web-zone" {
+		t.Fatalf("client certificate should be limited to its zones, got %s %v %v", caller, zones, ok)
+	}
+	r.Header.Set("X-Vault-Token", "s.web")
+	if caller, _, _ := vault.authenticate(r); caller != "vault-token:web-deployer" {
+		t.Fatalf("token should take precedence over client certificate, got %s", caller)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/Venafi/vcert/v4/pkg/endpoint"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/acmpca"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	verifyWaitDelay = time.Second
+
+	// verificationHeader is set on IssueCertificate responses when issued certificates are verified. It's pending
+	// when the certificate wasn't issued in VERIFY_WAIT_SECONDS or couldn't be checked, and it isn't revoked then.
+	verificationHeader   = "X-Venafi-Verification"
+	verificationVerified = "verified"
+	verificationPending  = "pending"
+)
+
+const defaultVerifyWaitTimeout = 5 * time.Second
+
+var (
+	verifyIssued      = false
+	verifyWaitTimeout = defaultVerifyWaitTimeout
+)
+
+// issuedCertificateViolation is returned when a certificate issued by ACM-PCA
+// does not satisfy the zone policy the request was validated against.
+type issuedCertificateViolation struct {
+	CertificateArn string
+	Reason         error
+}
+
+func (e issuedCertificateViolation) Error() string {
+	return fmt.Sprintf("issued certificate %s violates policy: %s", e.CertificateArn, e.Reason)
+}
+
+// violations returns the reason as audit record violations.
+func (e issuedCertificateViolation) violations() []string {
+	if v, ok := e.Reason.(common.PolicyViolations); ok {
+		return v
+	}
+	return []string{e.Reason.Error()}
+}
+
+// unrevokedCertificateViolation is returned when a certificate violating the policy could not be revoked, so
+// a non-compliant certificate is still valid.
+type unrevokedCertificateViolation struct {
+	issuedCertificateViolation
+	RevokeError error
+}
+
+func (e unrevokedCertificateViolation) Error() string {
+	return fmt.Sprintf("issued certificate %s violates policy (%s) but could not be revoked: %s", e.CertificateArn, e.Reason, e.RevokeError)
+}
+
+func initVerification() {
+	verifyIssued = os.Getenv("VERIFY_ISSUED_CERTIFICATE") == "true"
+	verifyWaitTimeout = defaultVerifyWaitTimeout
+	if s := os.Getenv("VERIFY_WAIT_SECONDS"); s != "" {
+		seconds, err := strconv.Atoi(s)
+		if err != nil || seconds < 1 {
+			log.Printf("Ignoring bad VERIFY_WAIT_SECONDS value %q", s)
+		} else {
+			verifyWaitTimeout = time.Duration(seconds) * time.Second
+		}
+	}
+}
+
+// verifyIssuedCertificate waits for the certificate to be issued, validates it against the zone policy
+// and revokes it if it doesn't comply. A policy violation is reported as issuedCertificateViolation, or as
+// unrevokedCertificateViolation when revocation fails. Other errors mean the certificate couldn't be checked.
+func verifyIssuedCertificate(ctx context.Context, cli *acmpca.Client, caArn, certArn string, policy endpoint.Policy) error {
+	log.Printf("Verifying issued certificate %s", certArn)
+	getReq := &acmpca.GetCertificateInput{
+		CertificateArn:          aws.String(certArn),
+		CertificateAuthorityArn: aws.String(caArn),
+	}
+	attempts := int(verifyWaitTimeout / verifyWaitDelay)
+	if attempts < 1 {
+		attempts = 1
+	}
+	err := cli.WaitUntilCertificateIssued(ctx, getReq,
+		aws.WithWaiterMaxAttempts(attempts),
+		aws.WithWaiterDelay(aws.ConstantWaiterDelay(verifyWaitDelay)))
+	if err != nil {
+		return fmt.Errorf("certificate %s was not issued in %s: %s", certArn, verifyWaitTimeout, err)
+	}
+	getResp, err := cli.GetCertificateRequest(getReq).Send(ctx)
+	if err != nil {
+		return fmt.Errorf("could not get certificate %s: %s", certArn, err)
+	}
+	cert, err := parseCertificatePEM(aws.StringValue(getResp.Certificate))
+	if err != nil {
+		return err
+	}
+
+	violation := common.CheckCertificate(policy, cert).Err()
+	if violation == nil {
+		return nil
+	}
+	log.Printf("Certificate %s violates policy: %s. Revoking.", certArn, violation)
+	_, err = cli.RevokeCertificateRequest(&acmpca.RevokeCertificateInput{
+		CertificateAuthorityArn: aws.String(caArn),
+		CertificateSerial:       aws.String(formatSerial(cert)),
+		RevocationReason:        acmpca.RevocationReasonPrivilegeWithdrawn,
+	}).Send(ctx)
+	if err != nil {
+		return unrevokedCertificateViolation{
+			issuedCertificateViolation: issuedCertificateViolation{CertificateArn: certArn, Reason: violation},
+			RevokeError:                err,
+		}
+	}
+	return issuedCertificateViolation{CertificateArn: certArn, Reason: violation}
+}
+
+func parseCertificatePEM(certPEM string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		return nil, fmt.Errorf("can't decode certificate PEM")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// formatSerial returns the certificate serial number in the colon separated hex form ACM-PCA expects.
+func formatSerial(cert *x509.Certificate) string {
+	b := cert.SerialNumber.Bytes()
+	parts := make([]string, len(b))
+	for i := range b {
+		parts[i] = fmt.Sprintf("%02x", b[i])
+	}
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/Venafi/vcert/v4/pkg/endpoint"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/defaults"
+	"github.com/aws/aws-sdk-go-v2/service/acmpca"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testCAArn = "arn:aws:acm-pca:eu-west-1:123456789012:certificate-authority/11111111-2222-3333-4444-555555555555"
+
+var verifyTestPolicy = endpoint.Policy{
+	SubjectCNRegexes: []string{`^.*\.example\.com$`},
+	SubjectORegexes:  []string{".*"},
+	SubjectOURegexes: []string{".*"},
+	SubjectSTRegexes: []string{".*"},
+	SubjectLRegexes:  []string{".*"},
+	SubjectCRegexes:  []string{".*"},
+	DnsSanRegExs:     []string{`^.*\.example\.com$`},
+}
+
+// fakeACMPCA imitates ACM-PCA JSON API, signing every issued CSR with a throwaway CA.
+type fakeACMPCA struct {
+	sync.Mutex
+	caKey   *rsa.PrivateKey
+	caCert  *x509.Certificate
+	certs   map[string][]byte
+	revoked []string
+	// rewriteCN, when set, replaces the common name of issued certificates, imitating a CA template
+	rewriteCN string
+	// tags are returned by ListTags for any certificate authority
+	tags map[string]string
+	// listTagsCalls counts ListTags requests
+	listTagsCalls int
+	// templateArns are TemplateArn values of IssueCertificate requests
+	templateArns []string
+	// validities are Validity values of IssueCertificate requests
+	validities []map[string]interface{}
+	// signingAlgorithms are SigningAlgorithm values of IssueCertificate requests
+	signingAlgorithms []string
+	// kmsContexts are encryption contexts of KMS Encrypt requests, the fake ciphertext is the plaintext
+	kmsContexts []map[string]interface{}
+	// kmsError makes KMS Encrypt requests fail with access denied
+	kmsError bool
+	// pending makes GetCertificate answer that the certificate is still being issued
+	pending bool
+	// issueError makes IssueCertificate requests fail with limit exceeded
+	issueError bool
+	// revokeError makes RevokeCertificate requests fail with access denied
+	revokeError bool
+	server      *httptest.Server
+}
+
+func newFakeACMPCA(t *testing.T) *fakeACMPCA {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake ACM-PCA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := x509.ParseCertificate(der)
+	f := &fakeACMPCA{caKey: key, caCert: caCert, certs: map[string][]byte{}}
+	f.server = httptest.NewServer(f)
+	return f
+}
+
+func (f *fakeACMPCA) config() aws.Config {
+	cfg := defaults.Config()
+	cfg.Region = "eu-west-1"
+	cfg.Credentials = aws.NewStaticCredentialsProvider("AKID", "SECRET", "")
+	cfg.EndpointResolver = aws.ResolveWithEndpointURL(f.server.URL)
+	return cfg
+}
+
+func (f *fakeACMPCA) client() *acmpca.Client {
+	return acmpca.New(f.config())
+}
+
+func (f *fakeACMPCA) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	target := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "ACMPrivateCA.")
+	var body map[string]interface{}
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	var resp interface{}
+	switch target {
+	case "IssueCertificate":
+		if f.issueError {
+			http.Error(w, `{"__type":"LimitExceededException","message":"limit exceeded"}`, http.StatusBadRequest)
+			return
+		}
+		csr, _ := body["Csr"].(string)
+		if template, ok := body["TemplateArn"].(string); ok {
+			f.templateArns = append(f.templateArns, template)
+		}
+		validity, _ := body["Validity"].(map[string]interface{})
+		f.validities = append(f.validities, validity)
+		algorithm, _ := body["SigningAlgorithm"].(string)
+		f.signingAlgorithms = append(f.signingAlgorithms, algorithm)
+		arn, err := f.issue(csr, apiPassthroughName(body["ApiPassthrough"]))
+		if err != nil {
+			http.Error(w, `{"__type":"MalformedCSRException","message":"bad csr"}`, http.StatusBadRequest)
+			return
+		}
+		resp = map[string]string{"CertificateArn": arn}
+	case "GetCertificate":
+		if f.pending {
+			http.Error(w, `{"__type":"RequestInProgressException","message":"in progress"}`, http.StatusBadRequest)
+			return
+		}
+		arn, _ := body["CertificateArn"].(string)
+		cert, ok := f.certs[arn]
+		if !ok {
+			http.Error(w, `{"__type":"ResourceNotFoundException","message":"not found"}`, http.StatusBadRequest)
+			return
+		}
+		resp = map[string]string{
+			"Certificate":      string(cert),
+			"CertificateChain": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.caCert.Raw})),
+		}
+	case "GetCertificateAuthorityCertificate":
+		resp = map[string]string{"Certificate": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.caCert.Raw}))}
+	case "ListTags":
+		f.listTagsCalls++
+		tags := make([]map[string]string, 0, len(f.tags))
+		for k, v := range f.tags {
+			tags = append(tags, map[string]string{"Key": k, "Value": v})
+		}
+		resp = map[string]interface{}{"Tags": tags}
+	case "TrentService.Encrypt":
+		if f.kmsError {
+			http.Error(w, `{"__type":"AccessDeniedException","message":"not allowed to use the key"}`, http.StatusBadRequest)
+			return
+		}
+		context, _ := body["EncryptionContext"].(map[string]interface{})
+		f.kmsContexts = append(f.kmsContexts, context)
+		resp = map[string]interface{}{"CiphertextBlob": body["Plaintext"], "KeyId": body["KeyId"]}
+	case "RevokeCertificate":
+		if f.revokeError {
+			http.Error(w, `{"__type":"AccessDeniedException","message":"not allowed to revoke"}`, http.StatusBadRequest)
+			return
+		}
+		serial, _ := body["CertificateSerial"].(string)
+		f.revoked = append(f.revoked, serial)
+		resp = map[string]string{}
+	default:
+		http.Error(w, `{"__type":"InvalidRequestException","message":"unknown target"}`, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// apiPassthroughName returns ApiPassthrough subject of IssueCertificate request body, nil if there is none.
+func apiPassthroughName(passthrough interface{}) *pkix.Name {
+	m, _ := passthrough.(map[string]interface{})
+	s, ok := m["Subject"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	values := func(name string) []string {
+		if v, ok := s[name].(string); ok {
+			return []string{v}
+		}
+		return nil
+	}
+	cn, _ := s["CommonName"].(string)
+	return &pkix.Name{
+		CommonName:         cn,
+		Organization:       values("Organization"),
+		OrganizationalUnit: values("OrganizationalUnit"),
+		Country:            values("Country"),
+		Locality:           values("Locality"),
+		Province:           values("State"),
+	}
+}
+
+// issue signs a base64 encoded PEM CSR and returns the certificate ARN. passthrough, when set, replaces
+// the CSR subject as ACM-PCA APIPassthrough templates do.
+func (f *fakeACMPCA) issue(csrB64 string, passthrough *pkix.Name) (string, error) {
+	var csrPEM []byte
+	if err := json.Unmarshal([]byte(`"`+csrB64+`"`), &csrPEM); err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode(csrPEM)
+	if block == nil {
+		return "", errBadCSR
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	serial := big.NewInt(int64(len(f.certs) + 1000))
+	subject := csr.Subject
+	if passthrough != nil {
+		subject = *passthrough
+	}
+	if f.rewriteCN != "" {
+		subject.CommonName = f.rewriteCN
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      subject,
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, f.caCert, csr.PublicKey, f.caKey)
+	if err != nil {
+		return "", err
+	}
+	arn := testCAArn + "/certificate/" + serial.Text(16)
+	f.certs[arn] = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return arn, nil
+}
+
+const errBadCSR venafiError = "bad csr"
+
+func issueFakeCertificate(t *testing.T, f *fakeACMPCA, cn string) string {
+	out, err := f.client().IssueCertificateRequest(&acmpca.IssueCertificateInput{
+		CertificateAuthorityArn: aws.String(testCAArn),
+		Csr:                     createCSR(cn),
+		SigningAlgorithm:        acmpca.SigningAlgorithmSha256withrsa,
+		Validity:                &acmpca.Validity{Type: acmpca.ValidityPeriodTypeDays, Value: aws.Int64(1)},
+	}).Send(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *out.CertificateArn
+}
+
+func TestVerifyIssuedCertificateCompliant(t *testing.T) {
+	f := newFakeACMPCA(t)
+	defer f.server.Close()
+	arn := issueFakeCertificate(t, f, "good.example.com")
+
+	err := verifyIssuedCertificate(context.Background(), f.client(), testCAArn, arn, verifyTestPolicy)
+	if err != nil {
+		t.Fatalf("compliant certificate should pass verification: %s", err)
+	}
+	if len(f.revoked) != 0 {
+		t.Fatalf("compliant certificate should not be revoked")
+	}
+}
+
+func TestVerifyIssuedCertificateRevokesViolation(t *testing.T) {
+	f := newFakeACMPCA(t)
+	defer f.server.Close()
+	f.rewriteCN = "rewritten.example.org"
+	arn := issueFakeCertificate(t, f, "good.example.com")
+
+	err := verifyIssuedCertificate(context.Background(), f.client(), testCAArn, arn, verifyTestPolicy)
+	violation, ok := err.(issuedCertificateViolation)
+	if !ok {
+		t.Fatalf("expected policy violation, got: %v", err)
+	}
+	if violation.CertificateArn != arn {
+		t.Fatalf("violation should reference %s, got %s", arn, violation.CertificateArn)
+	}
+	if len(f.revoked) != 1 {
+		t.Fatalf("violating certificate should be revoked once, revoked: %v", f.revoked)
+	}
+	cert, _ := parseCertificatePEM(string(f.certs[arn]))
+	if f.revoked[0] != formatSerial(cert) {
+		t.Fatalf("revoked serial %s doesn't match certificate serial %s", f.revoked[0], formatSerial(cert))
+	}
+}
+
+func TestVerifyIssuedCertificateNotIssued(t *testing.T) {
+	f := newFakeACMPCA(t)
+	defer f.server.Close()
+	verifyWaitTimeout = time.Second
+	err := verifyIssuedCertificate(context.Background(), f.client(), testCAArn, testCAArn+"/certificate/ff", verifyTestPolicy)
+	if err == nil {
+		t.Fatal("verification of missing certificate should fail")
+	}
+	if _, ok := err.(issuedCertificateViolation); ok {
+		t.Fatal("missing certificate should not be reported as policy violation")
+	}
+}
+
+func TestIssueCertificateVerification(t *testing.T) {
+	f := newFakeACMPCA(t)
+	defer f.server.Close()
+	_, _, cleanup := proxyTestSetup(t, f)
+	defer cleanup()
+	idempotencyStore = common.NewMemoryIdempotencyStore()
+	defer func() { idempotencyStore = nil }()
+	_ = os.Setenv("VERIFY_ISSUED_CERTIFICATE", "true")
+	_ = os.Setenv("VERIFY_WAIT_SECONDS", "1")
+	defer func() {
+		_ = os.Unsetenv("VERIFY_ISSUED_CERTIFICATE")
+		_ = os.Unsetenv("VERIFY_WAIT_SECONDS")
+		initVerification()
+	}()
+
+	issue := func(csr []byte) (events.APIGatewayProxyResponse, string) {
+		body := fmt.Sprintf(`{"CertificateAuthorityArn": "%s", "Csr": "%s", "SigningAlgorithm": "SHA256WITHRSA",
+			"Validity": {"Type": "DAYS", "Value": 1}}`, testCAArn, base64.StdEncoding.EncodeToString(csr))
+		resp, err := ACMPCAHandler(events.APIGatewayProxyRequest{
+			Headers: map[string]string{"X-Amz-Target": acmpcaIssueCertificate},
+			Body:    body,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out ACMPCAIssueCertificateResponse
+		_ = json.Unmarshal([]byte(resp.Body), &out)
+		return resp, out.CertificateArn
+	}
+
+	resp, _ := issue(createCSR("www.example.com"))
+	if resp.StatusCode != http.StatusOK || resp.Headers[verificationHeader] != verificationVerified {
+		t.Fatalf("certificate should be verified, got %d %v", resp.StatusCode, resp.Headers)
+	}
+
+	// a certificate which isn't issued in time is returned and recorded without verification
+	f.pending = true
+	csr := createCSR("api.example.com")
+	resp, arn := issue(csr)
+	if resp.StatusCode != http.StatusOK || arn == "" || resp.Headers[verificationHeader] != verificationPending {
+		t.Fatalf("certificate ARN should be returned as pending verification, got %d %s", resp.StatusCode, resp.Body)
+	}
+	if _, ok := f.certs[arn]; !ok || len(f.revoked) != 0 {
+		t.Fatalf("unexpected certificate ARN %s", arn)
+	}
+	records, _, err := auditStore.Query(common.AuditQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[1].CertificateArn != arn || records[1].Decision != common.AuditDecisionApproved {
+		t.Fatalf("pending certificate should be audited, got %+v", records)
+	}
+	if resp, replay := issue(csr); replay != arn || resp.Headers[idempotentReplayHeader] != "true" {
+		t.Fatalf("repeated request should return pending certificate %s, got %s", arn, replay)
+	}
+
+	// violations are still revoked and rejected, also when the request is repeated
+	f.pending, f.rewriteCN = false, "rewritten.example.org"
+	csr = createCSR("db.example.com")
+	for i := 0; i < 2; i++ {
+		if resp, _ = issue(csr); resp.StatusCode != http.StatusForbidden || len(f.revoked) != 1 {
+			t.Fatalf("violating certificate should be revoked and rejected, got %d %s", resp.StatusCode, resp.Body)
+		}
+	}
+	if len(f.certs) != 3 {
+		t.Fatalf("repeated violating request should not be issued again, got %d certificates", len(f.certs))
+	}
+
+	// a violating certificate which can't be revoked is not returned as issued
+	f.revokeError = true
+	if resp, _ = issue(createCSR("mail.example.com")); resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("unrevoked violating certificate should fail, got %d %s", resp.StatusCode, resp.Body)
+	}
+	records, _, _ = auditStore.Query(common.AuditQuery{})
+	last := records[len(records)-1]
+	if last.Decision != common.AuditDecisionError || len(last.Violations) == 0 || last.CertificateArn == "" {
+		t.Fatalf("unrevoked violating certificate should be audited with violations, got %+v", last)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/acm"
+	"github.com/aws/aws-sdk-go-v2/service/acmpca"
+	"log"
+	"os"
+	"strings"
+)
+
+const (
+	// zoneHeader lets unmodified AWS SDK clients choose the zone without VenafiZone body field.
+	zoneHeader = "X-Venafi-Zone"
+	// zoneSelectedByHeader is returned with the rule that selected the zone.
+	zoneSelectedByHeader = "X-Venafi-Zone-Rule"
+	// zoneTagKey is the request or certificate authority tag with the zone.
+	zoneTagKey = "venafi:zone"
+)
+
+// Zone selection rules. ZONE_RULES lists them in the order they are evaluated.
+const (
+	zoneRuleRequest   = "request"   // VenafiZone body field
+	zoneRuleHeader    = "header"    // X-Venafi-Zone header
+	zoneRuleTag       = "tag"       // venafi:zone tag of the request, then of the certificate authority
+	zoneRuleARN       = "arn"       // ARN_ZONES mapping of template or certificate authority ARN
+	zoneRulePrincipal = "principal" // PRINCIPAL_ZONES mapping of the caller
+	zoneRuleDomain    = "domain"    // DOMAIN_ZONES mapping of the requested domain suffix
+	zoneRuleDefault   = "default"   // DEFAULT_ZONE
+)
+
+var defaultZoneRules = []string{
+	zoneRuleRequest, zoneRuleHeader, zoneRuleTag, zoneRuleARN, zoneRulePrincipal, zoneRuleDomain, zoneRuleDefault,
+}
+
+var (
+	zoneRules      = defaultZoneRules
+	arnZones       map[string]string
+	principalZones map[string]string
+	domainZones    map[string]string
+)
+
+// zoneRequest is what zone rules look at.
+type zoneRequest struct {
+	Zone                    string
+	Tags                    map[string]string
+	CertificateAuthorityArn string
+	TemplateArn             string
+	// Domains are the common name followed by DNS SANs
+	Domains []string
+}
+
+// zoneSelection is the selected zone and the rule which selected it.
+type zoneSelection struct {
+	Zone string
+	Rule string
+}
+
+func initZoneRules() {
+	zoneRules = defaultZoneRules
+	if s := os.Getenv("ZONE_RULES"); s != "" {
+		zoneRules = nil
+		for _, r := range strings.Split(s, ",") {
+			r = strings.TrimSpace(r)
+			switch r {
+			case zoneRuleRequest, zoneRuleHeader, zoneRuleTag, zoneRuleARN, zoneRulePrincipal, zoneRuleDomain, zoneRuleDefault:
+				zoneRules = append(zoneRules, r)
+			default:
+				log.Printf("Ignoring unknown zone rule %q", r)
+			}
+		}
+	}
+	arnZones = zoneMappingFromEnv("ARN_ZONES")
+	principalZones = zoneMappingFromEnv("PRINCIPAL_ZONES")
+	domainZones = zoneMappingFromEnv("DOMAIN_ZONES")
+}
+
+func zoneMappingFromEnv(name string) map[string]string {
+	s := os.Getenv(name)
+	if s == "" {
+		return nil
+	}
+	var m map[string]string
+	err := json.Unmarshal([]byte(s), &m)
+	if err != nil {
+		log.Printf("Ignoring bad %s value: %s", name, err)
+		return nil
+	}
+	return m
+}
+
+// resolveZone evaluates zone rules in the configured order and returns the first zone found.
+func resolveZone(ctx context.Context, request events.APIGatewayProxyRequest, zr zoneRequest) (zoneSelection, error) {
+	for _, rule := range zoneRules {
+		zone := ""
+		switch rule {
+		case zoneRuleRequest:
+			zone = zr.Zone
+		case zoneRuleHeader:
+			zone = headerValue(request, zoneHeader)
+		case zoneRuleTag:
+			zone = zr.Tags[zoneTagKey]
+			if zone == "" && zr.CertificateAuthorityArn != "" {
+				var err error
+				zone, err = cachedCAZoneTag(ctx, zr.CertificateAuthorityArn)
+				if err != nil {
+					log.Printf("Can't read tags of %s: %s", zr.CertificateAuthorityArn, err)
+				}
+			}
+		case zoneRuleARN:
+			zone = arnZones[zr.TemplateArn]
+			if zone == "" {
+				zone = arnZones[zr.CertificateAuthorityArn]
+			}
+		case zoneRulePrincipal:
+			zone = principalZones[callerPrincipal(request)]
+		case zoneRuleDomain:
+			zone = domainZone(zr.Domains)
+		case zoneRuleDefault:
+			zone = defaultZone
+		}
+		if zone != "" {
+			log.Printf("Zone %s selected by %s rule", zone, rule)
+			return zoneSelection{Zone: zone, Rule: rule}, nil
+		}
+	}
+	return zoneSelection{}, fmt.Errorf("no zone rule (%s) matched the request", strings.Join(zoneRules, ", "))
+}
+
+// domainZone returns the zone of the longest DOMAIN_ZONES suffix matching the first mapped domain.
+func domainZone(domains []string) string {
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimSuffix(d, "."))
+		zone, matched := "", ""
+		for suffix, z := range domainZones {
+			s := strings.ToLower(strings.TrimPrefix(suffix, "."))
+			if (d == s || strings.HasSuffix(d, "."+s)) && len(s) > len(matched) {
+				zone, matched = z, s
+			}
+		}
+		if zone != "" {
+			return zone
+		}
+	}
+	return ""
+}
+
+func caZoneTag(ctx context.Context, caArn string) (string, error) {
+	cli, err := awsClients()
+	if err != nil {
+		return "", err
+	}
+	req := cli.acmpca.ListTagsRequest(&acmpca.ListTagsInput{CertificateAuthorityArn: aws.String(caArn)})
+	p := acmpca.NewListTagsPaginator(req)
+	for p.Next(ctx) {
+		for _, tag := range p.CurrentPage().Tags {
+			if aws.StringValue(tag.Key) == zoneTagKey {
+				return aws.StringValue(tag.Value), nil
+			}
+		}
+	}
+	return "", p.Err()
+}
+
+// csrDomains returns the common name and DNS SANs of PEM or DER CSR.
+func csrDomains(csr []byte) []string {
+	parsed, err := common.ParseCSR(csr)
+	if err != nil {
+		return nil
+	}
+	return append([]string{parsed.Subject.CommonName}, parsed.DNSNames...)
+}
+
+func tagsMap(tags []acm.Tag) map[string]string {
+	m := make(map[string]string, len(tags))
+	for _, t := range tags {
+		m[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	return m
+}
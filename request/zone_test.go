@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/Venafi/aws-private-ca-policy-venafi/common"
+	"github.com/aws/aws-lambda-go/events"
+	"net/http"
+	"os"
+	"testing"
+)
+
+const testTemplateArn = "arn:aws:acm-pca:::template/EndEntityServerAuthCertificate/V1"
+
+func setZoneEnv(env map[string]string) func() {
+	for k, v := range env {
+		_ = os.Setenv(k, v)
+	}
+	initZoneRules()
+	return func() {
+		for k := range env {
+			_ = os.Unsetenv(k)
+		}
+		initZoneRules()
+	}
+}
+
+func TestResolveZoneRules(t *testing.T) {
+	f := newFakeACMPCA(t)
+	defer f.server.Close()
+	_, _, cleanup := proxyTestSetup(t, f)
+	defer cleanup()
+	defer setZoneEnv(map[string]string{
+		"ZONE_RULES":   "tag,arn,domain,default",
+		"ARN_ZONES":    `{"` + testCAArn + `": "ca-zone", "` + testTemplateArn + `": "template-zone"}`,
+		"DOMAIN_ZONES": `{"example.com": "example-zone", "internal.example.com": "internal-zone"}`,
+	})()
+
+	cases := []struct {
+		name string
+		zr   zoneRequest
+		zone string
+		rule string
+	}{
+		{"request tag", zoneRequest{Zone: "ignored", Tags: map[string]string{zoneTagKey: "tag-zone"}, CertificateAuthorityArn: testCAArn}, "tag-zone", zoneRuleTag},
+		{"template", zoneRequest{CertificateAuthorityArn: testCAArn, TemplateArn: testTemplateArn}, "template-zone", zoneRuleARN},
+		{"CA", zoneRequest{CertificateAuthorityArn: testCAArn, Domains: []string{"www.example.com"}}, "ca-zone", zoneRuleARN},
+		{"longest suffix", zoneRequest{Domains: []string{"db.internal.example.com"}}, "internal-zone", zoneRuleDomain},
+		{"first mapped domain", zoneRequest{Domains: []string{"www.example.org", "www.example.com"}}, "example-zone", zoneRuleDomain},
+		{"default", zoneRequest{Domains: []string{"www.example.org"}}, defaultZone, zoneRuleDefault},
+	}
+	request := events.APIGatewayProxyRequest{Headers: map[string]string{zoneHeader: "header-zone"}}
+	for _, c := range cases {
+		sel, err := resolveZone(context.Background(), request, c.zr)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if sel.Zone != c.zone || sel.Rule != c.rule {
+			t.Errorf("%s: expected %s by %s, got %s by %s", c.name, c.zone, c.rule, sel.Zone, sel.Rule)
+		}
+	}
+
+	_ = os.Setenv("ZONE_RULES", "request,domain")
+	initZoneRules()
+	_, err := resolveZone(context.Background(), request, zoneRequest{Domains: []string{"www.example.org"}})
+	if err == nil {
+		t.Fatal("request should fail when no rule matches")
+	}
+}
+
+func TestZoneRuleEchoedAndTemplateForwarded(t *testing.T) {
+	f := newFakeACMPCA(t)
+	defer f.server.Close()
+	_, zones, cleanup := proxyTestSetup(t, f)
+	defer cleanup()
+	defer setZoneEnv(map[string]string{"ARN_ZONES": `{"` + testTemplateArn + `": "template-zone"}`})()
+
+	body := fmt.Sprintf(`{
+		"CertificateAuthorityArn": "%s",
+		"TemplateArn": "%s",
+		"Csr": "%s",
+		"SigningAlgorithm": "SHA256WITHRSA",
+		"Validity": {"Type": "DAYS", "Value": 1}
+	}`, testCAArn, testTemplateArn, base64.StdEncoding.EncodeToString(createCSR("www.example.com")))
+	resp, err := ACMPCAHandler(events.APIGatewayProxyRequest{
+		Headers: map[string]string{"X-Amz-Target": acmpcaIssueCertificate},
+		Body:    body,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf(wrongResponseCode, resp.StatusCode, resp.Body)
+	}
+	if resp.Headers[zoneHeader] != "template-zone" || resp.Headers[zoneSelectedByHeader] != zoneRuleARN {
+		t.Fatalf("zone and rule should be echoed in headers, got: %v", resp.Headers)
+	}
+	if len(*zones) != 1 || (*zones)[0] != "template-zone" {
+		t.Fatalf("policy should be loaded for template zone, got %v", *zones)
+	}
+	if len(f.templateArns) != 1 || f.templateArns[0] != testTemplateArn {
+		t.Fatalf("TemplateArn should be forwarded to ACM-PCA, got %v", f.templateArns)
+	}
+
+	records, _, err := auditStore.Query(common.AuditQuery{Zone: "template-zone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].ZoneRule != zoneRuleARN {
+		b, _ := json.Marshal(records)
+		t.Fatalf("audit record should contain zone rule: %s", b)
+	}
+}